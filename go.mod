@@ -15,5 +15,6 @@ require (
 	github.com/urfave/cli/v2 v2.2.0
 	github.com/valyala/fasthttp v1.9.0
 	github.com/xhit/go-str2duration/v2 v2.0.0
+	golang.org/x/net v0.0.0-20201202161906-c7110b5ffcbb
 	mvdan.cc/xurls/v2 v2.1.0
 )
@@ -0,0 +1,25 @@
+package blacklister
+
+import (
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"math/rand"
+	"time"
+)
+
+// backoffDelay returns the delay to wait before given retry (starting at 0): the initial delay is doubled on each
+// retry up to the max delay, and half of it is randomized so the replicas do not retry in lockstep
+func backoffDelay(backoff configapi.ConflictBackoff, retry int) time.Duration {
+	delay := backoff.InitialDelay
+	for i := 0; i < retry && (backoff.MaxDelay <= 0 || delay < backoff.MaxDelay); i++ {
+		delay *= 2
+	}
+	if backoff.MaxDelay > 0 && delay > backoff.MaxDelay {
+		delay = backoff.MaxDelay
+	}
+
+	if delay < 2 {
+		return delay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
@@ -0,0 +1,132 @@
+package blacklister
+
+import (
+	"context"
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/clock_mock"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := configapi.ConflictBackoff{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, MaxRetries: 5}
+
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{50, time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 10; i++ {
+			if delay := backoffDelay(backoff, test.retry); delay < test.max/2 || delay > test.max {
+				t.Errorf("backoffDelay(%d) = %s, want between %s and %s", test.retry, delay, test.max/2, test.max)
+			}
+		}
+	}
+
+	if delay := backoffDelay(configapi.ConflictBackoff{}, 3); delay != 0 {
+		t.Errorf("got %s want no delay", delay)
+	}
+}
+
+func TestBlacklist_Conflicts(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	backoff := configapi.ConflictBackoff{InitialDelay: time.Second, MaxDelay: time.Minute, MaxRetries: 3}
+	configClientMock.EXPECT().GetConflictBackoff().AnyTimes().Return(backoff, nil)
+
+	elapsed := make(chan time.Time, 2)
+	elapsed <- time.Now()
+	elapsed <- time.Now()
+
+	hostname := configapi.ForbiddenHostname{Hostname: "down.onion", Reason: "timeout"}
+	other := configapi.ForbiddenHostname{Hostname: "other.onion"}
+
+	// The forbidden hostnames are modified twice by another replica before being updated
+	gomock.InOrder(
+		configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v1"),
+		configClientMock.EXPECT().GetForbiddenHostnames().Return(nil, nil),
+		configClientMock.EXPECT().CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", []configapi.ForbiddenHostname{hostname}).Return(configapi.ErrConflict),
+		clockMock.EXPECT().After(gomock.Any()).Return(elapsed),
+		configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v1"),
+		configClientMock.EXPECT().GetForbiddenHostnames().Return(nil, nil),
+		configClientMock.EXPECT().CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", []configapi.ForbiddenHostname{hostname}).Return(configapi.ErrConflict),
+		clockMock.EXPECT().After(gomock.Any()).Return(elapsed),
+		configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v2"),
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{other}, nil),
+		configClientMock.EXPECT().CompareAndSet(configapi.ForbiddenHostnamesKey, "v2", []configapi.ForbiddenHostname{other, hostname}).Return(nil),
+		pubMock.EXPECT().PublishEvent(&event.HostnameBlacklistedEvent{Hostname: "down.onion", Reason: "timeout"}).Return(nil),
+	)
+
+	s := State{configClient: configClientMock, clock: clockMock, publisher: pubMock, ctx: context.Background()}
+	if err := s.blacklist(hostname); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestBlacklist_ConflictsGivingUp(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	configClientMock.EXPECT().GetConflictBackoff().Times(3).Return(configapi.ConflictBackoff{InitialDelay: time.Second, MaxRetries: 2}, nil)
+	configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Times(3).Return("v1")
+	configClientMock.EXPECT().GetForbiddenHostnames().Times(3).Return(nil, nil)
+	configClientMock.EXPECT().CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", gomock.Any()).Times(3).Return(configapi.ErrConflict)
+
+	elapsed := make(chan time.Time, 2)
+	elapsed <- time.Now()
+	elapsed <- time.Now()
+	clockMock.EXPECT().After(gomock.Any()).Times(2).Return(elapsed)
+
+	s := State{configClient: configClientMock, clock: clockMock, ctx: context.Background()}
+	if err := s.blacklist(configapi.ForbiddenHostname{Hostname: "down.onion"}); !errors.Is(err, configapi.ErrConflict) {
+		t.Errorf("got %v want %v", err, configapi.ErrConflict)
+	}
+}
+
+func TestBlacklist_BlacklistedConcurrently(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	elapsed := make(chan time.Time, 1)
+	elapsed <- time.Now()
+
+	// Another replica blacklisted the hostname meanwhile: nothing is published
+	gomock.InOrder(
+		configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v1"),
+		configClientMock.EXPECT().GetForbiddenHostnames().Return(nil, nil),
+		configClientMock.EXPECT().CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", gomock.Any()).Return(configapi.ErrConflict),
+		configClientMock.EXPECT().GetConflictBackoff().Return(configapi.ConflictBackoff{MaxRetries: 3}, nil),
+		clockMock.EXPECT().After(time.Duration(0)).Return(elapsed),
+		configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v2"),
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: "Down.onion"}}, nil),
+	)
+
+	s := State{configClient: configClientMock, clock: clockMock, ctx: context.Background()}
+	if err := s.blacklist(configapi.ForbiddenHostname{Hostname: "down.onion"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -1,25 +1,67 @@
 package blacklister
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/clock"
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/constraint"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	chttp "github.com/darkspot-org/bathyscaphe/internal/http"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 )
 
 var errAlreadyBlacklisted = fmt.Errorf("hostname is already blacklisted")
 
+// blacklistRetryPolicy is used to retry the events which could not be handled (i.e: ConfigAPI or cache outage)
+var blacklistRetryPolicy = event.RetryPolicy{MaxRetries: 5, Delay: 10 * time.Second, MaxDelay: 5 * time.Minute}
+
+// errBlockPage is returned when the hostname has answered the confirmation with a response considered down
+var errBlockPage = errors.New("block page")
+
+// manualReason is the reason of the hostnames blacklisted using the HTTP API (if none is given)
+const manualReason = "manual"
+
+var (
+	// thresholdWarnings is the number of time an hostname has come close to the blacklisting threshold
+	thresholdWarnings = expvar.NewInt("blacklister.threshold-warnings")
+	// eventsHandled is the number of down URL events handled
+	eventsHandled = expvar.NewInt("blacklister.events-handled")
+	// confirmations is the number of time a failure has been confirmed
+	confirmations = expvar.NewInt("blacklister.confirmations")
+	// blacklists is the number of hostnames blacklisted
+	blacklists = expvar.NewInt("blacklister.blacklists")
+)
+
 // State represent the application state
 type State struct {
 	configClient  configapi.Client
 	hostnameCache cache.Cache
 	httpClient    chttp.Client
+	clock         clock.Clock
+	publisher     event.Publisher
+
+	// ctx is cancelled on shutdown, to stop waiting for the grace period
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	workers *workerPool
+	// feeds are the URLs or paths of the blacklist feeds imported every feedInterval
+	feeds        []string
+	feedInterval time.Duration
+	// blacklistMutex prevent concurrent confirmations to blacklist the same hostname twice
+	blacklistMutex sync.Mutex
 }
 
 // Name return the process name
@@ -37,7 +79,28 @@ be blacklisted by the process and further crawling event involving the hostname
 will be discarded by the crawling process. This allow us to not waste time
 crawling for nothing.
 
-This process consumes the 'url.timeout' event.`
+Hostnames answering with one of the configured error status codes
+are handled the same way. The responses to the confirmation request
+configured using the 'blacklister-confirmation' config key (i.e: a
+captcha page) count as failures too.
+
+This process consumes the 'url.timeout' and 'url.error' events.
+The events are handled concurrently, the number of workers being
+configured using the 'blacklister-workers' config key. Timeouts are
+confirmed after the 'blacklister-grace-period' config key delay, to
+give the TOR circuit a chance to recover. The events which could not
+be handled (i.e: ConfigAPI outage) are retried later.
+
+The hostnames listed by the blacklist feeds ('--blacklist-feed', an
+URL or a file path) are imported periodically ('--blacklist-feed-interval'),
+their reason being 'feed'.
+
+The blacklisted hostnames (with the reason of their blacklisting) are
+exposed using the HTTP API, as well as the process health (degraded
+when the ConfigAPI cannot be reached). Hostnames can also be blacklisted
+immediately using the HTTP API.
+
+This process produces the 'hostname.blacklisted' event.`
 }
 
 // Features return the process features
@@ -47,7 +110,17 @@ func (state *State) Features() []process.Feature {
 
 // CustomFlags return process custom flags
 func (state *State) CustomFlags() []cli.Flag {
-	return []cli.Flag{}
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  blacklistFeedFlag,
+			Usage: "URL or path of a file listing hostnames (one per line) to blacklist",
+		},
+		&cli.DurationFlag{
+			Name:  blacklistFeedIntervalFlag,
+			Usage: "Interval between two imports of the blacklist feeds",
+			Value: defaultFeedInterval,
+		},
+	}
 }
 
 // Initialize the process
@@ -58,31 +131,228 @@ func (state *State) Initialize(provider process.Provider) error {
 	}
 	state.hostnameCache = hostnameCache
 
-	configClient, err := provider.ConfigClient([]string{configapi.ForbiddenHostnamesKey, configapi.BlackListConfigKey})
+	configClient, err := provider.ConfigClient([]string{configapi.ForbiddenHostnamesKey, configapi.BlackListConfigKey, configapi.BlackListOnStatusKey, configapi.BlacklisterWorkersKey,
+		configapi.HostMappingKey, configapi.BlacklisterGracePeriodKey, configapi.ConflictBackoffKey, configapi.BlacklisterConfirmationKey})
 	if err != nil {
 		return err
 	}
 	state.configClient = configClient
 
-	httpClient, err := provider.HTTPClient()
+	// The config client is only used once the process is initialized
+	// The TLS version is not enforced: the blacklister only checks that the hostnames are reachable
+	httpClient, err := provider.HTTPClient(func() (map[string]string, error) {
+		return state.configClient.GetHostMapping()
+	}, nil)
 	if err != nil {
 		return err
 	}
 	state.httpClient = httpClient
 
+	cl, err := provider.Clock()
+	if err != nil {
+		return err
+	}
+	state.clock = cl
+
+	pub, err := provider.Publisher()
+	if err != nil {
+		return err
+	}
+	state.publisher = pub
+
+	state.ctx, state.cancel = context.WithCancel(context.Background())
+
+	state.workers = newWorkerPool(func() (int, error) {
+		return state.configClient.GetBlacklisterWorkers()
+	})
+
+	state.feeds = provider.GetStrValues(blacklistFeedFlag)
+	state.feedInterval = provider.GetDurationValue(blacklistFeedIntervalFlag)
+	if len(state.feeds) > 0 {
+		go state.importFeedsPeriodically()
+	}
+
 	return nil
 }
 
 // Subscribers return the process subscribers
 func (state *State) Subscribers() []process.SubscriberDef {
 	return []process.SubscriberDef{
-		{Exchange: event.TimeoutURLExchange, Queue: "blacklistingQueue", Handler: state.handleTimeoutURLEvent},
+		{Exchange: event.TimeoutURLExchange, Queue: "blacklistingQueue", Handler: state.concurrently(state.handleTimeoutURLEvent), Retry: &blacklistRetryPolicy},
+		{Exchange: event.ErrorURLExchange, Queue: "errorBlacklistingQueue", Handler: state.concurrently(state.handleErrorURLEvent), Retry: &blacklistRetryPolicy},
 	}
 }
 
 // HTTPHandler returns the HTTP API the process expose
 func (state *State) HTTPHandler() http.Handler {
-	return nil
+	r := mux.NewRouter()
+	r.HandleFunc("/blacklist", state.getBlacklist).Methods(http.MethodGet)
+	r.HandleFunc("/blacklist", state.addBlacklistedHostname).Methods(http.MethodPost)
+	r.HandleFunc("/blacklist/{hostname}", state.getBlacklistedHostname).Methods(http.MethodGet)
+	r.HandleFunc("/down-hostnames", state.flushDownHostnames).Methods(http.MethodDelete)
+	r.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/health", state.getHealth).Methods(http.MethodGet)
+
+	return r
+}
+
+func (state *State) getBlacklist(w http.ResponseWriter, r *http.Request) {
+	forbiddenHostnames, err := state.configClient.GetForbiddenHostnames()
+	if err != nil {
+		log.Err(err).Msg("error while retrieving forbidden hostnames")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	process.WriteJSON(w, forbiddenHostnames)
+}
+
+func (state *State) getBlacklistedHostname(w http.ResponseWriter, r *http.Request) {
+	hostname := constraint.NormalizeHostname(mux.Vars(r)["hostname"])
+
+	forbiddenHostnames, err := state.configClient.GetForbiddenHostnames()
+	if err != nil {
+		log.Err(err).Msg("error while retrieving forbidden hostnames")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if forbiddenHostname, found := findForbiddenHostname(forbiddenHostnames, hostname); found {
+		process.WriteJSON(w, forbiddenHostname)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// blacklistRequest is the body of the request used to blacklist an hostname
+type blacklistRequest struct {
+	Hostname string `json:"hostname"`
+	Reason   string `json:"reason"`
+}
+
+// addBlacklistedHostname blacklist the hostname immediately, without waiting for the failures threshold.
+// Blacklisting an already blacklisted hostname does nothing
+func (state *State) addBlacklistedHostname(w http.ResponseWriter, r *http.Request) {
+	var req blacklistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hostname := constraint.NormalizeHostname(req.Hostname)
+	if hostname == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = manualReason
+	}
+
+	state.blacklistMutex.Lock()
+	defer state.blacklistMutex.Unlock()
+
+	forbiddenHostnames, err := state.configClient.GetForbiddenHostnames()
+	if err != nil {
+		log.Err(err).Msg("error while retrieving forbidden hostnames")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if forbiddenHostname, found := findForbiddenHostname(forbiddenHostnames, hostname); found {
+		process.WriteJSON(w, forbiddenHostname)
+		return
+	}
+
+	now := state.clock.Now()
+	forbiddenHostname := configapi.ForbiddenHostname{Hostname: hostname, Reason: req.Reason, FirstSeen: &now, LastSeen: &now}
+
+	count, err := state.blacklistMany([]configapi.ForbiddenHostname{forbiddenHostname})
+	if err != nil {
+		log.Err(err).Str("hostname", hostname).Msg("error while blacklisting hostname")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The hostname may have been blacklisted concurrently (i.e: by another replica)
+	if count == 0 {
+		log.Debug().Str("hostname", hostname).Msg("Hostname blacklisted concurrently")
+		process.WriteJSON(w, forbiddenHostname)
+		return
+	}
+
+	log.Info().Str("hostname", hostname).Str("reason", req.Reason).Msg("Hostname blacklisted manually")
+
+	process.WriteJSONStatus(w, http.StatusCreated, forbiddenHostname)
+}
+
+func (state *State) flushDownHostnames(w http.ResponseWriter, r *http.Request) {
+	// Only the blacklister namespace is cleared
+	count, err := state.hostnameCache.RemovePrefix("")
+	if err != nil {
+		log.Err(err).Msg("error while flushing down hostnames")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Int64("count", count).Msg("Successfully flushed down hostnames")
+
+	process.WriteJSON(w, map[string]int64{"count": count})
+}
+
+// health is the status of the process and of its dependencies
+type health struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+func (state *State) getHealth(w http.ResponseWriter, r *http.Request) {
+	h := health{Status: "ok", Dependencies: map[string]string{"config-api": "ok"}}
+	statusCode := http.StatusOK
+
+	// Every blacklisting decision relies on the ConfigAPI
+	if err := state.configClient.Ping(); err != nil {
+		log.Err(err).Msg("error while pinging the ConfigAPI")
+
+		h.Status = "degraded"
+		h.Dependencies["config-api"] = "unreachable"
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	process.WriteJSONStatus(w, statusCode, h)
+}
+
+// concurrently returns an handler running given one using the worker pool.
+// The message is acknowledged once handled successfully (or if the hostname is already blacklisted), and retried
+// otherwise. The panics are recovered, the message being retried as well
+func (state *State) concurrently(handler event.Handler) event.Handler {
+	return func(subscriber event.Subscriber, msg event.RawMessage) error {
+		err := state.workers.submit(func() {
+			err := event.Handle(subscriber, handler, msg)
+			if errors.Is(err, event.ErrAckDeferred) {
+				// Already taken care of (i.e: panic)
+				return
+			}
+
+			if err != nil && !errors.Is(err, errAlreadyBlacklisted) {
+				log.Err(err).Msg("error while processing event, retrying later")
+
+				if err := msg.Retry(); err != nil {
+					log.Err(err).Msg("error while retrying event")
+				}
+				return
+			}
+
+			if err := msg.Ack(); err != nil {
+				log.Err(err).Msg("error while acknowledging event")
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		return event.ErrAckDeferred
+	}
 }
 
 func (state *State) handleTimeoutURLEvent(subscriber event.Subscriber, msg event.RawMessage) error {
@@ -91,11 +361,53 @@ func (state *State) handleTimeoutURLEvent(subscriber event.Subscriber, msg event
 		return err
 	}
 
-	u, err := url.Parse(evt.URL)
+	return state.processDownURL(evt.URL, true)
+}
+
+func (state *State) handleErrorURLEvent(subscriber event.Subscriber, msg event.RawMessage) error {
+	var evt event.ErrorURLEvent
+	if err := subscriber.Read(&msg, &evt); err != nil {
+		return err
+	}
+
+	return state.processDownURL(evt.URL, false)
+}
+
+// Shutdown log a summary of the current session
+func (state *State) Shutdown() error {
+	// Stop the confirmations waiting for the grace period
+	if state.cancel != nil {
+		state.cancel()
+	}
+
+	// Wait for the events being handled so they are accounted in the summary
+	if state.workers != nil {
+		state.workers.wait()
+	}
+
+	log.Info().
+		Int64("events-handled", eventsHandled.Value()).
+		Int64("confirmations", confirmations.Value()).
+		Int64("blacklists", blacklists.Value()).
+		Int64("threshold-warnings", thresholdWarnings.Value()).
+		Msg("Blacklister session summary")
+
+	return nil
+}
+
+// processDownURL confirm the failure of given URL, blacklisting its hostname once the threshold is reached.
+// If the URL has timed out the confirmation waits for the grace period
+func (state *State) processDownURL(rawURL string, timeout bool) error {
+	eventsHandled.Add(1)
+
+	u, err := url.Parse(rawURL)
 	if err != nil {
 		return err
 	}
 
+	// Use the canonical form so IP addresses are always keyed the same way
+	hostname := constraint.NormalizeHostname(u.Hostname())
+
 	// Make sure hostname is not already 'blacklisted'
 	forbiddenHostnames, err := state.configClient.GetForbiddenHostnames()
 	if err != nil {
@@ -103,88 +415,298 @@ func (state *State) handleTimeoutURLEvent(subscriber event.Subscriber, msg event
 	}
 
 	// prevent duplicates
-	found := false
-	for _, hostname := range forbiddenHostnames {
-		if hostname.Hostname == u.Hostname() {
-			found = true
-			break
-		}
+	if _, found := findForbiddenHostname(forbiddenHostnames, hostname); found {
+		return fmt.Errorf("%s %w", hostname, errAlreadyBlacklisted)
 	}
 
-	if found {
-		return fmt.Errorf("%s %w", u.Hostname(), errAlreadyBlacklisted)
+	if timeout {
+		if err := state.waitGracePeriod(); err != nil {
+			return err
+		}
 	}
 
 	// Check by ourselves if the hostname doesn't respond
-	_, err = state.httpClient.Get(fmt.Sprintf("%s://%s", u.Scheme, u.Host))
-	if err != nil && err != chttp.ErrTimeout {
-		return err
+	resp, err := state.httpClient.Get(fmt.Sprintf("%s://%s", u.Scheme, u.Host))
+
+	// The connection has been established: the server is slow but alive
+	if errors.Is(err, chttp.ErrReadTimeout) {
+		log.Debug().Str("hostname", hostname).Msg("Read timeout, hostname is considered alive.")
+		err = nil
+	}
+
+	if err != nil && !errors.Is(err, chttp.ErrTimeout) {
+		var statusErr *chttp.StatusError
+		if !errors.As(err, &statusErr) {
+			return err
+		}
+
+		blacklisted, checkErr := constraint.CheckStatusBlacklisted(state.configClient, statusErr.Code)
+		if checkErr != nil {
+			return checkErr
+		}
+
+		// Hostname has answered with a status code which is not considered for blacklisting,
+		// unless it is one of a block page
+		if !blacklisted {
+			if err = state.checkConfirmation(statusErr.Code, nil); err != nil && !errors.Is(err, errBlockPage) {
+				return err
+			}
+		}
+	} else if err == nil && resp != nil {
+		// The hostname may be alive but serving a block page
+		if err = state.checkConfirmation(resp.StatusCode(), resp); err != nil && !errors.Is(err, errBlockPage) {
+			return err
+		}
 	}
 
-	cacheKey := u.Hostname()
+	cacheKey := hostname
 
 	if err == nil {
 		log.Debug().
-			Str("hostname", u.Hostname()).
+			Str("hostname", hostname).
 			Msg("Response received.")
 
 		// Host is not down, remove it from cache
 		if err := state.hostnameCache.Remove(cacheKey); err != nil {
 			return err
 		}
+		if err := state.hostnameCache.Remove(firstSeenCacheKey(cacheKey)); err != nil {
+			return err
+		}
 
 		return nil
 	}
 
+	reason := "timeout"
+	var statusErr *chttp.StatusError
+	if errors.Is(err, errBlockPage) {
+		reason = err.Error()
+	} else if errors.As(err, &statusErr) {
+		reason = fmt.Sprintf("status code %d", statusErr.Code)
+	}
+
 	log.Debug().
-		Str("hostname", u.Hostname()).
-		Msg("Timeout confirmed")
+		Str("hostname", hostname).
+		Str("reason", reason).
+		Msg("Failure confirmed")
+
+	confirmations.Add(1)
 
 	blackListConfig, err := state.configClient.GetBlackListConfig()
 	if err != nil {
 		return err
 	}
 
-	count, err := state.hostnameCache.GetInt64(cacheKey)
+	// Atomic since the same hostname may be confirmed concurrently
+	count, err := state.hostnameCache.IncrBy(cacheKey, 1, blackListConfig.TTL)
 	if err != nil {
 		return err
 	}
-	count++
 
-	if count >= blackListConfig.Threshold {
+	now := state.clock.Now()
+
+	// Keep track of the first failure
+	if count == 1 {
+		if err := state.hostnameCache.SetInt64(firstSeenCacheKey(cacheKey), now.Unix(), blackListConfig.TTL); err != nil {
+			return err
+		}
+	}
+
+	threshold := blackListConfig.GetThreshold(hostname)
+
+	// Warn when getting close to the threshold
+	if ratio := blackListConfig.WarningRatio; ratio > 0 && count < threshold && float64(count) >= ratio*float64(threshold) {
+		log.Warn().
+			Str("hostname", hostname).
+			Int64("count", count).
+			Int64("threshold", threshold).
+			Msg("Hostname is close to be blacklisted")
+
+		thresholdWarnings.Add(1)
+	}
+
+	if count >= threshold {
+		state.blacklistMutex.Lock()
+		defer state.blacklistMutex.Unlock()
+
 		forbiddenHostnames, err := state.configClient.GetForbiddenHostnames()
 		if err != nil {
 			return err
 		}
 
 		// prevent duplicates
-		found := false
-		for _, hostname := range forbiddenHostnames {
-			if hostname.Hostname == u.Hostname() {
-				found = true
-				break
-			}
-		}
-
-		if found {
-			log.Trace().Str("hostname", u.Hostname()).Msg("Skipping duplicate hostname")
+		if _, found := findForbiddenHostname(forbiddenHostnames, hostname); found {
+			log.Trace().Str("hostname", hostname).Msg("Skipping duplicate hostname")
 		} else {
 			log.Info().
-				Str("hostname", u.Hostname()).
+				Str("hostname", hostname).
 				Int64("count", count).
 				Msg("Blacklisting hostname")
 
-			forbiddenHostnames = append(forbiddenHostnames, configapi.ForbiddenHostname{Hostname: u.Hostname()})
-			if err := state.configClient.Set(configapi.ForbiddenHostnamesKey, forbiddenHostnames); err != nil {
+			firstSeen, err := state.hostnameCache.GetInt64(firstSeenCacheKey(cacheKey))
+			if err != nil {
+				return err
+			}
+
+			firstSeenTime := now
+			if firstSeen > 0 {
+				firstSeenTime = time.Unix(firstSeen, 0)
+			}
+
+			err = state.blacklist(configapi.ForbiddenHostname{
+				Hostname:  hostname,
+				Reason:    reason,
+				Count:     count,
+				FirstSeen: &firstSeenTime,
+				LastSeen:  &now,
+			})
+			if err != nil {
 				return err
 			}
 		}
 	}
 
-	// Update count
-	if err := state.hostnameCache.SetInt64(cacheKey, count, blackListConfig.TTL); err != nil {
+	return nil
+}
+
+// checkConfirmation returns errBlockPage if the confirmation response means the hostname is down,
+// according to the blacklister confirmation config. resp is nil if the hostname has answered with an error status code
+func (state *State) checkConfirmation(statusCode int, resp chttp.Response) error {
+	confirmation, err := state.configClient.GetBlacklisterConfirmation()
+	if err != nil {
 		return err
 	}
 
+	if confirmation.IsDownStatus(statusCode) {
+		return fmt.Errorf("%w (status code %d)", errBlockPage, statusCode)
+	}
+
+	// Only the content type of the successful responses is checked
+	if resp != nil && len(confirmation.ContentTypes) > 0 {
+		if contentType := resp.Headers()["Content-Type"]; !confirmation.AllowsContentType(contentType) {
+			return fmt.Errorf("%w (content type %s)", errBlockPage, contentType)
+		}
+	}
+
 	return nil
 }
+
+// waitGracePeriod wait for the configured grace period, unless the process is shutting down
+func (state *State) waitGracePeriod() error {
+	gracePeriod, err := state.configClient.GetBlacklisterGracePeriod()
+	if err != nil {
+		return err
+	}
+	if gracePeriod <= 0 {
+		return nil
+	}
+
+	select {
+	case <-state.clock.After(gracePeriod):
+		return nil
+	case <-state.ctx.Done():
+		return state.ctx.Err()
+	}
+}
+
+// blacklist add given hostname to the forbidden ones and publish the blacklisting (see blacklistMany).
+// The caller should hold the blacklist mutex
+func (state *State) blacklist(hostname configapi.ForbiddenHostname) error {
+	count, err := state.blacklistMany([]configapi.ForbiddenHostname{hostname})
+	if err == nil && count == 0 {
+		log.Debug().Str("hostname", hostname.Hostname).Msg("Hostname blacklisted concurrently")
+	}
+
+	return err
+}
+
+// blacklistMany add given hostnames to the forbidden ones and publish their blacklisting, returning the number
+// of hostnames added (the already forbidden ones are skipped). The forbidden hostnames are updated only if they have
+// not been modified concurrently (i.e: by another replica), the update being retried using the configured backoff
+// otherwise. The caller should hold the blacklist mutex
+func (state *State) blacklistMany(hostnames []configapi.ForbiddenHostname) (int, error) {
+	var added []configapi.ForbiddenHostname
+	for retry := 0; ; retry++ {
+		// The version must be read before the value
+		version := state.configClient.Version(configapi.ForbiddenHostnamesKey)
+		forbiddenHostnames, err := state.configClient.GetForbiddenHostnames()
+		if err != nil {
+			return 0, err
+		}
+
+		// The hostnames may have been blacklisted concurrently
+		forbiddenHostnames, added = mergeForbiddenHostnames(forbiddenHostnames, hostnames)
+		if len(added) == 0 {
+			return 0, nil
+		}
+
+		err = state.configClient.CompareAndSet(configapi.ForbiddenHostnamesKey, version, forbiddenHostnames)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, configapi.ErrConflict) {
+			return 0, err
+		}
+
+		backoff, err := state.configClient.GetConflictBackoff()
+		if err != nil {
+			return 0, err
+		}
+		if retry >= backoff.MaxRetries {
+			log.Warn().Int("count", len(added)).Int("retries", retry).Msg("Giving up blacklisting hostnames after conflicting updates")
+			return 0, fmt.Errorf("error while blacklisting %d hostnames: %w", len(added), configapi.ErrConflict)
+		}
+
+		// Wait for the concurrent update to be received
+		select {
+		case <-state.clock.After(backoffDelay(backoff, retry)):
+		case <-state.ctx.Done():
+			return 0, state.ctx.Err()
+		}
+	}
+
+	blacklists.Add(int64(len(added)))
+
+	for _, hostname := range added {
+		evt := &event.HostnameBlacklistedEvent{Hostname: hostname.Hostname, Reason: hostname.Reason}
+		if err := state.publisher.PublishEvent(evt); err != nil {
+			return len(added), fmt.Errorf("error while publishing blacklisted hostname: %s", err)
+		}
+	}
+
+	return len(added), nil
+}
+
+// mergeForbiddenHostnames append given hostnames to the forbidden ones, skipping the already forbidden (or duplicated) ones.
+// The hostnames added are returned as well
+func mergeForbiddenHostnames(forbiddenHostnames, hostnames []configapi.ForbiddenHostname) ([]configapi.ForbiddenHostname, []configapi.ForbiddenHostname) {
+	merged := make([]configapi.ForbiddenHostname, len(forbiddenHostnames), len(forbiddenHostnames)+len(hostnames))
+	copy(merged, forbiddenHostnames)
+
+	var added []configapi.ForbiddenHostname
+	for _, hostname := range hostnames {
+		if _, found := findForbiddenHostname(merged, constraint.NormalizeHostname(hostname.Hostname)); found {
+			continue
+		}
+
+		merged = append(merged, hostname)
+		added = append(added, hostname)
+	}
+
+	return merged, added
+}
+
+// findForbiddenHostname returns the forbidden hostname matching given (normalized) hostname, if any
+func findForbiddenHostname(forbiddenHostnames []configapi.ForbiddenHostname, hostname string) (configapi.ForbiddenHostname, bool) {
+	for _, forbiddenHostname := range forbiddenHostnames {
+		if constraint.NormalizeHostname(forbiddenHostname.Hostname) == hostname {
+			return forbiddenHostname, true
+		}
+	}
+
+	return configapi.ForbiddenHostname{}, false
+}
+
+func firstSeenCacheKey(hostname string) string {
+	return fmt.Sprintf("%s:first-seen", hostname)
+}
@@ -1,8 +1,10 @@
 package blacklister
 
 import (
+	"context"
 	"errors"
 	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/clock_mock"
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
@@ -13,6 +15,11 @@ import (
 	"github.com/darkspot-org/bathyscaphe/internal/process_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/test"
 	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -31,14 +38,19 @@ func TestState_Features(t *testing.T) {
 
 func TestState_CustomFlags(t *testing.T) {
 	s := State{}
-	test.CheckProcessCustomFlags(t, &s, nil)
+	test.CheckProcessCustomFlags(t, &s, []string{"blacklist-feed", "blacklist-feed-interval"})
 }
 
 func TestState_Initialize(t *testing.T) {
 	test.CheckInitialize(t, &State{}, func(p *process_mock.MockProviderMockRecorder) {
 		p.Cache("down-hostname")
-		p.ConfigClient([]string{configapi.ForbiddenHostnamesKey, configapi.BlackListConfigKey})
-		p.HTTPClient()
+		p.ConfigClient([]string{configapi.ForbiddenHostnamesKey, configapi.BlackListConfigKey, configapi.BlackListOnStatusKey, configapi.BlacklisterWorkersKey,
+			configapi.HostMappingKey, configapi.BlacklisterGracePeriodKey, configapi.ConflictBackoffKey, configapi.BlacklisterConfirmationKey})
+		p.HTTPClient(gomock.Any(), gomock.Any())
+		p.Clock()
+		p.Publisher()
+		p.GetStrValues("blacklist-feed")
+		p.GetDurationValue("blacklist-feed-interval")
 	})
 }
 
@@ -46,6 +58,7 @@ func TestState_Subscribers(t *testing.T) {
 	s := State{}
 	test.CheckProcessSubscribers(t, &s, []test.SubscriberDef{
 		{Queue: "blacklistingQueue", Exchange: "url.timeout"},
+		{Queue: "errorBlacklistingQueue", Exchange: "url.error"},
 	})
 }
 
@@ -55,6 +68,7 @@ func TestHandleTimeoutURLEventNoTimeout(t *testing.T) {
 
 	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
 	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
 	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
 	httpClientMock := http_mock.NewMockClient(mockCtrl)
 	httpResponseMock := http_mock.NewMockResponse(mockCtrl)
@@ -67,9 +81,12 @@ func TestHandleTimeoutURLEventNoTimeout(t *testing.T) {
 		}).Return(nil)
 
 	httpClientMock.EXPECT().Get("https://down-example.onion:8080").Return(httpResponseMock, nil)
+	httpResponseMock.EXPECT().StatusCode().Return(200)
 	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetBlacklisterConfirmation().Return(configapi.BlacklisterConfirmation{}, nil)
 
 	hostnameCacheMock.EXPECT().Remove("down-example.onion")
+	hostnameCacheMock.EXPECT().Remove("down-example.onion:first-seen")
 
 	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock}
 	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
@@ -77,7 +94,7 @@ func TestHandleTimeoutURLEventNoTimeout(t *testing.T) {
 	}
 }
 
-func TestHandleTimeoutURLEventNoDispatch(t *testing.T) {
+func TestHandleTimeoutURLEventGracePeriod(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
@@ -86,6 +103,108 @@ func TestHandleTimeoutURLEventNoDispatch(t *testing.T) {
 	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
 	httpClientMock := http_mock.NewMockClient(mockCtrl)
 	httpResponseMock := http_mock.NewMockResponse(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.TimeoutURLEvent{}).
+		SetArg(1, event.TimeoutURLEvent{URL: "https://down-example.onion/index.php"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().Return(5*time.Second, nil)
+
+	// The confirmation is only issued once the grace period has elapsed
+	elapsed := make(chan time.Time, 1)
+	elapsed <- time.Now()
+	gomock.InOrder(
+		clockMock.EXPECT().After(5*time.Second).Return(elapsed),
+		httpClientMock.EXPECT().Get("https://down-example.onion").Return(httpResponseMock, nil),
+	)
+	httpResponseMock.EXPECT().StatusCode().Return(200)
+	configClientMock.EXPECT().GetBlacklisterConfirmation().Return(configapi.BlacklisterConfirmation{}, nil)
+
+	hostnameCacheMock.EXPECT().Remove("down-example.onion")
+	hostnameCacheMock.EXPECT().Remove("down-example.onion:first-seen")
+
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock, ctx: context.Background()}
+	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestHandleTimeoutURLEventGracePeriodShutdown(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.TimeoutURLEvent{}).
+		SetArg(1, event.TimeoutURLEvent{URL: "https://down-example.onion/index.php"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().Return(time.Hour, nil)
+
+	// The grace period never elapse, no confirmation should be issued
+	clockMock.EXPECT().After(time.Hour).Return(make(chan time.Time))
+
+	s := State{configClient: configClientMock, clock: clockMock}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	go func() {
+		_ = s.Shutdown()
+	}()
+
+	if err := s.handleTimeoutURLEvent(subscriberMock, msg); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v want %v", err, context.Canceled)
+	}
+}
+
+func TestHandleTimeoutURLEventReadTimeout(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.TimeoutURLEvent{}).
+		SetArg(1, event.TimeoutURLEvent{URL: "https://slow-example.onion/index.php"}).
+		Return(nil)
+
+	// slow but alive servers should not be considered down
+	httpClientMock.EXPECT().Get("https://slow-example.onion").
+		Return(nil, &http.RequestError{Kind: http.ErrReadTimeout, Err: errors.New("timeout")})
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+
+	hostnameCacheMock.EXPECT().Remove("slow-example.onion")
+	hostnameCacheMock.EXPECT().Remove("slow-example.onion:first-seen")
+
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock}
+	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleTimeoutURLEventNoDispatch(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
 
 	msg := event.RawMessage{}
 	subscriberMock.EXPECT().
@@ -94,17 +213,19 @@ func TestHandleTimeoutURLEventNoDispatch(t *testing.T) {
 			URL: "https://down-example.onion/login.php",
 		}).Return(nil)
 
-	httpClientMock.EXPECT().Get("https://down-example.onion").Return(httpResponseMock, http.ErrTimeout)
+	httpClientMock.EXPECT().Get("https://down-example.onion").Return(nil, &http.RequestError{Kind: http.ErrConnectTimeout, Err: errors.New("timeout")})
 	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
 	configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{
 		Threshold: 10,
 		TTL:       5,
 	}, nil)
 
-	hostnameCacheMock.EXPECT().GetInt64("down-example.onion").Return(int64(0), nil)
-	hostnameCacheMock.EXPECT().SetInt64("down-example.onion", int64(1), time.Duration(5)).Return(nil)
+	hostnameCacheMock.EXPECT().IncrBy("down-example.onion", int64(1), time.Duration(5)).Return(int64(1), nil)
+	tn := time.Now()
+	clockMock.EXPECT().Now().Return(tn)
+	hostnameCacheMock.EXPECT().SetInt64("down-example.onion:first-seen", tn.Unix(), time.Duration(5)).Return(nil)
 
-	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock}
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock}
 	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
 		t.Fail()
 	}
@@ -116,9 +237,12 @@ func TestHandleTimeoutURLEvent(t *testing.T) {
 
 	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
 	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
 	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
 	httpClientMock := http_mock.NewMockClient(mockCtrl)
 	httpResponseMock := http_mock.NewMockResponse(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
 
 	msg := event.RawMessage{}
 	subscriberMock.EXPECT().
@@ -127,33 +251,112 @@ func TestHandleTimeoutURLEvent(t *testing.T) {
 			URL: "https://down-example.onion/test.html",
 		}).Return(nil)
 
-	httpClientMock.EXPECT().Get("https://down-example.onion").Return(httpResponseMock, http.ErrTimeout)
+	httpClientMock.EXPECT().
+		Get("https://down-example.onion").
+		Return(httpResponseMock, &http.RequestError{Kind: http.ErrTimeout, Err: errors.New("unknown error TTL expired")})
 	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
 	configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{
 		Threshold: 10,
 		TTL:       5,
 	}, nil)
 
-	hostnameCacheMock.EXPECT().GetInt64("down-example.onion").Return(int64(9), nil)
+	hostnameCacheMock.EXPECT().IncrBy("down-example.onion", int64(1), time.Duration(5)).Return(int64(10), nil)
+
+	tn := time.Now()
+	clockMock.EXPECT().Now().Return(tn)
 
 	configClientMock.EXPECT().
 		GetForbiddenHostnames().
 		Return([]configapi.ForbiddenHostname{{Hostname: "facebookcorewwwi.onion"}}, nil)
+
+	firstSeen := time.Unix(tn.Unix()-3600, 0)
+	hostnameCacheMock.EXPECT().GetInt64("down-example.onion:first-seen").Return(firstSeen.Unix(), nil)
+
+	configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v1")
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: "facebookcorewwwi.onion"}}, nil)
 	configClientMock.EXPECT().
-		Set(configapi.ForbiddenHostnamesKey, []configapi.ForbiddenHostname{
+		CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", []configapi.ForbiddenHostname{
 			{Hostname: "facebookcorewwwi.onion"},
-			{Hostname: "down-example.onion"},
+			{Hostname: "down-example.onion", Reason: "timeout", Count: 10, FirstSeen: &firstSeen, LastSeen: &tn},
 		}).
 		Return(nil)
+	pubMock.EXPECT().PublishEvent(&event.HostnameBlacklistedEvent{Hostname: "down-example.onion", Reason: "timeout"}).Return(nil)
 
-	hostnameCacheMock.EXPECT().
-		SetInt64("down-example.onion", int64(10), time.Duration(5)).
-		Return(nil)
+	handled, confirmed, blacklisted := eventsHandled.Value(), confirmations.Value(), blacklists.Value()
 
-	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock}
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock, publisher: pubMock}
 	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
 		t.Fail()
 	}
+
+	if eventsHandled.Value() != handled+1 || confirmations.Value() != confirmed+1 || blacklists.Value() != blacklisted+1 {
+		t.Error("session counters should have been incremented")
+	}
+}
+
+func TestHandleTimeoutURLEventConcurrentConfirmations(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	const events = 20
+
+	subscriberMock.EXPECT().
+		Read(gomock.Any(), &event.TimeoutURLEvent{}).
+		SetArg(1, event.TimeoutURLEvent{URL: "https://down-example.onion/index.php"}).
+		Return(nil).
+		Times(events)
+
+	httpClientMock.EXPECT().Get("https://down-example.onion").Return(nil, http.ErrTimeout).Times(events)
+	configClientMock.EXPECT().GetBlacklisterWorkers().Return(4, nil).Times(events)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil).Times(events)
+	configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{Threshold: 100, TTL: 5}, nil).Times(events)
+	clockMock.EXPECT().Now().Return(time.Now()).Times(events)
+
+	// emulate the atomic increment of the cache
+	var mutex sync.Mutex
+	count := int64(0)
+	hostnameCacheMock.EXPECT().
+		IncrBy("down-example.onion", int64(1), time.Duration(5)).
+		DoAndReturn(func(key string, value int64, TTL time.Duration) (int64, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			count += value
+			return count, nil
+		}).
+		Times(events)
+
+	// the first failure should only be tracked once
+	hostnameCacheMock.EXPECT().SetInt64("down-example.onion:first-seen", gomock.Any(), time.Duration(5)).Return(nil)
+
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock}
+	s.workers = newWorkerPool(configClientMock.GetBlacklisterWorkers)
+
+	var wg sync.WaitGroup
+	wg.Add(events)
+
+	handler := s.concurrently(func(subscriber event.Subscriber, msg event.RawMessage) error {
+		defer wg.Done()
+		return s.handleTimeoutURLEvent(subscriber, msg)
+	})
+	for i := 0; i < events; i++ {
+		if err := handler(subscriberMock, event.RawMessage{}); !errors.Is(err, event.ErrAckDeferred) {
+			t.Errorf("got %v want %v", err, event.ErrAckDeferred)
+		}
+	}
+
+	wg.Wait()
+
+	if count != events {
+		t.Errorf("got count %d want %d", count, events)
+	}
 }
 
 func TestHandleTimeoutURLEventNoDuplicates(t *testing.T) {
@@ -178,3 +381,560 @@ func TestHandleTimeoutURLEventNoDuplicates(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestHandleErrorURLEvent(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock, publisher: pubMock}
+
+	tn := time.Now()
+
+	// host keeps answering 403 until the threshold is reached
+	for count := int64(0); count < 3; count++ {
+		msg := event.RawMessage{}
+		subscriberMock.EXPECT().
+			Read(&msg, &event.ErrorURLEvent{}).
+			SetArg(1, event.ErrorURLEvent{
+				URL:        "https://forbidden-example.onion/admin.php",
+				StatusCode: 403,
+			}).Return(nil)
+
+		httpClientMock.EXPECT().Get("https://forbidden-example.onion").Return(nil, &http.StatusError{Code: 403})
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+		configClientMock.EXPECT().GetBlackListOnStatus().Return([]int{403, 500}, nil)
+		configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{
+			Threshold: 3,
+			TTL:       5,
+		}, nil)
+
+		hostnameCacheMock.EXPECT().IncrBy("forbidden-example.onion", int64(1), time.Duration(5)).Return(count+1, nil)
+		clockMock.EXPECT().Now().Return(tn)
+
+		if count == 0 {
+			hostnameCacheMock.EXPECT().SetInt64("forbidden-example.onion:first-seen", tn.Unix(), time.Duration(5)).Return(nil)
+		}
+
+		if count+1 == 3 {
+			firstSeen := time.Unix(tn.Unix(), 0)
+
+			configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+			hostnameCacheMock.EXPECT().GetInt64("forbidden-example.onion:first-seen").Return(tn.Unix(), nil)
+			configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v1")
+			configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+			configClientMock.EXPECT().
+				CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", []configapi.ForbiddenHostname{
+					{Hostname: "forbidden-example.onion", Reason: "status code 403", Count: 3, FirstSeen: &firstSeen, LastSeen: &tn},
+				}).
+				Return(nil)
+			pubMock.EXPECT().PublishEvent(&event.HostnameBlacklistedEvent{Hostname: "forbidden-example.onion", Reason: "status code 403"}).Return(nil)
+		}
+
+		if err := s.handleErrorURLEvent(subscriberMock, msg); err != nil {
+			t.Fail()
+		}
+	}
+}
+
+func TestHandleErrorURLEventStatusNotConfigured(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.ErrorURLEvent{}).
+		SetArg(1, event.ErrorURLEvent{
+			URL:        "https://forbidden-example.onion/admin.php",
+			StatusCode: 403,
+		}).Return(nil)
+
+	httpClientMock.EXPECT().Get("https://forbidden-example.onion").Return(nil, &http.StatusError{Code: 404})
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetBlackListOnStatus().Return([]int{403}, nil)
+	configClientMock.EXPECT().GetBlacklisterConfirmation().Return(configapi.BlacklisterConfirmation{}, nil)
+
+	// the hostname is considered alive
+	hostnameCacheMock.EXPECT().Remove("forbidden-example.onion")
+	hostnameCacheMock.EXPECT().Remove("forbidden-example.onion:first-seen")
+
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock}
+	if err := s.handleErrorURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleTimeoutURLEventBlockPageStatus(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.TimeoutURLEvent{}).
+		SetArg(1, event.TimeoutURLEvent{URL: "https://captcha-example.onion/index.php"}).
+		Return(nil)
+
+	// The hostname answers, but with a rate limiting page
+	httpClientMock.EXPECT().Get("https://captcha-example.onion").Return(nil, &http.StatusError{Code: 429})
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetBlackListOnStatus().Return([]int{403}, nil)
+	configClientMock.EXPECT().GetBlacklisterConfirmation().Return(configapi.BlacklisterConfirmation{DownStatusCodes: []int{429}}, nil)
+	configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{
+		Threshold: 10,
+		TTL:       5,
+	}, nil)
+
+	// ... which still counts toward the blacklisting
+	hostnameCacheMock.EXPECT().IncrBy("captcha-example.onion", int64(1), time.Duration(5)).Return(int64(2), nil)
+	clockMock.EXPECT().Now().Return(time.Now())
+
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock}
+	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestHandleTimeoutURLEventBlockPageContentType(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	httpResponseMock := http_mock.NewMockResponse(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.TimeoutURLEvent{}).
+		SetArg(1, event.TimeoutURLEvent{URL: "https://captcha-example.onion/index.php"}).
+		Return(nil)
+
+	httpClientMock.EXPECT().Get("https://captcha-example.onion").Return(httpResponseMock, nil)
+	httpResponseMock.EXPECT().StatusCode().Return(200)
+	httpResponseMock.EXPECT().Headers().Return(map[string]string{"Content-Type": "image/png"})
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetBlacklisterConfirmation().Return(configapi.BlacklisterConfirmation{ContentTypes: []string{"text/html"}}, nil)
+	configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{
+		Threshold: 1,
+		TTL:       5,
+	}, nil)
+
+	hostnameCacheMock.EXPECT().IncrBy("captcha-example.onion", int64(1), time.Duration(5)).Return(int64(1), nil)
+	tn := time.Now()
+	clockMock.EXPECT().Now().Return(tn)
+	hostnameCacheMock.EXPECT().SetInt64("captcha-example.onion:first-seen", tn.Unix(), time.Duration(5)).Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	hostnameCacheMock.EXPECT().GetInt64("captcha-example.onion:first-seen").Return(tn.Unix(), nil)
+
+	firstSeen := time.Unix(tn.Unix(), 0)
+	configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v1")
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().
+		CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", []configapi.ForbiddenHostname{
+			{Hostname: "captcha-example.onion", Reason: "block page (content type image/png)", Count: 1, FirstSeen: &firstSeen, LastSeen: &tn},
+		}).
+		Return(nil)
+	pubMock.EXPECT().
+		PublishEvent(&event.HostnameBlacklistedEvent{Hostname: "captcha-example.onion", Reason: "block page (content type image/png)"}).
+		Return(nil)
+
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock, publisher: pubMock}
+	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestGetBlacklist(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	tn := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{
+		{Hostname: "facebookcorewwwi.onion"},
+		{Hostname: "down-example.onion", Reason: "timeout", Count: 5, FirstSeen: &tn, LastSeen: &tn},
+	}, nil)
+
+	req := httptest.NewRequest(nethttp.MethodGet, "/blacklist", nil)
+	rec := httptest.NewRecorder()
+
+	s := State{configClient: configClientMock}
+	s.getBlacklist(rec, req)
+
+	if rec.Code != nethttp.StatusOK {
+		t.Fail()
+	}
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Fail()
+	}
+
+	want := `[{"hostname":"facebookcorewwwi.onion"},{"hostname":"down-example.onion","reason":"timeout","count":5,` +
+		`"first-seen":"2021-03-10T12:00:00Z","last-seen":"2021-03-10T12:00:00Z"}]`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+}
+
+func TestGetBlacklistedHostname(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	s := State{configClient: configClientMock}
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Times(2).Return([]configapi.ForbiddenHostname{
+		{Hostname: "down-example.onion", Reason: "status code 500", Count: 5},
+	}, nil)
+
+	req := httptest.NewRequest(nethttp.MethodGet, "/blacklist/down-example.onion", nil)
+	req = mux.SetURLVars(req, map[string]string{"hostname": "down-example.onion"})
+	rec := httptest.NewRecorder()
+
+	s.getBlacklistedHostname(rec, req)
+
+	if rec.Code != nethttp.StatusOK {
+		t.Fail()
+	}
+	if got := rec.Body.String(); got != `{"hostname":"down-example.onion","reason":"status code 500","count":5}` {
+		t.Errorf("unexpected body: %s", got)
+	}
+
+	req = httptest.NewRequest(nethttp.MethodGet, "/blacklist/example.onion", nil)
+	req = mux.SetURLVars(req, map[string]string{"hostname": "example.onion"})
+	rec = httptest.NewRecorder()
+
+	s.getBlacklistedHostname(rec, req)
+
+	if rec.Code != nethttp.StatusNotFound {
+		t.Fail()
+	}
+}
+
+func TestAddBlacklistedHostname(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	tn := time.Now()
+	clockMock.EXPECT().Now().Return(tn)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: "facebookcorewwwi.onion"}}, nil)
+	configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v1")
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: "facebookcorewwwi.onion"}}, nil)
+	configClientMock.EXPECT().
+		CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", []configapi.ForbiddenHostname{
+			{Hostname: "facebookcorewwwi.onion"},
+			{Hostname: "malicious.onion", Reason: "phishing", FirstSeen: &tn, LastSeen: &tn},
+		}).
+		Return(nil)
+	pubMock.EXPECT().PublishEvent(&event.HostnameBlacklistedEvent{Hostname: "malicious.onion", Reason: "phishing"}).Return(nil)
+
+	s := State{configClient: configClientMock, clock: clockMock, publisher: pubMock}
+
+	req := httptest.NewRequest(nethttp.MethodPost, "/blacklist", strings.NewReader(`{"hostname": "Malicious.onion", "reason": "phishing"}`))
+	rec := httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != nethttp.StatusCreated {
+		t.Errorf("got %d want %d", rec.Code, nethttp.StatusCreated)
+	}
+}
+
+func TestAddBlacklistedHostname_Duplicate(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	// Neither the config nor the events are updated
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: "malicious.onion", Reason: "timeout"}}, nil)
+
+	s := State{configClient: configClientMock}
+
+	req := httptest.NewRequest(nethttp.MethodPost, "/blacklist", strings.NewReader(`{"hostname": "malicious.onion"}`))
+	rec := httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != nethttp.StatusOK {
+		t.Errorf("got %d want %d", rec.Code, nethttp.StatusOK)
+	}
+	if !strings.Contains(rec.Body.String(), `"reason":"timeout"`) {
+		t.Errorf("the existing entry should be returned: got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(nethttp.MethodPost, "/blacklist", strings.NewReader(`{}`)))
+	if rec.Code != nethttp.StatusBadRequest {
+		t.Errorf("got %d want %d", rec.Code, nethttp.StatusBadRequest)
+	}
+}
+
+func TestAddBlacklistedHostname_ConcurrentDuplicate(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	// The hostname is blacklisted by another replica between the check and the update
+	tn := time.Now()
+	clockMock.EXPECT().Now().Return(tn)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v2")
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: "malicious.onion", Reason: "timeout"}}, nil)
+
+	s := State{configClient: configClientMock, clock: clockMock}
+
+	req := httptest.NewRequest(nethttp.MethodPost, "/blacklist", strings.NewReader(`{"hostname": "malicious.onion", "reason": "phishing"}`))
+	rec := httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != nethttp.StatusOK {
+		t.Errorf("got %d want %d", rec.Code, nethttp.StatusOK)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got %s want application/json", ct)
+	}
+}
+
+func TestHandleTimeoutURLEventThresholdWarning(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock}
+
+	// count: 7 (below ratio), 8 (reach ratio), 9 (above ratio)
+	for _, count := range []int64{6, 7, 8} {
+		msg := event.RawMessage{}
+		subscriberMock.EXPECT().
+			Read(&msg, &event.TimeoutURLEvent{}).
+			SetArg(1, event.TimeoutURLEvent{URL: "https://down-example.onion/login.php"}).
+			Return(nil)
+
+		httpClientMock.EXPECT().Get("https://down-example.onion").Return(nil, http.ErrTimeout)
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+		configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{
+			Threshold:    10,
+			TTL:          5,
+			WarningRatio: 0.8,
+		}, nil)
+
+		hostnameCacheMock.EXPECT().IncrBy("down-example.onion", int64(1), time.Duration(5)).Return(count+1, nil)
+		clockMock.EXPECT().Now().Return(time.Now())
+
+		before := thresholdWarnings.Value()
+		if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+			t.Fail()
+		}
+
+		warned := thresholdWarnings.Value() - before
+		if count+1 < 8 && warned != 0 {
+			t.Errorf("count %d: should not have warned", count+1)
+		}
+		if count+1 >= 8 && warned != 1 {
+			t.Errorf("count %d: should have warned", count+1)
+		}
+	}
+}
+
+func TestFlushDownHostnames(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	hostnameCacheMock.EXPECT().RemovePrefix("").Return(int64(12), nil)
+
+	req := httptest.NewRequest(nethttp.MethodDelete, "/down-hostnames", nil)
+	rec := httptest.NewRecorder()
+
+	s := State{hostnameCache: hostnameCacheMock}
+	s.flushDownHostnames(rec, req)
+
+	if rec.Code != nethttp.StatusOK {
+		t.Fail()
+	}
+	if got := rec.Body.String(); got != `{"count":12}` {
+		t.Errorf("got %s want %s", got, `{"count":12}`)
+	}
+}
+
+func TestGetHealth(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	s := State{configClient: configClientMock}
+
+	configClientMock.EXPECT().Ping().Return(nil)
+
+	rec := httptest.NewRecorder()
+	s.getHealth(rec, httptest.NewRequest(nethttp.MethodGet, "/health", nil))
+
+	if rec.Code != nethttp.StatusOK {
+		t.Errorf("got %d want %d", rec.Code, nethttp.StatusOK)
+	}
+	if got, want := rec.Body.String(), `{"status":"ok","dependencies":{"config-api":"ok"}}`; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+
+	configClientMock.EXPECT().Ping().Return(errors.New("connection refused"))
+
+	rec = httptest.NewRecorder()
+	s.getHealth(rec, httptest.NewRequest(nethttp.MethodGet, "/health", nil))
+
+	if rec.Code != nethttp.StatusServiceUnavailable {
+		t.Errorf("got %d want %d", rec.Code, nethttp.StatusServiceUnavailable)
+	}
+	if got, want := rec.Body.String(), `{"status":"degraded","dependencies":{"config-api":"unreachable"}}`; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("got %s want %s", got, "application/json")
+	}
+}
+
+func TestHandleTimeoutURLEventThresholdRule(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.TimeoutURLEvent{}).
+		SetArg(1, event.TimeoutURLEvent{URL: "https://shop.suspicious.onion/login.php"}).
+		Return(nil)
+
+	httpClientMock.EXPECT().Get("https://shop.suspicious.onion").Return(nil, http.ErrTimeout)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{
+		Threshold:      10,
+		ThresholdRules: []configapi.ThresholdRule{{Pattern: "*.suspicious.onion", Threshold: 2}},
+		TTL:            5,
+	}, nil)
+
+	// second timeout: blacklisted using the rule threshold instead of the default one
+	tn := time.Now()
+	hostnameCacheMock.EXPECT().IncrBy("shop.suspicious.onion", int64(1), time.Duration(5)).Return(int64(2), nil)
+	clockMock.EXPECT().Now().Return(tn)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	hostnameCacheMock.EXPECT().GetInt64("shop.suspicious.onion:first-seen").Return(tn.Unix(), nil)
+	configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v1")
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", gomock.Any()).Return(nil)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+	pubMock.EXPECT().PublishEvent(&event.HostnameBlacklistedEvent{Hostname: "shop.suspicious.onion", Reason: "timeout"}).Return(nil)
+
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock, publisher: pubMock}
+	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleTimeoutURLEventCacheKeys(t *testing.T) {
+	type test struct {
+		url      string
+		host     string
+		cacheKey string
+	}
+
+	tests := []test{
+		{url: "http://[2001:DB8::0001]:8080/login.php", host: "http://[2001:DB8::0001]:8080", cacheKey: "2001:db8::1"},
+		{url: "http://[2001:db8::1]/index.php", host: "http://[2001:db8::1]", cacheKey: "2001:db8::1"},
+		{url: "http://192.168.1.12:8080/index.php", host: "http://192.168.1.12:8080", cacheKey: "192.168.1.12"},
+		{url: "https://Down-Example.onion/index.php", host: "https://Down-Example.onion", cacheKey: "down-example.onion"},
+	}
+
+	for _, tst := range tests {
+		mockCtrl := gomock.NewController(t)
+
+		subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+		configClientMock := client_mock.NewMockClient(mockCtrl)
+		configClientMock.EXPECT().GetBlacklisterGracePeriod().AnyTimes().Return(time.Duration(0), nil)
+		hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+		httpClientMock := http_mock.NewMockClient(mockCtrl)
+		clockMock := clock_mock.NewMockClock(mockCtrl)
+
+		msg := event.RawMessage{}
+		subscriberMock.EXPECT().
+			Read(&msg, &event.TimeoutURLEvent{}).
+			SetArg(1, event.TimeoutURLEvent{URL: tst.url}).
+			Return(nil)
+
+		httpClientMock.EXPECT().Get(tst.host).Return(nil, http.ErrTimeout)
+
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: "10.0.0.1"}}, nil)
+		configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{Threshold: 10, TTL: 5}, nil)
+
+		hostnameCacheMock.EXPECT().IncrBy(tst.cacheKey, int64(1), time.Duration(5)).Return(int64(1), nil)
+		tn := time.Now()
+		clockMock.EXPECT().Now().Return(tn)
+		hostnameCacheMock.EXPECT().SetInt64(tst.cacheKey+":first-seen", tn.Unix(), time.Duration(5)).Return(nil)
+
+		s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock, clock: clockMock}
+		if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+			t.Errorf("%s: %s", tst.url, err)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestHandleTimeoutURLEventIPAlreadyBlacklisted(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.TimeoutURLEvent{}).
+		SetArg(1, event.TimeoutURLEvent{URL: "http://[2001:db8::1]/index.php"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: "2001:DB8:0:0:0:0:0:1"}}, nil)
+
+	s := State{configClient: configClientMock}
+	if err := s.handleTimeoutURLEvent(subscriberMock, msg); !errors.Is(err, errAlreadyBlacklisted) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,131 @@
+package blacklister
+
+import (
+	"bufio"
+	"fmt"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/constraint"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	blacklistFeedFlag         = "blacklist-feed"
+	blacklistFeedIntervalFlag = "blacklist-feed-interval"
+
+	// defaultFeedInterval is the default interval between two imports of the blacklist feeds
+	defaultFeedInterval = time.Hour
+)
+
+// feedReason is the reason of the hostnames imported from a blacklist feed
+const feedReason = "feed"
+
+// importFeedsPeriodically import the blacklist feeds, then again once per feed interval until shutdown
+func (state *State) importFeedsPeriodically() {
+	interval := state.feedInterval
+	if interval <= 0 {
+		interval = defaultFeedInterval
+	}
+
+	for {
+		state.importFeeds()
+
+		select {
+		case <-state.clock.After(interval):
+		case <-state.ctx.Done():
+			return
+		}
+	}
+}
+
+// importFeeds import each blacklist feed. A feed which could not be imported is retried on the next import
+func (state *State) importFeeds() {
+	for _, feed := range state.feeds {
+		count, err := state.importFeed(feed)
+		if err != nil {
+			log.Err(err).Str("feed", feed).Msg("error while importing blacklist feed")
+			continue
+		}
+
+		log.Info().Str("feed", feed).Int("count", count).Msg("Successfully imported blacklist feed")
+	}
+}
+
+// importFeed blacklist the hostnames listed by given feed and returns the number of hostnames added
+// (the already forbidden ones are skipped)
+func (state *State) importFeed(feed string) (int, error) {
+	hostnames, err := state.fetchFeed(feed)
+	if err != nil {
+		return 0, err
+	}
+
+	now := state.clock.Now()
+
+	forbiddenHostnames := make([]configapi.ForbiddenHostname, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		forbiddenHostnames = append(forbiddenHostnames, configapi.ForbiddenHostname{
+			Hostname:  hostname,
+			Reason:    feedReason,
+			FirstSeen: &now,
+			LastSeen:  &now,
+			Source:    feed,
+		})
+	}
+
+	state.blacklistMutex.Lock()
+	defer state.blacklistMutex.Unlock()
+
+	return state.blacklistMany(forbiddenHostnames)
+}
+
+// fetchFeed returns the hostnames listed by given feed, either an URL or a file path
+func (state *State) fetchFeed(feed string) ([]string, error) {
+	if strings.HasPrefix(feed, "http://") || strings.HasPrefix(feed, "https://") {
+		res, err := state.httpClient.Get(feed)
+		if err != nil {
+			return nil, fmt.Errorf("error while fetching feed: %w", err)
+		}
+
+		return parseFeed(res.Body())
+	}
+
+	f, err := os.Open(feed)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseFeed(f)
+}
+
+// parseFeed returns the (normalized) hostnames listed by given feed, one hostname or URL per line.
+// The empty lines and the comments (starting with #) are ignored
+func parseFeed(r io.Reader) ([]string, error) {
+	var hostnames []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.Contains(line, "://") {
+			u, err := url.Parse(line)
+			if err != nil {
+				continue
+			}
+			line = u.Hostname()
+		}
+
+		if hostname := constraint.NormalizeHostname(line); hostname != "" {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	return hostnames, scanner.Err()
+}
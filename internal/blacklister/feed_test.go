@@ -0,0 +1,118 @@
+package blacklister
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/clock_mock"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/golang/mock/gomock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFeed(t *testing.T) {
+	feed := `# Malicious hidden services
+scam.onion
+
+  PHISHING.onion  
+http://malware.onion:8080/download.php
+# duplicates are merged later on
+scam.onion
+`
+
+	hostnames, err := parseFeed(strings.NewReader(feed))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []string{"scam.onion", "phishing.onion", "malware.onion", "scam.onion"}
+	if !reflect.DeepEqual(hostnames, want) {
+		t.Errorf("got %v want %v", hostnames, want)
+	}
+}
+
+func TestMergeForbiddenHostnames(t *testing.T) {
+	forbiddenHostnames := []configapi.ForbiddenHostname{
+		{Hostname: "down.onion", Reason: "timeout", Count: 10},
+		{Hostname: "manual.onion", Reason: "manual"},
+	}
+
+	merged, added := mergeForbiddenHostnames(forbiddenHostnames, []configapi.ForbiddenHostname{
+		{Hostname: "scam.onion", Reason: feedReason},
+		// already forbidden
+		{Hostname: "Down.onion", Reason: feedReason},
+		{Hostname: "phishing.onion", Reason: feedReason},
+		// duplicated within the feed
+		{Hostname: "scam.onion", Reason: feedReason},
+	})
+
+	wantAdded := []configapi.ForbiddenHostname{
+		{Hostname: "scam.onion", Reason: feedReason},
+		{Hostname: "phishing.onion", Reason: feedReason},
+	}
+	if !reflect.DeepEqual(added, wantAdded) {
+		t.Errorf("got %v want %v", added, wantAdded)
+	}
+
+	// The existing hostnames are kept as-is
+	if want := append(forbiddenHostnames, wantAdded...); !reflect.DeepEqual(merged, want) {
+		t.Errorf("got %v want %v", merged, want)
+	}
+	if len(forbiddenHostnames) != 2 {
+		t.Error("the forbidden hostnames should not be modified")
+	}
+}
+
+func TestImportFeed(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	dir, err := ioutil.TempDir("", "bathyscaphe-feed")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	feed := filepath.Join(dir, "feed.txt")
+	if err := ioutil.WriteFile(feed, []byte("scam.onion\ndown.onion\n"), 0644); err != nil {
+		t.FailNow()
+	}
+
+	tn := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+	clockMock.EXPECT().Now().Return(tn)
+
+	// The hostname already blacklisted is skipped
+	configClientMock.EXPECT().Version(configapi.ForbiddenHostnamesKey).Return("v1")
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: "down.onion", Reason: "timeout"}}, nil)
+	configClientMock.EXPECT().
+		CompareAndSet(configapi.ForbiddenHostnamesKey, "v1", []configapi.ForbiddenHostname{
+			{Hostname: "down.onion", Reason: "timeout"},
+			{Hostname: "scam.onion", Reason: feedReason, FirstSeen: &tn, LastSeen: &tn, Source: feed},
+		}).
+		Return(nil)
+	pubMock.EXPECT().PublishEvent(&event.HostnameBlacklistedEvent{Hostname: "scam.onion", Reason: feedReason}).Return(nil)
+
+	s := State{configClient: configClientMock, clock: clockMock, publisher: pubMock}
+	count, err := s.importFeed(feed)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if count != 1 {
+		t.Errorf("got %d want 1", count)
+	}
+
+	// Fetch failures are reported
+	if _, err := s.importFeed(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("error should have been returned")
+	}
+}
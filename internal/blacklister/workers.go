@@ -0,0 +1,75 @@
+package blacklister
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"runtime/debug"
+	"sync"
+)
+
+// defaultWorkers is the pool size used when the configured one is invalid
+const defaultWorkers = 1
+
+// workerPool run tasks in background, with at most size() of them running at the same time.
+// The size is read before each task so it can be changed at runtime
+type workerPool struct {
+	size   func() (int, error)
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	active int
+	// running are the tasks submitted and not yet completed
+	running sync.WaitGroup
+}
+
+func newWorkerPool(size func() (int, error)) *workerPool {
+	p := &workerPool{size: size}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+// submit wait until a worker is available and run given task using it
+func (p *workerPool) submit(task func()) error {
+	size, err := p.size()
+	if err != nil {
+		return err
+	}
+	if size < 1 {
+		size = defaultWorkers
+	}
+
+	p.mutex.Lock()
+	for p.active >= size {
+		p.cond.Wait()
+	}
+	p.active++
+	p.mutex.Unlock()
+
+	p.running.Add(1)
+	go func() {
+		defer p.release()
+		defer func() {
+			// A panicking task should not take the whole process down
+			if r := recover(); r != nil {
+				log.Error().Str("panic", fmt.Sprint(r)).Str("stack", string(debug.Stack())).Msg("recovered panic while running task")
+			}
+		}()
+
+		task()
+	}()
+
+	return nil
+}
+
+func (p *workerPool) release() {
+	p.mutex.Lock()
+	p.active--
+	p.mutex.Unlock()
+
+	p.cond.Broadcast()
+	p.running.Done()
+}
+
+// wait until the submitted tasks are completed
+func (p *workerPool) wait() {
+	p.running.Wait()
+}
@@ -0,0 +1,191 @@
+package blacklister
+
+import (
+	"errors"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/streadway/amqp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool_Submit(t *testing.T) {
+	p := newWorkerPool(func() (int, error) { return 3, nil })
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		if err := p.submit(func() {
+			defer wg.Done()
+
+			current := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}); err != nil {
+			t.FailNow()
+		}
+	}
+
+	wg.Wait()
+
+	if maxRunning != 3 {
+		t.Errorf("got %d concurrent tasks want 3", maxRunning)
+	}
+}
+
+func TestWorkerPool_SubmitInvalidSize(t *testing.T) {
+	p := newWorkerPool(func() (int, error) { return 0, nil })
+
+	done := make(chan struct{})
+	if err := p.submit(func() { close(done) }); err != nil {
+		t.FailNow()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("task should have been run")
+	}
+}
+
+func TestWorkerPool_SubmitPanic(t *testing.T) {
+	p := newWorkerPool(func() (int, error) { return 1, nil })
+
+	if err := p.submit(func() { panic("nil map") }); err != nil {
+		t.FailNow()
+	}
+	p.wait()
+
+	// The worker should have been released
+	done := make(chan struct{})
+	if err := p.submit(func() { close(done) }); err != nil {
+		t.FailNow()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("task should have been run")
+	}
+}
+
+func TestWorkerPool_Wait(t *testing.T) {
+	p := newWorkerPool(func() (int, error) { return 2, nil })
+
+	var completed int32
+	for i := 0; i < 4; i++ {
+		if err := p.submit(func() {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&completed, 1)
+		}); err != nil {
+			t.FailNow()
+		}
+	}
+
+	p.wait()
+
+	if completed != 4 {
+		t.Errorf("got %d completed tasks want 4", completed)
+	}
+}
+
+// acknowledger record how a delivery has been acknowledged
+type acknowledger struct {
+	acked    bool
+	nacked   bool
+	requeued bool
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked = true
+	a.requeued = requeue
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestConcurrently(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler event.Handler
+		want    acknowledger
+	}{
+		{
+			name:    "success",
+			handler: func(event.Subscriber, event.RawMessage) error { return nil },
+			want:    acknowledger{acked: true},
+		},
+		{
+			name: "already blacklisted",
+			handler: func(event.Subscriber, event.RawMessage) error {
+				return fmt.Errorf("example.onion %w", errAlreadyBlacklisted)
+			},
+			want: acknowledger{acked: true},
+		},
+		{
+			// Consumed without retry policy: the message is requeued
+			name:    "error",
+			handler: func(event.Subscriber, event.RawMessage) error { return errors.New("ConfigAPI unreachable") },
+			want:    acknowledger{nacked: true, requeued: true},
+		},
+		{
+			// Consumed without retry policy: the message is rejected
+			name:    "panic",
+			handler: func(event.Subscriber, event.RawMessage) error { panic("nil map") },
+			want:    acknowledger{nacked: true},
+		},
+	}
+
+	for _, tst := range tests {
+		s := State{workers: newWorkerPool(func() (int, error) { return 1, nil })}
+
+		ack := &acknowledger{}
+		msg := event.NewRawMessage(&amqp.Delivery{Acknowledger: ack})
+
+		if err := s.concurrently(tst.handler)(nil, msg); !errors.Is(err, event.ErrAckDeferred) {
+			t.Errorf("%s: got %v want %v", tst.name, err, event.ErrAckDeferred)
+		}
+		s.workers.wait()
+
+		if *ack != tst.want {
+			t.Errorf("%s: got %+v want %+v", tst.name, *ack, tst.want)
+		}
+	}
+}
+
+func TestShutdownWaitsWorkers(t *testing.T) {
+	s := State{workers: newWorkerPool(func() (int, error) { return 1, nil })}
+
+	var completed int32
+	if err := s.workers.submit(func() {
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&completed, 1)
+	}); err != nil {
+		t.FailNow()
+	}
+
+	if err := s.Shutdown(); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+	if atomic.LoadInt32(&completed) != 1 {
+		t.Error("shutdown should wait for the running tasks")
+	}
+}
@@ -3,12 +3,16 @@ package cache
 //go:generate mockgen -destination=../cache_mock/cache_mock.go -package=cache_mock . Cache
 
 import (
+	"errors"
 	"time"
 )
 
 var (
 	// NoTTL define an entry that lives forever
 	NoTTL = time.Duration(0)
+
+	// ErrNoNamespace is returned when trying to remove every keys of a non-namespaced cache
+	ErrNoNamespace = errors.New("cannot remove keys without namespace")
 )
 
 // Cache represent a KV database
@@ -18,9 +22,16 @@ type Cache interface {
 
 	GetInt64(key string) (int64, error)
 	SetInt64(key string, value int64, TTL time.Duration) error
+	// IncrBy atomically increment the value of given key (0 if missing), refresh its TTL and returns the new value
+	IncrBy(key string, value int64, TTL time.Duration) (int64, error)
 
 	GetManyInt64(keys []string) (map[string]int64, error)
 	SetManyInt64(values map[string]int64, TTL time.Duration) error
 
 	Remove(key string) error
+	// RemovePrefix remove all keys starting with given prefix and returns the number of keys removed
+	RemovePrefix(prefix string) (int64, error)
+
+	// Ping check that the cache server can be reached
+	Ping() error
 }
@@ -28,6 +28,19 @@ func NewRedisCache(URI string, keyPrefix string) (Cache, error) {
 	}, nil
 }
 
+// Ping check that the redis server can be reached using given URI
+func Ping(URI string) error {
+	opts, err := parseRedisOpts(URI)
+	if err != nil {
+		return err
+	}
+
+	client := redis.NewClient(opts)
+	defer client.Close()
+
+	return client.Ping(context.Background()).Err()
+}
+
 func (rc *redisCache) GetBytes(key string) ([]byte, error) {
 	val, err := rc.client.Get(context.Background(), rc.getKey(key)).Bytes()
 	if err != nil && err != redis.Nil {
@@ -54,6 +67,25 @@ func (rc *redisCache) SetInt64(key string, value int64, TTL time.Duration) error
 	return rc.client.Set(context.Background(), rc.getKey(key), value, TTL).Err()
 }
 
+func (rc *redisCache) IncrBy(key string, value int64, TTL time.Duration) (int64, error) {
+	pipeline := rc.client.TxPipeline()
+
+	incr := pipeline.IncrBy(context.Background(), rc.getKey(key), value)
+	if TTL != NoTTL {
+		pipeline.Expire(context.Background(), rc.getKey(key), TTL)
+	}
+
+	if _, err := pipeline.Exec(context.Background()); err != nil {
+		return 0, err
+	}
+
+	return incr.Val(), nil
+}
+
+func (rc *redisCache) Ping() error {
+	return rc.client.Ping(context.Background()).Err()
+}
+
 func (rc *redisCache) GetManyInt64(keys []string) (map[string]int64, error) {
 	pipeline := rc.client.Pipeline()
 
@@ -101,6 +133,48 @@ func (rc *redisCache) Remove(key string) error {
 	return rc.client.Del(context.Background(), rc.getKey(key)).Err()
 }
 
+func (rc *redisCache) RemovePrefix(prefix string) (int64, error) {
+	// Prevent flushing the whole database
+	if rc.keyPrefix == "" && prefix == "" {
+		return 0, ErrNoNamespace
+	}
+
+	var count int64
+	var cursor uint64
+	for {
+		keys, nextCursor, err := rc.client.Scan(context.Background(), cursor, rc.getPattern(prefix), 100).Result()
+		if err != nil {
+			return count, err
+		}
+
+		if len(keys) > 0 {
+			deleted, err := rc.client.Del(context.Background(), keys...).Result()
+			if err != nil {
+				return count, err
+			}
+			count += deleted
+		}
+
+		if nextCursor == 0 {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	return count, nil
+}
+
+func (rc *redisCache) getPattern(prefix string) string {
+	// Escape glob-style characters
+	escaped := strings.NewReplacer("\\", "\\\\", "*", "\\*", "?", "\\?", "[", "\\[", "]", "\\]").Replace(prefix)
+
+	if rc.keyPrefix == "" {
+		return escaped + "*"
+	}
+
+	return fmt.Sprintf("%s:%s*", rc.keyPrefix, escaped)
+}
+
 func (rc *redisCache) getKey(key string) string {
 	if rc.keyPrefix == "" {
 		return key
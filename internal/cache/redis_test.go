@@ -51,3 +51,25 @@ func TestParseRedisOpts(t *testing.T) {
 		t.Errorf("wrong DB: (got: %d, want: %d)\n", opts.DB, 42)
 	}
 }
+
+func TestRedisCache_GetPattern(t *testing.T) {
+	rc := redisCache{keyPrefix: "down-hostname"}
+	if got := rc.getPattern(""); got != "down-hostname:*" {
+		t.Errorf("got %s want %s", got, "down-hostname:*")
+	}
+	if got := rc.getPattern("exa*mple"); got != "down-hostname:exa\\*mple*" {
+		t.Errorf("got %s want %s", got, "down-hostname:exa\\*mple*")
+	}
+
+	rc.keyPrefix = ""
+	if got := rc.getPattern("user"); got != "user*" {
+		t.Errorf("got %s want %s", got, "user*")
+	}
+}
+
+func TestRedisCache_RemovePrefixNoNamespace(t *testing.T) {
+	rc := redisCache{}
+	if _, err := rc.RemovePrefix(""); err != ErrNoNamespace {
+		t.Fail()
+	}
+}
@@ -8,6 +8,8 @@ import "time"
 type Clock interface {
 	// Now return current time
 	Now() time.Time
+	// After wait for the duration to elapse and then send the current time on the returned channel
+	After(d time.Duration) <-chan time.Time
 }
 
 // SystemClock is a clock that use system time
@@ -18,3 +20,8 @@ type SystemClock struct {
 func (clock *SystemClock) Now() time.Time {
 	return time.Now()
 }
+
+// After wait using system clock
+func (clock *SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,187 @@
+package configapi
+
+import (
+	"encoding/json"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBlacklistChanges is the number of blacklist changes kept for the long-polling clients
+	maxBlacklistChanges = 1000
+	// defaultBlacklistPollTimeout is the maximum duration a long-polling request waits for a change
+	defaultBlacklistPollTimeout = 30 * time.Second
+)
+
+// The actions of a blacklist change
+const (
+	blacklistAdded   = "added"
+	blacklistRemoved = "removed"
+)
+
+// blacklistChange is an hostname added to or removed from the forbidden hostnames
+type blacklistChange struct {
+	Cursor   int64  `json:"cursor"`
+	Hostname string `json:"hostname"`
+	Action   string `json:"action"`
+	// Reason is only set on the hostnames blacklisted automatically
+	Reason string `json:"reason,omitempty"`
+}
+
+// blacklistChangesResponse is the response of the long-polling endpoint
+type blacklistChangesResponse struct {
+	Changes []blacklistChange `json:"changes"`
+	// Cursor is the value to use as since in the next request
+	Cursor int64 `json:"cursor"`
+}
+
+// blacklistChanges is the log of the latest changes made to the forbidden hostnames.
+// The zero value is ready to use
+type blacklistChanges struct {
+	mutex   sync.Mutex
+	changes []blacklistChange
+	cursor  int64
+	// notify is closed (then replaced) each time changes are recorded
+	notify chan struct{}
+}
+
+// record given changes, waking up the waiting clients
+func (b *blacklistChanges) record(changes []blacklistChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, change := range changes {
+		b.cursor++
+		change.Cursor = b.cursor
+		b.changes = append(b.changes, change)
+	}
+	if len(b.changes) > maxBlacklistChanges {
+		b.changes = append([]blacklistChange(nil), b.changes[len(b.changes)-maxBlacklistChanges:]...)
+	}
+
+	if b.notify != nil {
+		close(b.notify)
+		b.notify = nil
+	}
+}
+
+// since returns the changes made after given cursor, the current cursor, and a channel closed once new changes are
+// recorded. A cursor ahead of the current one (i.e: the ConfigAPI has been restarted) is considered as outdated
+func (b *blacklistChanges) since(cursor int64) ([]blacklistChange, int64, <-chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if cursor > b.cursor {
+		cursor = 0
+	}
+
+	var changes []blacklistChange
+	for _, change := range b.changes {
+		if change.Cursor > cursor {
+			changes = append(changes, change)
+		}
+	}
+
+	if b.notify == nil {
+		b.notify = make(chan struct{})
+	}
+
+	return changes, b.cursor, b.notify
+}
+
+// diffForbiddenHostnames returns the changes between given forbidden hostnames values
+func diffForbiddenHostnames(previous, current []byte) []blacklistChange {
+	previousHostnames, err := parseForbiddenHostnames(previous)
+	if err != nil {
+		log.Err(err).Msg("error while parsing previous forbidden hostnames")
+	}
+	currentHostnames, err := parseForbiddenHostnames(current)
+	if err != nil {
+		log.Err(err).Msg("error while parsing forbidden hostnames")
+		return nil
+	}
+
+	var changes []blacklistChange
+	for _, hostname := range currentHostnames {
+		if !containsHostname(previousHostnames, hostname.Hostname) {
+			changes = append(changes, blacklistChange{Hostname: hostname.Hostname, Action: blacklistAdded, Reason: hostname.Reason})
+		}
+	}
+	for _, hostname := range previousHostnames {
+		if !containsHostname(currentHostnames, hostname.Hostname) {
+			changes = append(changes, blacklistChange{Hostname: hostname.Hostname, Action: blacklistRemoved})
+		}
+	}
+
+	return changes
+}
+
+// parseForbiddenHostnames returns the forbidden hostnames of given value. An empty value has no hostname
+func parseForbiddenHostnames(value []byte) ([]client.ForbiddenHostname, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	var hostnames []client.ForbiddenHostname
+	if err := json.Unmarshal(value, &hostnames); err != nil {
+		return nil, err
+	}
+
+	return hostnames, nil
+}
+
+func containsHostname(hostnames []client.ForbiddenHostname, hostname string) bool {
+	for _, h := range hostnames {
+		if h.Hostname == hostname {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getBlacklistChanges returns the blacklist changes made after the since cursor, waiting for a change if there is none
+func (state *State) getBlacklistChanges(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	if value := r.URL.Query().Get("since"); value != "" {
+		cursor, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || cursor < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		since = cursor
+	}
+
+	timeout := state.blacklistPollTimeout
+	if timeout <= 0 {
+		timeout = defaultBlacklistPollTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		changes, cursor, notify := state.blacklistChanges.since(since)
+		if len(changes) > 0 {
+			process.WriteJSON(w, blacklistChangesResponse{Changes: changes, Cursor: cursor})
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			process.WriteJSON(w, blacklistChangesResponse{Changes: []blacklistChange{}, Cursor: cursor})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
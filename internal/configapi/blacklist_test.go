@@ -0,0 +1,154 @@
+package configapi
+
+import (
+	"encoding/json"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/golang/mock/gomock"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func getBlacklistChanges(t *testing.T, s *State, url string) blacklistChangesResponse {
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	rec := httptest.NewRecorder()
+
+	s.getBlacklistChanges(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d want %d", rec.Code, http.StatusOK)
+	}
+
+	var res blacklistChangesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("error while parsing response: %s", err)
+	}
+
+	return res
+}
+
+func TestGetBlacklistChanges_Immediate(t *testing.T) {
+	s := State{blacklistPollTimeout: time.Hour}
+	s.blacklistChanges.record([]blacklistChange{
+		{Hostname: "a.onion", Action: blacklistAdded, Reason: "status 403"},
+		{Hostname: "b.onion", Action: blacklistRemoved},
+	})
+
+	res := getBlacklistChanges(t, &s, "/blacklist/changes")
+	want := blacklistChangesResponse{
+		Changes: []blacklistChange{
+			{Cursor: 1, Hostname: "a.onion", Action: blacklistAdded, Reason: "status 403"},
+			{Cursor: 2, Hostname: "b.onion", Action: blacklistRemoved},
+		},
+		Cursor: 2,
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("got %+v want %+v", res, want)
+	}
+
+	res = getBlacklistChanges(t, &s, "/blacklist/changes?since=1")
+	want = blacklistChangesResponse{Changes: want.Changes[1:], Cursor: 2}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("got %+v want %+v", res, want)
+	}
+
+	// The ConfigAPI has been restarted since the cursor has been returned
+	res = getBlacklistChanges(t, &s, "/blacklist/changes?since=42")
+	if len(res.Changes) != 2 || res.Cursor != 2 {
+		t.Errorf("got %+v want all changes", res)
+	}
+}
+
+func TestGetBlacklistChanges_Timeout(t *testing.T) {
+	s := State{blacklistPollTimeout: 10 * time.Millisecond}
+	s.blacklistChanges.record([]blacklistChange{{Hostname: "a.onion", Action: blacklistAdded}})
+
+	start := time.Now()
+	res := getBlacklistChanges(t, &s, "/blacklist/changes?since=1")
+
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("returned after %s, before the timeout", elapsed)
+	}
+	want := blacklistChangesResponse{Changes: []blacklistChange{}, Cursor: 1}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("got %+v want %+v", res, want)
+	}
+}
+
+func TestGetBlacklistChanges_Wait(t *testing.T) {
+	s := State{blacklistPollTimeout: 5 * time.Second}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.blacklistChanges.record([]blacklistChange{{Hostname: "a.onion", Action: blacklistAdded}})
+	}()
+
+	res := getBlacklistChanges(t, &s, "/blacklist/changes?since=0")
+	want := blacklistChangesResponse{
+		Changes: []blacklistChange{{Cursor: 1, Hostname: "a.onion", Action: blacklistAdded}},
+		Cursor:  1,
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("got %+v want %+v", res, want)
+	}
+}
+
+func TestGetBlacklistChanges_InvalidCursor(t *testing.T) {
+	s := State{}
+
+	req := httptest.NewRequest(http.MethodGet, "/blacklist/changes?since=abc", nil)
+	rec := httptest.NewRecorder()
+
+	s.getBlacklistChanges(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSetValue_ForbiddenHostnames(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configCacheMock := cache_mock.NewMockCache(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	value := []byte(`[{"hostname":"a.onion"},{"hostname":"c.onion","reason":"status 403"}]`)
+	configCacheMock.EXPECT().GetBytes("forbidden-hostnames").
+		Return([]byte(`[{"hostname":"a.onion"},{"hostname":"b.onion"}]`), nil)
+	configCacheMock.EXPECT().SetBytes("forbidden-hostnames", value, cache.NoTTL).Return(nil)
+	pubMock.EXPECT().PublishJSON("config", gomock.Any()).Return(nil)
+
+	s := State{configCache: configCacheMock, pub: pubMock}
+	if err := s.setValue("forbidden-hostnames", value); err != nil {
+		t.Fatalf("error while setting value: %s", err)
+	}
+
+	changes, cursor, _ := s.blacklistChanges.since(0)
+	want := []blacklistChange{
+		{Cursor: 1, Hostname: "c.onion", Action: blacklistAdded, Reason: "status 403"},
+		{Cursor: 2, Hostname: "b.onion", Action: blacklistRemoved},
+	}
+	if !reflect.DeepEqual(changes, want) || cursor != 2 {
+		t.Errorf("got %+v (%d) want %+v (%d)", changes, cursor, want, 2)
+	}
+}
+
+func TestBlacklistChanges_Record_Limit(t *testing.T) {
+	var b blacklistChanges
+	for i := 0; i < maxBlacklistChanges+10; i++ {
+		b.record([]blacklistChange{{Hostname: "a.onion", Action: blacklistAdded}})
+	}
+
+	changes, cursor, _ := b.since(0)
+	if len(changes) != maxBlacklistChanges || cursor != maxBlacklistChanges+10 {
+		t.Errorf("got %d changes (cursor %d) want %d (cursor %d)", len(changes), cursor, maxBlacklistChanges, maxBlacklistChanges+10)
+	}
+	if changes[0].Cursor != 11 {
+		t.Errorf("got first cursor %d want 11", changes[0].Cursor)
+	}
+}
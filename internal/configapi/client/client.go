@@ -4,16 +4,26 @@ package client
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/rs/zerolog/log"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"sync"
 	"time"
 )
 
+// ErrConflict is returned by CompareAndSet when the value has been modified concurrently
+var ErrConflict = errors.New("value has been modified concurrently")
+
 const (
 	// AllowedMimeTypesKey is the key to access the allowed mime types config
 	AllowedMimeTypesKey = "allowed-mime-types"
@@ -23,8 +33,83 @@ const (
 	RefreshDelayKey = "refresh-delay"
 	// BlackListConfigKey is the key to access the blacklist configuration
 	BlackListConfigKey = "blacklist-config"
+	// BlackListOnStatusKey is the key to access the status codes triggering blacklisting
+	BlackListOnStatusKey = "blacklist-on-status"
+	// CrawlSitemapKey is the key to access the sitemap crawling toggle
+	CrawlSitemapKey = "crawl-sitemap"
+	// MaxIndexedBodyLengthKey is the key to access the maximum number of characters of the indexed body
+	MaxIndexedBodyLengthKey = "max-indexed-body-length"
+	// RespectRobotsKey is the key to access the robots directives toggle
+	RespectRobotsKey = "respect-robots"
+	// AllowedSchemesKey is the key to access the allowed URL schemes config
+	AllowedSchemesKey = "allowed-schemes"
+	// MaxURLLengthKey is the key to access the maximum length of the scheduled URLs
+	MaxURLLengthKey = "max-url-length"
+	// StripQueryParamsKey is the key to access the query parameters removed from the URLs
+	StripQueryParamsKey = "strip-query-params"
+	// MaxConcurrentRequestsKey is the key to access the maximum number of concurrent requests of a crawler
+	MaxConcurrentRequestsKey = "max-concurrent-requests"
+	// MaxPathRepetitionKey is the key to access the maximum number of occurrences of an URL path segment
+	MaxPathRepetitionKey = "max-path-repetition"
+	// CrawlingPausedKey is the key to access the crawling pause toggle
+	CrawlingPausedKey = "crawling-paused"
+	// AcceptLanguageKey is the key to access the Accept-Language header sent by the crawler
+	AcceptLanguageKey = "accept-language"
+	// WatchlistKeywordsKey is the key to access the keywords flagged when found in a resource
+	WatchlistKeywordsKey = "watchlist-keywords"
+	// BlacklisterWorkersKey is the key to access the number of events handled concurrently by a blacklister
+	BlacklisterWorkersKey = "blacklister-workers"
+	// HostMappingKey is the key to access the addresses dialed instead of some hostnames
+	HostMappingKey = "host-mapping"
+	// MaxLinksPerPageKey is the key to access the maximum number of links scheduled per page (0 means unlimited)
+	MaxLinksPerPageKey = "max-links-per-page"
+	// StoreBodyKey is the key to access the body storage toggle (only the metadata are indexed if disabled)
+	StoreBodyKey = "store-body"
+	// BlacklisterGracePeriodKey is the key to access the delay waited before confirming a timeout
+	BlacklisterGracePeriodKey = "blacklister-grace-period"
+	// RetryBudgetKey is the key to access the number of retries per second allowed to a crawler (0 disables the retries)
+	RetryBudgetKey = "retry-budget"
+	// MinIndexBodyLengthKey is the key to access the minimum number of characters of text a resource must have to be indexed (0 means no minimum)
+	MinIndexBodyLengthKey = "min-index-body-length"
+	// SkipBodyPatternsKey is the key to access the patterns (substrings, or regexes if wrapped in slashes) of the bodies not to index
+	SkipBodyPatternsKey = "skip-body-patterns"
+	// AllowedPortsKey is the key to access the ports allowed when explicitly set in an URL
+	AllowedPortsKey = "allowed-ports"
+	// CrawlDelayKey is the key to access the minimum delay between two requests made by a crawler to the same hostname
+	CrawlDelayKey = "crawl-delay"
+	// MaxQueuedURLsKey is the key to access the maximum number of URLs queued for crawling (0 means no limit)
+	MaxQueuedURLsKey = "max-queued-urls"
+	// CrawlerIdentifierHeaderKey is the key to access the header identifying the crawler requests (not sent if empty)
+	CrawlerIdentifierHeaderKey = "crawler-identifier-header"
+	// MinTLSVersionKey is the key to access the minimum TLS version (i.e: 1.2) of the clearnet requests
+	MinTLSVersionKey = "min-tls-version"
+	// IndexableStatusCodesKey is the key to access the status codes (i.e: 200 or 200-299) of the resources to index
+	IndexableStatusCodesKey = "indexable-status-codes"
+	// IndexLanguagesKey is the key to access the languages of the resources to index
+	IndexLanguagesKey = "index-languages"
+	// QueueWatermarksKey is the key to access the number of queued URLs between which the scheduler publishing is paused
+	QueueWatermarksKey = "queue-watermarks"
+	// FieldSelectorsKey is the key to access the CSS selectors of the structured fields extracted per hostname
+	FieldSelectorsKey = "field-selectors"
+	// ConflictBackoffKey is the key to access the backoff used to retry the updates conflicting with a concurrent one
+	ConflictBackoffKey = "conflict-backoff"
+	// MaxParseBytesKey is the key to access the maximum number of bytes of the body parsed as HTML
+	MaxParseBytesKey = "max-parse-bytes"
+	// BlacklisterConfirmationKey is the key to access the responses to the blacklister confirmation considering the hostname still down
+	BlacklisterConfirmationKey = "blacklister-confirmation"
+	// AlwaysCrawlKey is the key to access the URLs or hostnames scheduled each time they are found, whatever the refresh delay
+	AlwaysCrawlKey = "always-crawl"
+	// AllowedURLsKey is the key to access the URLs (matched exactly) crawled even if their hostname is forbidden
+	AllowedURLsKey = "allowed-urls"
+	// ChallengePagesKey is the key to access the markers of the anti-bot challenge pages, which are not indexed
+	ChallengePagesKey = "challenge-pages"
+	// RangedFetchKey is the key to access the URLs of which only the first bytes are fetched
+	RangedFetchKey = "ranged-fetch"
 )
 
+// pingClient is the HTTP client used to ping the ConfigAPI, a short timeout is used to quickly detect outages
+var pingClient = &http.Client{Timeout: 5 * time.Second}
+
 // MimeType is the mime type as represented in the config
 type MimeType struct {
 	// The content-type
@@ -36,17 +121,240 @@ type MimeType struct {
 // ForbiddenHostname is the hostnames who's crawling is forbidden
 type ForbiddenHostname struct {
 	Hostname string `json:"hostname"`
+
+	// The following are only set when the hostname has been blacklisted automatically
+	Reason    string     `json:"reason,omitempty"`
+	Count     int64      `json:"count,omitempty"`
+	FirstSeen *time.Time `json:"first-seen,omitempty"`
+	LastSeen  *time.Time `json:"last-seen,omitempty"`
+	// Source is the feed the hostname has been imported from (only set for the imported hostnames)
+	Source string `json:"source,omitempty"`
 }
 
 // RefreshDelay is the refresh delay for re-crawling
 type RefreshDelay struct {
 	Delay time.Duration `json:"delay"`
+	// Jitter randomly spread the re-crawls within Delay ± Jitter
+	Jitter time.Duration `json:"jitter"`
+}
+
+// CrawlDelay is the minimum delay between two requests made to the same hostname
+type CrawlDelay struct {
+	// Delay is the default delay, used when the hostname has no delay of its own
+	Delay time.Duration `json:"delay"`
+	// Hostnames are the delays overriding the default one, by hostname
+	Hostnames map[string]time.Duration `json:"hostnames"`
+}
+
+// GetDelay returns the delay to use for given hostname
+func (c CrawlDelay) GetDelay(hostname string) time.Duration {
+	if delay, exists := c.Hostnames[hostname]; exists {
+		return delay
+	}
+
+	return c.Delay
+}
+
+// CrawlerIdentifierHeader is an header sent along with each crawler request, so that the operators
+// of a site can recognize the crawler traffic
+type CrawlerIdentifierHeader struct {
+	// Name of the header, nothing is sent if empty
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// IndexLanguages are the languages of the resources to index
+type IndexLanguages struct {
+	// Languages are the primary language tags (i.e: en, ru) to index, every language is indexed if empty
+	Languages []string `json:"languages"`
+	// SkipUndetected skips the resources whose language could not be detected (only if Languages is set)
+	SkipUndetected bool `json:"skip-undetected"`
+}
+
+// QueueWatermarks are the number of URLs queued for crawling between which the publishing of new URLs is paused
+type QueueWatermarks struct {
+	// High is the number of queued URLs pausing the publishing (disabled if 0)
+	High int64 `json:"high"`
+	// Low is the number of queued URLs resuming the publishing once paused
+	Low int64 `json:"low"`
+}
+
+// FieldSelectors are the CSS selectors of the fields extracted from the resources of the hostnames matching a pattern
+type FieldSelectors struct {
+	// Pattern is a glob pattern matched against the hostname (i.e: *.market.onion)
+	Pattern string `json:"pattern"`
+	// Fields are the CSS selectors by field name (i.e: price: .product .price)
+	Fields map[string]string `json:"fields"`
+}
+
+// ConflictBackoff is the backoff used to retry an update which conflicted with a concurrent one (see CompareAndSet)
+type ConflictBackoff struct {
+	// InitialDelay is the delay before the first retry, doubled on each retry
+	InitialDelay time.Duration `json:"initial-delay"`
+	// MaxDelay caps the delay between two retries
+	MaxDelay time.Duration `json:"max-delay"`
+	// MaxRetries is the number of retries after which the update is given up
+	MaxRetries int `json:"max-retries"`
+}
+
+// BlacklisterConfirmation configures the responses to the blacklister confirmation request which are considered
+// as the hostname still being down (i.e: a captcha or a block page served instead of the site)
+type BlacklisterConfirmation struct {
+	// ContentTypes are the content types (i.e: text/html) of the responses considering the hostname alive,
+	// any content type is accepted if empty
+	ContentTypes []string `json:"content-types"`
+	// DownStatusCodes are the status codes of the responses considering the hostname down, even if successful
+	DownStatusCodes []int `json:"down-status-codes"`
+}
+
+// IsDownStatus returns true if a confirmation response with given status code means the hostname is down
+func (c BlacklisterConfirmation) IsDownStatus(statusCode int) bool {
+	for _, code := range c.DownStatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsContentType returns true if a confirmation response with given content type means the hostname is alive
+func (c BlacklisterConfirmation) AllowsContentType(contentType string) bool {
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+
+	// Ignore the parameters (i.e: charset)
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+
+	for _, allowed := range c.ContentTypes {
+		if strings.EqualFold(strings.TrimSpace(allowed), contentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ChallengePages configures the detection of the anti-bot challenge (interstitial) pages served instead of the site
+type ChallengePages struct {
+	// StatusCodes restrict the challenge pages to the responses having one of the status codes,
+	// any status code is accepted if empty
+	StatusCodes []int `json:"status-codes"`
+	// Headers are the response headers marking a challenge page, either a name (i.e: cf-mitigated)
+	// or a name and a value (i.e: server: ddos-guard), matched case insensitively
+	Headers []string `json:"headers"`
+	// BodyMarkers are the substrings of the challenge pages body, matched case insensitively
+	BodyMarkers []string `json:"body-markers"`
+	// Requeue the URLs of the challenge pages to crawl them again later, with backoff
+	Requeue bool `json:"requeue"`
+}
+
+// IsChallengePage returns true if given response is a challenge page: it has one of the header or body markers
+// (and one of the status codes if any). Nothing is a challenge page if no marker is configured
+func (c ChallengePages) IsChallengePage(statusCode int, headers map[string]string, body string) bool {
+	if len(c.StatusCodes) > 0 {
+		found := false
+		for _, code := range c.StatusCodes {
+			if code == statusCode {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	for _, marker := range c.Headers {
+		name, value := marker, ""
+		if i := strings.Index(marker, ":"); i >= 0 {
+			name, value = marker[:i], strings.TrimSpace(marker[i+1:])
+		}
+		name = strings.TrimSpace(name)
+
+		for headerName, headerValue := range headers {
+			if strings.EqualFold(headerName, name) && (value == "" || strings.EqualFold(strings.TrimSpace(headerValue), value)) {
+				return true
+			}
+		}
+	}
+
+	if len(c.BodyMarkers) > 0 {
+		lowerBody := strings.ToLower(body)
+		for _, marker := range c.BodyMarkers {
+			if marker != "" && strings.Contains(lowerBody, strings.ToLower(marker)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RangedFetch configures the URLs of the resources likely to be large, of which only the first bytes are fetched
+type RangedFetch struct {
+	// Extensions of the URLs path (i.e: pdf), matched case insensitively
+	Extensions []string `json:"extensions"`
+	// MaxBytes is the number of leading bytes requested (disabled if 0)
+	MaxBytes int `json:"max-bytes"`
+}
+
+// MaxBytesFor returns the number of leading bytes to request for given URL, 0 if it should be fetched entirely
+func (r RangedFetch) MaxBytesFor(rawurl string) int {
+	if r.MaxBytes <= 0 {
+		return 0
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return 0
+	}
+
+	ext := strings.TrimPrefix(path.Ext(u.Path), ".")
+	if ext == "" {
+		return 0
+	}
+
+	for _, extension := range r.Extensions {
+		if strings.EqualFold(strings.TrimPrefix(extension, "."), ext) {
+			return r.MaxBytes
+		}
+	}
+
+	return 0
 }
 
 // BlackListConfig is the config used for hostname blacklisting
 type BlackListConfig struct {
-	Threshold int64         `json:"threshold"`
-	TTL       time.Duration `json:"ttl"`
+	// Threshold is the default threshold, used when no rule match the hostname
+	Threshold int64 `json:"threshold"`
+	// ThresholdRules are evaluated in order, the first rule matching the hostname is used
+	ThresholdRules []ThresholdRule `json:"threshold-rules"`
+	TTL            time.Duration   `json:"ttl"`
+	// WarningRatio is the fraction of the threshold after which a warning is emitted (0 to disable)
+	WarningRatio float64 `json:"warning-ratio"`
+}
+
+// ThresholdRule is a blacklisting threshold applied to the hostnames matching a pattern
+type ThresholdRule struct {
+	// Pattern is a glob pattern (i.e: *.example.onion)
+	Pattern   string `json:"pattern"`
+	Threshold int64  `json:"threshold"`
+}
+
+// GetThreshold returns the blacklisting threshold to use for given hostname
+func (c BlackListConfig) GetThreshold(hostname string) int64 {
+	for _, rule := range c.ThresholdRules {
+		if matched, err := path.Match(rule.Pattern, hostname); err == nil && matched {
+			return rule.Threshold
+		}
+	}
+
+	return c.Threshold
 }
 
 // Client is a nice client interface for the ConfigAPI
@@ -55,8 +363,53 @@ type Client interface {
 	GetForbiddenHostnames() ([]ForbiddenHostname, error)
 	GetRefreshDelay() (RefreshDelay, error)
 	GetBlackListConfig() (BlackListConfig, error)
+	GetBlackListOnStatus() ([]int, error)
+	GetCrawlSitemap() (bool, error)
+	GetMaxIndexedBodyLength() (int, error)
+	GetRespectRobots() (bool, error)
+	GetAllowedSchemes() ([]string, error)
+	GetMaxURLLength() (int, error)
+	GetStripQueryParams() ([]string, error)
+	GetMaxConcurrentRequests() (int, error)
+	GetMaxPathRepetition() (int, error)
+	GetCrawlingPaused() (bool, error)
+	GetAcceptLanguage() (string, error)
+	GetWatchlistKeywords() ([]string, error)
+	GetBlacklisterWorkers() (int, error)
+	GetHostMapping() (map[string]string, error)
+	GetMaxLinksPerPage() (int, error)
+	GetStoreBody() (bool, error)
+	GetBlacklisterGracePeriod() (time.Duration, error)
+	GetRetryBudget() (float64, error)
+	GetMinIndexBodyLength() (int, error)
+	GetSkipBodyPatterns() ([]string, error)
+	GetAllowedPorts() ([]int, error)
+	GetCrawlDelay() (CrawlDelay, error)
+	GetMaxQueuedURLs() (int64, error)
+	GetCrawlerIdentifierHeader() (CrawlerIdentifierHeader, error)
+	GetMinTLSVersion() (string, error)
+	GetIndexableStatusCodes() ([]string, error)
+	GetIndexLanguages() (IndexLanguages, error)
+	GetQueueWatermarks() (QueueWatermarks, error)
+	GetFieldSelectors() ([]FieldSelectors, error)
+	GetConflictBackoff() (ConflictBackoff, error)
+	GetMaxParseBytes() (int, error)
+	GetBlacklisterConfirmation() (BlacklisterConfirmation, error)
+	GetAlwaysCrawl() ([]string, error)
+	GetAllowedURLs() ([]string, error)
+	GetChallengePages() (ChallengePages, error)
+	GetRangedFetch() (RangedFetch, error)
 
 	Set(key string, value interface{}) error
+	// Version returns the version of the value of given key, to be read before the value when it is updated
+	// using CompareAndSet
+	Version(key string) string
+	// CompareAndSet set the value of given key if it is still at given version, ErrConflict is returned otherwise
+	CompareAndSet(key string, version string, value interface{}) error
+	Delete(key string) error
+
+	// Ping make sure the ConfigAPI is reachable
+	Ping() error
 }
 
 type client struct {
@@ -65,11 +418,51 @@ type client struct {
 	mutexes      map[string]*sync.RWMutex
 	keys         []string
 
-	forbiddenMimeTypes []MimeType
-	allowedMimeTypes   []MimeType
-	forbiddenHostnames []ForbiddenHostname
-	refreshDelay       RefreshDelay
-	blackListConfig    BlackListConfig
+	forbiddenMimeTypes      []MimeType
+	allowedMimeTypes        []MimeType
+	forbiddenHostnames      []ForbiddenHostname
+	refreshDelay            RefreshDelay
+	blackListConfig         BlackListConfig
+	blackListOnStatus       []int
+	crawlSitemap            bool
+	maxIndexedBodyLen       int
+	respectRobots           bool
+	allowedSchemes          []string
+	maxURLLength            int
+	stripQueryParams        []string
+	maxConcurrentReqs       int
+	maxPathRepetition       int
+	crawlingPaused          bool
+	acceptLanguage          string
+	watchlistKeywords       []string
+	blacklisterWorkers      int
+	hostMapping             map[string]string
+	maxLinksPerPage         int
+	storeBody               bool
+	gracePeriod             time.Duration
+	retryBudget             float64
+	minIndexBodyLength      int
+	skipBodyPatterns        []string
+	allowedPorts            []int
+	crawlDelay              CrawlDelay
+	maxQueuedURLs           int64
+	crawlerIdentifierHeader CrawlerIdentifierHeader
+	minTLSVersion           string
+	indexableStatusCodes    []string
+	indexLanguages          IndexLanguages
+	queueWatermarks         QueueWatermarks
+	fieldSelectors          []FieldSelectors
+	conflictBackoff         ConflictBackoff
+	maxParseBytes           int
+	blacklisterConfirmation BlacklisterConfirmation
+	alwaysCrawl             []string
+	allowedURLs             []string
+	challengePages          ChallengePages
+	rangedFetch             RangedFetch
+
+	// versions are the versions of the values, by key
+	versions      map[string]string
+	versionsMutex sync.RWMutex
 }
 
 // NewConfigClient create a new client for the ConfigAPI.
@@ -163,97 +556,1110 @@ func (c *client) setBlackListConfig(value BlackListConfig) error {
 	defer c.mutexes[BlackListConfigKey].Unlock()
 
 	c.blackListConfig = BlackListConfig{
-		Threshold: value.Threshold,
-		TTL:       value.TTL * time.Second, // TTL is in seconds
+		Threshold:      value.Threshold,
+		ThresholdRules: value.ThresholdRules,
+		TTL:            value.TTL * time.Second, // TTL is in seconds
+		WarningRatio:   value.WarningRatio,
 	}
 
 	return nil
 }
 
-func (c *client) Set(key string, value interface{}) error {
-	b, err := json.Marshal(value)
-	if err != nil {
-		return err
-	}
+func (c *client) GetBlackListOnStatus() ([]int, error) {
+	c.mutexes[BlackListOnStatusKey].RLock()
+	defer c.mutexes[BlackListOnStatusKey].RUnlock()
 
-	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/config/%s", c.configAPIURL, key), bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
+	return c.blackListOnStatus, nil
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
+func (c *client) setBlackListOnStatus(values []int) error {
+	c.mutexes[BlackListOnStatusKey].Lock()
+	defer c.mutexes[BlackListOnStatusKey].Unlock()
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("invalid status code: %d", res.StatusCode)
-	}
+	c.blackListOnStatus = values
 
 	return nil
 }
 
-func (c *client) get(key string) ([]byte, error) {
-	r, err := http.Get(fmt.Sprintf("%s/config/%s", c.configAPIURL, key))
-	if err != nil {
-		return nil, err
-	}
+func (c *client) GetCrawlSitemap() (bool, error) {
+	c.mutexes[CrawlSitemapKey].RLock()
+	defer c.mutexes[CrawlSitemapKey].RUnlock()
 
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
-	}
+	return c.crawlSitemap, nil
+}
 
-	return b, nil
+func (c *client) setCrawlSitemap(value bool) error {
+	c.mutexes[CrawlSitemapKey].Lock()
+	defer c.mutexes[CrawlSitemapKey].Unlock()
+
+	c.crawlSitemap = value
+
+	return nil
 }
 
-func (c *client) setValue(key string, value []byte) error {
-	switch key {
-	case AllowedMimeTypesKey:
-		var val []MimeType
-		if err := json.Unmarshal(value, &val); err != nil {
-			return err
-		}
-		if err := c.setAllowedMimeTypes(val); err != nil {
-			return err
-		}
-		break
-	case ForbiddenHostnamesKey:
-		var val []ForbiddenHostname
-		if err := json.Unmarshal(value, &val); err != nil {
-			return err
-		}
-		if err := c.setForbiddenHostnames(val); err != nil {
-			return err
-		}
-		break
-	case RefreshDelayKey:
-		var val RefreshDelay
-		if err := json.Unmarshal(value, &val); err != nil {
-			return err
-		}
-		if err := c.setRefreshDelay(val); err != nil {
-			return err
-		}
-		break
-	case BlackListConfigKey:
-		var val BlackListConfig
-		if err := json.Unmarshal(value, &val); err != nil {
-			return err
-		}
-		if err := c.setBlackListConfig(val); err != nil {
-			return err
-		}
-		break
-	default:
-		return fmt.Errorf("non managed value type: %s", key)
-	}
+func (c *client) GetMaxIndexedBodyLength() (int, error) {
+	c.mutexes[MaxIndexedBodyLengthKey].RLock()
+	defer c.mutexes[MaxIndexedBodyLengthKey].RUnlock()
 
-	log.Trace().Str("key", key).Bytes("value", value).Msg("Successfully set value")
+	return c.maxIndexedBodyLen, nil
+}
+
+func (c *client) setMaxIndexedBodyLength(value int) error {
+	c.mutexes[MaxIndexedBodyLengthKey].Lock()
+	defer c.mutexes[MaxIndexedBodyLengthKey].Unlock()
+
+	c.maxIndexedBodyLen = value
+
+	return nil
+}
+
+func (c *client) GetRespectRobots() (bool, error) {
+	c.mutexes[RespectRobotsKey].RLock()
+	defer c.mutexes[RespectRobotsKey].RUnlock()
+
+	return c.respectRobots, nil
+}
+
+func (c *client) setRespectRobots(value bool) error {
+	c.mutexes[RespectRobotsKey].Lock()
+	defer c.mutexes[RespectRobotsKey].Unlock()
+
+	c.respectRobots = value
+
+	return nil
+}
+
+func (c *client) GetAllowedSchemes() ([]string, error) {
+	c.mutexes[AllowedSchemesKey].RLock()
+	defer c.mutexes[AllowedSchemesKey].RUnlock()
+
+	return c.allowedSchemes, nil
+}
+
+func (c *client) setAllowedSchemes(values []string) error {
+	c.mutexes[AllowedSchemesKey].Lock()
+	defer c.mutexes[AllowedSchemesKey].Unlock()
+
+	c.allowedSchemes = values
+
+	return nil
+}
+
+func (c *client) GetMaxURLLength() (int, error) {
+	c.mutexes[MaxURLLengthKey].RLock()
+	defer c.mutexes[MaxURLLengthKey].RUnlock()
+
+	return c.maxURLLength, nil
+}
+
+func (c *client) setMaxURLLength(value int) error {
+	c.mutexes[MaxURLLengthKey].Lock()
+	defer c.mutexes[MaxURLLengthKey].Unlock()
+
+	c.maxURLLength = value
+
+	return nil
+}
+
+func (c *client) GetStripQueryParams() ([]string, error) {
+	c.mutexes[StripQueryParamsKey].RLock()
+	defer c.mutexes[StripQueryParamsKey].RUnlock()
+
+	return c.stripQueryParams, nil
+}
+
+func (c *client) setStripQueryParams(values []string) error {
+	c.mutexes[StripQueryParamsKey].Lock()
+	defer c.mutexes[StripQueryParamsKey].Unlock()
+
+	c.stripQueryParams = values
+
+	return nil
+}
+
+func (c *client) GetMaxConcurrentRequests() (int, error) {
+	c.mutexes[MaxConcurrentRequestsKey].RLock()
+	defer c.mutexes[MaxConcurrentRequestsKey].RUnlock()
+
+	return c.maxConcurrentReqs, nil
+}
+
+func (c *client) setMaxConcurrentRequests(value int) error {
+	c.mutexes[MaxConcurrentRequestsKey].Lock()
+	defer c.mutexes[MaxConcurrentRequestsKey].Unlock()
+
+	c.maxConcurrentReqs = value
+
+	return nil
+}
+
+func (c *client) GetMaxPathRepetition() (int, error) {
+	c.mutexes[MaxPathRepetitionKey].RLock()
+	defer c.mutexes[MaxPathRepetitionKey].RUnlock()
+
+	return c.maxPathRepetition, nil
+}
+
+func (c *client) setMaxPathRepetition(value int) error {
+	c.mutexes[MaxPathRepetitionKey].Lock()
+	defer c.mutexes[MaxPathRepetitionKey].Unlock()
+
+	c.maxPathRepetition = value
+
+	return nil
+}
+
+func (c *client) GetCrawlingPaused() (bool, error) {
+	c.mutexes[CrawlingPausedKey].RLock()
+	defer c.mutexes[CrawlingPausedKey].RUnlock()
+
+	return c.crawlingPaused, nil
+}
+
+func (c *client) setCrawlingPaused(value bool) error {
+	c.mutexes[CrawlingPausedKey].Lock()
+	defer c.mutexes[CrawlingPausedKey].Unlock()
+
+	c.crawlingPaused = value
+
+	return nil
+}
+
+func (c *client) GetAcceptLanguage() (string, error) {
+	c.mutexes[AcceptLanguageKey].RLock()
+	defer c.mutexes[AcceptLanguageKey].RUnlock()
+
+	return c.acceptLanguage, nil
+}
+
+func (c *client) setAcceptLanguage(value string) error {
+	c.mutexes[AcceptLanguageKey].Lock()
+	defer c.mutexes[AcceptLanguageKey].Unlock()
+
+	c.acceptLanguage = value
+
+	return nil
+}
+
+func (c *client) GetWatchlistKeywords() ([]string, error) {
+	c.mutexes[WatchlistKeywordsKey].RLock()
+	defer c.mutexes[WatchlistKeywordsKey].RUnlock()
+
+	return c.watchlistKeywords, nil
+}
+
+func (c *client) setWatchlistKeywords(values []string) error {
+	c.mutexes[WatchlistKeywordsKey].Lock()
+	defer c.mutexes[WatchlistKeywordsKey].Unlock()
+
+	c.watchlistKeywords = values
+
+	return nil
+}
+
+func (c *client) GetBlacklisterWorkers() (int, error) {
+	c.mutexes[BlacklisterWorkersKey].RLock()
+	defer c.mutexes[BlacklisterWorkersKey].RUnlock()
+
+	return c.blacklisterWorkers, nil
+}
+
+func (c *client) setBlacklisterWorkers(value int) error {
+	c.mutexes[BlacklisterWorkersKey].Lock()
+	defer c.mutexes[BlacklisterWorkersKey].Unlock()
+
+	c.blacklisterWorkers = value
+
+	return nil
+}
+
+func (c *client) GetHostMapping() (map[string]string, error) {
+	c.mutexes[HostMappingKey].RLock()
+	defer c.mutexes[HostMappingKey].RUnlock()
+
+	return c.hostMapping, nil
+}
+
+func (c *client) setHostMapping(values map[string]string) error {
+	c.mutexes[HostMappingKey].Lock()
+	defer c.mutexes[HostMappingKey].Unlock()
+
+	c.hostMapping = values
+
+	return nil
+}
+
+func (c *client) GetMaxLinksPerPage() (int, error) {
+	c.mutexes[MaxLinksPerPageKey].RLock()
+	defer c.mutexes[MaxLinksPerPageKey].RUnlock()
+
+	return c.maxLinksPerPage, nil
+}
+
+func (c *client) setMaxLinksPerPage(value int) error {
+	c.mutexes[MaxLinksPerPageKey].Lock()
+	defer c.mutexes[MaxLinksPerPageKey].Unlock()
+
+	c.maxLinksPerPage = value
 
 	return nil
 }
 
+func (c *client) GetStoreBody() (bool, error) {
+	c.mutexes[StoreBodyKey].RLock()
+	defer c.mutexes[StoreBodyKey].RUnlock()
+
+	return c.storeBody, nil
+}
+
+func (c *client) setStoreBody(value bool) error {
+	c.mutexes[StoreBodyKey].Lock()
+	defer c.mutexes[StoreBodyKey].Unlock()
+
+	c.storeBody = value
+
+	return nil
+}
+
+func (c *client) GetBlacklisterGracePeriod() (time.Duration, error) {
+	c.mutexes[BlacklisterGracePeriodKey].RLock()
+	defer c.mutexes[BlacklisterGracePeriodKey].RUnlock()
+
+	return c.gracePeriod, nil
+}
+
+func (c *client) setBlacklisterGracePeriod(value time.Duration) error {
+	c.mutexes[BlacklisterGracePeriodKey].Lock()
+	defer c.mutexes[BlacklisterGracePeriodKey].Unlock()
+
+	c.gracePeriod = value
+
+	return nil
+}
+
+func (c *client) GetRetryBudget() (float64, error) {
+	c.mutexes[RetryBudgetKey].RLock()
+	defer c.mutexes[RetryBudgetKey].RUnlock()
+
+	return c.retryBudget, nil
+}
+
+func (c *client) setRetryBudget(value float64) error {
+	c.mutexes[RetryBudgetKey].Lock()
+	defer c.mutexes[RetryBudgetKey].Unlock()
+
+	c.retryBudget = value
+
+	return nil
+}
+
+func (c *client) GetMinIndexBodyLength() (int, error) {
+	c.mutexes[MinIndexBodyLengthKey].RLock()
+	defer c.mutexes[MinIndexBodyLengthKey].RUnlock()
+
+	return c.minIndexBodyLength, nil
+}
+
+func (c *client) setMinIndexBodyLength(value int) error {
+	c.mutexes[MinIndexBodyLengthKey].Lock()
+	defer c.mutexes[MinIndexBodyLengthKey].Unlock()
+
+	c.minIndexBodyLength = value
+
+	return nil
+}
+
+func (c *client) GetSkipBodyPatterns() ([]string, error) {
+	c.mutexes[SkipBodyPatternsKey].RLock()
+	defer c.mutexes[SkipBodyPatternsKey].RUnlock()
+
+	return c.skipBodyPatterns, nil
+}
+
+func (c *client) setSkipBodyPatterns(values []string) error {
+	c.mutexes[SkipBodyPatternsKey].Lock()
+	defer c.mutexes[SkipBodyPatternsKey].Unlock()
+
+	c.skipBodyPatterns = values
+
+	return nil
+}
+
+func (c *client) GetAllowedPorts() ([]int, error) {
+	c.mutexes[AllowedPortsKey].RLock()
+	defer c.mutexes[AllowedPortsKey].RUnlock()
+
+	return c.allowedPorts, nil
+}
+
+func (c *client) setAllowedPorts(values []int) error {
+	c.mutexes[AllowedPortsKey].Lock()
+	defer c.mutexes[AllowedPortsKey].Unlock()
+
+	c.allowedPorts = values
+
+	return nil
+}
+
+func (c *client) GetCrawlDelay() (CrawlDelay, error) {
+	c.mutexes[CrawlDelayKey].RLock()
+	defer c.mutexes[CrawlDelayKey].RUnlock()
+
+	return c.crawlDelay, nil
+}
+
+func (c *client) setCrawlDelay(value CrawlDelay) error {
+	c.mutexes[CrawlDelayKey].Lock()
+	defer c.mutexes[CrawlDelayKey].Unlock()
+
+	c.crawlDelay = value
+
+	return nil
+}
+
+func (c *client) GetMaxQueuedURLs() (int64, error) {
+	c.mutexes[MaxQueuedURLsKey].RLock()
+	defer c.mutexes[MaxQueuedURLsKey].RUnlock()
+
+	return c.maxQueuedURLs, nil
+}
+
+func (c *client) setMaxQueuedURLs(value int64) error {
+	c.mutexes[MaxQueuedURLsKey].Lock()
+	defer c.mutexes[MaxQueuedURLsKey].Unlock()
+
+	c.maxQueuedURLs = value
+
+	return nil
+}
+
+func (c *client) GetCrawlerIdentifierHeader() (CrawlerIdentifierHeader, error) {
+	c.mutexes[CrawlerIdentifierHeaderKey].RLock()
+	defer c.mutexes[CrawlerIdentifierHeaderKey].RUnlock()
+
+	return c.crawlerIdentifierHeader, nil
+}
+
+func (c *client) setCrawlerIdentifierHeader(value CrawlerIdentifierHeader) error {
+	c.mutexes[CrawlerIdentifierHeaderKey].Lock()
+	defer c.mutexes[CrawlerIdentifierHeaderKey].Unlock()
+
+	c.crawlerIdentifierHeader = value
+
+	return nil
+}
+
+func (c *client) GetMinTLSVersion() (string, error) {
+	c.mutexes[MinTLSVersionKey].RLock()
+	defer c.mutexes[MinTLSVersionKey].RUnlock()
+
+	return c.minTLSVersion, nil
+}
+
+func (c *client) setMinTLSVersion(value string) error {
+	c.mutexes[MinTLSVersionKey].Lock()
+	defer c.mutexes[MinTLSVersionKey].Unlock()
+
+	c.minTLSVersion = value
+
+	return nil
+}
+
+func (c *client) GetIndexableStatusCodes() ([]string, error) {
+	c.mutexes[IndexableStatusCodesKey].RLock()
+	defer c.mutexes[IndexableStatusCodesKey].RUnlock()
+
+	return c.indexableStatusCodes, nil
+}
+
+func (c *client) setIndexableStatusCodes(values []string) error {
+	c.mutexes[IndexableStatusCodesKey].Lock()
+	defer c.mutexes[IndexableStatusCodesKey].Unlock()
+
+	c.indexableStatusCodes = values
+
+	return nil
+}
+
+func (c *client) GetIndexLanguages() (IndexLanguages, error) {
+	c.mutexes[IndexLanguagesKey].RLock()
+	defer c.mutexes[IndexLanguagesKey].RUnlock()
+
+	return c.indexLanguages, nil
+}
+
+func (c *client) setIndexLanguages(value IndexLanguages) error {
+	c.mutexes[IndexLanguagesKey].Lock()
+	defer c.mutexes[IndexLanguagesKey].Unlock()
+
+	c.indexLanguages = value
+
+	return nil
+}
+
+func (c *client) GetQueueWatermarks() (QueueWatermarks, error) {
+	c.mutexes[QueueWatermarksKey].RLock()
+	defer c.mutexes[QueueWatermarksKey].RUnlock()
+
+	return c.queueWatermarks, nil
+}
+
+func (c *client) setQueueWatermarks(value QueueWatermarks) error {
+	c.mutexes[QueueWatermarksKey].Lock()
+	defer c.mutexes[QueueWatermarksKey].Unlock()
+
+	c.queueWatermarks = value
+
+	return nil
+}
+
+func (c *client) GetFieldSelectors() ([]FieldSelectors, error) {
+	c.mutexes[FieldSelectorsKey].RLock()
+	defer c.mutexes[FieldSelectorsKey].RUnlock()
+
+	return c.fieldSelectors, nil
+}
+
+func (c *client) setFieldSelectors(value []FieldSelectors) error {
+	c.mutexes[FieldSelectorsKey].Lock()
+	defer c.mutexes[FieldSelectorsKey].Unlock()
+
+	c.fieldSelectors = value
+
+	return nil
+}
+
+func (c *client) GetConflictBackoff() (ConflictBackoff, error) {
+	c.mutexes[ConflictBackoffKey].RLock()
+	defer c.mutexes[ConflictBackoffKey].RUnlock()
+
+	return c.conflictBackoff, nil
+}
+
+func (c *client) setConflictBackoff(value ConflictBackoff) error {
+	c.mutexes[ConflictBackoffKey].Lock()
+	defer c.mutexes[ConflictBackoffKey].Unlock()
+
+	c.conflictBackoff = value
+
+	return nil
+}
+
+func (c *client) GetMaxParseBytes() (int, error) {
+	c.mutexes[MaxParseBytesKey].RLock()
+	defer c.mutexes[MaxParseBytesKey].RUnlock()
+
+	return c.maxParseBytes, nil
+}
+
+func (c *client) setMaxParseBytes(value int) error {
+	c.mutexes[MaxParseBytesKey].Lock()
+	defer c.mutexes[MaxParseBytesKey].Unlock()
+
+	c.maxParseBytes = value
+
+	return nil
+}
+
+func (c *client) GetBlacklisterConfirmation() (BlacklisterConfirmation, error) {
+	c.mutexes[BlacklisterConfirmationKey].RLock()
+	defer c.mutexes[BlacklisterConfirmationKey].RUnlock()
+
+	return c.blacklisterConfirmation, nil
+}
+
+func (c *client) setBlacklisterConfirmation(value BlacklisterConfirmation) error {
+	c.mutexes[BlacklisterConfirmationKey].Lock()
+	defer c.mutexes[BlacklisterConfirmationKey].Unlock()
+
+	c.blacklisterConfirmation = value
+
+	return nil
+}
+
+func (c *client) GetAlwaysCrawl() ([]string, error) {
+	c.mutexes[AlwaysCrawlKey].RLock()
+	defer c.mutexes[AlwaysCrawlKey].RUnlock()
+
+	return c.alwaysCrawl, nil
+}
+
+func (c *client) setAlwaysCrawl(values []string) error {
+	c.mutexes[AlwaysCrawlKey].Lock()
+	defer c.mutexes[AlwaysCrawlKey].Unlock()
+
+	c.alwaysCrawl = values
+
+	return nil
+}
+
+func (c *client) GetAllowedURLs() ([]string, error) {
+	c.mutexes[AllowedURLsKey].RLock()
+	defer c.mutexes[AllowedURLsKey].RUnlock()
+
+	return c.allowedURLs, nil
+}
+
+func (c *client) setAllowedURLs(values []string) error {
+	c.mutexes[AllowedURLsKey].Lock()
+	defer c.mutexes[AllowedURLsKey].Unlock()
+
+	c.allowedURLs = values
+
+	return nil
+}
+
+func (c *client) GetChallengePages() (ChallengePages, error) {
+	c.mutexes[ChallengePagesKey].RLock()
+	defer c.mutexes[ChallengePagesKey].RUnlock()
+
+	return c.challengePages, nil
+}
+
+func (c *client) setChallengePages(value ChallengePages) error {
+	c.mutexes[ChallengePagesKey].Lock()
+	defer c.mutexes[ChallengePagesKey].Unlock()
+
+	c.challengePages = value
+
+	return nil
+}
+
+func (c *client) GetRangedFetch() (RangedFetch, error) {
+	c.mutexes[RangedFetchKey].RLock()
+	defer c.mutexes[RangedFetchKey].RUnlock()
+
+	return c.rangedFetch, nil
+}
+
+func (c *client) setRangedFetch(value RangedFetch) error {
+	c.mutexes[RangedFetchKey].Lock()
+	defer c.mutexes[RangedFetchKey].Unlock()
+
+	c.rangedFetch = value
+
+	return nil
+}
+
+func (c *client) Set(key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/config/%s", c.configAPIURL, key), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *client) Version(key string) string {
+	c.versionsMutex.RLock()
+	defer c.versionsMutex.RUnlock()
+
+	return c.versions[key]
+}
+
+func (c *client) CompareAndSet(key string, version string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/config/%s", c.configAPIURL, key), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("If-Match", fmt.Sprintf("%q", version))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return ErrConflict
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *client) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/config/%s", c.configAPIURL, key), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("invalid status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *client) Ping() error {
+	return Ping(c.configAPIURL)
+}
+
+// Ping check that the ConfigAPI can be reached using given URL
+func Ping(configAPIURL string) error {
+	res, err := pingClient.Get(fmt.Sprintf("%s/health", configAPIURL))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *client) get(key string) ([]byte, error) {
+	r, err := http.Get(fmt.Sprintf("%s/config/%s", c.configAPIURL, key))
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (c *client) setValue(key string, value []byte) error {
+	// The version is computed using the value as stored by the ConfigAPI
+	version := ValueVersion(value)
+
+	// Key has no stored value: reset to the zero value
+	if len(value) == 0 {
+		value = []byte("null")
+	}
+
+	switch key {
+	case AllowedMimeTypesKey:
+		var val []MimeType
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setAllowedMimeTypes(val); err != nil {
+			return err
+		}
+		break
+	case ForbiddenHostnamesKey:
+		var val []ForbiddenHostname
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setForbiddenHostnames(val); err != nil {
+			return err
+		}
+		break
+	case RefreshDelayKey:
+		var val RefreshDelay
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setRefreshDelay(val); err != nil {
+			return err
+		}
+		break
+	case BlackListConfigKey:
+		var val BlackListConfig
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setBlackListConfig(val); err != nil {
+			return err
+		}
+		break
+	case BlackListOnStatusKey:
+		var val []int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setBlackListOnStatus(val); err != nil {
+			return err
+		}
+		break
+	case CrawlSitemapKey:
+		var val bool
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setCrawlSitemap(val); err != nil {
+			return err
+		}
+		break
+	case MaxIndexedBodyLengthKey:
+		var val int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setMaxIndexedBodyLength(val); err != nil {
+			return err
+		}
+		break
+	case RespectRobotsKey:
+		var val bool
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setRespectRobots(val); err != nil {
+			return err
+		}
+		break
+	case AllowedSchemesKey:
+		var val []string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setAllowedSchemes(val); err != nil {
+			return err
+		}
+		break
+	case MaxURLLengthKey:
+		var val int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setMaxURLLength(val); err != nil {
+			return err
+		}
+		break
+	case StripQueryParamsKey:
+		var val []string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setStripQueryParams(val); err != nil {
+			return err
+		}
+		break
+	case MaxConcurrentRequestsKey:
+		var val int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setMaxConcurrentRequests(val); err != nil {
+			return err
+		}
+		break
+	case MaxPathRepetitionKey:
+		var val int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setMaxPathRepetition(val); err != nil {
+			return err
+		}
+		break
+	case CrawlingPausedKey:
+		var val bool
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setCrawlingPaused(val); err != nil {
+			return err
+		}
+		break
+	case AcceptLanguageKey:
+		var val string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setAcceptLanguage(val); err != nil {
+			return err
+		}
+		break
+	case WatchlistKeywordsKey:
+		var val []string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setWatchlistKeywords(val); err != nil {
+			return err
+		}
+		break
+	case BlacklisterWorkersKey:
+		var val int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setBlacklisterWorkers(val); err != nil {
+			return err
+		}
+		break
+	case HostMappingKey:
+		var val map[string]string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setHostMapping(val); err != nil {
+			return err
+		}
+		break
+	case MaxLinksPerPageKey:
+		var val int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setMaxLinksPerPage(val); err != nil {
+			return err
+		}
+		break
+	case StoreBodyKey:
+		// The body is stored unless explicitly disabled
+		var val *bool
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setStoreBody(val == nil || *val); err != nil {
+			return err
+		}
+		break
+	case BlacklisterGracePeriodKey:
+		var val time.Duration
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setBlacklisterGracePeriod(val); err != nil {
+			return err
+		}
+		break
+	case RetryBudgetKey:
+		var val float64
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setRetryBudget(val); err != nil {
+			return err
+		}
+		break
+	case MinIndexBodyLengthKey:
+		var val int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setMinIndexBodyLength(val); err != nil {
+			return err
+		}
+		break
+	case SkipBodyPatternsKey:
+		var val []string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setSkipBodyPatterns(val); err != nil {
+			return err
+		}
+		break
+	case AllowedPortsKey:
+		var val []int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setAllowedPorts(val); err != nil {
+			return err
+		}
+		break
+	case CrawlDelayKey:
+		var val CrawlDelay
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setCrawlDelay(val); err != nil {
+			return err
+		}
+		break
+	case MaxQueuedURLsKey:
+		var val int64
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setMaxQueuedURLs(val); err != nil {
+			return err
+		}
+		break
+	case CrawlerIdentifierHeaderKey:
+		var val CrawlerIdentifierHeader
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setCrawlerIdentifierHeader(val); err != nil {
+			return err
+		}
+		break
+	case MinTLSVersionKey:
+		var val string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setMinTLSVersion(val); err != nil {
+			return err
+		}
+		break
+	case IndexableStatusCodesKey:
+		var val []string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setIndexableStatusCodes(val); err != nil {
+			return err
+		}
+		break
+	case IndexLanguagesKey:
+		var val IndexLanguages
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setIndexLanguages(val); err != nil {
+			return err
+		}
+		break
+	case QueueWatermarksKey:
+		var val QueueWatermarks
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setQueueWatermarks(val); err != nil {
+			return err
+		}
+		break
+	case FieldSelectorsKey:
+		var val []FieldSelectors
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setFieldSelectors(val); err != nil {
+			return err
+		}
+		break
+	case ConflictBackoffKey:
+		var val ConflictBackoff
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setConflictBackoff(val); err != nil {
+			return err
+		}
+		break
+	case MaxParseBytesKey:
+		var val int
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setMaxParseBytes(val); err != nil {
+			return err
+		}
+		break
+	case BlacklisterConfirmationKey:
+		var val BlacklisterConfirmation
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setBlacklisterConfirmation(val); err != nil {
+			return err
+		}
+		break
+	case AlwaysCrawlKey:
+		var val []string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setAlwaysCrawl(val); err != nil {
+			return err
+		}
+		break
+	case AllowedURLsKey:
+		var val []string
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setAllowedURLs(val); err != nil {
+			return err
+		}
+		break
+	case ChallengePagesKey:
+		var val ChallengePages
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setChallengePages(val); err != nil {
+			return err
+		}
+		break
+	case RangedFetchKey:
+		var val RangedFetch
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+
+		if err := c.setRangedFetch(val); err != nil {
+			return err
+		}
+		break
+	default:
+		return fmt.Errorf("non managed value type: %s", key)
+	}
+
+	// The version is updated after the value, so a version read before the value is never more recent
+	c.versionsMutex.Lock()
+	if c.versions == nil {
+		c.versions = map[string]string{}
+	}
+	c.versions[key] = version
+	c.versionsMutex.Unlock()
+
+	log.Trace().Str("key", key).Bytes("value", value).Msg("Successfully set value")
+
+	return nil
+}
+
+// ValueVersion returns the version of given stored value
+func ValueVersion(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
 func (c *client) handleConfigEvent(_ event.Subscriber, msg event.RawMessage) error {
 	// Make sure we have the header
 	configKey, ok := msg.Headers["Config-Key"].(string)
@@ -1,11 +1,17 @@
 package client
 
 import (
+	"errors"
+	"fmt"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
 	"github.com/golang/mock/gomock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestClient(t *testing.T) {
@@ -63,3 +69,287 @@ func TestClient(t *testing.T) {
 	}
 
 }
+
+func TestClient_ForbiddenHostnamesLegacyFormat(t *testing.T) {
+	client := &client{
+		mutexes: map[string]*sync.RWMutex{ForbiddenHostnamesKey: {}},
+		keys:    []string{ForbiddenHostnamesKey},
+	}
+
+	body := `[{"hostname": "example.onion"}, {"hostname": "down.onion", "reason": "timeout", "count": 5, "last-seen": "2021-03-10T12:00:00Z"}]`
+	if err := client.setValue(ForbiddenHostnamesKey, []byte(body)); err != nil {
+		t.FailNow()
+	}
+
+	val, err := client.GetForbiddenHostnames()
+	if err != nil || len(val) != 2 {
+		t.FailNow()
+	}
+
+	if val[0].Hostname != "example.onion" || val[0].Reason != "" || val[0].LastSeen != nil {
+		t.Fail()
+	}
+	if val[1].Reason != "timeout" || val[1].Count != 5 || val[1].FirstSeen != nil || val[1].LastSeen == nil {
+		t.Fail()
+	}
+}
+
+func TestClient_Delete(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Path != "/config/"+RefreshDelayKey {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := &client{configAPIURL: srv.URL}
+	if err := c.Delete(RefreshDelayKey); err != nil {
+		t.Errorf("error while deleting key: %s", err)
+	}
+	if err := c.Delete("unknown"); err == nil {
+		t.Error("delete should have failed")
+	}
+}
+
+func TestClient_CompareAndSet(t *testing.T) {
+	stored := []byte(`[{"hostname":"example.onion"}]`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/config/"+ForbiddenHostnamesKey {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Header.Get("If-Match") != fmt.Sprintf("%q", ValueVersion(stored)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		stored, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	c := &client{configAPIURL: srv.URL, mutexes: map[string]*sync.RWMutex{ForbiddenHostnamesKey: {}}}
+	if err := c.setValue(ForbiddenHostnamesKey, []byte(`[{"hostname":"example.onion"}]`)); err != nil {
+		t.FailNow()
+	}
+
+	version := c.Version(ForbiddenHostnamesKey)
+	if err := c.CompareAndSet(ForbiddenHostnamesKey, version, []ForbiddenHostname{{Hostname: "other.onion"}}); err != nil {
+		t.Errorf("error while setting value: %s", err)
+	}
+
+	// The value has been modified since the version has been read
+	if err := c.CompareAndSet(ForbiddenHostnamesKey, version, []ForbiddenHostname{}); !errors.Is(err, ErrConflict) {
+		t.Errorf("got %v want %v", err, ErrConflict)
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}))
+
+	c := &client{configAPIURL: srv.URL}
+	if err := c.Ping(); err != nil {
+		t.Errorf("error while pinging: %s", err)
+	}
+
+	srv.Close()
+
+	if err := c.Ping(); err == nil {
+		t.Error("ping should have failed")
+	}
+}
+
+func TestClient_ResetValue(t *testing.T) {
+	c := &client{
+		mutexes:         map[string]*sync.RWMutex{BlackListConfigKey: {}},
+		blackListConfig: BlackListConfig{Threshold: 10},
+	}
+
+	if err := c.setValue(BlackListConfigKey, nil); err != nil {
+		t.FailNow()
+	}
+
+	if val, _ := c.GetBlackListConfig(); val.Threshold != 0 {
+		t.Fail()
+	}
+}
+
+func TestClient_StoreBodyDefault(t *testing.T) {
+	c := &client{mutexes: map[string]*sync.RWMutex{StoreBodyKey: {}}}
+
+	if err := c.setValue(StoreBodyKey, nil); err != nil {
+		t.FailNow()
+	}
+	if val, _ := c.GetStoreBody(); !val {
+		t.Error("the body should be stored when the key has no value")
+	}
+
+	if err := c.setValue(StoreBodyKey, []byte("false")); err != nil {
+		t.FailNow()
+	}
+	if val, _ := c.GetStoreBody(); val {
+		t.Error("the body should not be stored")
+	}
+}
+
+func TestCrawlDelay_GetDelay(t *testing.T) {
+	c := CrawlDelay{
+		Delay:     time.Second,
+		Hostnames: map[string]time.Duration{"fragile.onion": time.Minute},
+	}
+
+	if got := c.GetDelay("fragile.onion"); got != time.Minute {
+		t.Errorf("got %s want %s", got, time.Minute)
+	}
+	if got := c.GetDelay("example.onion"); got != time.Second {
+		t.Errorf("got %s want %s", got, time.Second)
+	}
+}
+
+func TestBlackListConfig_GetThreshold(t *testing.T) {
+	c := BlackListConfig{
+		Threshold: 10,
+		ThresholdRules: []ThresholdRule{
+			{Pattern: "*.suspicious.onion", Threshold: 2},
+			{Pattern: "trusted*.onion", Threshold: 50},
+			{Pattern: "*.onion", Threshold: 20},
+		},
+	}
+
+	tests := map[string]int64{
+		"shop.suspicious.onion": 2,
+		"trustedmarket.onion":   50,
+		"example.onion":         20,
+		"example.org":           10,
+	}
+
+	for hostname, want := range tests {
+		if got := c.GetThreshold(hostname); got != want {
+			t.Errorf("%s: got %d want %d", hostname, got, want)
+		}
+	}
+}
+
+func TestBlacklisterConfirmation(t *testing.T) {
+	c := BlacklisterConfirmation{ContentTypes: []string{"text/html"}, DownStatusCodes: []int{202, 429}}
+
+	statusCodes := map[int]bool{200: false, 202: true, 429: true, 503: false}
+	for statusCode, want := range statusCodes {
+		if got := c.IsDownStatus(statusCode); got != want {
+			t.Errorf("%d: got %v want %v", statusCode, got, want)
+		}
+	}
+
+	contentTypes := map[string]bool{
+		"text/html":                true,
+		"text/html; charset=UTF-8": true,
+		"TEXT/HTML":                true,
+		"text/plain":               false,
+		"":                         false,
+	}
+	for contentType, want := range contentTypes {
+		if got := c.AllowsContentType(contentType); got != want {
+			t.Errorf("%s: got %v want %v", contentType, got, want)
+		}
+	}
+
+	// Every response is considered alive by default
+	if (BlacklisterConfirmation{}).IsDownStatus(200) || !(BlacklisterConfirmation{}).AllowsContentType("text/plain") {
+		t.Error("every response should be considered alive by default")
+	}
+}
+
+func TestChallengePages(t *testing.T) {
+	c := ChallengePages{
+		Headers:     []string{"cf-mitigated", "Server: ddos-guard"},
+		BodyMarkers: []string{"<title>Just a moment...</title>"},
+	}
+
+	type test struct {
+		headers map[string]string
+		body    string
+		want    bool
+	}
+
+	tests := []test{
+		{headers: map[string]string{"Cf-Mitigated": "challenge"}, want: true},
+		{headers: map[string]string{"Server": "DDoS-Guard"}, want: true},
+		{headers: map[string]string{"Server": "nginx"}, want: false},
+		{body: "<html><head><TITLE>Just a moment...</TITLE></head></html>", want: true},
+		{body: "<html><head><title>Forum</title></head></html>", want: false},
+	}
+
+	for _, tst := range tests {
+		if got := c.IsChallengePage(200, tst.headers, tst.body); got != tst.want {
+			t.Errorf("%v %s: got %v want %v", tst.headers, tst.body, got, tst.want)
+		}
+	}
+
+	// The status codes restrict the challenge pages
+	c.StatusCodes = []int{403, 503}
+	if c.IsChallengePage(200, map[string]string{"Cf-Mitigated": "challenge"}, "") {
+		t.Error("a response with another status code should not be a challenge page")
+	}
+	if !c.IsChallengePage(503, map[string]string{"Cf-Mitigated": "challenge"}, "") {
+		t.Error("a response with a listed status code should be a challenge page")
+	}
+
+	// Nothing is a challenge page by default
+	if (ChallengePages{StatusCodes: []int{200}}).IsChallengePage(200, nil, "<title>Just a moment...</title>") {
+		t.Error("nothing should be a challenge page by default")
+	}
+}
+
+func TestRangedFetch(t *testing.T) {
+	r := RangedFetch{Extensions: []string{"pdf", ".TXT"}, MaxBytes: 1024}
+
+	urls := map[string]int{
+		"https://example.onion/leak.pdf":        1024,
+		"https://example.onion/dump.txt?part=2": 1024,
+		"https://example.onion/Dump.TXT":        1024,
+		"https://example.onion/index.php":       0,
+		"https://example.onion/pdf":             0,
+		"https://example.onion/files.pdf/":      0,
+		"https://example.onion/":                0,
+	}
+	for rawurl, want := range urls {
+		if got := r.MaxBytesFor(rawurl); got != want {
+			t.Errorf("%s: got %d want %d", rawurl, got, want)
+		}
+	}
+
+	// Disabled by default
+	if got := (RangedFetch{Extensions: []string{"pdf"}}).MaxBytesFor("https://example.onion/leak.pdf"); got != 0 {
+		t.Errorf("got %d want 0", got)
+	}
+}
+
+func TestClient_BlackListConfigBackwardCompatibility(t *testing.T) {
+	c := &client{mutexes: map[string]*sync.RWMutex{BlackListConfigKey: {}}}
+
+	if err := c.setValue(BlackListConfigKey, []byte(`{"threshold": 5, "ttl": 1200}`)); err != nil {
+		t.FailNow()
+	}
+
+	val, _ := c.GetBlackListConfig()
+	if val.GetThreshold("example.onion") != 5 {
+		t.Fail()
+	}
+
+	if err := c.setValue(BlackListConfigKey, []byte(`{"threshold": 5, "threshold-rules": [{"pattern": "*.xyz.onion", "threshold": 1}]}`)); err != nil {
+		t.FailNow()
+	}
+
+	val, _ = c.GetBlackListConfig()
+	if val.GetThreshold("example.onion") != 5 || val.GetThreshold("a.xyz.onion") != 1 {
+		t.Fail()
+	}
+}
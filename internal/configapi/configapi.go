@@ -3,6 +3,7 @@ package configapi
 import (
 	"fmt"
 	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
 	"github.com/gorilla/mux"
@@ -10,13 +11,27 @@ import (
 	"github.com/urfave/cli/v2"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// defaultEnvPrefix is the prefix of the environment variables used to bootstrap the config keys
+const defaultEnvPrefix = "BS_CONFIG_"
+
 // State represent the application state
 type State struct {
-	configCache cache.Cache
-	pub         event.Publisher
+	configCache   cache.Cache
+	pub           event.Publisher
+	defaultValues map[string]string
+
+	blacklistChanges     blacklistChanges
+	blacklistPollTimeout time.Duration
+
+	// valuesMutex makes the conditional updates (If-Match) atomic
+	valuesMutex sync.Mutex
 }
 
 // Name return the process name
@@ -34,6 +49,17 @@ configuration as startup time, and to allow value update at runtime.
 Each time a configuration is update trough the API, an event will
 be dispatched so that running processes can update their local values.
 
+The crawling can be paused & resumed using the API.
+
+The changes made to the forbidden hostnames can be followed using
+long-polling: GET /blacklist/changes?since=<cursor> returns the
+changes made after the cursor, waiting up to 30s for one if needed.
+
+The config keys can be bootstrapped at startup using environment
+variables: BS_CONFIG_BLACKLIST_CONFIG sets 'blacklist-config' for example.
+The stored values take precedence over the environment variables,
+which take precedence over the --default-value flags.
+
 This component produces the 'config' event.`
 }
 
@@ -49,6 +75,11 @@ func (state *State) CustomFlags() []cli.Flag {
 			Name:  "default-value",
 			Usage: "Set default value of key. (format key=value)",
 		},
+		&cli.StringFlag{
+			Name:  "env-prefix",
+			Usage: "Prefix of the environment variables used to set the missing keys at startup. Empty to disable",
+			Value: defaultEnvPrefix,
+		},
 	}
 }
 
@@ -66,9 +97,16 @@ func (state *State) Initialize(provider process.Provider) error {
 	}
 	state.pub = pub
 
+	// Bootstrap the missing keys using the environment first, so it takes precedence over the default values
+	if prefix := provider.GetStrValue("env-prefix"); prefix != "" {
+		if err := setDefaultValues(configCache, envValues(os.Environ(), prefix)); err != nil {
+			return err
+		}
+	}
+
 	defaultValues := map[string]string{}
 	for _, value := range provider.GetStrValues("default-value") {
-		parts := strings.Split(value, "=")
+		parts := strings.SplitN(value, "=", 2)
 
 		if len(parts) == 2 {
 			defaultValues[parts[0]] = parts[1]
@@ -79,6 +117,8 @@ func (state *State) Initialize(provider process.Provider) error {
 			return err
 		}
 	}
+	state.defaultValues = defaultValues
+	state.blacklistPollTimeout = defaultBlacklistPollTimeout
 
 	return nil // TODO
 }
@@ -93,17 +133,27 @@ func (state *State) HTTPHandler() http.Handler {
 	r := mux.NewRouter()
 	r.HandleFunc("/config/{key}", state.getConfiguration).Methods(http.MethodGet)
 	r.HandleFunc("/config/{key}", state.setConfiguration).Methods(http.MethodPut)
+	r.HandleFunc("/config/{key}", state.deleteConfiguration).Methods(http.MethodDelete)
+	r.HandleFunc("/health", state.getHealth).Methods(http.MethodGet)
+	r.HandleFunc("/pause", state.pauseCrawling).Methods(http.MethodPost)
+	r.HandleFunc("/resume", state.resumeCrawling).Methods(http.MethodPost)
+	r.HandleFunc("/blacklist/changes", state.getBlacklistChanges).Methods(http.MethodGet)
 
 	return r
 }
 
+func (state *State) getHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
 func (state *State) getConfiguration(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
 
 	log.Debug().Str("key", key).Msg("Getting key")
 
-	b, err := state.configCache.GetBytes(key)
+	b, err := state.getValue(key)
 	if err != nil {
 		log.Err(err).Msg("error while retrieving configuration")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -111,9 +161,26 @@ func (state *State) getConfiguration(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fmt.Sprintf("%q", client.ValueVersion(b)))
 	_, _ = w.Write(b)
 }
 
+// getValue returns the value of given key, falling back to its default value if any
+func (state *State) getValue(key string) ([]byte, error) {
+	b, err := state.configCache.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if b == nil {
+		if defaultValue, exist := state.defaultValues[key]; exist {
+			b = []byte(defaultValue)
+		}
+	}
+
+	return b, nil
+}
+
 func (state *State) setConfiguration(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
@@ -127,23 +194,124 @@ func (state *State) setConfiguration(w http.ResponseWriter, r *http.Request) {
 
 	log.Debug().Str("key", key).Bytes("value", b).Msg("Setting key")
 
-	if err := state.configCache.SetBytes(key, b, cache.NoTTL); err != nil {
+	state.valuesMutex.Lock()
+	defer state.valuesMutex.Unlock()
+
+	// The value is only set if it has not been modified since the given version has been read
+	if version := r.Header.Get("If-Match"); version != "" {
+		current, err := state.getValue(key)
+		if err != nil {
+			log.Err(err).Msg("error while retrieving configuration")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if strings.Trim(version, `"`) != client.ValueVersion(current) {
+			log.Debug().Str("key", key).Msg("Conflicting update")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	if err := state.setValue(key, b); err != nil {
 		log.Err(err).Msg("error while setting configuration")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+func (state *State) pauseCrawling(w http.ResponseWriter, r *http.Request) {
+	state.setCrawlingPaused(w, true)
+}
+
+func (state *State) resumeCrawling(w http.ResponseWriter, r *http.Request) {
+	state.setCrawlingPaused(w, false)
+}
+
+func (state *State) setCrawlingPaused(w http.ResponseWriter, paused bool) {
+	state.valuesMutex.Lock()
+	defer state.valuesMutex.Unlock()
+
+	if err := state.setValue(client.CrawlingPausedKey, []byte(strconv.FormatBool(paused))); err != nil {
+		log.Err(err).Msg("error while setting crawling pause")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Bool("paused", paused).Msg("Successfully updated crawling pause")
+
+	process.WriteJSON(w, map[string]bool{"paused": paused})
+}
+
+// setValue store given value and notify the running processes
+func (state *State) setValue(key string, value []byte) error {
+	var previous []byte
+	if key == client.ForbiddenHostnamesKey {
+		b, err := state.getValue(key)
+		if err != nil {
+			return err
+		}
+		previous = b
+	}
+
+	if err := state.configCache.SetBytes(key, value, cache.NoTTL); err != nil {
+		return err
+	}
+
+	if key == client.ForbiddenHostnamesKey {
+		state.blacklistChanges.record(diffForbiddenHostnames(previous, value))
+	}
+
 	// publish event to notify config changed
+	return state.pub.PublishJSON(event.ConfigExchange, event.RawMessage{
+		Body:    value,
+		Headers: map[string]interface{}{"Config-Key": key},
+	})
+}
+
+func (state *State) deleteConfiguration(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	log.Debug().Str("key", key).Msg("Deleting key")
+
+	state.valuesMutex.Lock()
+	defer state.valuesMutex.Unlock()
+
+	var previous []byte
+	if key == client.ForbiddenHostnamesKey {
+		b, err := state.getValue(key)
+		if err != nil {
+			log.Err(err).Msg("error while retrieving configuration")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		previous = b
+	}
+
+	if err := state.configCache.Remove(key); err != nil {
+		log.Err(err).Msg("error while deleting configuration")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if key == client.ForbiddenHostnamesKey {
+		state.blacklistChanges.record(diffForbiddenHostnames(previous, []byte(state.defaultValues[key])))
+	}
+
+	// publish event to notify config changed (back to default value, if any)
 	if err := state.pub.PublishJSON(event.ConfigExchange, event.RawMessage{
-		Body:    b,
+		Body:    []byte(state.defaultValues[key]),
 		Headers: map[string]interface{}{"Config-Key": key},
 	}); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write(b)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func setDefaultValues(configCache cache.Cache, values map[string]string) error {
@@ -162,3 +330,32 @@ func setDefaultValues(configCache cache.Cache, values map[string]string) error {
 
 	return nil
 }
+
+// envValues returns the config values defined in given environment, using the variables having given prefix.
+// The key is derived from the variable name: BS_CONFIG_BLACKLIST_CONFIG is mapped to blacklist-config.
+// The variables with an empty value are ignored
+func envValues(environ []string, prefix string) map[string]string {
+	values := map[string]string{}
+	for _, variable := range environ {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		// An empty value is not a valid JSON document
+		if key, ok := envKey(parts[0], prefix); ok && parts[1] != "" {
+			values[key] = parts[1]
+		}
+	}
+
+	return values
+}
+
+// envKey returns the config key mapped to given environment variable name, if it has given prefix
+func envKey(name, prefix string) (string, bool) {
+	if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+		return "", false
+	}
+
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(name, prefix)), "_", "-"), true
+}
@@ -1,8 +1,10 @@
 package configapi
 
 import (
+	"fmt"
 	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
@@ -13,6 +15,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -31,13 +35,14 @@ func TestState_Features(t *testing.T) {
 
 func TestState_CustomFlags(t *testing.T) {
 	s := State{}
-	test.CheckProcessCustomFlags(t, &s, []string{"default-value"})
+	test.CheckProcessCustomFlags(t, &s, []string{"default-value", "env-prefix"})
 }
 
 func TestState_Initialize(t *testing.T) {
 	test.CheckInitialize(t, &State{}, func(p *process_mock.MockProviderMockRecorder) {
 		p.Cache("configuration")
 		p.Publisher()
+		p.GetStrValue("env-prefix")
 		p.GetStrValues("default-value")
 	})
 }
@@ -68,6 +73,9 @@ func TestGetConfiguration(t *testing.T) {
 	if rec.Header().Get("Content-Type") != "application/json" {
 		t.Fail()
 	}
+	if want := fmt.Sprintf("%q", client.ValueVersion([]byte("{\"ttl\": \"10s\"}"))); rec.Header().Get("ETag") != want {
+		t.Errorf("got ETag %s want %s", rec.Header().Get("ETag"), want)
+	}
 
 	b, err := ioutil.ReadAll(rec.Body)
 	if err != nil {
@@ -116,3 +124,180 @@ func TestSetConfiguration(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSetConfiguration_IfMatch(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configCacheMock := cache_mock.NewMockCache(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	current := []byte(`["example.onion"]`)
+	configCacheMock.EXPECT().GetBytes("hello").Times(2).Return(current, nil)
+	configCacheMock.EXPECT().SetBytes("hello", []byte(`["other.onion"]`), cache.NoTTL).Return(nil)
+	pubMock.EXPECT().PublishJSON("config", event.RawMessage{
+		Body:    []byte(`["other.onion"]`),
+		Headers: map[string]interface{}{"Config-Key": "hello"},
+	}).Return(nil)
+
+	s := State{configCache: configCacheMock, pub: pubMock}
+
+	// Outdated version
+	req := httptest.NewRequest(http.MethodPut, "/config/hello", strings.NewReader(`["other.onion"]`))
+	req = mux.SetURLVars(req, map[string]string{"key": "hello"})
+	req.Header.Set("If-Match", `"outdated"`)
+	rec := httptest.NewRecorder()
+	s.setConfiguration(rec, req)
+
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("got %d want %d", rec.Code, http.StatusPreconditionFailed)
+	}
+
+	// Current version
+	req = httptest.NewRequest(http.MethodPut, "/config/hello", strings.NewReader(`["other.onion"]`))
+	req = mux.SetURLVars(req, map[string]string{"key": "hello"})
+	req.Header.Set("If-Match", fmt.Sprintf("%q", client.ValueVersion(current)))
+	rec = httptest.NewRecorder()
+	s.setConfiguration(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("got %d want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestDeleteConfiguration(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configCacheMock := cache_mock.NewMockCache(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	s := State{configCache: configCacheMock, pub: pubMock, defaultValues: map[string]string{"hello": "{\"ttl\": \"5s\"}"}}
+
+	configCacheMock.EXPECT().Remove("hello").Return(nil)
+	pubMock.EXPECT().PublishJSON("config", event.RawMessage{
+		Body:    []byte("{\"ttl\": \"5s\"}"),
+		Headers: map[string]interface{}{"Config-Key": "hello"},
+	}).Return(nil)
+
+	req := httptest.NewRequest(http.MethodDelete, "/config/hello", nil)
+	req = mux.SetURLVars(req, map[string]string{"key": "hello"})
+	rec := httptest.NewRecorder()
+
+	s.deleteConfiguration(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fail()
+	}
+
+	// value should be back to default
+	configCacheMock.EXPECT().GetBytes("hello").Return(nil, nil)
+
+	req = httptest.NewRequest(http.MethodGet, "/config/hello", nil)
+	req = mux.SetURLVars(req, map[string]string{"key": "hello"})
+	rec = httptest.NewRecorder()
+
+	s.getConfiguration(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fail()
+	}
+	if b := rec.Body.String(); b != "{\"ttl\": \"5s\"}" {
+		t.Errorf("got %s want %s", b, "{\"ttl\": \"5s\"}")
+	}
+}
+
+func TestGetHealth(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	s := State{}
+	s.getHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("got %d want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestPauseResumeCrawling(t *testing.T) {
+	tests := []struct {
+		paused  bool
+		handler func(s *State) http.HandlerFunc
+	}{
+		{true, func(s *State) http.HandlerFunc { return s.pauseCrawling }},
+		{false, func(s *State) http.HandlerFunc { return s.resumeCrawling }},
+	}
+
+	for _, test := range tests {
+		mockCtrl := gomock.NewController(t)
+
+		configCacheMock := cache_mock.NewMockCache(mockCtrl)
+		pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+		value := []byte(strconv.FormatBool(test.paused))
+		configCacheMock.EXPECT().SetBytes("crawling-paused", value, cache.NoTTL).Return(nil)
+		pubMock.EXPECT().PublishJSON("config", event.RawMessage{
+			Body:    value,
+			Headers: map[string]interface{}{"Config-Key": "crawling-paused"},
+		}).Return(nil)
+
+		rec := httptest.NewRecorder()
+
+		s := State{configCache: configCacheMock, pub: pubMock}
+		test.handler(&s)(rec, httptest.NewRequest(http.MethodPost, "/pause", nil))
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("got status %d want %d", rec.Code, http.StatusOK)
+		}
+
+		b, err := ioutil.ReadAll(rec.Body)
+		if err != nil {
+			t.FailNow()
+		}
+
+		if want := fmt.Sprintf("{\"paused\":%t}", test.paused); string(b) != want {
+			t.Errorf("got %s want %s", b, want)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestEnvKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		ok   bool
+	}{
+		{"BS_CONFIG_BLACKLIST_CONFIG", "blacklist-config", true},
+		{"BS_CONFIG_CRAWLING_PAUSED", "crawling-paused", true},
+		{"BS_CONFIG_", "", false},
+		{"BS_TOR_PROXY_USERNAME", "", false},
+		{"HOME", "", false},
+	}
+
+	for _, tst := range tests {
+		key, ok := envKey(tst.name, "BS_CONFIG_")
+		if key != tst.key || ok != tst.ok {
+			t.Errorf("%s: got (%s, %v) want (%s, %v)", tst.name, key, ok, tst.key, tst.ok)
+		}
+	}
+}
+
+func TestEnvValues(t *testing.T) {
+	environ := []string{
+		"HOME=/root",
+		"BS_CONFIG_BLACKLIST_THRESHOLD=10",
+		"BS_CONFIG_ALLOWED_MIME_TYPES=[{\"content-type\":\"text/\",\"extensions\":[\"html\"]}]",
+		"BS_CONFIG_EMPTY=",
+	}
+
+	got := envValues(environ, "BS_CONFIG_")
+	want := map[string]string{
+		"blacklist-threshold": "10",
+		"allowed-mime-types":  "[{\"content-type\":\"text/\",\"extensions\":[\"html\"]}]",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,37 @@
+package constraint
+
+import (
+	"net/url"
+	"strings"
+)
+
+// IsAlwaysCrawled check if given URL matches one of given always crawled entries. An entry is either an URL,
+// matching only itself, or an hostname, matching all of its URLs
+func IsAlwaysCrawled(alwaysCrawl []string, rawurl string) bool {
+	if len(alwaysCrawl) == 0 {
+		return false
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	hostname := NormalizeHostname(u.Hostname())
+
+	for _, entry := range alwaysCrawl {
+		entry = strings.TrimSpace(entry)
+
+		if strings.Contains(entry, "://") {
+			if entry == rawurl {
+				return true
+			}
+			continue
+		}
+
+		if NormalizeHostname(entry) == hostname {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,27 @@
+package constraint
+
+import "testing"
+
+func TestIsAlwaysCrawled(t *testing.T) {
+	alwaysCrawl := []string{"directory.onion", "https://forum.onion/latest"}
+
+	tests := map[string]bool{
+		"https://directory.onion":               true,
+		"http://Directory.onion:8080/links?p=2": true,
+		"https://sub.directory.onion":           false,
+		"https://forum.onion/latest":            true,
+		"https://forum.onion/latest?page=2":     false,
+		"https://forum.onion/threads/1":         false,
+		"https://example.onion/directory.onion": false,
+	}
+
+	for rawurl, want := range tests {
+		if got := IsAlwaysCrawled(alwaysCrawl, rawurl); got != want {
+			t.Errorf("%s: got %v want %v", rawurl, got, want)
+		}
+	}
+
+	if IsAlwaysCrawled(nil, "https://directory.onion") {
+		t.Error("no URL should be always crawled by default")
+	}
+}
@@ -2,6 +2,7 @@ package constraint
 
 import (
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"net"
 	"net/url"
 	"strings"
 )
@@ -18,11 +19,57 @@ func CheckHostnameAllowed(configClient configapi.Client, rawurl string) (bool, e
 		return false, err
 	}
 
-	for _, hostname := range forbiddenHostnames {
-		if strings.Contains(u.Hostname(), hostname.Hostname) {
+	hostname := NormalizeHostname(u.Hostname())
+	isIP := net.ParseIP(hostname) != nil
+
+	for _, forbiddenHostname := range forbiddenHostnames {
+		forbidden := NormalizeHostname(forbiddenHostname.Hostname)
+
+		// IP addresses must match exactly (10.0.0.1 should not forbid 10.0.0.10)
+		if isIP && hostname == forbidden {
+			return false, nil
+		}
+		if !isIP && strings.Contains(hostname, forbidden) {
 			return false, nil
 		}
 	}
 
 	return true, nil
 }
+
+// CheckURLAllowed check if given URL is allowed: either its hostname is allowed, or the URL is one of the allowed URLs
+// (matched exactly) exempted from the forbidden hostnames
+func CheckURLAllowed(configClient configapi.Client, rawurl string) (bool, error) {
+	allowed, err := CheckHostnameAllowed(configClient, rawurl)
+	if err != nil || allowed {
+		return allowed, err
+	}
+
+	allowedURLs, err := configClient.GetAllowedURLs()
+	if err != nil {
+		return false, err
+	}
+
+	for _, allowedURL := range allowedURLs {
+		if allowedURL == rawurl {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// NormalizeHostname returns the canonical form of given hostname (as returned by url.URL.Hostname()).
+// Hostnames are lowercased, and IP addresses are formatted using their shortest representation
+func NormalizeHostname(hostname string) string {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+
+	// Remove brackets of IPv6 literal if any
+	hostname = strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]")
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		return ip.String()
+	}
+
+	return hostname
+}
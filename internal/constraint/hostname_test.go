@@ -7,6 +7,29 @@ import (
 	"testing"
 )
 
+func TestCheckURLAllowed(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetForbiddenHostnames().AnyTimes().Return([]client.ForbiddenHostname{{Hostname: "market.onion"}}, nil)
+	configClientMock.EXPECT().GetAllowedURLs().AnyTimes().Return([]string{"https://market.onion/status"}, nil)
+
+	tests := map[string]bool{
+		"https://market.onion/status":     true,
+		"https://market.onion/status?x=1": false,
+		"https://market.onion/":           false,
+		"http://market.onion/status":      false,
+		"https://example.onion/status":    true,
+	}
+
+	for rawurl, want := range tests {
+		if allowed, err := CheckURLAllowed(configClientMock, rawurl); allowed != want || err != nil {
+			t.Errorf("%s: got %v (%v) want %v", rawurl, allowed, err, want)
+		}
+	}
+}
+
 func TestCheckHostnameAllowed(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -27,3 +50,53 @@ func TestCheckHostnameAllowed(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCheckHostnameAllowed_IP(t *testing.T) {
+	type test struct {
+		url     string
+		allowed bool
+	}
+
+	tests := []test{
+		{url: "http://10.0.0.1/index.php", allowed: false},
+		{url: "http://10.0.0.10/index.php", allowed: true},
+		{url: "http://[2001:DB8::0001]:8080/index.php", allowed: false},
+		{url: "http://[2001:db8::10]/index.php", allowed: true},
+		{url: "http://Google.onion/", allowed: false},
+	}
+
+	for _, tst := range tests {
+		mockCtrl := gomock.NewController(t)
+		configClientMock := client_mock.NewMockClient(mockCtrl)
+
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{
+			{Hostname: "10.0.0.1"},
+			{Hostname: "2001:db8::1"},
+			{Hostname: "google.onion"},
+		}, nil)
+
+		if allowed, err := CheckHostnameAllowed(configClientMock, tst.url); allowed != tst.allowed || err != nil {
+			t.Errorf("%s: got %v want %v", tst.url, allowed, tst.allowed)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	hostnames := map[string]string{
+		"example.onion":                "example.onion",
+		"EXAMPLE.onion.":               "example.onion",
+		"192.168.1.12":                 "192.168.1.12",
+		"2001:DB8:0:0:0:0:0:1":         "2001:db8::1",
+		"[2001:db8::1]":                "2001:db8::1",
+		"::ffff:192.168.1.12":          "192.168.1.12",
+		"fe80:0000:0000:0000:0000::ab": "fe80::ab",
+	}
+
+	for hostname, want := range hostnames {
+		if got := NormalizeHostname(hostname); got != want {
+			t.Errorf("%s: got %s want %s", hostname, got, want)
+		}
+	}
+}
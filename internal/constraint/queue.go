@@ -0,0 +1,33 @@
+package constraint
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+)
+
+// QueuedURLsCache is the name of the cache holding the approximate number of URLs queued for crawling,
+// shared by the scheduler (incrementing it on publish) and the crawlers (decrementing it once crawled)
+const QueuedURLsCache = "queue"
+
+// queuedURLsKey is the cache key of the number of URLs queued for crawling
+const queuedURLsKey = "urls"
+
+// GetQueuedURLs returns the approximate number of URLs queued for crawling.
+// The counter may drift below zero (i.e: URLs queued before the counter existed), it is then read as zero
+func GetQueuedURLs(c cache.Cache) (int64, error) {
+	queued, err := c.GetInt64(queuedURLsKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if queued < 0 {
+		return 0, nil
+	}
+
+	return queued, nil
+}
+
+// AddQueuedURLs add given count (negative once crawled) to the number of URLs queued for crawling
+func AddQueuedURLs(c cache.Cache, count int64) error {
+	_, err := c.IncrBy(queuedURLsKey, count, cache.NoTTL)
+	return err
+}
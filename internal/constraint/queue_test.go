@@ -0,0 +1,44 @@
+package constraint
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
+	"github.com/golang/mock/gomock"
+	"testing"
+)
+
+func TestAddQueuedURLs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	cacheMock.EXPECT().IncrBy("urls", int64(10), cache.NoTTL).Return(int64(10), nil)
+	if err := AddQueuedURLs(cacheMock, 10); err != nil {
+		t.FailNow()
+	}
+
+	// The counter should not be reset once drifted below zero (it would race with the increments)
+	cacheMock.EXPECT().IncrBy("urls", int64(-1), cache.NoTTL).Return(int64(-1), nil)
+	if err := AddQueuedURLs(cacheMock, -1); err != nil {
+		t.FailNow()
+	}
+}
+
+func TestGetQueuedURLs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	cacheMock.EXPECT().GetInt64("urls").Return(int64(10), nil)
+	if queued, err := GetQueuedURLs(cacheMock); err != nil || queued != 10 {
+		t.Errorf("got (%d, %v) want (10, nil)", queued, err)
+	}
+
+	// A counter drifted below zero should be read as zero
+	cacheMock.EXPECT().GetInt64("urls").Return(int64(-3), nil)
+	if queued, err := GetQueuedURLs(cacheMock); err != nil || queued != 0 {
+		t.Errorf("got (%d, %v) want (0, nil)", queued, err)
+	}
+}
@@ -0,0 +1,59 @@
+package constraint
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"strings"
+)
+
+// RobotsDirectives are the directives set using the robots meta tag
+type RobotsDirectives struct {
+	// NoIndex means the resource should not be indexed
+	NoIndex bool
+	// NoFollow means the links of the resource should not be followed
+	NoFollow bool
+}
+
+// GetRobotsDirectives returns the robots directives of given body.
+// No directives are returned if robots directives should not be respected
+func GetRobotsDirectives(configClient configapi.Client, body string) (RobotsDirectives, error) {
+	respectRobots, err := configClient.GetRespectRobots()
+	if err != nil {
+		return RobotsDirectives{}, err
+	}
+
+	if !respectRobots {
+		return RobotsDirectives{}, nil
+	}
+
+	return parseRobotsDirectives(body)
+}
+
+func parseRobotsDirectives(body string) (RobotsDirectives, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return RobotsDirectives{}, err
+	}
+
+	directives := RobotsDirectives{}
+	doc.Find("meta").Each(func(i int, s *goquery.Selection) {
+		if name, _ := s.Attr("name"); !strings.EqualFold(name, "robots") {
+			return
+		}
+
+		content, _ := s.Attr("content")
+		for _, directive := range strings.Split(content, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "noindex":
+				directives.NoIndex = true
+			case "nofollow":
+				directives.NoFollow = true
+			case "none":
+				directives.NoIndex = true
+				directives.NoFollow = true
+			}
+		}
+	})
+
+	return directives, nil
+}
@@ -0,0 +1,58 @@
+package constraint
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/golang/mock/gomock"
+	"testing"
+)
+
+func TestGetRobotsDirectives(t *testing.T) {
+	type test struct {
+		body       string
+		directives RobotsDirectives
+	}
+
+	tests := []test{
+		{body: `<html><head><title>Hello</title></head></html>`, directives: RobotsDirectives{}},
+		{body: `<meta name="robots" content="noindex">`, directives: RobotsDirectives{NoIndex: true}},
+		{body: `<meta name="robots" content="nofollow">`, directives: RobotsDirectives{NoFollow: true}},
+		{body: `<meta name="ROBOTS" content="NoIndex, NoFollow">`, directives: RobotsDirectives{NoIndex: true, NoFollow: true}},
+		{body: `<meta name="robots" content="none">`, directives: RobotsDirectives{NoIndex: true, NoFollow: true}},
+		{body: `<meta name="robots" content="index,follow">`, directives: RobotsDirectives{}},
+		{body: `<meta name="description" content="noindex">`, directives: RobotsDirectives{}},
+	}
+
+	for _, tst := range tests {
+		mockCtrl := gomock.NewController(t)
+		configClientMock := client_mock.NewMockClient(mockCtrl)
+
+		configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+
+		directives, err := GetRobotsDirectives(configClientMock, tst.body)
+		if err != nil {
+			t.FailNow()
+		}
+		if directives != tst.directives {
+			t.Errorf("%s: got %+v want %+v", tst.body, directives, tst.directives)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetRobotsDirectives_NotRespected(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+
+	directives, err := GetRobotsDirectives(configClientMock, `<meta name="robots" content="noindex,nofollow">`)
+	if err != nil {
+		t.FailNow()
+	}
+	if directives.NoIndex || directives.NoFollow {
+		t.Fail()
+	}
+}
@@ -0,0 +1,21 @@
+package constraint
+
+import (
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+)
+
+// CheckStatusBlacklisted check if given status code should count toward hostname blacklisting
+func CheckStatusBlacklisted(configClient configapi.Client, statusCode int) (bool, error) {
+	statusCodes, err := configClient.GetBlackListOnStatus()
+	if err != nil {
+		return false, err
+	}
+
+	for _, code := range statusCodes {
+		if code == statusCode {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
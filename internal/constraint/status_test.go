@@ -0,0 +1,29 @@
+package constraint
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/golang/mock/gomock"
+	"testing"
+)
+
+func TestCheckStatusBlacklisted(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	configClientMock.EXPECT().GetBlackListOnStatus().Return([]int{403, 500}, nil)
+	if blacklisted, err := CheckStatusBlacklisted(configClientMock, 403); !blacklisted || err != nil {
+		t.Fail()
+	}
+
+	configClientMock.EXPECT().GetBlackListOnStatus().Return([]int{403, 500}, nil)
+	if blacklisted, err := CheckStatusBlacklisted(configClientMock, 404); blacklisted || err != nil {
+		t.Fail()
+	}
+
+	configClientMock.EXPECT().GetBlackListOnStatus().Return(nil, nil)
+	if blacklisted, err := CheckStatusBlacklisted(configClientMock, 500); blacklisted || err != nil {
+		t.Fail()
+	}
+}
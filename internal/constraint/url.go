@@ -0,0 +1,67 @@
+package constraint
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/purell"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ScheduledUntilExpiry is the scheduler URL cache value of the URLs scheduled until their cache entry expires,
+// the other values being the time (unix nano) after which the URL can be scheduled again
+const ScheduledUntilExpiry = 1
+
+// IsScheduled returns true if given scheduler URL cache value mark the URL as scheduled at given time
+func IsScheduled(value int64, now time.Time) bool {
+	return value == ScheduledUntilExpiry || value > now.UnixNano()
+}
+
+// NormalizeURL returns the canonical form of given URL, as scheduled (then crawled & indexed)
+func NormalizeURL(u string) (string, error) {
+	normalizedURL, err := purell.NormalizeURLString(u, purell.FlagsUsuallySafeGreedy|
+		purell.FlagRemoveDirectoryIndex|purell.FlagRemoveFragment|purell.FlagRemoveDuplicateSlashes)
+	if err != nil {
+		return "", fmt.Errorf("error while normalizing URL %s: %s", u, err)
+	}
+
+	return normalizedURL, nil
+}
+
+// StripURLQueryParams remove the query parameters matching one of given patterns (i.e: utm_*, sessionid, *)
+// the patterns are case insensitive
+func StripURLQueryParams(rawURL string, patterns []string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		name := param
+		if idx := strings.Index(param, "="); idx >= 0 {
+			name = param[:idx]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+
+		stripped := false
+		for _, pattern := range patterns {
+			if matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(name)); err == nil && matched {
+				stripped = true
+				break
+			}
+		}
+
+		if !stripped {
+			params = append(params, param)
+		}
+	}
+
+	u.RawQuery = strings.Join(params, "&")
+	u.ForceQuery = false
+
+	return u.String()
+}
@@ -0,0 +1,86 @@
+package constraint
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	url, err := NormalizeURL("https://this-is-sparta.de?url=url-query-param#fragment-23")
+	if err != nil {
+		t.FailNow()
+	}
+
+	if url != "https://this-is-sparta.de?url=url-query-param" {
+		t.Fail()
+	}
+
+	// default ports are removed
+	url, err = NormalizeURL("https://this-is-sparta.onion:443/forum/")
+	if err != nil {
+		t.FailNow()
+	}
+
+	if url != "https://this-is-sparta.onion/forum" {
+		t.Errorf("got %s", url)
+	}
+}
+
+func TestIsScheduled(t *testing.T) {
+	now := time.Now()
+
+	if IsScheduled(0, now) {
+		t.Error("missing URL should not be scheduled")
+	}
+	if !IsScheduled(ScheduledUntilExpiry, now) {
+		t.Error("URL should be scheduled until its entry expires")
+	}
+	if !IsScheduled(now.Add(time.Minute).UnixNano(), now) {
+		t.Error("URL should be scheduled until its eligibility time")
+	}
+	if IsScheduled(now.Add(-time.Minute).UnixNano(), now) {
+		t.Error("URL should be eligible once its eligibility time is passed")
+	}
+}
+
+func TestStripURLQueryParams(t *testing.T) {
+	type test struct {
+		url      string
+		patterns []string
+		want     string
+	}
+
+	tests := []test{
+		{
+			url:      "https://example.onion/forum.php?utm_source=reddit&id=12&SessionID=abc&utm_medium=social",
+			patterns: []string{"utm_*", "sessionid"},
+			want:     "https://example.onion/forum.php?id=12",
+		},
+		{
+			url:      "https://example.onion/forum.php?utm_source=reddit&sessionid=abc",
+			patterns: []string{"utm_*", "sessionid"},
+			want:     "https://example.onion/forum.php",
+		},
+		{
+			url:      "https://example.onion/forum.php?id=12&page=2",
+			patterns: []string{"*"},
+			want:     "https://example.onion/forum.php",
+		},
+		{
+			url:      "https://example.onion/forum.php?id=12&page=2",
+			patterns: []string{"utm_*"},
+			want:     "https://example.onion/forum.php?id=12&page=2",
+		},
+		{
+			url:      "https://example.onion/",
+			patterns: []string{"*"},
+			want:     "https://example.onion/",
+		},
+	}
+
+	for _, tst := range tests {
+		if got := StripURLQueryParams(tst.url, tst.patterns); got != tst.want {
+			t.Errorf("got %s want %s", got, tst.want)
+		}
+	}
+}
@@ -1,23 +1,44 @@
 package crawler
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	"github.com/darkspot-org/bathyscaphe/internal/clock"
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/constraint"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	chttp "github.com/darkspot-org/bathyscaphe/internal/http"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 var (
 	errContentTypeNotAllowed = fmt.Errorf("content type is not allowed")
 	errHostnameNotAllowed    = fmt.Errorf("hostname is not allowed")
+	errChallengePage         = fmt.Errorf("anti-bot challenge page")
+)
+
+// challengeRetryPolicy is used to crawl again the URLs answered with an anti-bot challenge page (if enabled),
+// leaving time for the challenge to be lifted
+var challengeRetryPolicy = event.RetryPolicy{MaxRetries: 5, Delay: 10 * time.Minute, MaxDelay: 6 * time.Hour}
+
+const (
+	// maxRequestWait is the maximum duration a request waits for a slot when the concurrent requests are limited
+	maxRequestWait = time.Minute
+	// defaultPausedDelay is the duration an URL is held before being requeued when crawling is paused
+	defaultPausedDelay = 5 * time.Second
+
+	skipRecentlyCrawledFlag = "skip-recently-crawled"
 )
 
 // State represent the application state
@@ -25,6 +46,26 @@ type State struct {
 	httpClient   chttp.Client
 	clock        clock.Clock
 	configClient configapi.Client
+	hostErrors   *hostErrorsTracker
+	validators   cache.Cache
+	pausedDelay  time.Duration
+	// ctx is cancelled on shutdown, to stop holding the consumer while crawling is paused
+	ctx    context.Context
+	cancel context.CancelFunc
+	// queueCache holds the approximate number of URLs queued for crawling
+	queueCache cache.Cache
+	// crawlTimes holds the last crawl time of the URLs, to skip the ones crawled within the refresh window
+	// (nil if disabled)
+	crawlTimes cache.Cache
+}
+
+// Shutdown stop holding the consumer while crawling is paused
+func (state *State) Shutdown() error {
+	if state.cancel != nil {
+		state.cancel()
+	}
+
+	return nil
 }
 
 // Name return the process name
@@ -40,26 +81,74 @@ publish the result (page content + headers).
 
 The crawler consumes the 'url.new' event and produces either:
 - 'url.timeout' event if the crawling has failed because of timeout issue
-- 'resource.new' event if the crawling has succeeded.`
+- 'url.error' event if the crawling has failed because of a configured error status code
+- 'resource.new' event if the crawling has succeeded.
+- 'resource.not-modified' event if the resource has not changed since
+  the previous crawl (conditional GET using ETag / Last-Modified).
+
+Only the first bytes of the URLs matching the 'ranged-fetch' config key
+are requested (Range header), the whole resource being received if the
+server ignores it.
+
+The anti-bot challenge pages (matching the 'challenge-pages' config key)
+are not published, their URL being optionally crawled again later with
+backoff.
+
+When crawling is paused, the URLs are held and given back to the queue.
+
+The requests failing with a temporary error (timeout, 5xx, ...) are
+retried once, as long as the retry budget ('retry-budget' config key,
+in retries per second) is not exhausted.
+
+The requests made to the same hostname are spaced by the crawl delay
+('crawl-delay' config key), which may be overridden per hostname.
+
+If sitemap crawling is enabled, the crawler will also fetch the sitemap
+when crawling an hostname root, and produces a 'url.found' event for
+each URL found.
+
+The crawling errors are accumulated per host, and the hosts failing
+the most are exposed using the HTTP API.
+
+If enabled ('--skip-recently-crawled'), the URLs already crawled within
+the refresh window are skipped, even if they have been scheduled again
+(i.e: messages in flight while the scheduler was restarted).`
 }
 
 // Features return the process features
 func (state *State) Features() []process.Feature {
-	return []process.Feature{process.EventFeature, process.ConfigFeature, process.CrawlingFeature}
+	return []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature, process.CrawlingFeature}
 }
 
 // CustomFlags return process custom flags
 func (state *State) CustomFlags() []cli.Flag {
-	return []cli.Flag{}
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  skipRecentlyCrawledFlag,
+			Usage: "Skip the URLs already crawled within the refresh window (refresh delay minus jitter)",
+		},
+	}
 }
 
 // Initialize the process
 func (state *State) Initialize(provider process.Provider) error {
-	httpClient, err := provider.HTTPClient()
+	// The config client is only used once the process is initialized
+	httpClient, err := provider.HTTPClient(func() (map[string]string, error) {
+		return state.configClient.GetHostMapping()
+	}, func() (uint16, error) {
+		name, err := state.configClient.GetMinTLSVersion()
+		if err != nil {
+			return 0, err
+		}
+		if name == "" {
+			return chttp.DefaultMinTLSVersion, nil
+		}
+
+		return chttp.ParseTLSVersion(name)
+	})
 	if err != nil {
 		return err
 	}
-	state.httpClient = httpClient
 
 	cl, err := provider.Clock()
 	if err != nil {
@@ -67,28 +156,128 @@ func (state *State) Initialize(provider process.Provider) error {
 	}
 	state.clock = cl
 
-	configClient, err := provider.ConfigClient([]string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey})
+	keys := []string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey, configapi.CrawlSitemapKey,
+		configapi.BlackListOnStatusKey, configapi.MaxConcurrentRequestsKey, configapi.CrawlingPausedKey,
+		configapi.AcceptLanguageKey, configapi.HostMappingKey, configapi.RetryBudgetKey, configapi.CrawlDelayKey,
+		configapi.CrawlerIdentifierHeaderKey, configapi.MinTLSVersionKey, configapi.RefreshDelayKey, configapi.AlwaysCrawlKey,
+		configapi.AllowedURLsKey, configapi.ChallengePagesKey, configapi.RangedFetchKey}
+	configClient, err := provider.ConfigClient(keys)
 	if err != nil {
 		return err
 	}
 	state.configClient = configClient
 
+	// Identify the crawler requests if configured, for the operators who want to allow them
+	identifiedClient := chttp.NewIdentifiedClient(httpClient, func() (string, string, error) {
+		header, err := state.configClient.GetCrawlerIdentifierHeader()
+		if err != nil {
+			return "", "", err
+		}
+
+		return header.Name, header.Value, nil
+	})
+
+	// Retry the temporary failures while the retry budget allows it
+	retryClient := chttp.NewRetryClient(identifiedClient, func() (float64, error) {
+		return state.configClient.GetRetryBudget()
+	})
+
+	// Bound the number of simultaneous requests going through the TOR proxy (retries included)
+	limitedClient := chttp.NewLimitedClient(retryClient, func() (int, error) {
+		return state.configClient.GetMaxConcurrentRequests()
+	}, maxRequestWait)
+
+	// Space the requests made to the same hostname, without holding a request slot while waiting
+	state.httpClient = chttp.NewDelayedClient(limitedClient, func(hostname string) (time.Duration, error) {
+		crawlDelay, err := state.configClient.GetCrawlDelay()
+		if err != nil {
+			return 0, err
+		}
+
+		return crawlDelay.GetDelay(hostname), nil
+	})
+
+	errorsCache, err := provider.Cache("crawl-errors")
+	if err != nil {
+		return err
+	}
+	state.hostErrors = &hostErrorsTracker{cache: errorsCache}
+
+	validatorsCache, err := provider.Cache("validators")
+	if err != nil {
+		return err
+	}
+	state.validators = validatorsCache
+
+	queueCache, err := provider.Cache(constraint.QueuedURLsCache)
+	if err != nil {
+		return err
+	}
+	state.queueCache = queueCache
+	state.pausedDelay = defaultPausedDelay
+	state.ctx, state.cancel = context.WithCancel(context.Background())
+
+	if provider.GetBoolValue(skipRecentlyCrawledFlag) {
+		crawlTimesCache, err := provider.Cache("crawl-time")
+		if err != nil {
+			return err
+		}
+		state.crawlTimes = crawlTimesCache
+	}
+
 	return nil
 }
 
 // Subscribers return the process subscribers
 func (state *State) Subscribers() []process.SubscriberDef {
 	return []process.SubscriberDef{
-		{Exchange: event.NewURLExchange, Queue: "crawlingQueue", Handler: state.handleNewURLEvent},
+		{Exchange: event.NewURLExchange, Queue: "crawlingQueue", Handler: state.handleNewURLEvent, Retry: &challengeRetryPolicy},
 	}
 }
 
 // HTTPHandler returns the HTTP API the process expose
 func (state *State) HTTPHandler() http.Handler {
-	return nil
+	r := mux.NewRouter()
+	r.HandleFunc("/hosts/errors", state.getHostErrors).Methods(http.MethodGet)
+	r.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
+
+	return r
 }
 
 func (state *State) handleNewURLEvent(subscriber event.Subscriber, msg event.RawMessage) error {
+	if paused, err := state.configClient.GetCrawlingPaused(); err != nil {
+		return err
+	} else if paused {
+		// Hold the consumer for a while (unless shutting down) and give the URL back to the queue
+		select {
+		case <-state.clock.After(state.pausedDelay):
+		case <-state.ctx.Done():
+		}
+
+		if err := msg.Nack(true); err != nil {
+			return err
+		}
+
+		return event.ErrAckDeferred
+	}
+
+	// The URL is no longer queued once crawled, whatever the outcome, unless it is requeued (no request slot)
+	// or retried (challenge page or panic, see event.Handle): it is then only once dead-lettered
+	requeued, retried := false, false
+	defer func() {
+		r := recover()
+		if !requeued && ((r == nil && !retried) || msg.LastRetry()) {
+			if err := constraint.AddQueuedURLs(state.queueCache, -1); err != nil {
+				log.Err(err).Msg("error while counting queued URLs")
+			}
+		}
+
+		if r != nil {
+			// Let the subscriber retry the message
+			panic(r)
+		}
+	}()
+
 	var evt event.NewURLEvent
 	if err := subscriber.Read(&msg, &evt); err != nil {
 		return err
@@ -96,18 +285,58 @@ func (state *State) handleNewURLEvent(subscriber event.Subscriber, msg event.Raw
 
 	log.Debug().Str("url", evt.URL).Msg("Processing URL")
 
-	if allowed, err := constraint.CheckHostnameAllowed(state.configClient, evt.URL); err != nil {
+	if allowed, err := constraint.CheckURLAllowed(state.configClient, evt.URL); err != nil {
 		return err
 	} else if !allowed {
 		log.Debug().Str("url", evt.URL).Msg("Skipping forbidden hostname")
 		return fmt.Errorf("%s %w", evt.URL, errHostnameNotAllowed)
 	}
 
-	r, err := state.httpClient.Get(evt.URL)
+	// Last check against the duplicate work, the scheduler already prevents most of it
+	if state.recentlyCrawled(evt) {
+		log.Debug().Str("url", evt.URL).Msg("Skipping recently crawled URL")
+		return nil
+	}
+
+	r, err := state.fetch(evt)
+	if errors.Is(err, chttp.ErrNoRequestSlot) {
+		// Not an issue with the host, nothing to report: give the URL back to the queue
+		log.Debug().Str("url", evt.URL).Msg("No request slot available, crawling URL again later")
+
+		requeued = true
+		if err := msg.Nack(true); err != nil {
+			return err
+		}
+
+		return event.ErrAckDeferred
+	}
+	if errors.Is(err, chttp.ErrNotModified) {
+		log.Debug().Str("url", evt.URL).Msg("Resource has not changed")
+
+		// Only the crawl time should be updated
+		crawlTime := state.clock.Now()
+		if err := subscriber.PublishEvent(&event.NotModifiedResourceEvent{URL: evt.URL, Time: crawlTime}); err != nil {
+			return err
+		}
+
+		state.recordCrawl(evt, crawlTime)
+		return nil
+	}
 	if err != nil {
-		if err == chttp.ErrTimeout {
+		if recordErr := state.hostErrors.record(evt.URL, err); recordErr != nil {
+			log.Err(recordErr).Str("url", evt.URL).Msg("error while recording crawling error")
+		}
+
+		var statusErr *chttp.StatusError
+
+		if errors.Is(err, chttp.ErrTimeout) {
 			// indicate that crawling has failed
 			_ = subscriber.PublishEvent(&event.TimeoutURLEvent{URL: evt.URL})
+		} else if errors.As(err, &statusErr) {
+			// indicate that crawling has failed if status code is considered for blacklisting
+			if blacklisted, _ := constraint.CheckStatusBlacklisted(state.configClient, statusErr.Code); blacklisted {
+				_ = subscriber.PublishEvent(&event.ErrorURLEvent{URL: evt.URL, StatusCode: statusErr.Code})
+			}
 		}
 
 		return err
@@ -115,7 +344,8 @@ func (state *State) handleNewURLEvent(subscriber event.Subscriber, msg event.Raw
 
 	// Determinate if content type is allowed
 	allowed := false
-	contentType := r.Headers()["Content-Type"]
+	headers := r.Headers()
+	contentType := headers["Content-Type"]
 
 	if allowedMimeTypes, err := state.configClient.GetAllowedMimeTypes(); err == nil {
 		if len(allowedMimeTypes) == 0 {
@@ -140,16 +370,112 @@ func (state *State) handleNewURLEvent(subscriber event.Subscriber, msg event.Raw
 		return err
 	}
 
+	// Do not store the interstitial served instead of the resource
+	challengePages, err := state.configClient.GetChallengePages()
+	if err != nil {
+		return err
+	}
+
+	statusCode := r.StatusCode()
+	if challengePages.IsChallengePage(statusCode, headers, string(b)) {
+		if challengePages.Requeue {
+			log.Debug().Str("url", evt.URL).Msg("Challenge page, crawling URL again later")
+
+			retried = true
+			if err := msg.Retry(); err != nil {
+				return err
+			}
+
+			return event.ErrAckDeferred
+		}
+
+		return fmt.Errorf("%s %w", evt.URL, errChallengePage)
+	}
+
+	if evt.Method != http.MethodPost {
+		if err := storeValidators(state.validators, evt.URL, headers); err != nil {
+			log.Err(err).Str("url", evt.URL).Msg("error while storing response validators")
+		}
+	}
+
 	res := event.NewResourceEvent{
-		URL:     evt.URL,
-		Body:    string(b),
-		Headers: r.Headers(),
-		Time:    state.clock.Now(),
+		URL:        evt.URL,
+		Body:       string(b),
+		Headers:    headers,
+		Time:       state.clock.Now(),
+		Tag:        evt.Tag,
+		Via:        r.Via(),
+		StatusCode: statusCode,
 	}
 
 	if err := subscriber.PublishEvent(&res); err != nil {
 		return err
 	}
 
+	state.recordCrawl(evt, res.Time)
+
+	// Crawl the sitemap when crawling hostname root
+	if isRootURL(evt.URL) {
+		if crawlSitemap, err := state.configClient.GetCrawlSitemap(); err == nil && crawlSitemap {
+			if err := state.crawlSitemap(subscriber, evt.URL, evt.Tag); err != nil {
+				log.Err(err).Str("url", evt.URL).Msg("error while crawling sitemap")
+			}
+		}
+	}
+
 	return nil
 }
+
+// fetch perform the request described by given event, using a conditional GET if the resource
+// has already been crawled
+func (state *State) fetch(evt event.NewURLEvent) (chttp.Response, error) {
+	httpClient := state.httpClient
+	if language := state.acceptLanguage(evt); language != "" {
+		httpClient = httpClient.WithHeaders(map[string]string{"Accept-Language": language})
+	}
+
+	if evt.Method == http.MethodPost {
+		return httpClient.Post(evt.URL, evt.ContentType, []byte(evt.Body))
+	}
+
+	// Only the first bytes of the resources likely to be large are requested
+	if rangedFetch, err := state.configClient.GetRangedFetch(); err != nil {
+		log.Err(err).Msg("error while retrieving ranged fetch")
+	} else if maxBytes := rangedFetch.MaxBytesFor(evt.URL); maxBytes > 0 {
+		httpClient = httpClient.WithHeaders(map[string]string{chttp.RangeHeader: chttp.PrefixRange(maxBytes)})
+	}
+
+	v, err := getValidators(state.validators, evt.URL)
+	if err != nil {
+		log.Err(err).Str("url", evt.URL).Msg("error while retrieving response validators")
+	}
+	if v != nil {
+		return httpClient.GetIfModified(evt.URL, v.ETag, v.LastModified)
+	}
+
+	return httpClient.Get(evt.URL)
+}
+
+// acceptLanguage returns the Accept-Language to use for given event: the event one if any, the configured one otherwise
+func (state *State) acceptLanguage(evt event.NewURLEvent) string {
+	if evt.Language != "" {
+		return evt.Language
+	}
+
+	language, err := state.configClient.GetAcceptLanguage()
+	if err != nil {
+		log.Err(err).Msg("error while retrieving accept language")
+		return ""
+	}
+
+	return language
+}
+
+func isRootURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	return (u.Path == "" || u.Path == "/") && u.RawQuery == ""
+}
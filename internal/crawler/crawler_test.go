@@ -1,7 +1,10 @@
 package crawler
 
 import (
+	"context"
 	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/clock_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
@@ -27,19 +30,28 @@ func TestState_Name(t *testing.T) {
 
 func TestState_Features(t *testing.T) {
 	s := State{}
-	test.CheckProcessFeatures(t, &s, []process.Feature{process.EventFeature, process.ConfigFeature, process.CrawlingFeature})
+	test.CheckProcessFeatures(t, &s, []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature, process.CrawlingFeature})
 }
 
 func TestState_CustomFlags(t *testing.T) {
 	s := State{}
-	test.CheckProcessCustomFlags(t, &s, nil)
+	test.CheckProcessCustomFlags(t, &s, []string{"skip-recently-crawled"})
 }
 
 func TestState_Initialize(t *testing.T) {
 	test.CheckInitialize(t, &State{}, func(p *process_mock.MockProviderMockRecorder) {
-		p.HTTPClient()
+		p.HTTPClient(gomock.Any(), gomock.Any())
 		p.Clock()
-		p.ConfigClient([]string{client.AllowedMimeTypesKey, client.ForbiddenHostnamesKey})
+		p.ConfigClient([]string{client.AllowedMimeTypesKey, client.ForbiddenHostnamesKey, client.CrawlSitemapKey,
+			client.BlackListOnStatusKey, client.MaxConcurrentRequestsKey, client.CrawlingPausedKey,
+			client.AcceptLanguageKey, client.HostMappingKey, client.RetryBudgetKey, client.CrawlDelayKey,
+			client.CrawlerIdentifierHeaderKey, client.MinTLSVersionKey, client.RefreshDelayKey, client.AlwaysCrawlKey,
+			client.AllowedURLsKey, client.ChallengePagesKey, client.RangedFetchKey})
+		p.Cache("crawl-errors")
+		p.Cache("validators")
+		p.Cache("queue")
+		p.GetBoolValue("skip-recently-crawled").Return(true)
+		p.Cache("crawl-time")
 	})
 }
 
@@ -50,6 +62,14 @@ func TestState_Subscribers(t *testing.T) {
 	})
 }
 
+// newQueueCacheMock returns a queue cache expecting given number of URLs to be crawled
+func newQueueCacheMock(mockCtrl *gomock.Controller, crawled int) *cache_mock.MockCache {
+	queueCacheMock := cache_mock.NewMockCache(mockCtrl)
+	queueCacheMock.EXPECT().IncrBy("urls", int64(-1), cache.NoTTL).Times(crawled).Return(int64(0), nil)
+
+	return queueCacheMock
+}
+
 func TestHandleNewURLEvent(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -59,13 +79,25 @@ func TestHandleNewURLEvent(t *testing.T) {
 	httpResponseMock := http_mock.NewMockResponse(mockCtrl)
 	clockMock := clock_mock.NewMockClock(mockCtrl)
 	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetCrawlingPaused().AnyTimes().Return(false, nil)
+	configClientMock.EXPECT().GetAcceptLanguage().AnyTimes().Return("", nil)
+	configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
+	errorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+	validatorsCacheMock := cache_mock.NewMockCache(mockCtrl)
 
 	s := State{
 		httpClient:   httpClientMock,
 		configClient: configClientMock,
 		clock:        clockMock,
+		hostErrors:   &hostErrorsTracker{cache: errorsCacheMock},
+		validators:   validatorsCacheMock,
+		queueCache:   newQueueCacheMock(mockCtrl, 5),
 	}
 
+	validatorsCacheMock.EXPECT().GetBytes(gomock.Any()).AnyTimes().Return(nil, nil)
+
+	configClientMock.EXPECT().GetCrawlSitemap().AnyTimes().Return(false, nil)
+
 	type test struct {
 		// the incoming url
 		url string
@@ -144,6 +176,8 @@ func TestHandleNewURLEvent(t *testing.T) {
 		case http.ErrTimeout:
 			httpClientMock.EXPECT().Get(test.url).Return(httpResponseMock, http.ErrTimeout)
 			subscriberMock.EXPECT().PublishEvent(&event.TimeoutURLEvent{URL: test.url}).Return(nil)
+			errorsCacheMock.EXPECT().IncrBy("downhostname.onion:total", int64(1), cache.NoTTL).Return(int64(2), nil)
+			errorsCacheMock.EXPECT().IncrBy("downhostname.onion:timeouts", int64(1), cache.NoTTL).Return(int64(2), nil)
 			break
 		default:
 			httpResponseMock.EXPECT().Headers().Return(test.responseHeaders)
@@ -157,18 +191,22 @@ func TestHandleNewURLEvent(t *testing.T) {
 		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
 
 		if test.err == nil {
-			httpResponseMock.EXPECT().Headers().Return(test.responseHeaders)
+			configClientMock.EXPECT().GetChallengePages().Return(client.ChallengePages{}, nil)
 			httpResponseMock.EXPECT().Body().Return(strings.NewReader(test.responseBody))
+			httpResponseMock.EXPECT().Via().Return("127.0.0.1:9050")
+			httpResponseMock.EXPECT().StatusCode().Return(200)
 
 			tn := time.Now()
 			clockMock.EXPECT().Now().Return(tn)
 
 			// if test should pass expect event publishing
 			subscriberMock.EXPECT().PublishEvent(&event.NewResourceEvent{
-				URL:     test.url,
-				Body:    test.responseBody,
-				Headers: test.responseHeaders,
-				Time:    tn,
+				URL:        test.url,
+				Body:       test.responseBody,
+				Headers:    test.responseHeaders,
+				Time:       tn,
+				Via:        "127.0.0.1:9050",
+				StatusCode: 200,
 			}).Return(nil)
 		}
 
@@ -188,9 +226,13 @@ func TestHandleNewURLEventHostnameForbidden(t *testing.T) {
 
 	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
 	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetCrawlingPaused().AnyTimes().Return(false, nil)
+	configClientMock.EXPECT().GetAcceptLanguage().AnyTimes().Return("", nil)
+	configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
 
 	s := State{
 		configClient: configClientMock,
+		queueCache:   newQueueCacheMock(mockCtrl, 1),
 	}
 
 	msg := event.RawMessage{}
@@ -201,8 +243,542 @@ func TestHandleNewURLEventHostnameForbidden(t *testing.T) {
 
 	configClientMock.EXPECT().GetForbiddenHostnames().
 		Return([]client.ForbiddenHostname{{Hostname: "facebookcorewwwi.onion"}}, nil)
+	configClientMock.EXPECT().GetAllowedURLs().Return(nil, nil)
 
 	if err := s.handleNewURLEvent(subscriberMock, msg); !errors.Is(err, errHostnameNotAllowed) {
 		t.Fail()
 	}
 }
+
+func TestHandleNewURLEventErrorStatus(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetCrawlingPaused().AnyTimes().Return(false, nil)
+	configClientMock.EXPECT().GetAcceptLanguage().AnyTimes().Return("", nil)
+	configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
+	errorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+	validatorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	s := State{
+		httpClient:   httpClientMock,
+		configClient: configClientMock,
+		hostErrors:   &hostErrorsTracker{cache: errorsCacheMock},
+		validators:   validatorsCacheMock,
+		queueCache:   newQueueCacheMock(mockCtrl, 2),
+	}
+
+	validatorsCacheMock.EXPECT().GetBytes("https://example.onion/admin.php").Times(2).Return(nil, nil)
+
+	errorsCacheMock.EXPECT().IncrBy("example.onion:total", int64(1), cache.NoTTL).Times(2).Return(int64(2), nil)
+	errorsCacheMock.EXPECT().IncrBy("example.onion:status-403", int64(1), cache.NoTTL).Return(int64(2), nil)
+	errorsCacheMock.EXPECT().IncrBy("example.onion:status-404", int64(1), cache.NoTTL).Return(int64(2), nil)
+
+	for _, statusCode := range []int{403, 404} {
+		msg := event.RawMessage{}
+		subscriberMock.EXPECT().
+			Read(&msg, &event.NewURLEvent{}).
+			SetArg(1, event.NewURLEvent{URL: "https://example.onion/admin.php"}).
+			Return(nil)
+
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+		httpClientMock.EXPECT().Get("https://example.onion/admin.php").Return(nil, &http.StatusError{Code: statusCode})
+		configClientMock.EXPECT().GetBlackListOnStatus().Return([]int{403}, nil)
+
+		// only configured status code should be published
+		if statusCode == 403 {
+			subscriberMock.EXPECT().
+				PublishEvent(&event.ErrorURLEvent{URL: "https://example.onion/admin.php", StatusCode: 403}).
+				Return(nil)
+		}
+
+		var statusErr *http.StatusError
+		if err := s.handleNewURLEvent(subscriberMock, msg); !errors.As(err, &statusErr) {
+			t.Fail()
+		}
+	}
+}
+
+func TestHandleNewURLEventPost(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	httpResponseMock := http_mock.NewMockResponse(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetCrawlingPaused().AnyTimes().Return(false, nil)
+	configClientMock.EXPECT().GetAcceptLanguage().AnyTimes().Return("", nil)
+	configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewURLEvent{}).
+		SetArg(1, event.NewURLEvent{
+			URL:         "https://directory.onion/search.php",
+			Tag:         "directories",
+			Method:      "POST",
+			ContentType: "application/x-www-form-urlencoded",
+			Body:        "q=market",
+		}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	httpClientMock.EXPECT().
+		Post("https://directory.onion/search.php", "application/x-www-form-urlencoded", []byte("q=market")).
+		Return(httpResponseMock, nil)
+
+	httpResponseMock.EXPECT().Headers().AnyTimes().Return(map[string]string{"Content-Type": "text/html"})
+	httpResponseMock.EXPECT().Body().Return(strings.NewReader(`<a href="https://market.onion">Market</a>`))
+	httpResponseMock.EXPECT().Via()
+	httpResponseMock.EXPECT().StatusCode()
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{ContentType: "text/"}}, nil)
+	configClientMock.EXPECT().GetChallengePages().Return(client.ChallengePages{}, nil)
+
+	tn := time.Now()
+	clockMock.EXPECT().Now().Return(tn)
+
+	// The response should be published to be indexed & have its links extracted
+	subscriberMock.EXPECT().PublishEvent(&event.NewResourceEvent{
+		URL:     "https://directory.onion/search.php",
+		Body:    `<a href="https://market.onion">Market</a>`,
+		Headers: map[string]string{"Content-Type": "text/html"},
+		Time:    tn,
+		Tag:     "directories",
+	}).Return(nil)
+
+	s := State{httpClient: httpClientMock, configClient: configClientMock, clock: clockMock, queueCache: newQueueCacheMock(mockCtrl, 1)}
+	if err := s.handleNewURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+// challengePageFixture is an anti-bot interstitial served instead of the resource
+const challengePageFixture = `<!DOCTYPE html>
+<html lang="en-US">
+<head>
+  <title>Just a moment...</title>
+  <meta http-equiv="refresh" content="35">
+  <noscript><meta http-equiv="refresh" content="0; url=/?__challenge=nojs"></noscript>
+</head>
+<body>
+  <h1>Checking if the site connection is secure</h1>
+  <p>example.onion needs to review the security of your connection before proceeding.</p>
+  <form id="challenge-form" action="/?__challenge=answer" method="POST"></form>
+</body>
+</html>`
+
+func TestHandleNewURLEventChallengePage(t *testing.T) {
+	challengePages := client.ChallengePages{Headers: []string{"cf-mitigated"}, BodyMarkers: []string{"<title>Just a moment...</title>"}}
+
+	for _, requeue := range []bool{false, true} {
+		mockCtrl := gomock.NewController(t)
+
+		subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+		httpClientMock := http_mock.NewMockClient(mockCtrl)
+		httpResponseMock := http_mock.NewMockResponse(mockCtrl)
+		configClientMock := client_mock.NewMockClient(mockCtrl)
+		validatorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+		msg := event.RawMessage{}
+		subscriberMock.EXPECT().
+			Read(&msg, &event.NewURLEvent{}).
+			SetArg(1, event.NewURLEvent{URL: "https://example.onion/index.php"}).
+			Return(nil)
+
+		configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+		configClientMock.EXPECT().GetAcceptLanguage().Return("", nil)
+		configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+		configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{ContentType: "text/"}}, nil)
+		challengePages.Requeue = requeue
+		configClientMock.EXPECT().GetChallengePages().Return(challengePages, nil)
+
+		validatorsCacheMock.EXPECT().GetBytes("https://example.onion/index.php").Return(nil, nil)
+		httpClientMock.EXPECT().Get("https://example.onion/index.php").Return(httpResponseMock, nil)
+		httpResponseMock.EXPECT().Headers().Return(map[string]string{"Content-Type": "text/html"})
+		httpResponseMock.EXPECT().Body().Return(strings.NewReader(challengePageFixture))
+		httpResponseMock.EXPECT().StatusCode().Return(200)
+
+		// The challenge page should neither be published nor have its validators stored,
+		// the URL being still queued once requeued
+		crawled := 1
+		if requeue {
+			crawled = 0
+		}
+		s := State{httpClient: httpClientMock, configClient: configClientMock, validators: validatorsCacheMock,
+			queueCache: newQueueCacheMock(mockCtrl, crawled)}
+		err := s.handleNewURLEvent(subscriberMock, msg)
+
+		if requeue && !errors.Is(err, event.ErrAckDeferred) {
+			t.Errorf("got %v want %v", err, event.ErrAckDeferred)
+		}
+		if !requeue && !errors.Is(err, errChallengePage) {
+			t.Errorf("got %v want %v", err, errChallengePage)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestHandleNewURLEventNoRequestSlot(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	validatorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewURLEvent{}).
+		SetArg(1, event.NewURLEvent{URL: "https://example.onion/index.php"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetAcceptLanguage().Return("", nil)
+	configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+
+	validatorsCacheMock.EXPECT().GetBytes("https://example.onion/index.php").Return(nil, nil)
+	httpClientMock.EXPECT().Get("https://example.onion/index.php").Return(nil, http.ErrNoRequestSlot)
+
+	// The URL should be given back to the queue, hence still queued
+	s := State{httpClient: httpClientMock, configClient: configClientMock, validators: validatorsCacheMock,
+		queueCache: newQueueCacheMock(mockCtrl, 0)}
+	if err := s.handleNewURLEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.Errorf("got %v want %v", err, event.ErrAckDeferred)
+	}
+}
+
+func TestHandleNewURLEventPanic(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	subscriberMock.EXPECT().Read(&msg, &event.NewURLEvent{}).Do(func(*event.RawMessage, event.Event) {
+		panic("nil map")
+	})
+
+	// The panicking message is retried by the subscriber: the URL should still be queued
+	s := State{configClient: configClientMock, queueCache: newQueueCacheMock(mockCtrl, 0)}
+
+	defer func() {
+		if r := recover(); r != "nil map" {
+			t.Errorf("got panic %v want nil map", r)
+		}
+	}()
+	_ = s.handleNewURLEvent(subscriberMock, msg)
+}
+
+func TestHandleNewURLEventNotModified(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetCrawlingPaused().AnyTimes().Return(false, nil)
+	configClientMock.EXPECT().GetAcceptLanguage().AnyTimes().Return("", nil)
+	configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
+	validatorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewURLEvent{}).
+		SetArg(1, event.NewURLEvent{URL: "https://example.onion/index.php"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	validatorsCacheMock.EXPECT().
+		GetBytes("https://example.onion/index.php").
+		Return([]byte(`{"etag":"\"v1\"","last-modified":"Wed, 10 Mar 2021 12:00:00 GMT"}`), nil)
+	httpClientMock.EXPECT().
+		GetIfModified("https://example.onion/index.php", `"v1"`, "Wed, 10 Mar 2021 12:00:00 GMT").
+		Return(nil, http.ErrNotModified)
+
+	tn := time.Now()
+	clockMock.EXPECT().Now().Return(tn)
+
+	// Only the crawl time should be updated: the resource is not published
+	subscriberMock.EXPECT().
+		PublishEvent(&event.NotModifiedResourceEvent{URL: "https://example.onion/index.php", Time: tn}).
+		Return(nil)
+
+	s := State{httpClient: httpClientMock, configClient: configClientMock, clock: clockMock, validators: validatorsCacheMock,
+		queueCache: newQueueCacheMock(mockCtrl, 1)}
+	if err := s.handleNewURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleNewURLEventStoreValidators(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	httpResponseMock := http_mock.NewMockResponse(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetCrawlingPaused().AnyTimes().Return(false, nil)
+	configClientMock.EXPECT().GetAcceptLanguage().AnyTimes().Return("", nil)
+	configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
+	validatorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewURLEvent{}).
+		SetArg(1, event.NewURLEvent{URL: "https://example.onion/index.php"}).
+		Return(nil)
+
+	headers := map[string]string{"Content-Type": "text/html", "Etag": `"v2"`}
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{ContentType: "text/"}}, nil)
+	configClientMock.EXPECT().GetChallengePages().Return(client.ChallengePages{}, nil)
+	validatorsCacheMock.EXPECT().GetBytes("https://example.onion/index.php").Return(nil, nil)
+	httpClientMock.EXPECT().Get("https://example.onion/index.php").Return(httpResponseMock, nil)
+	httpResponseMock.EXPECT().Headers().AnyTimes().Return(headers)
+	httpResponseMock.EXPECT().Body().Return(strings.NewReader("Hello"))
+	httpResponseMock.EXPECT().Via()
+	httpResponseMock.EXPECT().StatusCode()
+
+	validatorsCacheMock.EXPECT().
+		SetBytes("https://example.onion/index.php", []byte(`{"etag":"\"v2\""}`), validatorsTTL).
+		Return(nil)
+
+	tn := time.Now()
+	clockMock.EXPECT().Now().Return(tn)
+
+	subscriberMock.EXPECT().PublishEvent(&event.NewResourceEvent{
+		URL:     "https://example.onion/index.php",
+		Body:    "Hello",
+		Headers: headers,
+		Time:    tn,
+	}).Return(nil)
+
+	s := State{httpClient: httpClientMock, configClient: configClientMock, clock: clockMock, validators: validatorsCacheMock,
+		queueCache: newQueueCacheMock(mockCtrl, 1)}
+	if err := s.handleNewURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleNewURLEventRecentlyCrawled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetCrawlingPaused().AnyTimes().Return(false, nil)
+	crawlTimesCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewURLEvent{}).
+		SetArg(1, event.NewURLEvent{URL: "https://example.onion/index.php"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 24 * time.Hour, Jitter: time.Hour}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return([]string{"directory.onion"}, nil)
+
+	// Crawled 20 hours ago: within the 23 hours window
+	tn := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+	crawlTimesCacheMock.EXPECT().GetInt64("https://example.onion/index.php").Return(tn.Add(-20*time.Hour).Unix(), nil)
+	clockMock.EXPECT().Now().Return(tn)
+
+	// The URL should be acknowledged without being crawled
+	s := State{configClient: configClientMock, clock: clockMock, crawlTimes: crawlTimesCacheMock,
+		queueCache: newQueueCacheMock(mockCtrl, 1)}
+	if err := s.handleNewURLEvent(subscriberMock, msg); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+}
+
+func TestRecentlyCrawledAlwaysCrawl(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 24 * time.Hour}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return([]string{"directory.onion"}, nil)
+
+	// The crawl time should not even be looked up
+	s := State{configClient: configClientMock, crawlTimes: cache_mock.NewMockCache(mockCtrl)}
+	if s.recentlyCrawled(event.NewURLEvent{URL: "https://directory.onion/links"}) {
+		t.Error("always crawled URL should never be considered recently crawled")
+	}
+}
+
+func TestHandleNewURLEventRecordCrawlTime(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetCrawlingPaused().AnyTimes().Return(false, nil)
+	configClientMock.EXPECT().GetAcceptLanguage().AnyTimes().Return("", nil)
+	configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
+	configClientMock.EXPECT().GetRefreshDelay().AnyTimes().Return(client.RefreshDelay{Delay: 24 * time.Hour, Jitter: time.Hour}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().AnyTimes().Return(nil, nil)
+	validatorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+	crawlTimesCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewURLEvent{}).
+		SetArg(1, event.NewURLEvent{URL: "https://example.onion/index.php"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+
+	// Crawled 30 hours ago: past the window
+	tn := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+	crawlTimesCacheMock.EXPECT().GetInt64("https://example.onion/index.php").Return(tn.Add(-30*time.Hour).Unix(), nil)
+	clockMock.EXPECT().Now().Times(2).Return(tn)
+
+	validatorsCacheMock.EXPECT().
+		GetBytes("https://example.onion/index.php").
+		Return([]byte(`{"etag":"\"v1\""}`), nil)
+	httpClientMock.EXPECT().
+		GetIfModified("https://example.onion/index.php", `"v1"`, "").
+		Return(nil, http.ErrNotModified)
+	subscriberMock.EXPECT().
+		PublishEvent(&event.NotModifiedResourceEvent{URL: "https://example.onion/index.php", Time: tn}).
+		Return(nil)
+
+	crawlTimesCacheMock.EXPECT().SetInt64("https://example.onion/index.php", tn.Unix(), 23*time.Hour).Return(nil)
+
+	s := State{httpClient: httpClientMock, configClient: configClientMock, clock: clockMock, validators: validatorsCacheMock,
+		crawlTimes: crawlTimesCacheMock, queueCache: newQueueCacheMock(mockCtrl, 1)}
+	if err := s.handleNewURLEvent(subscriberMock, msg); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+}
+
+func TestHandleNewURLEventPaused(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	// The URL should be given back to the queue without being crawled
+	configClientMock.EXPECT().GetCrawlingPaused().Return(true, nil)
+	after := make(chan time.Time, 1)
+	after <- time.Now()
+	clockMock.EXPECT().After(5 * time.Second).Return(after)
+
+	s := State{configClient: configClientMock, clock: clockMock, pausedDelay: 5 * time.Second, ctx: context.Background()}
+	if err := s.handleNewURLEvent(subscriberMock, event.RawMessage{}); !errors.Is(err, event.ErrAckDeferred) {
+		t.Fail()
+	}
+}
+
+func TestHandleNewURLEventPausedShutdown(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	// The pause delay never elapse, the consumer should be released on shutdown
+	configClientMock.EXPECT().GetCrawlingPaused().Return(true, nil)
+	clockMock.EXPECT().After(5 * time.Second).Return(make(chan time.Time))
+
+	s := State{configClient: configClientMock, clock: clockMock, pausedDelay: 5 * time.Second}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	go func() {
+		_ = s.Shutdown()
+	}()
+
+	if err := s.handleNewURLEvent(subscriberMock, event.RawMessage{}); !errors.Is(err, event.ErrAckDeferred) {
+		t.Errorf("got %v want %v", err, event.ErrAckDeferred)
+	}
+}
+
+func TestFetchAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		// the configured accept language
+		configured string
+		// the language hint of the event
+		language string
+		// the expected Accept-Language header (empty if none)
+		want string
+	}{
+		{configured: "", language: "", want: ""},
+		{configured: "en-US,en;q=0.9", language: "", want: "en-US,en;q=0.9"},
+		{configured: "en-US,en;q=0.9", language: "fr-FR,fr;q=0.9", want: "fr-FR,fr;q=0.9"},
+	}
+
+	for _, test := range tests {
+		mockCtrl := gomock.NewController(t)
+
+		httpClientMock := http_mock.NewMockClient(mockCtrl)
+		configClientMock := client_mock.NewMockClient(mockCtrl)
+		validatorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+		configClientMock.EXPECT().GetAcceptLanguage().AnyTimes().Return(test.configured, nil)
+		configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{}, nil)
+		validatorsCacheMock.EXPECT().GetBytes("https://example.onion").Return(nil, nil)
+
+		if test.want != "" {
+			httpClientMock.EXPECT().
+				WithHeaders(map[string]string{"Accept-Language": test.want}).
+				Return(httpClientMock)
+		}
+		httpClientMock.EXPECT().Get("https://example.onion").Return(nil, nil)
+
+		s := State{httpClient: httpClientMock, configClient: configClientMock, validators: validatorsCacheMock}
+		if _, err := s.fetch(event.NewURLEvent{URL: "https://example.onion", Language: test.language}); err != nil {
+			t.Errorf("error while fetching URL: %s", err)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestFetchRanged(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	validatorsCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	configClientMock.EXPECT().GetAcceptLanguage().AnyTimes().Return("", nil)
+	configClientMock.EXPECT().GetRangedFetch().AnyTimes().Return(client.RangedFetch{Extensions: []string{"pdf"}, MaxBytes: 1024}, nil)
+	validatorsCacheMock.EXPECT().GetBytes(gomock.Any()).AnyTimes().Return(nil, nil)
+
+	// Only the first bytes of the PDF should be requested
+	rangedClientMock := http_mock.NewMockClient(mockCtrl)
+	httpClientMock.EXPECT().WithHeaders(map[string]string{"Range": "bytes=0-1023"}).Return(rangedClientMock)
+	rangedClientMock.EXPECT().Get("https://example.onion/leak.pdf").Return(nil, nil)
+
+	httpClientMock.EXPECT().Get("https://example.onion/index.php").Return(nil, nil)
+
+	s := State{httpClient: httpClientMock, configClient: configClientMock, validators: validatorsCacheMock}
+	for _, rawURL := range []string{"https://example.onion/leak.pdf", "https://example.onion/index.php"} {
+		if _, err := s.fetch(event.NewURLEvent{URL: rawURL}); err != nil {
+			t.Errorf("error while fetching URL: %s", err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	chttp "github.com/darkspot-org/bathyscaphe/internal/http"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+const (
+	// maxTrackedHosts is the maximum number of hosts for which errors are tracked
+	maxTrackedHosts = 1000
+
+	// hostsIndexKey is the cache key of the number of hosts ever tracked, used to assign them a slot of the index.
+	// The index keys contain a character forbidden in hostnames to not collide with the hosts counters
+	hostsIndexKey = "#hosts"
+
+	totalErrors      = "total"
+	timeoutErrors    = "timeouts"
+	connectionErrors = "connection-errors"
+	otherErrors      = "others"
+	// statusCodesKey is the number of distinct status codes tracked for an host, used to assign them a slot
+	statusCodesKey = "status-codes"
+
+	defaultHostErrorsLimit = 10
+	maxHostErrorsLimit     = 100
+)
+
+// hostErrors are the crawling errors accumulated for an host
+type hostErrors struct {
+	Hostname         string        `json:"hostname"`
+	Total            int64         `json:"total"`
+	Timeouts         int64         `json:"timeouts"`
+	ConnectionErrors int64         `json:"connection-errors"`
+	StatusCodes      map[int]int64 `json:"status-codes,omitempty"`
+	Others           int64         `json:"others"`
+}
+
+// hostErrorsTracker accumulate the crawling errors per host in the cache, using a counter per host & kind of error
+// (i.e: example.onion:timeouts). The tracked hosts are listed in a ring of maxTrackedHosts slots:
+// once full the oldest host is evicted along with its counters
+type hostErrorsTracker struct {
+	cache cache.Cache
+}
+
+// record increment the error counters of given URL host
+func (t *hostErrorsTracker) record(rawURL string, crawlErr error) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	hostname := u.Hostname()
+
+	total, err := t.cache.IncrBy(hostErrorsKey(hostname, totalErrors), 1, cache.NoTTL)
+	if err != nil {
+		return err
+	}
+
+	// First error of the host: track it
+	if total == 1 {
+		if err := t.track(hostname); err != nil {
+			return err
+		}
+	}
+
+	var statusErr *chttp.StatusError
+	switch {
+	case errors.Is(crawlErr, chttp.ErrTimeout):
+		_, err = t.cache.IncrBy(hostErrorsKey(hostname, timeoutErrors), 1, cache.NoTTL)
+	case errors.Is(crawlErr, chttp.ErrConnRefused), errors.Is(crawlErr, chttp.ErrDNS),
+		errors.Is(crawlErr, chttp.ErrCircuitOpen):
+		_, err = t.cache.IncrBy(hostErrorsKey(hostname, connectionErrors), 1, cache.NoTTL)
+	case errors.As(crawlErr, &statusErr):
+		err = t.recordStatusCode(hostname, statusErr.Code)
+	default:
+		_, err = t.cache.IncrBy(hostErrorsKey(hostname, otherErrors), 1, cache.NoTTL)
+	}
+
+	return err
+}
+
+// track add given host to the index, evicting the host previously using its slot
+func (t *hostErrorsTracker) track(hostname string) error {
+	count, err := t.cache.IncrBy(hostsIndexKey, 1, cache.NoTTL)
+	if err != nil {
+		return err
+	}
+
+	slot := hostsSlotKey((count - 1) % maxTrackedHosts)
+
+	if count > maxTrackedHosts {
+		evicted, err := t.cache.GetBytes(slot)
+		if err != nil {
+			return err
+		}
+
+		if len(evicted) > 0 && string(evicted) != hostname {
+			if _, err := t.cache.RemovePrefix(hostErrorsKey(string(evicted), "")); err != nil {
+				return err
+			}
+		}
+	}
+
+	return t.cache.SetBytes(slot, []byte(hostname), cache.NoTTL)
+}
+
+// recordStatusCode increment the counter of given status code, assigning it a slot if first seen for the host
+func (t *hostErrorsTracker) recordStatusCode(hostname string, code int) error {
+	count, err := t.cache.IncrBy(statusCodeKey(hostname, int64(code)), 1, cache.NoTTL)
+	if err != nil || count != 1 {
+		return err
+	}
+
+	codes, err := t.cache.IncrBy(hostErrorsKey(hostname, statusCodesKey), 1, cache.NoTTL)
+	if err != nil {
+		return err
+	}
+
+	return t.cache.SetInt64(statusCodeSlotKey(hostname, codes-1), int64(code), cache.NoTTL)
+}
+
+// worstOffenders returns the hosts having the most errors (at most limit)
+func (t *hostErrorsTracker) worstOffenders(limit int) ([]hostErrors, error) {
+	hostnames, err := t.trackedHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, hostname := range hostnames {
+		for _, kind := range []string{totalErrors, timeoutErrors, connectionErrors, otherErrors, statusCodesKey} {
+			keys = append(keys, hostErrorsKey(hostname, kind))
+		}
+	}
+
+	counters, err := t.cache.GetManyInt64(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	// Then resolve the status codes of the hosts
+	var slotKeys []string
+	for _, hostname := range hostnames {
+		for i := int64(0); i < counters[hostErrorsKey(hostname, statusCodesKey)]; i++ {
+			slotKeys = append(slotKeys, statusCodeSlotKey(hostname, i))
+		}
+	}
+
+	codes, err := t.cache.GetManyInt64(slotKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var codeKeys []string
+	for _, hostname := range hostnames {
+		for i := int64(0); i < counters[hostErrorsKey(hostname, statusCodesKey)]; i++ {
+			codeKeys = append(codeKeys, statusCodeKey(hostname, codes[statusCodeSlotKey(hostname, i)]))
+		}
+	}
+
+	codeCounters, err := t.cache.GetManyInt64(codeKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	offenders := make([]hostErrors, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		stats := hostErrors{
+			Hostname:         hostname,
+			Total:            counters[hostErrorsKey(hostname, totalErrors)],
+			Timeouts:         counters[hostErrorsKey(hostname, timeoutErrors)],
+			ConnectionErrors: counters[hostErrorsKey(hostname, connectionErrors)],
+			Others:           counters[hostErrorsKey(hostname, otherErrors)],
+		}
+
+		for i := int64(0); i < counters[hostErrorsKey(hostname, statusCodesKey)]; i++ {
+			code := codes[statusCodeSlotKey(hostname, i)]
+			if count := codeCounters[statusCodeKey(hostname, code)]; count > 0 {
+				if stats.StatusCodes == nil {
+					stats.StatusCodes = map[int]int64{}
+				}
+				stats.StatusCodes[int(code)] = count
+			}
+		}
+
+		// The host may have been evicted meanwhile
+		if stats.Total > 0 {
+			offenders = append(offenders, stats)
+		}
+	}
+
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].Total == offenders[j].Total {
+			return offenders[i].Hostname < offenders[j].Hostname
+		}
+		return offenders[i].Total > offenders[j].Total
+	})
+
+	if len(offenders) > limit {
+		offenders = offenders[:limit]
+	}
+
+	return offenders, nil
+}
+
+// trackedHosts returns the hosts of the index
+func (t *hostErrorsTracker) trackedHosts() ([]string, error) {
+	count, err := t.cache.GetInt64(hostsIndexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if count > maxTrackedHosts {
+		count = maxTrackedHosts
+	}
+
+	var hostnames []string
+	seen := map[string]bool{}
+	for i := int64(0); i < count; i++ {
+		b, err := t.cache.GetBytes(hostsSlotKey(i))
+		if err != nil {
+			return nil, err
+		}
+
+		// An host evicted then tracked again may appear twice
+		if hostname := string(b); hostname != "" && !seen[hostname] {
+			seen[hostname] = true
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	return hostnames, nil
+}
+
+func hostErrorsKey(hostname, kind string) string {
+	return fmt.Sprintf("%s:%s", hostname, kind)
+}
+
+func hostsSlotKey(slot int64) string {
+	return fmt.Sprintf("%s:%d", hostsIndexKey, slot)
+}
+
+func statusCodeKey(hostname string, code int64) string {
+	return fmt.Sprintf("%s:status-%d", hostname, code)
+}
+
+func statusCodeSlotKey(hostname string, slot int64) string {
+	return fmt.Sprintf("%s:status-code-%d", hostname, slot)
+}
+
+func (state *State) getHostErrors(w http.ResponseWriter, r *http.Request) {
+	limit := defaultHostErrorsLimit
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		val, err := strconv.Atoi(rawLimit)
+		if err != nil || val <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit = val
+	}
+
+	if limit > maxHostErrorsLimit {
+		limit = maxHostErrorsLimit
+	}
+
+	offenders, err := state.hostErrors.worstOffenders(limit)
+	if err != nil {
+		log.Err(err).Msg("error while retrieving host errors")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	process.WriteJSON(w, offenders)
+}
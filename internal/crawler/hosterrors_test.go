@@ -0,0 +1,107 @@
+package crawler
+
+import (
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
+	chttp "github.com/darkspot-org/bathyscaphe/internal/http"
+	"github.com/golang/mock/gomock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostErrorsTracker_Record(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	// Host already tracked, status code first seen
+	cacheMock.EXPECT().IncrBy("example.onion:total", int64(1), cache.NoTTL).Return(int64(3), nil)
+	cacheMock.EXPECT().IncrBy("example.onion:status-500", int64(1), cache.NoTTL).Return(int64(1), nil)
+	cacheMock.EXPECT().IncrBy("example.onion:status-codes", int64(1), cache.NoTTL).Return(int64(1), nil)
+	cacheMock.EXPECT().SetInt64("example.onion:status-code-0", int64(500), cache.NoTTL).Return(nil)
+
+	tracker := hostErrorsTracker{cache: cacheMock}
+	if err := tracker.record("https://example.onion/index.php", &chttp.StatusError{Code: 500}); err != nil {
+		t.FailNow()
+	}
+
+	// Host first seen: tracked in the next slot of the index
+	cacheMock.EXPECT().IncrBy("other.onion:total", int64(1), cache.NoTTL).Return(int64(1), nil)
+	cacheMock.EXPECT().IncrBy("#hosts", int64(1), cache.NoTTL).Return(int64(2), nil)
+	cacheMock.EXPECT().SetBytes("#hosts:1", []byte("other.onion"), cache.NoTTL).Return(nil)
+	cacheMock.EXPECT().IncrBy("other.onion:connection-errors", int64(1), cache.NoTTL).Return(int64(1), nil)
+
+	err := &chttp.RequestError{Kind: chttp.ErrConnRefused, Err: fmt.Errorf("dial tcp: connection refused")}
+	if err := tracker.record("https://other.onion", err); err != nil {
+		t.FailNow()
+	}
+}
+
+func TestHostErrorsTracker_Evict(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	// The index is full: the oldest host should be evicted along with its counters
+	cacheMock.EXPECT().IncrBy("new.onion:total", int64(1), cache.NoTTL).Return(int64(1), nil)
+	cacheMock.EXPECT().IncrBy("#hosts", int64(1), cache.NoTTL).Return(int64(maxTrackedHosts+3), nil)
+	cacheMock.EXPECT().GetBytes("#hosts:2").Return([]byte("old.onion"), nil)
+	cacheMock.EXPECT().RemovePrefix("old.onion:").Return(int64(3), nil)
+	cacheMock.EXPECT().SetBytes("#hosts:2", []byte("new.onion"), cache.NoTTL).Return(nil)
+	cacheMock.EXPECT().IncrBy("new.onion:timeouts", int64(1), cache.NoTTL).Return(int64(1), nil)
+
+	tracker := hostErrorsTracker{cache: cacheMock}
+	if err := tracker.record("https://new.onion", chttp.ErrTimeout); err != nil {
+		t.FailNow()
+	}
+}
+
+func TestGetHostErrors(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cacheMock := cache_mock.NewMockCache(mockCtrl)
+	cacheMock.EXPECT().GetInt64("#hosts").Return(int64(3), nil)
+	cacheMock.EXPECT().GetBytes("#hosts:0").Return([]byte("a.onion"), nil)
+	cacheMock.EXPECT().GetBytes("#hosts:1").Return([]byte("b.onion"), nil)
+	cacheMock.EXPECT().GetBytes("#hosts:2").Return([]byte("c.onion"), nil)
+	cacheMock.EXPECT().GetManyInt64(gomock.Any()).Return(map[string]int64{
+		"a.onion:total": 2, "a.onion:timeouts": 2,
+		"b.onion:total": 7, "b.onion:others": 5, "b.onion:status-codes": 1,
+		"c.onion:total": 4, "c.onion:timeouts": 4,
+	}, nil)
+	cacheMock.EXPECT().GetManyInt64([]string{"b.onion:status-code-0"}).Return(map[string]int64{"b.onion:status-code-0": 500}, nil)
+	cacheMock.EXPECT().GetManyInt64([]string{"b.onion:status-500"}).Return(map[string]int64{"b.onion:status-500": 2}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/hosts/errors?limit=2", nil)
+	rec := httptest.NewRecorder()
+
+	s := State{hostErrors: &hostErrorsTracker{cache: cacheMock}}
+	s.getHostErrors(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fail()
+	}
+
+	want := `[{"hostname":"b.onion","total":7,"timeouts":0,"connection-errors":0,"status-codes":{"500":2},"others":5},` +
+		`{"hostname":"c.onion","total":4,"timeouts":4,"connection-errors":0,"others":0}]`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+}
+
+func TestGetHostErrors_InvalidLimit(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/hosts/errors?limit=abc", nil)
+	rec := httptest.NewRecorder()
+
+	s := State{}
+	s.getHostErrors(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,62 @@
+package crawler
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/constraint"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+// recentlyCrawled returns true if the URL of given event has been crawled within the refresh window, i.e. before
+// the earliest time the scheduler may schedule it again. The cache failures are logged, the URL being crawled anyway
+func (state *State) recentlyCrawled(evt event.NewURLEvent) bool {
+	if state.crawlTimes == nil || evt.Method == http.MethodPost {
+		return false
+	}
+
+	window, err := state.refreshWindow()
+	if err != nil || window <= 0 {
+		return false
+	}
+
+	// The always crawled URLs are crawled each time they are scheduled
+	if alwaysCrawl, err := state.configClient.GetAlwaysCrawl(); err != nil || constraint.IsAlwaysCrawled(alwaysCrawl, evt.URL) {
+		return false
+	}
+
+	crawlTime, err := state.crawlTimes.GetInt64(evt.URL)
+	if err != nil {
+		log.Err(err).Str("url", evt.URL).Msg("error while getting URL crawl time")
+		return false
+	}
+
+	return crawlTime != 0 && state.clock.Now().Sub(time.Unix(crawlTime, 0)) < window
+}
+
+// recordCrawl store the crawl time of the URL of given event, for the duration of the refresh window
+func (state *State) recordCrawl(evt event.NewURLEvent, crawlTime time.Time) {
+	if state.crawlTimes == nil || evt.Method == http.MethodPost {
+		return
+	}
+
+	window, err := state.refreshWindow()
+	if err != nil || window <= 0 {
+		return
+	}
+
+	if err := state.crawlTimes.SetInt64(evt.URL, crawlTime.Unix(), window); err != nil {
+		log.Err(err).Str("url", evt.URL).Msg("error while storing URL crawl time")
+	}
+}
+
+// refreshWindow returns the duration during which a crawled URL is not scheduled again (refresh delay minus jitter).
+// The window is empty if the URLs are never re-scheduled, since they can only be re-crawled on purpose
+func (state *State) refreshWindow() (time.Duration, error) {
+	delay, err := state.configClient.GetRefreshDelay()
+	if err != nil {
+		return 0, err
+	}
+
+	return delay.Delay - delay.Jitter, nil
+}
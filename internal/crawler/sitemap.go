@@ -0,0 +1,169 @@
+package crawler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/constraint"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+const (
+	// maxSitemapDepth is the maximum number of nested sitemap index followed
+	maxSitemapDepth = 3
+	// maxNestedSitemaps is the maximum number of nested sitemaps fetched per root sitemap
+	maxNestedSitemaps = 50
+	// maxSitemapBytes is the maximum size of a sitemap, once decompressed (limit of the sitemaps protocol)
+	maxSitemapBytes = 50 * 1024 * 1024
+)
+
+var errSitemapTooLarge = errors.New("sitemap is too large")
+
+// sitemap represent both a sitemap urlset and a sitemap index
+type sitemap struct {
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// crawlSitemap fetch the sitemap of given URL hostname and publish the found URLs (using given tag)
+func (state *State) crawlSitemap(publisher event.Publisher, rawURL, tag string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	root := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/sitemap.xml"}
+	nested := 0
+
+	urls, err := state.extractSitemapURLs(root, root.String(), 0, &nested)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range urls {
+		if err := publisher.PublishEvent(&event.FoundURLEvent{URL: u, Tag: tag}); err != nil {
+			return fmt.Errorf("error while publishing URL: %s", err)
+		}
+	}
+
+	log.Debug().Str("url", rawURL).Int("count", len(urls)).Msg("Successfully crawled sitemap")
+
+	return nil
+}
+
+// extractSitemapURLs fetch given sitemap and return the URLs found, following nested sitemap index.
+// Only the nested sitemaps on the scheme & host of the root one are followed (as long as they are allowed),
+// nested counting the ones fetched so far
+func (state *State) extractSitemapURLs(root *url.URL, sitemapURL string, depth int, nested *int) ([]string, error) {
+	r, err := state.httpClient.Get(sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+
+	sm, err := parseSitemap(r.Body(), maxSitemapBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing sitemap %s: %s", sitemapURL, err)
+	}
+
+	var urls []string
+	for _, loc := range sm.URLs {
+		urls = append(urls, loc.Loc)
+	}
+
+	if depth >= maxSitemapDepth {
+		return urls, nil
+	}
+
+	for _, loc := range sm.Sitemaps {
+		if *nested >= maxNestedSitemaps {
+			log.Debug().Str("url", root.String()).Msg("Too many nested sitemaps, ignoring the extra ones")
+			break
+		}
+
+		if !state.followSitemap(root, loc.Loc) {
+			log.Debug().Str("url", loc.Loc).Msg("Skipping out of scope nested sitemap")
+			continue
+		}
+
+		*nested++
+		nestedURLs, err := state.extractSitemapURLs(root, loc.Loc, depth+1, nested)
+		if err != nil {
+			log.Err(err).Str("url", loc.Loc).Msg("error while extracting nested sitemap")
+			continue
+		}
+
+		urls = append(urls, nestedURLs...)
+	}
+
+	return urls, nil
+}
+
+// followSitemap returns true if given nested sitemap is on the scheme & host of given root sitemap, and is allowed
+func (state *State) followSitemap(root *url.URL, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != root.Scheme || !strings.EqualFold(u.Host, root.Host) {
+		return false
+	}
+
+	allowed, err := constraint.CheckURLAllowed(state.configClient, rawURL)
+	if err != nil {
+		log.Err(err).Str("url", rawURL).Msg("error while checking nested sitemap")
+		return false
+	}
+
+	return allowed
+}
+
+// parseSitemap parse given sitemap, decompressing it if needed.
+// errSitemapTooLarge is returned if the sitemap is larger than maxBytes (once decompressed)
+func parseSitemap(r io.Reader, maxBytes int64) (*sitemap, error) {
+	b, err := readLimited(r, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handle gzip compressed sitemap
+	if len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b {
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+
+		if b, err = readLimited(gr, maxBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	var sm sitemap
+	if err := xml.Unmarshal(b, &sm); err != nil {
+		return nil, err
+	}
+
+	return &sm, nil
+}
+
+// readLimited read given reader, errSitemapTooLarge being returned if it holds more than maxBytes
+func readLimited(r io.Reader, maxBytes int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(b)) > maxBytes {
+		return nil, errSitemapTooLarge
+	}
+
+	return b, nil
+}
@@ -0,0 +1,199 @@
+package crawler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/http"
+	"github.com/darkspot-org/bathyscaphe/internal/http_mock"
+	"github.com/golang/mock/gomock"
+	"strings"
+	"testing"
+)
+
+const sitemapIndexBody = `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap>
+    <loc>https://example.onion/sitemap-posts.xml.gz</loc>
+  </sitemap>
+</sitemapindex>`
+
+const sitemapURLSetBody = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url>
+    <loc>https://example.onion/posts/1</loc>
+  </url>
+  <url>
+    <loc>https://example.onion/posts/2</loc>
+  </url>
+</urlset>`
+
+func TestParseSitemap(t *testing.T) {
+	sm, err := parseSitemap(strings.NewReader(sitemapURLSetBody), maxSitemapBytes)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(sm.URLs) != 2 || len(sm.Sitemaps) != 0 {
+		t.FailNow()
+	}
+	if sm.URLs[0].Loc != "https://example.onion/posts/1" {
+		t.Errorf("got %s want %s", sm.URLs[0].Loc, "https://example.onion/posts/1")
+	}
+
+	sm, err = parseSitemap(strings.NewReader(sitemapIndexBody), maxSitemapBytes)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(sm.URLs) != 0 || len(sm.Sitemaps) != 1 {
+		t.FailNow()
+	}
+	if sm.Sitemaps[0].Loc != "https://example.onion/sitemap-posts.xml.gz" {
+		t.Errorf("got %s want %s", sm.Sitemaps[0].Loc, "https://example.onion/sitemap-posts.xml.gz")
+	}
+}
+
+func TestParseSitemap_Gzip(t *testing.T) {
+	sm, err := parseSitemap(bytes.NewReader(gzipBytes(t, sitemapURLSetBody)), maxSitemapBytes)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(sm.URLs) != 2 {
+		t.Fail()
+	}
+}
+
+func TestCrawlSitemap(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	publisherMock := event_mock.NewMockPublisher(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	indexResponseMock := http_mock.NewMockResponse(mockCtrl)
+	urlSetResponseMock := http_mock.NewMockResponse(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return(nil, nil)
+
+	httpClientMock.EXPECT().Get("https://example.onion/sitemap.xml").Return(indexResponseMock, nil)
+	indexResponseMock.EXPECT().Body().Return(strings.NewReader(sitemapIndexBody))
+
+	httpClientMock.EXPECT().Get("https://example.onion/sitemap-posts.xml.gz").Return(urlSetResponseMock, nil)
+	urlSetResponseMock.EXPECT().Body().Return(bytes.NewReader(gzipBytes(t, sitemapURLSetBody)))
+
+	publisherMock.EXPECT().PublishEvent(&event.FoundURLEvent{URL: "https://example.onion/posts/1", Tag: "forums"}).Return(nil)
+	publisherMock.EXPECT().PublishEvent(&event.FoundURLEvent{URL: "https://example.onion/posts/2", Tag: "forums"}).Return(nil)
+
+	s := State{httpClient: httpClientMock, configClient: configClientMock}
+	if err := s.crawlSitemap(publisherMock, "https://example.onion/", "forums"); err != nil {
+		t.Fail()
+	}
+}
+
+func TestParseSitemap_TooLarge(t *testing.T) {
+	// A small gzip bomb: the limit should apply to the decompressed sitemap
+	bomb := gzipBytes(t, strings.Repeat(" ", 1024*1024))
+	if _, err := parseSitemap(bytes.NewReader(bomb), 1024); !errors.Is(err, errSitemapTooLarge) {
+		t.Errorf("got %v want %v", err, errSitemapTooLarge)
+	}
+
+	if _, err := parseSitemap(strings.NewReader(sitemapURLSetBody), 10); !errors.Is(err, errSitemapTooLarge) {
+		t.Errorf("got %v want %v", err, errSitemapTooLarge)
+	}
+}
+
+func TestCrawlSitemap_Scope(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	publisherMock := event_mock.NewMockPublisher(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	indexResponseMock := http_mock.NewMockResponse(mockCtrl)
+
+	index := `<sitemapindex>
+  <sitemap><loc>https://other.onion/sitemap.xml</loc></sitemap>
+  <sitemap><loc>http://example.onion/sitemap-http.xml</loc></sitemap>
+  <sitemap><loc>https://example.com/sitemap.xml</loc></sitemap>
+  <sitemap><loc>https://example.onion/forbidden.xml</loc></sitemap>
+</sitemapindex>`
+
+	httpClientMock.EXPECT().Get("https://example.onion/sitemap.xml").Return(indexResponseMock, nil)
+	indexResponseMock.EXPECT().Body().Return(strings.NewReader(index))
+
+	// Only the same host sitemap should be checked, and none fetched
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{{Hostname: "example.onion"}}, nil)
+	configClientMock.EXPECT().GetAllowedURLs().Return(nil, nil)
+
+	s := State{httpClient: httpClientMock, configClient: configClientMock}
+	if err := s.crawlSitemap(publisherMock, "https://example.onion/", "forums"); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+}
+
+func TestCrawlSitemap_MaxNestedSitemaps(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	publisherMock := event_mock.NewMockPublisher(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetForbiddenHostnames().AnyTimes().Return(nil, nil)
+
+	var index strings.Builder
+	index.WriteString("<sitemapindex>")
+	for i := 0; i < 2*maxNestedSitemaps; i++ {
+		index.WriteString(fmt.Sprintf("<sitemap><loc>https://example.onion/sitemap-%d.xml</loc></sitemap>", i))
+	}
+	index.WriteString("</sitemapindex>")
+
+	indexResponseMock := http_mock.NewMockResponse(mockCtrl)
+	httpClientMock.EXPECT().Get("https://example.onion/sitemap.xml").Return(indexResponseMock, nil)
+	indexResponseMock.EXPECT().Body().Return(strings.NewReader(index.String()))
+
+	// The nested sitemaps past the limit should not be fetched
+	httpClientMock.EXPECT().Get(gomock.Any()).Times(maxNestedSitemaps).DoAndReturn(func(string) (http.Response, error) {
+		r := http_mock.NewMockResponse(mockCtrl)
+		r.EXPECT().Body().Return(strings.NewReader("<urlset></urlset>"))
+		return r, nil
+	})
+
+	s := State{httpClient: httpClientMock, configClient: configClientMock}
+	if err := s.crawlSitemap(publisherMock, "https://example.onion/", "forums"); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+}
+
+func TestIsRootURL(t *testing.T) {
+	urls := map[string]bool{
+		"https://example.onion":          true,
+		"https://example.onion/":         true,
+		"https://example.onion/?id=12":   false,
+		"https://example.onion/test.php": false,
+	}
+
+	for u, want := range urls {
+		if got := isRootURL(u); got != want {
+			t.Errorf("%s: got %v want %v", u, got, want)
+		}
+	}
+}
+
+func gzipBytes(t *testing.T, content string) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.FailNow()
+	}
+	if err := w.Close(); err != nil {
+		t.FailNow()
+	}
+
+	return b.Bytes()
+}
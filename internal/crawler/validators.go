@@ -0,0 +1,65 @@
+package crawler
+
+import (
+	"encoding/json"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"strings"
+	"time"
+)
+
+// validatorsTTL is the duration during which the validators of a response are kept
+const validatorsTTL = 30 * 24 * time.Hour
+
+// validators are the response headers used to perform a conditional request on re-crawl
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last-modified,omitempty"`
+}
+
+// getValidators returns the validators stored for given URL (nil if none)
+func getValidators(c cache.Cache, rawURL string) (*validators, error) {
+	b, err := c.GetBytes(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	var v validators
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+// storeValidators store the validators of given response headers (if any) for given URL
+func storeValidators(c cache.Cache, rawURL string, headers map[string]string) error {
+	v := validators{
+		ETag:         getHeader(headers, "ETag"),
+		LastModified: getHeader(headers, "Last-Modified"),
+	}
+
+	if v.ETag == "" && v.LastModified == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.SetBytes(rawURL, b, validatorsTTL)
+}
+
+// getHeader returns the value of given header, using a case insensitive lookup
+func getHeader(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -7,10 +7,22 @@ import "time"
 const (
 	// NewURLExchange is the exchange used when an URL is schedule for crawling
 	NewURLExchange = "url.new"
+	// FoundURLExchange is the exchange used when an URL has been discovered and should be scheduled
+	FoundURLExchange = "url.found"
 	// TimeoutURLExchange is the exchange used when a crawling fail because of timeout
 	TimeoutURLExchange = "url.timeout"
+	// ErrorURLExchange is the exchange used when a crawling fail because of an error status code
+	ErrorURLExchange = "url.error"
 	// NewResourceExchange is the exchange used when a new resource has been crawled
 	NewResourceExchange = "resource.new"
+	// ResourceIndexedExchange is the exchange used when a resource has been indexed
+	ResourceIndexedExchange = "resource.indexed"
+	// NotModifiedResourceExchange is the exchange used when a re-crawled resource has not changed
+	NotModifiedResourceExchange = "resource.not-modified"
+	// WatchlistHitExchange is the exchange used when an indexed resource mentions watchlist keywords
+	WatchlistHitExchange = "resource.watchlist-hit"
+	// HostnameBlacklistedExchange is the exchange used when an hostname has been blacklisted
+	HostnameBlacklistedExchange = "hostname.blacklisted"
 	// ConfigExchange is the exchange used to dispatch new configuration
 	ConfigExchange = "config"
 )
@@ -24,6 +36,15 @@ type Event interface {
 // NewURLEvent represent an URL to crawl
 type NewURLEvent struct {
 	URL string `json:"url"`
+	// Tag is the crawl campaign the URL belongs to
+	Tag string `json:"tag,omitempty"`
+	// Language is the Accept-Language used to crawl the URL (overrides the configured one)
+	Language string `json:"language,omitempty"`
+
+	// The following are only set when the URL should be crawled using a POST request
+	Method      string `json:"method,omitempty"`
+	ContentType string `json:"content-type,omitempty"`
+	Body        string `json:"body,omitempty"`
 }
 
 // Exchange returns the exchange where event should be push
@@ -31,6 +52,17 @@ func (msg *NewURLEvent) Exchange() string {
 	return NewURLExchange
 }
 
+// FoundURLEvent represent an URL discovered while crawling
+type FoundURLEvent struct {
+	URL string `json:"url"`
+	Tag string `json:"tag,omitempty"`
+}
+
+// Exchange returns the exchange where event should be push
+func (msg *FoundURLEvent) Exchange() string {
+	return FoundURLExchange
+}
+
 // TimeoutURLEvent represent a failed crawling because of timeout
 type TimeoutURLEvent struct {
 	URL string `json:"url"`
@@ -41,15 +73,82 @@ func (msg *TimeoutURLEvent) Exchange() string {
 	return TimeoutURLExchange
 }
 
+// ErrorURLEvent represent a failed crawling because of an error status code
+type ErrorURLEvent struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status-code"`
+}
+
+// Exchange returns the exchange where event should be push
+func (msg *ErrorURLEvent) Exchange() string {
+	return ErrorURLExchange
+}
+
+// HostnameBlacklistedEvent represent an hostname added to the forbidden hostnames
+type HostnameBlacklistedEvent struct {
+	Hostname string `json:"hostname"`
+	Reason   string `json:"reason"`
+}
+
+// Exchange returns the exchange where event should be push
+func (msg *HostnameBlacklistedEvent) Exchange() string {
+	return HostnameBlacklistedExchange
+}
+
 // NewResourceEvent represent a crawled resource
 type NewResourceEvent struct {
 	URL     string            `json:"url"`
 	Body    string            `json:"body"`
 	Headers map[string]string `json:"headers"`
 	Time    time.Time         `json:"time"`
+	Tag     string            `json:"tag,omitempty"`
+	// Via is the address of the proxy which served the resource (see http.Response)
+	Via string `json:"via,omitempty"`
+	// StatusCode of the response (0 if published by a crawler not reporting it)
+	StatusCode int `json:"status-code,omitempty"`
 }
 
 // Exchange returns the exchange where event should be push
 func (msg *NewResourceEvent) Exchange() string {
 	return NewResourceExchange
 }
+
+// ResourceIndexedEvent represent an indexed resource
+type ResourceIndexedEvent struct {
+	URL         string    `json:"url"`
+	Hostname    string    `json:"hostname"`
+	ContentType string    `json:"content-type"`
+	BodyLength  int       `json:"body-length"`
+	Language    string    `json:"language"`
+	Time        time.Time `json:"time"`
+	Tag         string    `json:"tag,omitempty"`
+}
+
+// Exchange returns the exchange where event should be push
+func (msg *ResourceIndexedEvent) Exchange() string {
+	return ResourceIndexedExchange
+}
+
+// WatchlistHitEvent represent an indexed resource mentioning watchlist keywords
+type WatchlistHitEvent struct {
+	URL      string    `json:"url"`
+	Keywords []string  `json:"keywords"`
+	Time     time.Time `json:"time"`
+	Tag      string    `json:"tag,omitempty"`
+}
+
+// Exchange returns the exchange where event should be push
+func (msg *WatchlistHitEvent) Exchange() string {
+	return WatchlistHitExchange
+}
+
+// NotModifiedResourceEvent represent a re-crawled resource which has not changed since the previous crawl
+type NotModifiedResourceEvent struct {
+	URL  string    `json:"url"`
+	Time time.Time `json:"time"`
+}
+
+// Exchange returns the exchange where event should be push
+func (msg *NotModifiedResourceEvent) Exchange() string {
+	return NotModifiedResourceExchange
+}
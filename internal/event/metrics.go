@@ -0,0 +1,138 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+const (
+	successOutcome = "success"
+	errorOutcome   = "error"
+	// requeuedOutcome is the outcome of the messages given back to the queue without being processed (i.e: paused)
+	requeuedOutcome = "requeued"
+)
+
+// handlerDurations are the durations of the event handlers, by queue (the exchange for SubscribeAll) and outcome
+// (i.e: crawlingQueue.success, see observe)
+var handlerDurations = expvar.NewMap("event.handler-durations")
+
+// handlerDurationsMutex prevent the histograms of a label to be created twice
+var handlerDurationsMutex sync.Mutex
+
+// durationBuckets are the upper bounds of the histograms buckets
+var durationBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// histogram is an expvar.Var counting the observed durations per bucket
+type histogram struct {
+	mutex sync.Mutex
+	// counts are the number of durations per bucket, the last one holding the durations past the last bound
+	counts []int64
+	count  int64
+	sum    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, len(durationBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	i := 0
+	for i < len(durationBuckets) && d > durationBuckets[i] {
+		i++
+	}
+
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+type histogramBucket struct {
+	// LE is the bucket upper bound (inclusive), +Inf for the last one
+	LE string `json:"le"`
+	// Count is the cumulative number of durations lower or equal to the bound
+	Count int64 `json:"count"`
+}
+
+type histogramValue struct {
+	Buckets    []histogramBucket `json:"buckets"`
+	Count      int64             `json:"count"`
+	SumSeconds float64           `json:"sum-seconds"`
+}
+
+// String returns the JSON value of the histogram, with cumulative buckets
+func (h *histogram) String() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	value := histogramValue{Count: h.count, SumSeconds: h.sum.Seconds()}
+
+	var cumulative int64
+	for i, count := range h.counts {
+		cumulative += count
+
+		le := "+Inf"
+		if i < len(durationBuckets) {
+			le = durationBuckets[i].String()
+		}
+
+		value.Buckets = append(value.Buckets, histogramBucket{LE: le, Count: cumulative})
+	}
+
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+// observe record the duration of an handler consuming given queue, labeled with its outcome
+func observe(queue string, d time.Duration, outcome string) {
+	key := queue + "." + outcome
+
+	handlerDurationsMutex.Lock()
+	h, ok := handlerDurations.Get(key).(*histogram)
+	if !ok {
+		h = newHistogram()
+		handlerDurations.Set(key, h)
+	}
+	handlerDurationsMutex.Unlock()
+
+	h.observe(d)
+}
+
+// observe record the duration of the message handling, from its delivery to its acknowledgment by the handler
+// (see ErrAckDeferred). Nothing is recorded for the messages which have not been delivered by a subscriber
+func (msg RawMessage) observe(outcome string) {
+	if msg.queue == "" {
+		return
+	}
+
+	observe(msg.queue, time.Since(msg.delivered), outcome)
+}
+
+// handleObserved handle given message like handle, recording the handler duration labeled with its outcome
+// (success or error). The duration of the messages acknowledged by the handler itself (i.e: retried, or processed
+// in another goroutine) is recorded once acknowledged instead, using the acknowledgment outcome
+func handleObserved(s Subscriber, queue string, handler Handler, msg RawMessage) error {
+	msg.queue, msg.delivered = queue, time.Now()
+
+	err := handle(s, handler, msg)
+	if errors.Is(err, ErrAckDeferred) {
+		return err
+	}
+
+	if err != nil {
+		observe(queue, time.Since(msg.delivered), errorOutcome)
+	} else {
+		observe(queue, time.Since(msg.delivered), successOutcome)
+	}
+
+	return err
+}
@@ -0,0 +1,92 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	h.observe(3 * time.Millisecond)
+	h.observe(10 * time.Millisecond)
+	h.observe(2 * time.Second)
+	h.observe(time.Hour)
+
+	var value histogramValue
+	if err := json.Unmarshal([]byte(h.String()), &value); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+
+	if value.Count != 4 {
+		t.Errorf("got count %d want 4", value.Count)
+	}
+	if len(value.Buckets) != len(durationBuckets)+1 {
+		t.Fatalf("got %d buckets want %d", len(value.Buckets), len(durationBuckets)+1)
+	}
+
+	// The buckets are cumulative, the bounds being inclusive
+	want := map[string]int64{"5ms": 1, "10ms": 2, "1s": 2, "2.5s": 3, "1m0s": 3, "+Inf": 4}
+	for _, bucket := range value.Buckets {
+		if count, ok := want[bucket.LE]; ok && bucket.Count != count {
+			t.Errorf("%s: got %d want %d", bucket.LE, bucket.Count, count)
+		}
+	}
+}
+
+func TestHandleObserved(t *testing.T) {
+	type test struct {
+		queue   string
+		handler Handler
+		outcome string
+	}
+
+	tests := []test{
+		{queue: "successQueue", handler: func(Subscriber, RawMessage) error { return nil }, outcome: successOutcome},
+		{queue: "errorQueue", handler: func(Subscriber, RawMessage) error { return errors.New("invalid event") }, outcome: errorOutcome},
+		// The messages acknowledged by the handler are observed using the acknowledgment outcome
+		{queue: "ackQueue", handler: func(s Subscriber, msg RawMessage) error {
+			_ = msg.Ack()
+			return ErrAckDeferred
+		}, outcome: successOutcome},
+		{queue: "requeueQueue", handler: func(s Subscriber, msg RawMessage) error {
+			_ = msg.Nack(true)
+			return ErrAckDeferred
+		}, outcome: requeuedOutcome},
+		{queue: "retryQueue", handler: func(s Subscriber, msg RawMessage) error {
+			_ = msg.Retry()
+			return ErrAckDeferred
+		}, outcome: errorOutcome},
+	}
+
+	for _, tst := range tests {
+		_ = handleObserved(nil, tst.queue, tst.handler, RawMessage{})
+
+		h, ok := handlerDurations.Get(tst.queue + "." + tst.outcome).(*histogram)
+		if !ok {
+			t.Errorf("%s: no histogram recorded", tst.queue)
+			continue
+		}
+
+		var value histogramValue
+		if err := json.Unmarshal([]byte(h.String()), &value); err != nil {
+			t.Fatalf("got %v want nil", err)
+		}
+		if value.Count != 1 {
+			t.Errorf("%s: got count %d want 1", tst.queue, value.Count)
+		}
+	}
+}
+
+func TestHandleObserved_NotAcknowledged(t *testing.T) {
+	// Nothing should be recorded until the message is acknowledged
+	handler := func(Subscriber, RawMessage) error { return ErrAckDeferred }
+	_ = handleObserved(nil, "deferredQueue", handler, RawMessage{})
+
+	for _, outcome := range []string{successOutcome, errorOutcome, requeuedOutcome} {
+		if h := handlerDurations.Get("deferredQueue." + outcome); h != nil {
+			t.Errorf("got %s histogram want none", outcome)
+		}
+	}
+}
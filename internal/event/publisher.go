@@ -2,10 +2,19 @@ package event
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/streadway/amqp"
+	"sync"
+	"time"
 )
 
+// confirmTimeout is the maximum duration waited for the broker to confirm a message
+const confirmTimeout = 30 * time.Second
+
+// ErrPublishNotConfirmed is returned when the broker has not accepted a message published in confirm mode
+var ErrPublishNotConfirmed = errors.New("message not confirmed by the broker")
+
 // Publisher is something that push an event
 type Publisher interface {
 	PublishEvent(event Event) error
@@ -13,12 +22,35 @@ type Publisher interface {
 	Close() error
 }
 
+// PublisherOptions are the options used to create a Publisher
+type PublisherOptions struct {
+	// Confirm wait for the broker to confirm each message before returning, an error is returned if it has not
+	// been accepted. This adds latency since the messages are published one at a time
+	Confirm bool
+}
+
+// publishChannel is the part of the channel used to publish the messages
+type publishChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// confirmBufferSize is the number of confirmations buffered. The late confirmations (of the messages which have
+// timed out) are only drained by the next publish, and the connection blocks once the buffer is full
+const confirmBufferSize = 128
+
 type publisher struct {
-	channel *amqp.Channel
+	channel publishChannel
+	// confirms is only set in confirm mode
+	confirms <-chan amqp.Confirmation
+	// confirmMutex make sure a single message is waiting for its confirmation
+	confirmMutex sync.Mutex
+	// seq is the delivery tag of the last message published in confirm mode
+	seq uint64
 }
 
 // NewPublisher create a new Publisher instance
-func NewPublisher(amqpURI string) (Publisher, error) {
+func NewPublisher(amqpURI string, opts PublisherOptions) (Publisher, error) {
 	conn, err := amqp.Dial(amqpURI)
 	if err != nil {
 		return nil, err
@@ -29,9 +61,24 @@ func NewPublisher(amqpURI string) (Publisher, error) {
 		return nil, err
 	}
 
-	return &publisher{
+	return newPublisher(c, opts)
+}
+
+// newPublisher create a publisher using given channel, enabling the confirm mode if wanted.
+// All the messages published on the channel should then go through the publisher, to keep the delivery tags in sync
+func newPublisher(c *amqp.Channel, opts PublisherOptions) (*publisher, error) {
+	p := &publisher{
 		channel: c,
-	}, nil
+	}
+
+	if opts.Confirm {
+		if err := c.Confirm(false); err != nil {
+			return nil, fmt.Errorf("error while enabling confirm mode: %s", err)
+		}
+		p.confirms = c.NotifyPublish(make(chan amqp.Confirmation, confirmBufferSize))
+	}
+
+	return p, nil
 }
 
 func (p *publisher) PublishEvent(event Event) error {
@@ -44,7 +91,7 @@ func (p *publisher) PublishEvent(event Event) error {
 }
 
 func (p *publisher) PublishJSON(exchange string, msg RawMessage) error {
-	return p.channel.Publish(exchange, "", false, false, amqp.Publishing{
+	return p.publish(exchange, "", false, false, amqp.Publishing{
 		ContentType:  "application/json",
 		Body:         msg.Body,
 		DeliveryMode: amqp.Persistent,
@@ -52,6 +99,59 @@ func (p *publisher) PublishJSON(exchange string, msg RawMessage) error {
 	})
 }
 
+// publish given message on the channel, waiting for its confirmation in confirm mode
+func (p *publisher) publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if p.confirms == nil {
+		return p.channel.Publish(exchange, key, mandatory, immediate, msg)
+	}
+
+	p.confirmMutex.Lock()
+	defer p.confirmMutex.Unlock()
+
+	if err := p.channel.Publish(exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+
+	// The broker numbers the messages published on the channel from 1
+	p.seq++
+
+	return p.waitConfirm(p.seq)
+}
+
+// waitConfirm wait for the confirmation of the message having given delivery tag
+func (p *publisher) waitConfirm(seq uint64) error {
+	timeout := time.After(confirmTimeout)
+
+	for {
+		select {
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				return fmt.Errorf("%w: channel closed", ErrPublishNotConfirmed)
+			}
+			// Late confirmation of a message which has timed out, already reported as not confirmed
+			if confirm.DeliveryTag < seq {
+				continue
+			}
+			if confirm.DeliveryTag != seq || !confirm.Ack {
+				return fmt.Errorf("%w: message %d nacked", ErrPublishNotConfirmed, confirm.DeliveryTag)
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("%w: timeout", ErrPublishNotConfirmed)
+		}
+	}
+}
+
 func (p *publisher) Close() error {
 	return p.channel.Close()
 }
+
+// Ping check that the event server can be reached using given URI
+func Ping(amqpURI string) error {
+	conn, err := amqp.Dial(amqpURI)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
@@ -0,0 +1,80 @@
+package event
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+// confirmChannel confirm the published messages using ack
+type confirmChannel struct {
+	confirms  chan amqp.Confirmation
+	ack       bool
+	published int
+}
+
+func (c *confirmChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.published++
+	c.confirms <- amqp.Confirmation{DeliveryTag: uint64(c.published), Ack: c.ack}
+	return nil
+}
+
+func (c *confirmChannel) Close() error {
+	close(c.confirms)
+	return nil
+}
+
+func TestPublisher_PublishJSON_Confirm(t *testing.T) {
+	c := &confirmChannel{confirms: make(chan amqp.Confirmation, 1), ack: true}
+	p := &publisher{channel: c, confirms: c.confirms}
+
+	if err := p.PublishJSON("url.found", RawMessage{Body: []byte("{}")}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestPublisher_PublishJSON_Nacked(t *testing.T) {
+	c := &confirmChannel{confirms: make(chan amqp.Confirmation, 1), ack: false}
+	p := &publisher{channel: c, confirms: c.confirms}
+
+	if err := p.PublishJSON("url.found", RawMessage{Body: []byte("{}")}); !errors.Is(err, ErrPublishNotConfirmed) {
+		t.Errorf("wrong error: got: %v want: %v", err, ErrPublishNotConfirmed)
+	}
+}
+
+func TestPublisher_PublishJSON_ChannelClosed(t *testing.T) {
+	c := &confirmChannel{confirms: make(chan amqp.Confirmation, 1)}
+	p := &publisher{channel: c, confirms: c.confirms}
+	_ = c.Close()
+
+	if err := p.waitConfirm(1); !errors.Is(err, ErrPublishNotConfirmed) {
+		t.Errorf("wrong error: got: %v want: %v", err, ErrPublishNotConfirmed)
+	}
+}
+
+func TestPublisher_PublishJSON_StaleConfirm(t *testing.T) {
+	// The first message has timed out, its confirmation arriving late
+	c := &confirmChannel{confirms: make(chan amqp.Confirmation, 2), ack: true, published: 1}
+	c.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+	p := &publisher{channel: c, confirms: c.confirms, seq: 1}
+
+	if err := p.PublishJSON("url.found", RawMessage{Body: []byte("{}")}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if p.seq != 2 {
+		t.Errorf("got seq %d want 2", p.seq)
+	}
+	if len(c.confirms) != 0 {
+		t.Errorf("got %d pending confirmations want 0", len(c.confirms))
+	}
+}
+
+func TestPublisher_WaitConfirm_WrongTag(t *testing.T) {
+	c := &confirmChannel{confirms: make(chan amqp.Confirmation, 1)}
+	c.confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+	p := &publisher{channel: c, confirms: c.confirms}
+
+	if err := p.waitConfirm(2); !errors.Is(err, ErrPublishNotConfirmed) {
+		t.Errorf("wrong error: got: %v want: %v", err, ErrPublishNotConfirmed)
+	}
+}
@@ -0,0 +1,79 @@
+package event
+
+import (
+	"expvar"
+	"github.com/streadway/amqp"
+)
+
+// replayedMessages is the number of dead-lettered messages replayed
+var replayedMessages = expvar.NewInt("event.replayed-messages")
+
+// ReplayOptions are the options used to replay the dead-lettered messages of a queue
+type ReplayOptions struct {
+	// MaxCount is the maximum number of messages replayed (0 means no limit)
+	MaxCount int
+	// DryRun only count the messages that would be replayed, without consuming them
+	DryRun bool
+}
+
+// deadLetterChannel is the part of the channel used to replay the dead-lettered messages
+type deadLetterChannel interface {
+	QueueInspect(name string) (amqp.Queue, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// replayDeadLetters drain the dead-letter queue of given queue, publishing back its messages to the queue
+// with a reset retry count. Only the messages present when starting are replayed, so that the messages
+// dead-lettered again while replaying are not replayed in loop. It returns the number of messages replayed
+func replayDeadLetters(c deadLetterChannel, queue string, opts ReplayOptions) (int, error) {
+	q, err := c.QueueInspect(deadLetterQueueName(queue))
+	if err != nil {
+		return 0, err
+	}
+
+	count := q.Messages
+	if opts.MaxCount > 0 && opts.MaxCount < count {
+		count = opts.MaxCount
+	}
+
+	if opts.DryRun {
+		return count, nil
+	}
+
+	for i := 0; i < count; i++ {
+		delivery, ok, err := c.Get(deadLetterQueueName(queue), false)
+		if err != nil {
+			return i, err
+		}
+		if !ok {
+			return i, nil
+		}
+
+		headers := amqp.Table{}
+		for key, value := range delivery.Headers {
+			headers[key] = value
+		}
+		delete(headers, retryCountHeader)
+
+		// Use the default exchange to publish directly to the queue
+		if err := c.Publish("", queue, false, false, amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         delivery.Body,
+			DeliveryMode: amqp.Persistent,
+			Headers:      headers,
+		}); err != nil {
+			// Keep the message dead-lettered
+			_ = delivery.Nack(false, true)
+			return i, err
+		}
+
+		if err := delivery.Ack(false); err != nil {
+			return i, err
+		}
+
+		replayedMessages.Add(1)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,121 @@
+package event
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+// deadLetterChannelMock serve the dead-lettered messages & record the published ones
+type deadLetterChannelMock struct {
+	deliveries []amqp.Delivery
+	published  map[string][]amqp.Publishing
+	publishErr error
+}
+
+func (c *deadLetterChannelMock) QueueInspect(name string) (amqp.Queue, error) {
+	return amqp.Queue{Name: name, Messages: len(c.deliveries)}, nil
+}
+
+func (c *deadLetterChannelMock) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	if queue != "elasticIndexingQueue.dead-letter" || len(c.deliveries) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	delivery := c.deliveries[0]
+	c.deliveries = c.deliveries[1:]
+	return delivery, true, nil
+}
+
+func (c *deadLetterChannelMock) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if c.publishErr != nil {
+		return c.publishErr
+	}
+
+	c.published[key] = append(c.published[key], msg)
+	return nil
+}
+
+func newDeadLetterChannelMock(count int) (*deadLetterChannelMock, []*acknowledgerRecorder) {
+	c := &deadLetterChannelMock{published: map[string][]amqp.Publishing{}}
+
+	var acks []*acknowledgerRecorder
+	for i := 0; i < count; i++ {
+		ack := &acknowledgerRecorder{}
+		acks = append(acks, ack)
+		c.deliveries = append(c.deliveries, amqp.Delivery{
+			Acknowledger: ack,
+			Body:         []byte(`{"url":"https://example.onion"}`),
+			Headers:      amqp.Table{retryCountHeader: int64(5), "x-custom": "value"},
+		})
+	}
+
+	return c, acks
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	c, acks := newDeadLetterChannelMock(3)
+
+	count, err := replayDeadLetters(c, "elasticIndexingQueue", ReplayOptions{})
+	if err != nil {
+		t.FailNow()
+	}
+	if count != 3 {
+		t.Errorf("got %d want %d", count, 3)
+	}
+
+	published := c.published["elasticIndexingQueue"]
+	if len(published) != 3 {
+		t.Fatalf("got %d published messages want %d", len(published), 3)
+	}
+
+	// The retry count is reset
+	if _, exists := published[0].Headers[retryCountHeader]; exists || published[0].Headers["x-custom"] != "value" {
+		t.Errorf("wrong headers: %v", published[0].Headers)
+	}
+
+	for _, ack := range acks {
+		if !ack.acked {
+			t.Error("replayed message should have been acknowledged")
+		}
+	}
+}
+
+func TestReplayDeadLetters_MaxCount(t *testing.T) {
+	c, _ := newDeadLetterChannelMock(3)
+
+	count, err := replayDeadLetters(c, "elasticIndexingQueue", ReplayOptions{MaxCount: 2})
+	if err != nil {
+		t.FailNow()
+	}
+	if count != 2 || len(c.published["elasticIndexingQueue"]) != 2 || len(c.deliveries) != 1 {
+		t.Errorf("got %d replayed, %d remaining want 2 replayed, 1 remaining", count, len(c.deliveries))
+	}
+}
+
+func TestReplayDeadLetters_DryRun(t *testing.T) {
+	c, _ := newDeadLetterChannelMock(3)
+
+	count, err := replayDeadLetters(c, "elasticIndexingQueue", ReplayOptions{DryRun: true})
+	if err != nil {
+		t.FailNow()
+	}
+	if count != 3 || len(c.published) != 0 || len(c.deliveries) != 3 {
+		t.Errorf("nothing should be replayed: got %d, published %v", count, c.published)
+	}
+}
+
+func TestReplayDeadLetters_PublishError(t *testing.T) {
+	c, acks := newDeadLetterChannelMock(2)
+	c.publishErr = errors.New("channel closed")
+
+	count, err := replayDeadLetters(c, "elasticIndexingQueue", ReplayOptions{})
+	if err == nil || count != 0 {
+		t.Errorf("got %d, %v want 0, error", count, err)
+	}
+
+	// The message should be kept dead-lettered
+	if !acks[0].nacked || !acks[0].requeued || acks[0].acked {
+		t.Errorf("message should have been requeued: %+v", acks[0])
+	}
+}
@@ -0,0 +1,112 @@
+package event
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"time"
+)
+
+// retryCountHeader is the header holding the number of times a message has been retried
+const retryCountHeader = "x-retry-count"
+
+// RetryPolicy define how the messages of a queue are retried (see RawMessage.Retry)
+type RetryPolicy struct {
+	// MaxRetries is the number of retries before the message is moved to the dead-letter queue
+	MaxRetries int
+	// Delay is the delay before the first retry, it is doubled on each retry
+	Delay time.Duration
+	// MaxDelay is the maximum delay between two retries
+	MaxDelay time.Duration
+}
+
+// delay returns the delay before given retry (starting at 1)
+func (p RetryPolicy) delay(retry int) time.Duration {
+	delay := p.Delay
+	for i := 1; i < retry; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+
+	return delay
+}
+
+// queueChannel is the part of the channel used to route the retried messages
+type queueChannel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// retrier re-deliver the messages of a queue using delayed retry queues.
+// A retry queue is declared per delay since RabbitMQ only expires the messages at the head of a queue.
+// Once expired the messages are dead-lettered back to the original queue (only)
+type retrier struct {
+	channel queueChannel
+	queue   string
+	policy  RetryPolicy
+}
+
+// retry publish given message either to the retry queue matching its retry count, or to the dead-letter queue
+// once the maximum number of retries is reached
+func (r *retrier) retry(msg RawMessage) error {
+	retries := retryCount(msg.Headers) + 1
+	if retries > r.policy.MaxRetries {
+		return r.publish(msg, retries, deadLetterQueueName(r.queue), amqp.Table{})
+	}
+
+	delay := r.policy.delay(retries)
+	return r.publish(msg, retries, retryQueueName(r.queue, delay), amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": r.queue,
+	})
+}
+
+// deadLetter publish given message to the dead-letter queue, whatever its retry count
+func (r *retrier) deadLetter(msg RawMessage) error {
+	return r.publish(msg, retryCount(msg.Headers), deadLetterQueueName(r.queue), amqp.Table{})
+}
+
+// publish given message to given queue (declared using given args), with given retry count
+func (r *retrier) publish(msg RawMessage, retries int, queue string, args amqp.Table) error {
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[retryCountHeader] = int64(retries)
+
+	if _, err := r.channel.QueueDeclare(queue, true, false, false, false, args); err != nil {
+		return err
+	}
+
+	// Use the default exchange to publish directly to the queue
+	return r.channel.Publish("", queue, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         msg.Body,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+	})
+}
+
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry-%s", queue, delay)
+}
+
+func deadLetterQueueName(queue string) string {
+	return fmt.Sprintf("%s.dead-letter", queue)
+}
+
+// retryCount returns the number of times the message having given headers has been retried
+func retryCount(headers map[string]interface{}) int {
+	switch count := headers[retryCountHeader].(type) {
+	case int:
+		return count
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	default:
+		return 0
+	}
+}
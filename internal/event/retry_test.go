@@ -0,0 +1,106 @@
+package event
+
+import (
+	"github.com/streadway/amqp"
+	"testing"
+	"time"
+)
+
+// queueChannelMock record the declared queues and the published messages
+type queueChannelMock struct {
+	queues    map[string]amqp.Table
+	published map[string][]amqp.Publishing
+}
+
+func (c *queueChannelMock) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.queues[name] = args
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *queueChannelMock) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.published[key] = append(c.published[key], msg)
+	return nil
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{MaxRetries: 10, Delay: 10 * time.Second, MaxDelay: time.Minute}
+
+	tests := map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 4: time.Minute, 10: time.Minute}
+	for retry, want := range tests {
+		if got := p.delay(retry); got != want {
+			t.Errorf("retry %d: got %s want %s", retry, got, want)
+		}
+	}
+}
+
+func TestRetrier_Retry(t *testing.T) {
+	c := &queueChannelMock{queues: map[string]amqp.Table{}, published: map[string][]amqp.Publishing{}}
+	r := &retrier{channel: c, queue: "elasticIndexingQueue", policy: RetryPolicy{MaxRetries: 2, Delay: 10 * time.Second}}
+
+	msg := RawMessage{Body: []byte(`{"url":"https://example.onion"}`)}
+
+	// First retry: delayed & routed back to the original queue
+	if err := r.retry(msg); err != nil {
+		t.FailNow()
+	}
+
+	args, exists := c.queues["elasticIndexingQueue.retry-10s"]
+	if !exists {
+		t.Fatalf("retry queue not declared: %v", c.queues)
+	}
+	if args["x-message-ttl"] != int64(10000) || args["x-dead-letter-exchange"] != "" ||
+		args["x-dead-letter-routing-key"] != "elasticIndexingQueue" {
+		t.Errorf("wrong retry queue args: %v", args)
+	}
+
+	published := c.published["elasticIndexingQueue.retry-10s"]
+	if len(published) != 1 || string(published[0].Body) != string(msg.Body) || published[0].Headers[retryCountHeader] != int64(1) {
+		t.Errorf("wrong retried message: %v", published)
+	}
+
+	// Second retry: the delay is doubled
+	msg.Headers = published[0].Headers
+	if err := r.retry(msg); err != nil {
+		t.FailNow()
+	}
+	if len(c.published["elasticIndexingQueue.retry-20s"]) != 1 {
+		t.Errorf("message not retried with doubled delay: %v", c.published)
+	}
+
+	// Max retries reached: dead-letter
+	msg.Headers = map[string]interface{}{retryCountHeader: int32(2)}
+	if err := r.retry(msg); err != nil {
+		t.FailNow()
+	}
+	if len(c.published["elasticIndexingQueue.dead-letter"]) != 1 {
+		t.Errorf("message not dead-lettered: %v", c.published)
+	}
+}
+
+func TestRetrier_DeadLetter(t *testing.T) {
+	c := &queueChannelMock{queues: map[string]amqp.Table{}, published: map[string][]amqp.Publishing{}}
+	r := &retrier{channel: c, queue: "elasticIndexingQueue", policy: RetryPolicy{MaxRetries: 2, Delay: 10 * time.Second}}
+
+	// Dead-lettered without being retried
+	msg := RawMessage{Body: []byte(`{"url":"https://example.onion"}`)}
+	if err := r.deadLetter(msg); err != nil {
+		t.FailNow()
+	}
+
+	published := c.published["elasticIndexingQueue.dead-letter"]
+	if len(published) != 1 || string(published[0].Body) != string(msg.Body) || published[0].Headers[retryCountHeader] != int64(0) {
+		t.Errorf("wrong dead-lettered message: %v", c.published)
+	}
+}
+
+func TestRawMessage_Retry_NoDelivery(t *testing.T) {
+	if err := (RawMessage{}).Retry(); err != nil {
+		t.Fail()
+	}
+}
+
+func TestRawMessage_DeadLetter_NoDelivery(t *testing.T) {
+	if err := (RawMessage{}).DeadLetter(); err != nil {
+		t.Fail()
+	}
+}
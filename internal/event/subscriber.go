@@ -2,20 +2,168 @@ package event
 
 import (
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"github.com/streadway/amqp"
+	"runtime/debug"
+	"time"
 )
 
+// ErrAckDeferred is returned by an handler to indicate that it will acknowledge the message by itself
+// (using RawMessage.Ack / RawMessage.Nack) once it has been processed
+var ErrAckDeferred = errors.New("acknowledgment deferred")
+
+// recoveredPanics is the number of panics recovered while handling the messages
+var recoveredPanics = expvar.NewInt("event.recovered-panics")
+
 // RawMessage is a raw message as viewed by the messaging system
 type RawMessage struct {
 	Body    []byte
 	Headers map[string]interface{}
+
+	delivery *amqp.Delivery
+	retrier  *retrier
+
+	// queue & delivered are used to observe the handling duration once the message is acknowledged,
+	// when the handler has returned ErrAckDeferred (see handleObserved)
+	queue     string
+	delivered time.Time
+}
+
+// NewRawMessage returns the message of given delivery, as consumed without retry policy
+func NewRawMessage(delivery *amqp.Delivery) RawMessage {
+	return RawMessage{Body: delivery.Body, Headers: delivery.Headers, delivery: delivery}
+}
+
+// Ack acknowledge the message. It should only be used when the handler has returned ErrAckDeferred
+func (msg RawMessage) Ack() error {
+	msg.observe(successOutcome)
+	return msg.ack()
+}
+
+// Nack reject the message, requeuing it if wanted. It should only be used when the handler has returned ErrAckDeferred
+func (msg RawMessage) Nack(requeue bool) error {
+	if requeue {
+		msg.observe(requeuedOutcome)
+	} else {
+		msg.observe(errorOutcome)
+	}
+	return msg.nack(requeue)
+}
+
+// Retry acknowledge the message and deliver it again to its queue after a delay growing with the number of retries.
+// Once the maximum number of retries is reached the message is moved to the dead-letter queue instead.
+// Messages consumed without retry policy are requeued. It should only be used when the handler has returned ErrAckDeferred
+func (msg RawMessage) Retry() error {
+	msg.observe(errorOutcome)
+
+	if msg.delivery == nil {
+		return nil
+	}
+
+	if msg.retrier == nil {
+		return msg.nack(true)
+	}
+
+	if err := msg.retrier.retry(msg); err != nil {
+		// Do not lose the message
+		if nackErr := msg.nack(true); nackErr != nil {
+			log.Err(nackErr).Msg("error while rejecting event")
+		}
+		return err
+	}
+
+	return msg.ack()
+}
+
+// LastRetry returns true if Retry would move the message to the dead-letter queue, its maximum number of retries
+// being reached. It is always false for the messages consumed without retry policy, since they are requeued
+func (msg RawMessage) LastRetry() bool {
+	return msg.retrier != nil && retryCount(msg.Headers)+1 > msg.retrier.policy.MaxRetries
+}
+
+// DeadLetter acknowledge the message and move it to the dead-letter queue without retrying it.
+// Messages consumed without retry policy are rejected. It should only be used when the handler has returned ErrAckDeferred
+func (msg RawMessage) DeadLetter() error {
+	msg.observe(errorOutcome)
+
+	if msg.delivery == nil {
+		return nil
+	}
+
+	if msg.retrier == nil {
+		return msg.nack(false)
+	}
+
+	if err := msg.retrier.deadLetter(msg); err != nil {
+		// Do not lose the message
+		if nackErr := msg.nack(true); nackErr != nil {
+			log.Err(nackErr).Msg("error while rejecting event")
+		}
+		return err
+	}
+
+	return msg.ack()
+}
+
+func (msg RawMessage) ack() error {
+	if msg.delivery == nil {
+		return nil
+	}
+
+	return msg.delivery.Ack(false)
+}
+
+func (msg RawMessage) nack(requeue bool) error {
+	if msg.delivery == nil {
+		return nil
+	}
+
+	return msg.delivery.Nack(false, requeue)
 }
 
 // Handler represent an event handler
 type Handler func(Subscriber, RawMessage) error
 
+// Handle run given handler like the subscribers do, recovering its panics (see handle).
+// It should be used by the handlers processing the messages in their own goroutines
+func Handle(s Subscriber, handler Handler, msg RawMessage) error {
+	return handle(s, handler, msg)
+}
+
+// handle call handler with given message, recovering from a panic instead of crashing the process.
+// The message of a panicking handler is retried (and dead-lettered after repeated panics, see RawMessage.Retry)
+// if consumed with a retry policy, otherwise it is rejected
+func handle(s Subscriber, handler Handler, msg RawMessage) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		recoveredPanics.Add(1)
+		log.Error().
+			Str("panic", fmt.Sprint(r)).
+			Str("stack", string(debug.Stack())).
+			Msg("recovered panic while processing event")
+
+		if msg.retrier != nil {
+			err = msg.Retry()
+		} else {
+			err = msg.Nack(false)
+		}
+		if err != nil {
+			log.Err(err).Msg("error while rejecting event")
+		}
+
+		err = ErrAckDeferred
+	}()
+
+	return handler(s, msg)
+}
+
 // Subscriber is something that read msg from an event queue
 type Subscriber interface {
 	Publisher
@@ -26,17 +174,45 @@ type Subscriber interface {
 	// Subscribe to named exchange with unique consuming guaranty
 	Subscribe(exchange, queue string, handler Handler) error
 
+	// SubscribeWithRetry subscribe to named exchange with unique consuming guaranty,
+	// the messages being retried (see RawMessage.Retry) using given policy
+	SubscribeWithRetry(exchange, queue string, policy RetryPolicy, handler Handler) error
+
 	// SubscribeAll subscribe to given exchange but ensure everyone on the exchange receive the messages
 	SubscribeAll(exchange string, handler Handler) error
+
+	// ReplayDeadLetters publish back to given queue the messages of its dead-letter queue,
+	// and returns the number of messages replayed
+	ReplayDeadLetters(queue string, opts ReplayOptions) (int, error)
+}
+
+// qosSetter is the part of the channel used to configure the prefetch
+type qosSetter interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
 }
 
 // Subscriber represent a subscriber
 type subscriber struct {
+	// publisher publish the messages on the subscriber channel
+	*publisher
 	channel *amqp.Channel
 }
 
+// confirmedChannel is a channel publishing its messages through the publisher, so that they are confirmed
+// in confirm mode (i.e: the retried and the replayed messages)
+type confirmedChannel struct {
+	*amqp.Channel
+	publisher *publisher
+}
+
+func (c confirmedChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return c.publisher.publish(exchange, key, mandatory, immediate, msg)
+}
+
 // NewSubscriber create a new subscriber and connect it to given server
-func NewSubscriber(amqpURI string, prefetch int) (Subscriber, error) {
+// prefetch is the maximum number of unacknowledged messages held by each consumer,
+// the messages published by the subscriber (i.e: from the handlers) use given options
+func NewSubscriber(amqpURI string, prefetch int, opts PublisherOptions) (Subscriber, error) {
 	conn, err := amqp.Dial(amqpURI)
 	if err != nil {
 		return nil, err
@@ -46,35 +222,34 @@ func NewSubscriber(amqpURI string, prefetch int) (Subscriber, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := c.Qos(prefetch, 0, false); err != nil {
+	if err := setPrefetch(c, prefetch); err != nil {
+		return nil, err
+	}
+
+	p, err := newPublisher(c, opts)
+	if err != nil {
 		return nil, err
 	}
 
 	return &subscriber{
-		channel: c,
+		publisher: p,
+		channel:   c,
 	}, nil
 }
 
-func (s *subscriber) PublishEvent(event Event) error {
-	evtBytes, err := json.Marshal(event)
-	if err != nil {
-		return fmt.Errorf("error while encoding event: %s", err)
+// setPrefetch apply given prefetch to the channel consumers
+func setPrefetch(c qosSetter, prefetch int) error {
+	// A prefetch of 0 means unlimited for the broker, which would let a consumer hold the whole queue
+	if prefetch < 1 {
+		return fmt.Errorf("invalid prefetch %d: should be at least 1", prefetch)
 	}
 
-	return s.PublishJSON(event.Exchange(), RawMessage{Body: evtBytes})
-}
-
-func (s *subscriber) PublishJSON(exchange string, msg RawMessage) error {
-	return s.channel.Publish(exchange, "", false, false, amqp.Publishing{
-		ContentType:  "application/json",
-		Body:         msg.Body,
-		DeliveryMode: amqp.Persistent,
-		Headers:      msg.Headers,
-	})
+	return c.Qos(prefetch, 0, false)
 }
 
-func (s *subscriber) Close() error {
-	return s.channel.Close()
+// confirmedChannel returns the subscriber channel, publishing through the subscriber publisher
+func (s *subscriber) confirmedChannel() confirmedChannel {
+	return confirmedChannel{Channel: s.channel, publisher: s.publisher}
 }
 
 func (s *subscriber) Read(msg *RawMessage, event Event) error {
@@ -86,6 +261,14 @@ func (s *subscriber) Read(msg *RawMessage, event Event) error {
 }
 
 func (s *subscriber) Subscribe(exchange, queue string, handler Handler) error {
+	return s.subscribe(exchange, queue, nil, handler)
+}
+
+func (s *subscriber) SubscribeWithRetry(exchange, queue string, policy RetryPolicy, handler Handler) error {
+	return s.subscribe(exchange, queue, &retrier{channel: s.confirmedChannel(), queue: queue, policy: policy}, handler)
+}
+
+func (s *subscriber) subscribe(exchange, queue string, r *retrier, handler Handler) error {
 	// First of all declare the exchange
 	if err := s.channel.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
 		return err
@@ -110,11 +293,19 @@ func (s *subscriber) Subscribe(exchange, queue string, handler Handler) error {
 
 	go func() {
 		for delivery := range deliveries {
+			delivery := delivery
 			msg := RawMessage{
-				Body:    delivery.Body,
-				Headers: delivery.Headers,
+				Body:     delivery.Body,
+				Headers:  delivery.Headers,
+				delivery: &delivery,
+				retrier:  r,
 			}
-			if err := handler(s, msg); err != nil {
+			if err := handleObserved(s, queue, handler, msg); err != nil {
+				// The handler will take care of the acknowledgment
+				if errors.Is(err, ErrAckDeferred) {
+					continue
+				}
+
 				log.Err(err).Msg("error while processing event")
 			}
 
@@ -128,6 +319,10 @@ func (s *subscriber) Subscribe(exchange, queue string, handler Handler) error {
 	return nil
 }
 
+func (s *subscriber) ReplayDeadLetters(queue string, opts ReplayOptions) (int, error) {
+	return replayDeadLetters(s.confirmedChannel(), queue, opts)
+}
+
 func (s *subscriber) SubscribeAll(exchange string, handler Handler) error {
 	// First of all declare the exchange
 	if err := s.channel.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
@@ -157,7 +352,7 @@ func (s *subscriber) SubscribeAll(exchange string, handler Handler) error {
 				Body:    delivery.Body,
 				Headers: delivery.Headers,
 			}
-			if err := handler(s, msg); err != nil {
+			if err := handleObserved(s, exchange, handler, msg); err != nil && !errors.Is(err, ErrAckDeferred) {
 				log.Err(err).Msg("error while processing event")
 			}
 
@@ -0,0 +1,130 @@
+package event
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+	"time"
+)
+
+type qosRecorder struct {
+	prefetchCount int
+	global        bool
+}
+
+func (q *qosRecorder) Qos(prefetchCount, prefetchSize int, global bool) error {
+	q.prefetchCount = prefetchCount
+	q.global = global
+	return nil
+}
+
+// acknowledgerRecorder record the acknowledgments of a delivery
+type acknowledgerRecorder struct {
+	acked    bool
+	nacked   bool
+	requeued bool
+}
+
+func (a *acknowledgerRecorder) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *acknowledgerRecorder) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked = true
+	a.requeued = requeue
+	return nil
+}
+
+func (a *acknowledgerRecorder) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func panickingHandler(Subscriber, RawMessage) error {
+	panic("nil map")
+}
+
+func TestSetPrefetch(t *testing.T) {
+	c := &qosRecorder{}
+	if err := setPrefetch(c, 20); err != nil {
+		t.FailNow()
+	}
+
+	if c.prefetchCount != 20 {
+		t.Errorf("got %d want %d", c.prefetchCount, 20)
+	}
+	if c.global {
+		t.Errorf("prefetch should be applied per consumer")
+	}
+}
+
+func TestSetPrefetch_Invalid(t *testing.T) {
+	for _, prefetch := range []int{0, -1} {
+		c := &qosRecorder{}
+		if err := setPrefetch(c, prefetch); err == nil {
+			t.Errorf("prefetch %d should have been rejected", prefetch)
+		}
+		if c.prefetchCount != 0 {
+			t.Errorf("prefetch %d should not have been applied", prefetch)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	handler := func(Subscriber, RawMessage) error { return errors.New("invalid event") }
+
+	if err := handle(nil, handler, RawMessage{}); err == nil || err.Error() != "invalid event" {
+		t.Errorf("got %v want handler error", err)
+	}
+}
+
+func TestHandle_Panic(t *testing.T) {
+	ack := &acknowledgerRecorder{}
+	msg := RawMessage{delivery: &amqp.Delivery{Acknowledger: ack}}
+
+	count := recoveredPanics.Value()
+
+	// The panic should be recovered & the message rejected
+	if err := handle(nil, panickingHandler, msg); !errors.Is(err, ErrAckDeferred) {
+		t.Errorf("got %v want %v", err, ErrAckDeferred)
+	}
+
+	if !ack.nacked || ack.requeued || ack.acked {
+		t.Errorf("message should have been rejected: %+v", ack)
+	}
+	if recoveredPanics.Value() != count+1 {
+		t.Errorf("recovered panic not counted")
+	}
+}
+
+func TestHandle_PanicRetry(t *testing.T) {
+	ack := &acknowledgerRecorder{}
+	c := &queueChannelMock{queues: map[string]amqp.Table{}, published: map[string][]amqp.Publishing{}}
+	msg := RawMessage{
+		delivery: &amqp.Delivery{Acknowledger: ack},
+		retrier:  &retrier{channel: c, queue: "elasticIndexingQueue", policy: RetryPolicy{MaxRetries: 2, Delay: 10 * time.Second}},
+	}
+
+	// The message should be retried
+	if err := handle(nil, panickingHandler, msg); !errors.Is(err, ErrAckDeferred) {
+		t.Errorf("got %v want %v", err, ErrAckDeferred)
+	}
+
+	if len(c.published["elasticIndexingQueue.retry-10s"]) != 1 || !ack.acked {
+		t.Errorf("message should have been retried: %v", c.published)
+	}
+}
+
+func TestRawMessage_LastRetry(t *testing.T) {
+	r := &retrier{queue: "crawlingQueue", policy: RetryPolicy{MaxRetries: 2, Delay: 10 * time.Second}}
+
+	if (RawMessage{}).LastRetry() {
+		t.Error("message without retry policy should be requeued")
+	}
+	if (RawMessage{retrier: r, Headers: map[string]interface{}{retryCountHeader: int64(1)}}).LastRetry() {
+		t.Error("message should be retried")
+	}
+	if !(RawMessage{retrier: r, Headers: map[string]interface{}{retryCountHeader: int64(2)}}).LastRetry() {
+		t.Error("message should be dead-lettered")
+	}
+}
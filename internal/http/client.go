@@ -3,60 +3,400 @@ package http
 //go:generate mockgen -destination=../http_mock/client_mock.go -package=http_mock . Client
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/valyala/fasthttp"
+	"golang.org/x/net/proxy"
+	"net"
 	"strings"
+	"time"
 )
 
-// ErrTimeout is returned when the crawling failed because of timeout issue
-var ErrTimeout = errors.New("timeout has occurred")
+const (
+	// DefaultMaxConnsPerHost is the default maximum number of connections per host.
+	// Hidden services are slow to respond and each connection goes through a TOR circuit,
+	// therefore it's better to keep this value low.
+	DefaultMaxConnsPerHost = 16
+	// DefaultMaxIdleConnDuration is the default duration after which an idle connection is closed.
+	// Building a TOR circuit is expensive, therefore idle connections are kept longer than usual.
+	DefaultMaxIdleConnDuration = 30 * time.Second
+	// DefaultDialTimeout is the default maximum duration of the connection establishment.
+	// It includes the opening of the TOR circuit, which is slow, hence the large value.
+	DefaultDialTimeout = 30 * time.Second
+	// DefaultReadTimeout is the default maximum duration of the response reading
+	DefaultReadTimeout = 5 * time.Second
+	// DefaultMaxRedirectHosts is the default maximum number of distinct hosts a redirect chain may go through.
+	// Redirects bouncing across many hosts are often used to launder malicious links
+	DefaultMaxRedirectHosts = 3
+	// DefaultMaxRequestDuration is the default maximum duration of a request, from the connection establishment
+	// to the end of the response reading (redirects included). It bounds the time spent on the slowly streamed responses
+	DefaultMaxRequestDuration = time.Minute
+)
 
 // Client is an HTTP client
 type Client interface {
 	// Get the corresponding URL
 	// this methods follows redirections
 	Get(URL string) (Response, error)
+
+	// GetIfModified get the corresponding URL using the validators of a previous response
+	// (empty validators are not sent). ErrNotModified is returned if the resource has not changed
+	GetIfModified(URL string, etag, lastModified string) (Response, error)
+
+	// Post given body to the corresponding URL
+	// redirections are followed using GET requests
+	Post(URL string, contentType string, body []byte) (Response, error)
+
+	// WithHeaders returns a Client sending given headers along with each request
+	// (in addition to the headers of the current one)
+	WithHeaders(headers map[string]string) Client
+}
+
+// HostMappingFunc returns the addresses (host or host:port) to dial instead of the hostnames
+type HostMappingFunc func() (map[string]string, error)
+
+// Options are the options used to build a Client
+type Options struct {
+	// ProxyURI is the URI of the SOCKS proxy used to reach the hidden services
+	ProxyURI string
+	// ProxyUsername is the username used to authenticate against the SOCKS proxy (if any)
+	ProxyUsername string
+	// ProxyPassword is the password used to authenticate against the SOCKS proxy (if any)
+	ProxyPassword string
+	// UserAgent is the user agent used when performing the requests
+	UserAgent string
+	// DialTimeout is the maximum duration of the connection establishment (through the SOCKS proxy),
+	// ErrConnectTimeout is returned once elapsed
+	DialTimeout time.Duration
+	// ReadTimeout is the maximum duration of the response reading (and of the request writing),
+	// ErrReadTimeout is returned once elapsed
+	ReadTimeout time.Duration
+	// MaxConnsPerHost is the maximum number of connections (idle or not) per host.
+	// Connections are pooled per host, there is no global limit on idle connections
+	MaxConnsPerHost int
+	// MaxIdleConnDuration is the duration after which an idle connection is closed
+	MaxIdleConnDuration time.Duration
+	// HostMapping override the address dialed to reach some hostnames (evaluated before each dial).
+	// The mapped addresses are dialed directly, unless they are hidden services
+	HostMapping HostMappingFunc
+	// MinTLSVersion returns the minimum TLS version of the clearnet requests (evaluated before each request).
+	// The hidden services are not concerned since their traffic is already encrypted by TOR
+	MinTLSVersion TLSVersionFunc
+	// MaxRedirectHosts is the maximum number of distinct hosts a redirect chain may go through, the requested one
+	// included. ErrTooManyRedirectHosts is returned once exceeded
+	MaxRedirectHosts int
+	// MaxRequestDuration is the maximum duration of a request, redirects included, whatever the progress of the
+	// response reading. ErrMaxRequestDuration is returned once elapsed
+	MaxRequestDuration time.Duration
 }
 
 type client struct {
 	c *fasthttp.Client
+	// tls are the clients enforcing the minimum TLS version (nil if there is none)
+	tls     *tlsClients
+	headers map[string]string
+	// proxyAddress is the address reported by the responses whose connection is unknown
+	proxyAddress string
+	// maxRedirectHosts is the maximum number of distinct hosts a redirect chain may go through
+	maxRedirectHosts int
+	// maxRequestDuration is the maximum duration of a request (no limit if 0)
+	maxRequestDuration time.Duration
+}
+
+// NewClient create a new Client using given options
+func NewClient(opts Options) Client {
+	maxRedirectHosts := opts.MaxRedirectHosts
+	if maxRedirectHosts <= 0 {
+		maxRedirectHosts = DefaultMaxRedirectHosts
+	}
+
+	maxRequestDuration := opts.MaxRequestDuration
+	if maxRequestDuration <= 0 {
+		maxRequestDuration = DefaultMaxRequestDuration
+	}
+
+	c := &client{c: newFastHTTPClient(opts), proxyAddress: opts.ProxyURI, maxRedirectHosts: maxRedirectHosts,
+		maxRequestDuration: maxRequestDuration}
+	if opts.MinTLSVersion != nil {
+		c.tls = newTLSClients(c.c, opts.MinTLSVersion)
+	}
+
+	return c
 }
 
 // NewFastHTTPClient create a new Client using fasthttp.Client as backend
 func NewFastHTTPClient(c *fasthttp.Client) Client {
-	return &client{c: c}
+	return &client{c: c, maxRedirectHosts: DefaultMaxRedirectHosts}
+}
+
+func newFastHTTPClient(opts Options) *fasthttp.Client {
+	maxConnsPerHost := opts.MaxConnsPerHost
+	if maxConnsPerHost <= 0 {
+		maxConnsPerHost = DefaultMaxConnsPerHost
+	}
+
+	maxIdleConnDuration := opts.MaxIdleConnDuration
+	if maxIdleConnDuration <= 0 {
+		maxIdleConnDuration = DefaultMaxIdleConnDuration
+	}
+
+	readTimeout := opts.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = DefaultReadTimeout
+	}
+
+	return &fasthttp.Client{
+		// Use given TOR proxy to reach the hidden services
+		Dial: mappedDialer(opts, socksDialer(opts)),
+		// Disable SSL verification since we do not really care about this
+		TLSConfig:           &tls.Config{InsecureSkipVerify: true},
+		ReadTimeout:         readTimeout,
+		WriteTimeout:        readTimeout,
+		Name:                opts.UserAgent,
+		MaxConnsPerHost:     maxConnsPerHost,
+		MaxIdleConnDuration: maxIdleConnDuration,
+	}
 }
 
 func (c *client) Get(URL string) (Response, error) {
 	req := fasthttp.AcquireRequest()
-	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseRequest(req)
-	defer fasthttp.ReleaseResponse(resp)
 
 	req.SetRequestURI(URL)
 
-	if err := c.c.Do(req, resp); err != nil {
-		// TODO better
-		if strings.Contains(err.Error(), "unknown error TTL expired") {
-			return nil, ErrTimeout
+	return c.do(req)
+}
+
+func (c *client) GetIfModified(URL string, etag, lastModified string) (Response, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.SetRequestURI(URL)
+	if etag != "" {
+		req.Header.Set(fasthttp.HeaderIfNoneMatch, etag)
+	}
+	if lastModified != "" {
+		req.Header.Set(fasthttp.HeaderIfModifiedSince, lastModified)
+	}
+
+	return c.do(req)
+}
+
+func (c *client) Post(URL string, contentType string, body []byte) (Response, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.SetRequestURI(URL)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType(contentType)
+	req.SetBody(body)
+
+	return c.do(req)
+}
+
+func (c *client) WithHeaders(headers map[string]string) Client {
+	merged := make(map[string]string, len(c.headers)+len(headers))
+	for key, value := range c.headers {
+		merged[key] = value
+	}
+	for key, value := range headers {
+		merged[key] = value
+	}
+
+	return &client{c: c.c, tls: c.tls, headers: merged, proxyAddress: c.proxyAddress, maxRedirectHosts: c.maxRedirectHosts,
+		maxRequestDuration: c.maxRequestDuration}
+}
+
+func (c *client) do(req *fasthttp.Request) (Response, error) {
+	var deadline time.Time
+	if c.maxRequestDuration > 0 {
+		deadline = time.Now().Add(c.maxRequestDuration)
+	}
+
+	return c.doRedirects(req, []string{strings.ToLower(string(req.URI().Host()))}, deadline)
+}
+
+// doRedirects perform given request, following the redirections. hosts are the distinct hosts
+// the redirect chain went through, and deadline the time by which the whole chain must be done (if not zero)
+func (c *client) doRedirects(req *fasthttp.Request, hosts []string, deadline time.Time) (Response, error) {
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+
+	fc := c.c
+	if c.tls != nil {
+		tc, err := c.tls.clientFor(req.URI())
+		if err != nil {
+			return nil, err
 		}
+		fc = tc
+	}
 
-		return nil, err
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := doDeadline(fc, req, resp, deadline); err != nil {
+		return nil, wrapError(err)
 	}
 
 	switch code := resp.StatusCode(); {
+	case code == 304:
+		return nil, ErrNotModified
 	case code > 302:
-		return nil, fmt.Errorf("non-managed error code %d", code)
+		return nil, &StatusError{Code: code}
 	// follow redirect
 	case code == 301 || code == 302:
-		if location := string(resp.Header.Peek("Location")); location != "" {
-			return c.Get(location)
+		if location := resp.Header.Peek("Location"); len(location) > 0 {
+			return c.redirect(req.URI(), location, hosts, deadline)
 		}
 	}
 
-	r := &response{}
+	r := &response{via: via(resp, c.proxyAddress)}
 	resp.CopyTo(&r.raw)
 
 	return r, nil
 }
+
+// redirect get given location (resolved against the URI of the redirected request)
+func (c *client) redirect(from *fasthttp.URI, location []byte, hosts []string, deadline time.Time) (Response, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	from.CopyTo(req.URI())
+	req.URI().UpdateBytes(location)
+
+	host := strings.ToLower(string(req.URI().Host()))
+	if !containsHost(hosts, host) {
+		hosts = append(hosts, host)
+		if len(hosts) > c.maxRedirectHosts {
+			return nil, &RequestError{Kind: ErrTooManyRedirectHosts, Err: fmt.Errorf("redirected through %s", strings.Join(hosts, ", "))}
+		}
+	}
+
+	return c.doRedirects(req, hosts, deadline)
+}
+
+// doDeadline perform given request, returning ErrMaxRequestDuration if the response has not been entirely received
+// before given deadline (if not zero). The request is abandoned, not aborted: it keeps its connection until the read timeout
+func doDeadline(fc *fasthttp.Client, req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	if deadline.IsZero() {
+		return fc.Do(req, resp)
+	}
+
+	err := fc.DoDeadline(req, resp, deadline)
+	// The read timeout is reported the same way
+	if errors.Is(err, fasthttp.ErrTimeout) && !time.Now().Before(deadline) {
+		return &RequestError{Kind: ErrMaxRequestDuration, Err: err}
+	}
+
+	return err
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func socksDialer(opts Options) fasthttp.DialFunc {
+	var auth *proxy.Auth
+	if opts.ProxyUsername != "" {
+		auth = &proxy.Auth{User: opts.ProxyUsername, Password: opts.ProxyPassword}
+	}
+
+	dialTimeout := opts.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", opts.ProxyURI, auth, proxy.Direct)
+
+	return func(addr string) (net.Conn, error) {
+		if err != nil {
+			return nil, err
+		}
+
+		return dialContext(dialer, addr, dialTimeout)
+	}
+}
+
+// dialContext dial given address using given dialer, returning ErrConnectTimeout if the connection
+// has not been established before timeout elapsed
+func dialContext(dialer proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	ctxDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return dialer.Dial("tcp", addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := ctxDialer.DialContext(ctx, "tcp", addr)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, &RequestError{Kind: ErrConnectTimeout, Err: err}
+	}
+
+	return conn, err
+}
+
+// mappedDialer returns a dialer applying the host mapping before dialing. The mapped addresses are dialed directly,
+// the other ones (and the mapped hidden services) using given dialer
+func mappedDialer(opts Options, dial fasthttp.DialFunc) fasthttp.DialFunc {
+	if opts.HostMapping == nil {
+		return dial
+	}
+
+	dialTimeout := opts.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+
+	return func(addr string) (net.Conn, error) {
+		mapping, err := opts.HostMapping()
+		if err != nil {
+			return nil, err
+		}
+
+		target, mapped := mapAddress(mapping, addr)
+		if !mapped || isHiddenService(target) {
+			return dial(target)
+		}
+
+		return dialContext(proxy.Direct, target, dialTimeout)
+	}
+}
+
+// mapAddress returns the address mapped to the host of given one (the port is kept if the mapping has none)
+func mapAddress(mapping map[string]string, addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false
+	}
+
+	target, exists := mapping[strings.ToLower(host)]
+	if !exists {
+		return addr, false
+	}
+
+	// The port is part of the mapping
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target, true
+	}
+
+	return net.JoinHostPort(target, port), true
+}
+
+func isHiddenService(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
@@ -0,0 +1,517 @@
+package http
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/valyala/fasthttp"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewFastHTTPClient(t *testing.T) {
+	c := newFastHTTPClient(Options{
+		ProxyURI:            "torproxy:9050",
+		UserAgent:           "bathyscaphe",
+		DialTimeout:         10 * time.Second,
+		ReadTimeout:         5 * time.Second,
+		MaxConnsPerHost:     4,
+		MaxIdleConnDuration: time.Minute,
+	})
+
+	if c.MaxConnsPerHost != 4 {
+		t.Errorf("wrong max conns per host: got %d want %d", c.MaxConnsPerHost, 4)
+	}
+	if c.MaxIdleConnDuration != time.Minute {
+		t.Errorf("wrong max idle conn duration: got %s want %s", c.MaxIdleConnDuration, time.Minute)
+	}
+	if c.ReadTimeout != 5*time.Second || c.WriteTimeout != 5*time.Second {
+		t.Fail()
+	}
+	if c.Name != "bathyscaphe" {
+		t.Fail()
+	}
+	if c.Dial == nil {
+		t.Fail()
+	}
+}
+
+func TestNewFastHTTPClient_Defaults(t *testing.T) {
+	c := newFastHTTPClient(Options{})
+
+	if c.MaxConnsPerHost != DefaultMaxConnsPerHost {
+		t.Errorf("wrong max conns per host: got %d want %d", c.MaxConnsPerHost, DefaultMaxConnsPerHost)
+	}
+	if c.MaxIdleConnDuration != DefaultMaxIdleConnDuration {
+		t.Errorf("wrong max idle conn duration: got %s want %s", c.MaxIdleConnDuration, DefaultMaxIdleConnDuration)
+	}
+}
+
+func TestClient_Post(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		_ = r.ParseForm()
+		_, _ = w.Write([]byte("Results for " + r.PostForm.Get("q")))
+	}))
+	defer srv.Close()
+
+	c := NewFastHTTPClient(&fasthttp.Client{})
+
+	r, err := c.Post(srv.URL, "application/x-www-form-urlencoded", []byte("q=market"))
+	if err != nil {
+		t.Fatalf("error while posting URL: %s", err)
+	}
+
+	b, err := ioutil.ReadAll(r.Body())
+	if err != nil {
+		t.FailNow()
+	}
+	if string(b) != "Results for market" {
+		t.Errorf("got %s want %s", string(b), "Results for market")
+	}
+}
+
+func TestClient_GetIfModified(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` || r.Header.Get("If-Modified-Since") == "Wed, 10 Mar 2021 12:00:00 GMT" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v2"`)
+		_, _ = w.Write([]byte("Hello"))
+	}))
+	defer srv.Close()
+
+	c := NewFastHTTPClient(&fasthttp.Client{})
+
+	if _, err := c.GetIfModified(srv.URL, `"v1"`, ""); err != ErrNotModified {
+		t.Errorf("got %v want %v", err, ErrNotModified)
+	}
+	if _, err := c.GetIfModified(srv.URL, "", "Wed, 10 Mar 2021 12:00:00 GMT"); err != ErrNotModified {
+		t.Errorf("got %v want %v", err, ErrNotModified)
+	}
+
+	r, err := c.GetIfModified(srv.URL, `"v0"`, "")
+	if err != nil {
+		t.Fatalf("error while getting URL: %s", err)
+	}
+	if got := r.Headers()["Etag"]; got != `"v2"` {
+		t.Errorf("got %s want %s", got, `"v2"`)
+	}
+}
+
+func TestClient_WithHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language") + "|" + r.Header.Get("X-Test")))
+	}))
+	defer srv.Close()
+
+	c := NewFastHTTPClient(&fasthttp.Client{})
+
+	tests := []struct {
+		client Client
+		want   string
+	}{
+		{c, "|"},
+		{c.WithHeaders(map[string]string{"Accept-Language": "en"}), "en|"},
+		{c.WithHeaders(map[string]string{"Accept-Language": "en", "X-Test": "1"}).
+			WithHeaders(map[string]string{"Accept-Language": "fr"}), "fr|1"},
+	}
+
+	for _, test := range tests {
+		r, err := test.client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("error while getting URL: %s", err)
+		}
+
+		b, err := ioutil.ReadAll(r.Body())
+		if err != nil {
+			t.FailNow()
+		}
+
+		if string(b) != test.want {
+			t.Errorf("got %s want %s", b, test.want)
+		}
+	}
+}
+
+func TestClient_ReadTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	c := NewFastHTTPClient(&fasthttp.Client{ReadTimeout: 50 * time.Millisecond})
+
+	_, err := c.Get(srv.URL)
+	if !errors.Is(err, ErrReadTimeout) || !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v want %v", err, ErrReadTimeout)
+	}
+}
+
+// blockingDialer is a proxy.ContextDialer never establishing the connection
+type blockingDialer struct{}
+
+func (d blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d blockingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClient_ConnectTimeout(t *testing.T) {
+	c := NewFastHTTPClient(&fasthttp.Client{
+		Dial: func(addr string) (net.Conn, error) {
+			return dialContext(blockingDialer{}, addr, 50*time.Millisecond)
+		},
+	})
+
+	_, err := c.Get("http://example.onion")
+	if !errors.Is(err, ErrConnectTimeout) || !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v want %v", err, ErrConnectTimeout)
+	}
+	if errors.Is(err, ErrReadTimeout) {
+		t.Errorf("connect timeout should not be a read timeout")
+	}
+}
+
+func TestClient_GetAuthenticatedProxy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello, world"))
+	}))
+	defer srv.Close()
+
+	proxyAddr, stop := startSocks5Server(t, "bathyscaphe", "secret")
+	defer stop()
+
+	c := NewClient(Options{ProxyURI: proxyAddr, ProxyUsername: "bathyscaphe", ProxyPassword: "secret", ReadTimeout: 5 * time.Second})
+
+	r, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("error while getting URL: %s", err)
+	}
+
+	b, err := ioutil.ReadAll(r.Body())
+	if err != nil {
+		t.FailNow()
+	}
+	if string(b) != "Hello, world" {
+		t.Errorf("got %s want %s", string(b), "Hello, world")
+	}
+
+	// The response has been served by the proxy
+	if r.Via() != proxyAddr {
+		t.Errorf("got %s want %s", r.Via(), proxyAddr)
+	}
+
+	// Wrong credentials should be rejected
+	c = NewClient(Options{ProxyURI: proxyAddr, ProxyUsername: "bathyscaphe", ProxyPassword: "wrong", ReadTimeout: 5 * time.Second})
+	if _, err := c.Get(srv.URL); err == nil {
+		t.Error("request should have failed")
+	}
+}
+
+func TestVia_ProxyAddressFallback(t *testing.T) {
+	// The connection is unknown, the proxy address is used instead
+	if got := via(&fasthttp.Response{}, "torproxy:9050"); got != "torproxy:9050" {
+		t.Errorf("got %s want %s", got, "torproxy:9050")
+	}
+}
+
+// startSocks5Server start a minimal SOCKS5 server (CONNECT only) requiring username/password authentication
+func startSocks5Server(t *testing.T, username, password string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go handleSocks5Conn(conn, username, password)
+		}
+	}()
+
+	return l.Addr().String(), func() { _ = l.Close() }
+}
+
+func handleSocks5Conn(conn net.Conn, username, password string) {
+	defer conn.Close()
+
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+
+	// Require username/password authentication
+	if _, err := conn.Write([]byte{0x05, 0x02}); err != nil {
+		return
+	}
+
+	// Auth: VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return
+	}
+	passLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passLen); err != nil {
+		return
+	}
+	pass := make([]byte, passLen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return
+	}
+
+	if string(user) != username || string(pass) != password {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		hostLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, hostLen); err != nil {
+			return
+		}
+		hostname := make([]byte, hostLen[0])
+		if _, err := io.ReadFull(conn, hostname); err != nil {
+			return
+		}
+		host = string(hostname)
+	default:
+		return
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		_, _ = conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+
+	if _, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(target, conn)
+	}()
+	_, _ = io.Copy(conn, target)
+}
+
+func TestClient_HostMapping(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello from " + r.Host))
+	}))
+	defer srv.Close()
+
+	// The proxy is not reachable: only the mapped hostnames can be reached
+	c := NewClient(Options{
+		ProxyURI:    "127.0.0.1:1",
+		DialTimeout: time.Second,
+		HostMapping: func() (map[string]string, error) {
+			return map[string]string{"example.onion": srv.Listener.Addr().String()}, nil
+		},
+	})
+
+	r, err := c.Get("http://example.onion/index.php")
+	if err != nil {
+		t.Fatalf("error while getting URL: %s", err)
+	}
+
+	b, err := ioutil.ReadAll(r.Body())
+	if err != nil {
+		t.FailNow()
+	}
+	if string(b) != "Hello from example.onion" {
+		t.Errorf("got %s want %s", string(b), "Hello from example.onion")
+	}
+
+	if _, err := c.Get("http://other.onion/index.php"); err == nil {
+		t.Error("unmapped hostname should be dialed using the proxy")
+	}
+}
+
+func TestMappedDialer(t *testing.T) {
+	mapping := map[string]string{"mirror.onion": "example.onion", "example.org": "example.onion:8080"}
+
+	var dialed []string
+	dial := mappedDialer(Options{HostMapping: func() (map[string]string, error) {
+		return mapping, nil
+	}}, func(addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, nil
+	})
+
+	for _, addr := range []string{"mirror.onion:80", "example.org:443", "unmapped.onion:80"} {
+		if _, err := dial(addr); err != nil {
+			t.Errorf("%s: %s", addr, err)
+		}
+	}
+
+	// The mapped hidden services should still be dialed using the proxy
+	want := []string{"example.onion:80", "example.onion:8080", "unmapped.onion:80"}
+	if !reflect.DeepEqual(dialed, want) {
+		t.Errorf("got %v want %v", dialed, want)
+	}
+}
+
+func TestMapAddress(t *testing.T) {
+	mapping := map[string]string{"example.onion": "127.0.0.1", "mirror.onion": "10.0.0.1:8080"}
+
+	tests := []struct {
+		addr   string
+		want   string
+		mapped bool
+	}{
+		{"example.onion:80", "127.0.0.1:80", true},
+		{"EXAMPLE.onion:443", "127.0.0.1:443", true},
+		{"mirror.onion:80", "10.0.0.1:8080", true},
+		{"other.onion:80", "other.onion:80", false},
+		{"example.onion", "example.onion", false},
+	}
+
+	for _, tst := range tests {
+		got, mapped := mapAddress(mapping, tst.addr)
+		if got != tst.want || mapped != tst.mapped {
+			t.Errorf("%s: got (%s, %v) want (%s, %v)", tst.addr, got, mapped, tst.want, tst.mapped)
+		}
+	}
+}
+
+func TestClient_MaxRequestDuration(t *testing.T) {
+	// The response is streamed slowly, each chunk being received well within the read timeout
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "20")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 20; i++ {
+			_, _ = w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+			time.Sleep(25 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient(Options{
+		ProxyURI:    "127.0.0.1:1",
+		ReadTimeout: 5 * time.Second,
+		HostMapping: func() (map[string]string, error) {
+			return map[string]string{"slow.onion": srv.Listener.Addr().String()}, nil
+		},
+		MaxRequestDuration: 100 * time.Millisecond,
+	})
+
+	start := time.Now()
+	_, err := c.Get("http://slow.onion")
+	if !errors.Is(err, ErrMaxRequestDuration) {
+		t.Fatalf("got %v want %v", err, ErrMaxRequestDuration)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("request has lasted %s", elapsed)
+	}
+	if errors.Is(err, ErrTimeout) || err.(Error).Temporary() {
+		t.Error("max request duration error should neither be a timeout nor temporary")
+	}
+}
+
+func TestClient_MaxRedirectHosts(t *testing.T) {
+	// a.onion/start -> a.onion/next -> b.onion -> c.onion -> d.onion
+	redirects := map[string]string{
+		"a.onion/start": "/next",
+		"a.onion/next":  "http://b.onion/",
+		"b.onion/":      "http://c.onion/",
+		"c.onion/":      "http://d.onion/",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if location, exists := redirects[r.Host+r.URL.Path]; exists {
+			http.Redirect(w, r, location, http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("Hello from " + r.Host))
+	}))
+	defer srv.Close()
+
+	newClient := func(maxRedirectHosts int) Client {
+		return NewClient(Options{
+			ProxyURI:    "127.0.0.1:1",
+			DialTimeout: time.Second,
+			HostMapping: func() (map[string]string, error) {
+				addr := srv.Listener.Addr().String()
+				return map[string]string{"a.onion": addr, "b.onion": addr, "c.onion": addr, "d.onion": addr}, nil
+			},
+			MaxRedirectHosts: maxRedirectHosts,
+		})
+	}
+
+	// the chain goes through 4 distinct hosts
+	_, err := newClient(0).Get("http://a.onion/start")
+	if !errors.Is(err, ErrTooManyRedirectHosts) {
+		t.Fatalf("got %v want %v", err, ErrTooManyRedirectHosts)
+	}
+	if err.(Error).Temporary() {
+		t.Error("too many redirect hosts error should not be temporary")
+	}
+
+	r, err := newClient(4).Get("http://a.onion/start")
+	if err != nil {
+		t.Fatalf("error while getting URL: %s", err)
+	}
+	b, err := ioutil.ReadAll(r.Body())
+	if err != nil {
+		t.FailNow()
+	}
+	if string(b) != "Hello from d.onion" {
+		t.Errorf("got %s want %s", string(b), "Hello from d.onion")
+	}
+
+	// the limit includes the requested host
+	if _, err := newClient(3).Get("http://b.onion/"); err != nil {
+		t.Errorf("error while getting URL: %s", err)
+	}
+}
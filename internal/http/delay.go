@@ -0,0 +1,116 @@
+package http
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// delayedHostsPruneThreshold is the number of tracked hostnames after which the hostnames
+// which can be requested right away are forgotten
+const delayedHostsPruneThreshold = 1000
+
+// DelayFunc returns the minimum delay between two requests made to given hostname (0 means no delay)
+type DelayFunc func(hostname string) (time.Duration, error)
+
+type delayedClient struct {
+	client Client
+	*delayer
+}
+
+// delayer is shared by the clients derived from a delayedClient
+type delayer struct {
+	delay DelayFunc
+	now   func() time.Time
+	sleep func(d time.Duration)
+
+	mutex sync.Mutex
+	// next is the time after which each hostname can be requested again
+	next map[string]time.Time
+}
+
+// NewDelayedClient create a Client spacing the requests made to the same hostname using given client.
+// The delay is evaluated before each request, so it may be changed at runtime
+func NewDelayedClient(client Client, delay DelayFunc) Client {
+	return &delayedClient{
+		client: client,
+		delayer: &delayer{
+			delay: delay,
+			now:   time.Now,
+			sleep: time.Sleep,
+			next:  map[string]time.Time{},
+		},
+	}
+}
+
+func (c *delayedClient) Get(URL string) (Response, error) {
+	if err := c.wait(URL); err != nil {
+		return nil, err
+	}
+
+	return c.client.Get(URL)
+}
+
+func (c *delayedClient) GetIfModified(URL string, etag, lastModified string) (Response, error) {
+	if err := c.wait(URL); err != nil {
+		return nil, err
+	}
+
+	return c.client.GetIfModified(URL, etag, lastModified)
+}
+
+func (c *delayedClient) Post(URL string, contentType string, body []byte) (Response, error) {
+	if err := c.wait(URL); err != nil {
+		return nil, err
+	}
+
+	return c.client.Post(URL, contentType, body)
+}
+
+func (c *delayedClient) WithHeaders(headers map[string]string) Client {
+	return &delayedClient{client: c.client.WithHeaders(headers), delayer: c.delayer}
+}
+
+// wait until given URL hostname can be requested, reserving the next request slot of the hostname
+func (d *delayer) wait(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Let the client report the invalid URL
+		return nil
+	}
+	hostname := strings.ToLower(u.Hostname())
+
+	delay, err := d.delay(hostname)
+	if err != nil {
+		return err
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	d.mutex.Lock()
+	now := d.now()
+
+	if len(d.next) >= delayedHostsPruneThreshold {
+		for h, next := range d.next {
+			if !next.After(now) {
+				delete(d.next, h)
+			}
+		}
+	}
+
+	// The request is made at the end of the previous request slot, or right away if it's already over
+	at := now
+	if next, exists := d.next[hostname]; exists && next.After(now) {
+		at = next
+	}
+	d.next[hostname] = at.Add(delay)
+	d.mutex.Unlock()
+
+	if wait := at.Sub(now); wait > 0 {
+		d.sleep(wait)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestDelayer returns a delayer whose clock is frozen, recording its sleeps instead of sleeping
+func newTestDelayer(delay DelayFunc) (*delayer, *[]time.Duration) {
+	now := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+	var sleeps []time.Duration
+
+	return &delayer{
+		delay: delay,
+		now:   func() time.Time { return now },
+		sleep: func(d time.Duration) {
+			sleeps = append(sleeps, d)
+		},
+		next: map[string]time.Time{},
+	}, &sleeps
+}
+
+func TestDelayer_Wait(t *testing.T) {
+	d, sleeps := newTestDelayer(func(hostname string) (time.Duration, error) {
+		if hostname == "fragile.onion" {
+			return time.Minute, nil
+		}
+		return time.Second, nil
+	})
+
+	urls := []string{
+		"https://fragile.onion/a",
+		"https://fragile.onion/b",
+		"https://example.onion/a",
+		"https://FRAGILE.onion/c",
+		"https://example.onion/b",
+	}
+	for _, u := range urls {
+		if err := d.wait(u); err != nil {
+			t.FailNow()
+		}
+	}
+
+	// The first request of each hostname is made right away
+	want := []time.Duration{time.Minute, 2 * time.Minute, time.Second}
+	if len(*sleeps) != len(want) {
+		t.Fatalf("got %v want %v", *sleeps, want)
+	}
+	for i, sleep := range *sleeps {
+		if sleep != want[i] {
+			t.Errorf("got %v want %v", *sleeps, want)
+		}
+	}
+}
+
+func TestDelayer_Wait_NoDelay(t *testing.T) {
+	d, sleeps := newTestDelayer(func(hostname string) (time.Duration, error) { return 0, nil })
+
+	for i := 0; i < 3; i++ {
+		if err := d.wait("https://example.onion"); err != nil {
+			t.FailNow()
+		}
+	}
+
+	if len(*sleeps) != 0 || len(d.next) != 0 {
+		t.Errorf("requests should not be delayed: %v", *sleeps)
+	}
+}
+
+func TestDelayedClient_Error(t *testing.T) {
+	backend := &failingClient{}
+	delayErr := errors.New("config unavailable")
+	c := NewDelayedClient(backend, func(hostname string) (time.Duration, error) { return 0, delayErr })
+
+	if _, err := c.Get("https://example.onion"); !errors.Is(err, delayErr) {
+		t.Errorf("got %v want %v", err, delayErr)
+	}
+	if backend.requests != 0 {
+		t.Errorf("no request should have been made")
+	}
+}
@@ -0,0 +1,140 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"net"
+	"strings"
+	"syscall"
+)
+
+var (
+	// ErrTimeout is returned when the crawling failed because of timeout issue.
+	// ErrConnectTimeout and ErrReadTimeout errors also match it
+	ErrTimeout = errors.New("timeout has occurred")
+	// ErrConnectTimeout is returned when the connection to the remote server could not be established in time
+	ErrConnectTimeout = errors.New("connect timeout has occurred")
+	// ErrReadTimeout is returned when the remote server is reachable but has not answered in time
+	ErrReadTimeout = errors.New("read timeout has occurred")
+	// ErrConnRefused is returned when the remote server has refused the connection
+	ErrConnRefused = errors.New("connection refused")
+	// ErrDNS is returned when the hostname could not be resolved
+	ErrDNS = errors.New("hostname resolution failed")
+	// ErrCircuitOpen is returned when the (TOR) circuit to the remote server could not be opened
+	ErrCircuitOpen = errors.New("circuit could not be opened")
+	// ErrTLSVersion is returned when the remote server cannot negotiate the minimum TLS version
+	ErrTLSVersion = errors.New("TLS version not supported")
+	// ErrTooManyRedirectHosts is returned when a redirect chain goes through more distinct hosts than allowed
+	ErrTooManyRedirectHosts = errors.New("too many redirect hosts")
+	// ErrMaxRequestDuration is returned when the request has lasted longer than allowed, whatever its progress.
+	// It does not match ErrTimeout since the remote server is alive
+	ErrMaxRequestDuration = errors.New("maximum request duration exceeded")
+	// ErrNotModified is returned when a conditional request has determined that the resource has not changed
+	ErrNotModified = errors.New("resource not modified")
+)
+
+// Error is the interface implemented by the errors returned by the Client
+type Error interface {
+	error
+
+	// Temporary returns true if the request may succeed if retried later
+	Temporary() bool
+}
+
+// RequestError is returned when a request has failed before a response was received.
+// It matches its Kind using errors.Is and wrap the underlying cause
+type RequestError struct {
+	Kind error
+	Err  error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying cause
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the kind of the error
+func (e *RequestError) Is(target error) bool {
+	return target == e.Kind || (target == ErrTimeout && e.isTimeout())
+}
+
+// Temporary returns true if the request may succeed if retried later
+func (e *RequestError) Temporary() bool {
+	return e.isTimeout() || e.Kind == ErrCircuitOpen
+}
+
+func (e *RequestError) isTimeout() bool {
+	return e.Kind == ErrTimeout || e.Kind == ErrConnectTimeout || e.Kind == ErrReadTimeout
+}
+
+// StatusError is returned when the server has answered with a non-managed status code
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("non-managed error code %d", e.Code)
+}
+
+// Temporary returns true if the request may succeed if retried later
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == 429
+}
+
+// wrapError convert given error into a RequestError if its cause can be determined
+func wrapError(err error) error {
+	// already wrapped (by the dialer)
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr
+	}
+
+	if kind := errorKind(err); kind != nil {
+		return &RequestError{Kind: kind, Err: err}
+	}
+
+	return err
+}
+
+func errorKind(err error) error {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, fasthttp.ErrDialTimeout):
+		return ErrConnectTimeout
+	case errors.Is(err, fasthttp.ErrTimeout):
+		return ErrReadTimeout
+	case errors.As(err, &dnsErr):
+		return ErrDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrConnRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout
+	}
+
+	// Errors returned by the SOCKS proxy
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "TTL expired"):
+		return ErrConnectTimeout
+	case strings.Contains(msg, "connection refused"):
+		return ErrConnRefused
+	case strings.Contains(msg, "host unreachable"):
+		return ErrDNS
+	case strings.Contains(msg, "general SOCKS server failure"), strings.Contains(msg, "network unreachable"):
+		return ErrCircuitOpen
+	}
+
+	// Errors returned by the TLS handshake
+	if strings.Contains(msg, "protocol version not supported") || strings.Contains(msg, "unsupported protocol version") {
+		return ErrTLSVersion
+	}
+
+	return nil
+}
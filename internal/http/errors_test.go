@@ -0,0 +1,92 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"net"
+	"testing"
+)
+
+func TestWrapError(t *testing.T) {
+	type test struct {
+		err  error
+		kind error
+	}
+
+	tests := []test{
+		{err: errors.New("socks connect tcp torproxy:9050->example.onion:80: unknown error TTL expired"), kind: ErrConnectTimeout},
+		{err: fasthttp.ErrDialTimeout, kind: ErrConnectTimeout},
+		{err: fasthttp.ErrTimeout, kind: ErrReadTimeout},
+		{err: errors.New("socks connect tcp torproxy:9050->example.onion:80: unknown error connection refused"), kind: ErrConnRefused},
+		{err: errors.New("socks connect tcp torproxy:9050->example.onion:80: unknown error host unreachable"), kind: ErrDNS},
+		{err: &net.DNSError{Err: "no such host", Name: "example.org"}, kind: ErrDNS},
+		{err: errors.New("socks connect tcp torproxy:9050->example.onion:80: unknown error general SOCKS server failure"), kind: ErrCircuitOpen},
+		{err: errors.New("remote error: tls: protocol version not supported"), kind: ErrTLSVersion},
+	}
+
+	for _, test := range tests {
+		err := wrapError(test.err)
+
+		if !errors.Is(err, test.kind) {
+			t.Errorf("%s: expected kind %s", test.err, test.kind)
+		}
+
+		// underlying cause should be reachable
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: cause is not wrapped", test.err)
+		}
+
+		// should be detectable when wrapped
+		var clientErr Error
+		if !errors.As(fmt.Errorf("error while crawling: %w", err), &clientErr) {
+			t.Errorf("%s: does not implement Error", test.err)
+		}
+	}
+
+	// Errors already wrapped are returned as-is
+	dialErr := &RequestError{Kind: ErrConnectTimeout, Err: errors.New("i/o timeout")}
+	if err := wrapError(fmt.Errorf("dial: %w", dialErr)); err != dialErr {
+		t.Fail()
+	}
+
+	// Unknown errors are returned as-is
+	unknownErr := errors.New("unexpected EOF")
+	if err := wrapError(unknownErr); err != unknownErr {
+		t.Fail()
+	}
+}
+
+func TestRequestError_IsTimeout(t *testing.T) {
+	connectErr := &RequestError{Kind: ErrConnectTimeout}
+	if !errors.Is(connectErr, ErrTimeout) || errors.Is(connectErr, ErrReadTimeout) {
+		t.Error("connect timeout should only match ErrTimeout & ErrConnectTimeout")
+	}
+
+	readErr := &RequestError{Kind: ErrReadTimeout}
+	if !errors.Is(readErr, ErrTimeout) || errors.Is(readErr, ErrConnectTimeout) {
+		t.Error("read timeout should only match ErrTimeout & ErrReadTimeout")
+	}
+
+	if errors.Is(&RequestError{Kind: ErrTimeout}, ErrConnectTimeout) {
+		t.Error("generic timeout should not match ErrConnectTimeout")
+	}
+}
+
+func TestErrorTemporary(t *testing.T) {
+	if !(&RequestError{Kind: ErrTimeout}).Temporary() {
+		t.Fail()
+	}
+	if !(&RequestError{Kind: ErrConnectTimeout}).Temporary() || !(&RequestError{Kind: ErrReadTimeout}).Temporary() {
+		t.Fail()
+	}
+	if (&RequestError{Kind: ErrDNS}).Temporary() {
+		t.Fail()
+	}
+	if !(&StatusError{Code: 503}).Temporary() {
+		t.Fail()
+	}
+	if (&StatusError{Code: 404}).Temporary() {
+		t.Fail()
+	}
+}
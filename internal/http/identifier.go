@@ -0,0 +1,61 @@
+package http
+
+// HeaderFunc returns the header identifying the requests (nothing is sent if the name is empty)
+type HeaderFunc func() (name string, value string, err error)
+
+type identifiedClient struct {
+	client Client
+	header HeaderFunc
+}
+
+// NewIdentifiedClient create a Client sending an identifying header along with each request made using given client.
+// The header is evaluated before each request, so it may be changed at runtime
+func NewIdentifiedClient(client Client, header HeaderFunc) Client {
+	return &identifiedClient{client: client, header: header}
+}
+
+func (c *identifiedClient) Get(URL string) (Response, error) {
+	client, err := c.identify()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Get(URL)
+}
+
+func (c *identifiedClient) GetIfModified(URL string, etag, lastModified string) (Response, error) {
+	client, err := c.identify()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.GetIfModified(URL, etag, lastModified)
+}
+
+func (c *identifiedClient) Post(URL string, contentType string, body []byte) (Response, error) {
+	client, err := c.identify()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Post(URL, contentType, body)
+}
+
+func (c *identifiedClient) WithHeaders(headers map[string]string) Client {
+	return &identifiedClient{client: c.client.WithHeaders(headers), header: c.header}
+}
+
+// identify returns the client to use for the next request
+func (c *identifiedClient) identify() (Client, error) {
+	name, value, err := c.header()
+	if err != nil {
+		return nil, err
+	}
+
+	// Do not stand out from the other clients unless explicitly configured
+	if name == "" {
+		return c.client, nil
+	}
+
+	return c.client.WithHeaders(map[string]string{name: value}), nil
+}
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"errors"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdentifiedClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values, exists := r.Header["X-Crawler"]
+		if !exists {
+			_, _ = w.Write([]byte("none"))
+			return
+		}
+		_, _ = w.Write([]byte(values[0]))
+	}))
+	defer srv.Close()
+
+	var name, value string
+	c := NewIdentifiedClient(NewFastHTTPClient(&fasthttp.Client{}), func() (string, string, error) {
+		return name, value, nil
+	})
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"", "", "none"},
+		{"", "bathyscaphe", "none"},
+		{"X-Crawler", "bathyscaphe", "bathyscaphe"},
+	}
+
+	for _, test := range tests {
+		name, value = test.name, test.value
+
+		r, err := c.WithHeaders(map[string]string{"Accept-Language": "en"}).Get(srv.URL)
+		if err != nil {
+			t.Fatalf("error while getting URL: %s", err)
+		}
+
+		b, err := ioutil.ReadAll(r.Body())
+		if err != nil {
+			t.FailNow()
+		}
+
+		if string(b) != test.want {
+			t.Errorf("got %s want %s", b, test.want)
+		}
+	}
+}
+
+func TestIdentifiedClient_Error(t *testing.T) {
+	c := NewIdentifiedClient(NewFastHTTPClient(&fasthttp.Client{}), func() (string, string, error) {
+		return "", "", errors.New("config unavailable")
+	})
+
+	if _, err := c.Get("http://127.0.0.1:1"); err == nil || err.Error() != "config unavailable" {
+		t.Errorf("got %v want config unavailable", err)
+	}
+}
@@ -0,0 +1,112 @@
+package http
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoRequestSlot is returned when no request slot has been freed before the maximum wait duration
+var ErrNoRequestSlot = errors.New("no request slot available")
+
+// LimitFunc returns the maximum number of concurrent requests (0 means unlimited)
+type LimitFunc func() (int, error)
+
+type limitedClient struct {
+	client Client
+	*limiter
+}
+
+// limiter is shared by the clients derived from a limitedClient
+type limiter struct {
+	limit   LimitFunc
+	maxWait time.Duration
+
+	mutex    sync.Mutex
+	active   int
+	released chan struct{}
+}
+
+// NewLimitedClient create a Client limiting the number of concurrent requests made using given client.
+// The limit is evaluated before each request, so it may be changed at runtime.
+// Requests wait at most maxWait for a slot to be freed, ErrNoRequestSlot is returned otherwise
+func NewLimitedClient(client Client, limit LimitFunc, maxWait time.Duration) Client {
+	return &limitedClient{
+		client: client,
+		limiter: &limiter{
+			limit:    limit,
+			maxWait:  maxWait,
+			released: make(chan struct{}),
+		},
+	}
+}
+
+func (c *limitedClient) Get(URL string) (Response, error) {
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	return c.client.Get(URL)
+}
+
+func (c *limitedClient) GetIfModified(URL string, etag, lastModified string) (Response, error) {
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	return c.client.GetIfModified(URL, etag, lastModified)
+}
+
+func (c *limitedClient) Post(URL string, contentType string, body []byte) (Response, error) {
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	return c.client.Post(URL, contentType, body)
+}
+
+func (c *limitedClient) WithHeaders(headers map[string]string) Client {
+	return &limitedClient{client: c.client.WithHeaders(headers), limiter: c.limiter}
+}
+
+// acquire wait until a request slot is available
+func (c *limiter) acquire() error {
+	timer := time.NewTimer(c.maxWait)
+	defer timer.Stop()
+
+	for {
+		limit, err := c.limit()
+		if err != nil {
+			return err
+		}
+
+		c.mutex.Lock()
+		if limit <= 0 || c.active < limit {
+			c.active++
+			c.mutex.Unlock()
+			return nil
+		}
+		released := c.released
+		c.mutex.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return ErrNoRequestSlot
+		}
+	}
+}
+
+// release free a request slot and wake up the waiting requests
+func (c *limiter) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.active--
+
+	close(c.released)
+	c.released = make(chan struct{})
+}
@@ -0,0 +1,108 @@
+package http
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingClient is a Client whose requests are blocked until unblock is closed
+type blockingClient struct {
+	mutex     sync.Mutex
+	active    int
+	maxActive int
+	unblock   chan struct{}
+}
+
+func (c *blockingClient) Get(URL string) (Response, error) {
+	c.mutex.Lock()
+	c.active++
+	if c.active > c.maxActive {
+		c.maxActive = c.active
+	}
+	c.mutex.Unlock()
+
+	<-c.unblock
+
+	c.mutex.Lock()
+	c.active--
+	c.mutex.Unlock()
+
+	return nil, nil
+}
+
+func (c *blockingClient) GetIfModified(URL string, etag, lastModified string) (Response, error) {
+	return c.Get(URL)
+}
+
+func (c *blockingClient) Post(URL string, contentType string, body []byte) (Response, error) {
+	return c.Get(URL)
+}
+
+func (c *blockingClient) WithHeaders(headers map[string]string) Client {
+	return c
+}
+
+func TestLimitedClient(t *testing.T) {
+	backend := &blockingClient{unblock: make(chan struct{})}
+	c := NewLimitedClient(backend, func() (int, error) { return 3, nil }, 5*time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get("https://example.onion"); err != nil {
+				t.Errorf("error while getting URL: %s", err)
+			}
+		}()
+	}
+
+	// Let the requests pile up before unblocking them
+	time.Sleep(100 * time.Millisecond)
+	close(backend.unblock)
+	wg.Wait()
+
+	if backend.maxActive != 3 {
+		t.Errorf("got %d concurrent requests want %d", backend.maxActive, 3)
+	}
+}
+
+func TestLimitedClient_NoSlot(t *testing.T) {
+	backend := &blockingClient{unblock: make(chan struct{})}
+	c := NewLimitedClient(backend, func() (int, error) { return 1, nil }, 50*time.Millisecond)
+
+	go func() { _, _ = c.Get("https://example.onion") }()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := c.Get("https://example.onion"); err != ErrNoRequestSlot {
+		t.Errorf("got %v want %v", err, ErrNoRequestSlot)
+	}
+
+	close(backend.unblock)
+}
+
+func TestLimitedClient_WithHeaders(t *testing.T) {
+	backend := &blockingClient{unblock: make(chan struct{})}
+	c := NewLimitedClient(backend, func() (int, error) { return 1, nil }, 50*time.Millisecond)
+
+	// The derived client must share the request slots
+	go func() { _, _ = c.Get("https://example.onion") }()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := c.WithHeaders(map[string]string{"Accept-Language": "fr"}).Get("https://example.onion"); err != ErrNoRequestSlot {
+		t.Errorf("got %v want %v", err, ErrNoRequestSlot)
+	}
+
+	close(backend.unblock)
+}
+
+func TestLimitedClient_Unlimited(t *testing.T) {
+	backend := &blockingClient{unblock: make(chan struct{})}
+	c := NewLimitedClient(backend, func() (int, error) { return 0, nil }, 50*time.Millisecond)
+
+	close(backend.unblock)
+	if _, err := c.Post("https://example.onion", "text/plain", nil); err != nil {
+		t.Errorf("error while posting URL: %s", err)
+	}
+}
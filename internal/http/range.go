@@ -0,0 +1,12 @@
+package http
+
+import "fmt"
+
+// RangeHeader is the header requesting a part of the resource only (see PrefixRange)
+const RangeHeader = "Range"
+
+// PrefixRange returns the value of the Range header requesting the first given bytes of the resource.
+// The servers honoring it answer with a partial response (206), the other ones with the whole resource
+func PrefixRange(maxBytes int) string {
+	return fmt.Sprintf("bytes=0-%d", maxBytes-1)
+}
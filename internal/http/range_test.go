@@ -0,0 +1,69 @@
+package http
+
+import (
+	"bytes"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrefixRange(t *testing.T) {
+	if got := PrefixRange(1024); got != "bytes=0-1023" {
+		t.Errorf("got %s want bytes=0-1023", got)
+	}
+}
+
+func TestClient_PrefixRange(t *testing.T) {
+	body := strings.Repeat("0123456789", 100)
+
+	// http.ServeContent honors the Range header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "dump.txt", time.Time{}, bytes.NewReader([]byte(body)))
+	}))
+	defer srv.Close()
+
+	c := NewFastHTTPClient(&fasthttp.Client{}).WithHeaders(map[string]string{RangeHeader: PrefixRange(15)})
+
+	r, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("error while getting URL: %s", err)
+	}
+
+	if r.StatusCode() != http.StatusPartialContent {
+		t.Errorf("got status %d want %d", r.StatusCode(), http.StatusPartialContent)
+	}
+	if got := r.Headers()["Content-Range"]; got != "bytes 0-14/1000" {
+		t.Errorf("got content range %s want bytes 0-14/1000", got)
+	}
+
+	b, _ := ioutil.ReadAll(r.Body())
+	if string(b) != body[:15] {
+		t.Errorf("got %s want %s", b, body[:15])
+	}
+}
+
+func TestClient_PrefixRangeIgnored(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello world"))
+	}))
+	defer srv.Close()
+
+	c := NewFastHTTPClient(&fasthttp.Client{}).WithHeaders(map[string]string{RangeHeader: PrefixRange(5)})
+
+	r, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("error while getting URL: %s", err)
+	}
+
+	// The whole resource should be returned
+	if r.StatusCode() != http.StatusOK {
+		t.Errorf("got status %d want %d", r.StatusCode(), http.StatusOK)
+	}
+	if b, _ := ioutil.ReadAll(r.Body()); string(b) != "Hello world" {
+		t.Errorf("got %s want Hello world", b)
+	}
+}
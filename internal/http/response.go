@@ -10,14 +10,24 @@ import (
 
 // Response is an HTTP response
 type Response interface {
+	// StatusCode returns the response status code
+	StatusCode() int
 	// Headers returns the response headers
 	Headers() map[string]string
 	// Body return the response body
 	Body() io.Reader
+	// Via returns the address of the SOCKS proxy (or of the server when dialed directly) which served the response.
+	// The TOR circuit used is not exposed by the SOCKS proxy
+	Via() string
 }
 
 type response struct {
 	raw fasthttp.Response
+	via string
+}
+
+func (r *response) StatusCode() int {
+	return r.raw.StatusCode()
 }
 
 func (r *response) Headers() map[string]string {
@@ -31,3 +41,17 @@ func (r *response) Headers() map[string]string {
 func (r *response) Body() io.Reader {
 	return bytes.NewReader(r.raw.Body())
 }
+
+func (r *response) Via() string {
+	return r.via
+}
+
+// via returns the address which served given response: the remote address of its connection, which is the SOCKS proxy
+// for the proxied requests, or the proxy address if the connection is unknown
+func via(resp *fasthttp.Response, proxyAddress string) string {
+	if addr := resp.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+
+	return proxyAddress
+}
@@ -0,0 +1,116 @@
+package http
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// RateFunc returns the number of retries allowed per second (0 disables the retries)
+type RateFunc func() (float64, error)
+
+type retryClient struct {
+	client Client
+	*retryBudget
+}
+
+// retryBudget is a token bucket shared by the clients derived from a retryClient.
+// It holds at most one second of retries (at least one), and is full when created
+type retryBudget struct {
+	rate RateFunc
+	now  func() time.Time
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRetryClient create a Client retrying once the requests made using given client which have failed
+// with a temporary error, as long as the retry budget allows it. The budget is refilled at the rate returned
+// by given function (evaluated before each retry, so it may be changed at runtime): during broad outages the
+// budget is exhausted and the retries are suppressed, to avoid amplifying the load
+func NewRetryClient(client Client, rate RateFunc) Client {
+	return &retryClient{
+		client:      client,
+		retryBudget: &retryBudget{rate: rate, now: time.Now},
+	}
+}
+
+func (c *retryClient) Get(URL string) (Response, error) {
+	return c.retry(func() (Response, error) {
+		return c.client.Get(URL)
+	})
+}
+
+func (c *retryClient) GetIfModified(URL string, etag, lastModified string) (Response, error) {
+	return c.retry(func() (Response, error) {
+		return c.client.GetIfModified(URL, etag, lastModified)
+	})
+}
+
+func (c *retryClient) Post(URL string, contentType string, body []byte) (Response, error) {
+	return c.retry(func() (Response, error) {
+		return c.client.Post(URL, contentType, body)
+	})
+}
+
+func (c *retryClient) WithHeaders(headers map[string]string) Client {
+	return &retryClient{client: c.client.WithHeaders(headers), retryBudget: c.retryBudget}
+}
+
+// retry perform given request, and retry it once if it has failed with a temporary error and the budget allows it
+func (c *retryClient) retry(request func() (Response, error)) (Response, error) {
+	r, err := request()
+
+	var clientErr Error
+	if err == nil || !errors.As(err, &clientErr) || !clientErr.Temporary() {
+		return r, err
+	}
+
+	allowed, budgetErr := c.allow()
+	if budgetErr != nil {
+		return nil, budgetErr
+	}
+	if !allowed {
+		return r, err
+	}
+
+	return request()
+}
+
+// allow take a token from the budget, if any
+func (b *retryBudget) allow() (bool, error) {
+	rate, err := b.rate()
+	if err != nil {
+		return false, err
+	}
+	if rate <= 0 {
+		return false, nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	capacity := rate
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	now := b.now()
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	b.last = now
+
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+	if b.tokens < 1 {
+		return false, nil
+	}
+
+	b.tokens--
+	return true, nil
+}
@@ -0,0 +1,98 @@
+package http
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingClient is a Client whose requests fail using err
+type failingClient struct {
+	mutex    sync.Mutex
+	requests int
+	err      error
+}
+
+func (c *failingClient) Get(URL string) (Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.requests++
+	return nil, c.err
+}
+
+func (c *failingClient) GetIfModified(URL string, etag, lastModified string) (Response, error) {
+	return c.Get(URL)
+}
+
+func (c *failingClient) Post(URL string, contentType string, body []byte) (Response, error) {
+	return c.Get(URL)
+}
+
+func (c *failingClient) WithHeaders(headers map[string]string) Client {
+	return c
+}
+
+func TestRetryClient(t *testing.T) {
+	backend := &failingClient{err: &StatusError{Code: 503}}
+	c := NewRetryClient(backend, func() (float64, error) { return 1, nil })
+
+	if _, err := c.Get("https://example.onion"); !errors.Is(err, backend.err) {
+		t.Errorf("got %v want %v", err, backend.err)
+	}
+	if backend.requests != 2 {
+		t.Errorf("got %d requests want %d", backend.requests, 2)
+	}
+}
+
+func TestRetryClient_NotTemporary(t *testing.T) {
+	backend := &failingClient{err: &StatusError{Code: 404}}
+	c := NewRetryClient(backend, func() (float64, error) { return 1, nil })
+
+	if _, err := c.Get("https://example.onion"); !errors.Is(err, backend.err) {
+		t.Errorf("got %v want %v", err, backend.err)
+	}
+	if backend.requests != 1 {
+		t.Errorf("got %d requests want %d", backend.requests, 1)
+	}
+}
+
+func TestRetryClient_BudgetExhausted(t *testing.T) {
+	backend := &failingClient{err: &RequestError{Kind: ErrTimeout, Err: errors.New("timeout")}}
+
+	now := time.Now()
+	c := NewRetryClient(backend, func() (float64, error) { return 2, nil }).(*retryClient)
+	c.now = func() time.Time { return now }
+
+	// The budget allows 2 retries, the derived clients share it
+	for i := 0; i < 2; i++ {
+		_, _ = c.WithHeaders(map[string]string{"Accept-Language": "fr"}).Get("https://example.onion")
+	}
+	if backend.requests != 4 {
+		t.Errorf("got %d requests want %d", backend.requests, 4)
+	}
+
+	// The retries are denied once the budget is exhausted
+	_, _ = c.Get("https://example.onion")
+	if backend.requests != 5 {
+		t.Errorf("got %d requests want %d", backend.requests, 5)
+	}
+
+	// The budget is refilled over time
+	now = now.Add(500 * time.Millisecond)
+	_, _ = c.Get("https://example.onion")
+	if backend.requests != 7 {
+		t.Errorf("got %d requests want %d", backend.requests, 7)
+	}
+}
+
+func TestRetryClient_Disabled(t *testing.T) {
+	backend := &failingClient{err: &StatusError{Code: 503}}
+	c := NewRetryClient(backend, func() (float64, error) { return 0, nil })
+
+	_, _ = c.Get("https://example.onion")
+	if backend.requests != 1 {
+		t.Errorf("got %d requests want %d", backend.requests, 1)
+	}
+}
@@ -0,0 +1,96 @@
+package http
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"sync"
+)
+
+// DefaultMinTLSVersion is the minimum TLS version of the clearnet requests used when none is configured
+const DefaultMinTLSVersion = tls.VersionTLS12
+
+// TLSVersionFunc returns the minimum TLS version of the clearnet requests (0 means no minimum)
+type TLSVersionFunc func() (uint16, error)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the TLS version matching given name (i.e: 1.2), or 0 if the name is empty
+func ParseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	version, exists := tlsVersions[name]
+	if !exists {
+		return 0, fmt.Errorf("unknown TLS version: %s", name)
+	}
+
+	return version, nil
+}
+
+// tlsClients are the clients used for the clearnet requests, by minimum TLS version.
+// The TLS configuration of a fasthttp.Client cannot be changed once used, hence a client per version
+type tlsClients struct {
+	base       *fasthttp.Client
+	minVersion TLSVersionFunc
+
+	mutex   sync.Mutex
+	clients map[uint16]*fasthttp.Client
+}
+
+func newTLSClients(base *fasthttp.Client, minVersion TLSVersionFunc) *tlsClients {
+	return &tlsClients{base: base, minVersion: minVersion, clients: map[uint16]*fasthttp.Client{}}
+}
+
+// clientFor returns the client to use to request given URI
+func (t *tlsClients) clientFor(uri *fasthttp.URI) (*fasthttp.Client, error) {
+	// The traffic to the hidden services is already encrypted by TOR
+	if !bytes.EqualFold(uri.Scheme(), []byte("https")) || isHiddenService(string(uri.Host())) {
+		return t.base, nil
+	}
+
+	version, err := t.minVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return t.base, nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	c, exists := t.clients[version]
+	if !exists {
+		c = withMinTLSVersion(t.base, version)
+		t.clients[version] = c
+	}
+
+	return c, nil
+}
+
+// withMinTLSVersion returns a copy of given client requiring given TLS version
+func withMinTLSVersion(c *fasthttp.Client, version uint16) *fasthttp.Client {
+	tlsConfig := &tls.Config{}
+	if c.TLSConfig != nil {
+		tlsConfig = c.TLSConfig.Clone()
+	}
+	tlsConfig.MinVersion = version
+
+	return &fasthttp.Client{
+		Dial:                c.Dial,
+		TLSConfig:           tlsConfig,
+		ReadTimeout:         c.ReadTimeout,
+		WriteTimeout:        c.WriteTimeout,
+		Name:                c.Name,
+		MaxConnsPerHost:     c.MaxConnsPerHost,
+		MaxIdleConnDuration: c.MaxIdleConnDuration,
+	}
+}
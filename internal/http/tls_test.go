@@ -0,0 +1,94 @@
+package http
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/valyala/fasthttp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := map[string]uint16{"": 0, "1.0": tls.VersionTLS10, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+	for name, want := range tests {
+		version, err := ParseTLSVersion(name)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		}
+		if version != want {
+			t.Errorf("%s: got %d want %d", name, version, want)
+		}
+	}
+
+	if _, err := ParseTLSVersion("2.0"); err == nil {
+		t.Error("expected error for unknown version")
+	}
+}
+
+func TestClient_MinTLSVersion(t *testing.T) {
+	// The server only offers TLS 1.0 & 1.1
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	srv.StartTLS()
+	defer srv.Close()
+
+	var minVersion uint16
+	fc := &fasthttp.Client{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	c := &client{c: fc, tls: newTLSClients(fc, func() (uint16, error) { return minVersion, nil })}
+
+	minVersion = tls.VersionTLS10
+	if _, err := c.Get(srv.URL); err != nil {
+		t.Errorf("error while getting URL using TLS 1.0 minimum: %s", err)
+	}
+
+	minVersion = tls.VersionTLS12
+	_, err := c.Get(srv.URL)
+	if !errors.Is(err, ErrTLSVersion) {
+		t.Errorf("got %v want %v", err, ErrTLSVersion)
+	}
+
+	var clientErr Error
+	if !errors.As(err, &clientErr) || clientErr.Temporary() {
+		t.Errorf("%v should be a permanent client error", err)
+	}
+}
+
+func TestTLSClients_ClientFor(t *testing.T) {
+	base := &fasthttp.Client{}
+	calls := 0
+	clients := newTLSClients(base, func() (uint16, error) {
+		calls++
+		return tls.VersionTLS12, nil
+	})
+
+	// Neither the plain HTTP requests nor the hidden services are concerned
+	for _, u := range []string{"http://example.org", "https://example.onion", "https://example.onion:8443/a"} {
+		uri := &fasthttp.URI{}
+		uri.Update(u)
+
+		c, err := clients.clientFor(uri)
+		if err != nil || c != base {
+			t.Errorf("%s: got %v (%v) want base client", u, c, err)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("got %d calls want 0", calls)
+	}
+
+	uri := &fasthttp.URI{}
+	uri.Update("https://example.org")
+
+	first, err := clients.clientFor(uri)
+	if err != nil || first == base || first.TLSConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("got %v (%v) want client requiring TLS 1.2", first, err)
+	}
+
+	// The client of a version is reused
+	if second, _ := clients.clientFor(uri); second != first {
+		t.Error("client not reused")
+	}
+}
@@ -0,0 +1,51 @@
+package indexer
+
+import (
+	"golang.org/x/net/html/charset"
+	"mime"
+	"regexp"
+)
+
+// charsetSniffLength is the number of bytes of the body scanned for a <meta> charset declaration
+const charsetSniffLength = 1024
+
+// metaCharsetRegex match both <meta charset="..."> and <meta http-equiv="Content-Type" content="...; charset=...">
+var metaCharsetRegex = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-z0-9_:.\-]+)`)
+
+// toUTF8 transcode given body to UTF-8 using the charset declared in the Content-Type header or in a <meta> tag.
+// The body is returned as-is if no (known) charset is declared or if it cannot be transcoded
+func toUTF8(headers map[string]string, body string) string {
+	label := detectCharset(getHeader(headers, "Content-Type"), body)
+	if label == "" {
+		return body
+	}
+
+	encoding, name := charset.Lookup(label)
+	if encoding == nil || name == "utf-8" {
+		return body
+	}
+
+	transcoded, err := encoding.NewDecoder().String(body)
+	if err != nil {
+		return body
+	}
+
+	return transcoded
+}
+
+// detectCharset returns the charset declared for given body, the Content-Type header taking precedence
+func detectCharset(contentType, body string) string {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		return params["charset"]
+	}
+
+	if len(body) > charsetSniffLength {
+		body = body[:charsetSniffLength]
+	}
+
+	if match := metaCharsetRegex.FindStringSubmatch(body); match != nil {
+		return match[1]
+	}
+
+	return ""
+}
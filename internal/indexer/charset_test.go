@@ -0,0 +1,36 @@
+package indexer
+
+import "testing"
+
+// windows1251Sample is "Привет мир" encoded using windows-1251
+const windows1251Sample = "\xcf\xf0\xe8\xe2\xe5\xf2 \xec\xe8\xf0"
+
+func TestToUTF8(t *testing.T) {
+	type test struct {
+		headers map[string]string
+		body    string
+		want    string
+	}
+
+	tests := []test{
+		// Charset declared in the Content-Type header
+		{map[string]string{"Content-Type": "text/html; charset=windows-1251"}, windows1251Sample, "Привет мир"},
+		{map[string]string{"content-type": "text/html; charset=CP1251"}, windows1251Sample, "Привет мир"},
+		// Charset declared in a <meta> tag
+		{nil, `<meta charset="windows-1251"><p>` + windows1251Sample + `</p>`, `<meta charset="windows-1251"><p>Привет мир</p>`},
+		{map[string]string{"Content-Type": "text/html"},
+			`<meta http-equiv="Content-Type" content="text/html; charset=windows-1251">` + windows1251Sample,
+			`<meta http-equiv="Content-Type" content="text/html; charset=windows-1251">Привет мир`},
+		// The header takes precedence over the <meta> tag
+		{map[string]string{"Content-Type": "text/html; charset=utf-8"}, `<meta charset="windows-1251">Привет мир`, `<meta charset="windows-1251">Привет мир`},
+		// Unknown or missing charset: passthrough
+		{map[string]string{"Content-Type": "text/html; charset=unknown"}, windows1251Sample, windows1251Sample},
+		{nil, "Привет мир", "Привет мир"},
+	}
+
+	for _, tst := range tests {
+		if got := toUTF8(tst.headers, tst.body); got != tst.want {
+			t.Errorf("got %q want %q", got, tst.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package indexer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxExtractedTextLength is the maximum number of bytes of the body scanned by the extractors.
+// Go regexps run in linear time, bounding the input therefore bounds the extraction cost
+const maxExtractedTextLength = 1 << 20
+
+// builtinExtractors are the patterns of the extractors usable by name
+var builtinExtractors = map[string]string{
+	"email":    `\b[A-Za-z0-9._%+\-]{1,64}@(?:[A-Za-z0-9\-]{1,63}\.){1,8}[A-Za-z]{2,24}\b`,
+	"bitcoin":  `\b(?:[13][a-km-zA-HJ-NP-Z1-9]{25,34}|bc1[ac-hj-np-z02-9]{11,71})\b`,
+	"monero":   `\b[48][0-9AB][1-9A-HJ-NP-Za-km-z]{93}\b`,
+	"ethereum": `\b0x[a-fA-F0-9]{40}\b`,
+}
+
+// extractor extract the entities matching a pattern from the resources body
+type extractor struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// parseExtractors parse given extractors, formatted either as the name of a built-in extractor or as `NAME=REGEX`
+func parseExtractors(definitions []string) ([]extractor, error) {
+	var extractors []extractor
+	for _, definition := range definitions {
+		name, pattern := definition, ""
+		if parts := strings.SplitN(definition, "=", 2); len(parts) == 2 {
+			name, pattern = parts[0], parts[1]
+		} else if builtin, exists := builtinExtractors[name]; exists {
+			pattern = builtin
+		} else {
+			return nil, fmt.Errorf("no extractor named %s found", name)
+		}
+
+		if name == "" || pattern == "" {
+			return nil, fmt.Errorf("invalid extractor: %s", definition)
+		}
+
+		exp, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extractor %s: %s", name, err)
+		}
+
+		extractors = append(extractors, extractor{name: name, pattern: exp})
+	}
+
+	return extractors, nil
+}
+
+// extractEntities returns the deduplicated entities found in given text by the extractors,
+// indexed by extractor name. At most maxMatches entities are kept per extractor (0 means no limit)
+func extractEntities(extractors []extractor, text string, maxMatches int) map[string][]string {
+	if len(text) > maxExtractedTextLength {
+		text = text[:maxExtractedTextLength]
+	}
+
+	entities := map[string][]string{}
+	for _, e := range extractors {
+		seen := map[string]bool{}
+
+		for _, match := range e.pattern.FindAllString(text, -1) {
+			// Email addresses are case insensitive
+			if e.name == "email" {
+				match = strings.ToLower(match)
+			}
+
+			if seen[match] {
+				continue
+			}
+			seen[match] = true
+
+			entities[e.name] = append(entities[e.name], match)
+			if maxMatches > 0 && len(entities[e.name]) == maxMatches {
+				break
+			}
+		}
+	}
+
+	return entities
+}
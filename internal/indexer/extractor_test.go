@@ -0,0 +1,72 @@
+package indexer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const extractorSample = `
+<p>Contact us at Admin@Market.onion or admin@market.onion, support: help.desk+vendor@mail.example.org</p>
+<p>BTC: 1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2, 3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy
+or bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq (same as 1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2)</p>
+<p>XMR: 4AdUndXHHZ6cfufTMvppY6JwXNouMBzSkbLYfpAV5Usx3skxNgYeYTRj5UzqtReoS44qo9mtmXCqY45DJ852K5Jv2684Rge</p>
+<p>ETH: 0xde0B295669a9FD93d5F28D9Ec85E40f4cb697BAe</p>
+<p>PGP: 0x1234ABCD</p>
+`
+
+func TestParseExtractors(t *testing.T) {
+	extractors, err := parseExtractors([]string{"email", "pgp=0x[A-F0-9]{8}"})
+	if err != nil {
+		t.FailNow()
+	}
+	if len(extractors) != 2 || extractors[0].name != "email" || extractors[1].name != "pgp" {
+		t.Errorf("wrong extractors: %+v", extractors)
+	}
+
+	for _, definition := range []string{"unknown", "=0x[A-F0-9]{8}", "pgp=", "pgp=(["} {
+		if _, err := parseExtractors([]string{definition}); err == nil {
+			t.Errorf("extractor %s should be rejected", definition)
+		}
+	}
+}
+
+func TestExtractEntities(t *testing.T) {
+	extractors, err := parseExtractors([]string{"email", "bitcoin", "monero", "ethereum", "pgp=0x[A-F0-9]{8}\\b"})
+	if err != nil {
+		t.FailNow()
+	}
+
+	got := extractEntities(extractors, extractorSample, 0)
+	want := map[string][]string{
+		"email": {"admin@market.onion", "help.desk+vendor@mail.example.org"},
+		"bitcoin": {"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy",
+			"bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"},
+		"monero":   {"4AdUndXHHZ6cfufTMvppY6JwXNouMBzSkbLYfpAV5Usx3skxNgYeYTRj5UzqtReoS44qo9mtmXCqY45DJ852K5Jv2684Rge"},
+		"ethereum": {"0xde0B295669a9FD93d5F28D9Ec85E40f4cb697BAe"},
+		"pgp":      {"0x1234ABCD"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestExtractEntities_Limits(t *testing.T) {
+	extractors, err := parseExtractors([]string{"email"})
+	if err != nil {
+		t.FailNow()
+	}
+
+	// Only the first matches should be kept
+	got := extractEntities(extractors, "a@example.org b@example.org c@example.org", 2)
+	if want := []string{"a@example.org", "b@example.org"}; !reflect.DeepEqual(got["email"], want) {
+		t.Errorf("got %v want %v", got["email"], want)
+	}
+
+	// Only the beginning of the text should be scanned
+	text := strings.Repeat(" ", maxExtractedTextLength) + "a@example.org"
+	if got := extractEntities(extractors, text, 0); len(got) != 0 {
+		t.Errorf("got %v want no entities", got)
+	}
+}
@@ -0,0 +1,62 @@
+package indexer
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"net/url"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxFieldLength is the maximum number of characters stored per extracted field
+const maxFieldLength = 1000
+
+// matchFieldSelectors returns the CSS selectors of the first rule whose pattern match the hostname of given URL
+// (nil if no rule match)
+func matchFieldSelectors(rules []configapi.FieldSelectors, rawURL string) map[string]string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+
+	for _, rule := range rules {
+		if matched, err := path.Match(rule.Pattern, u.Hostname()); err == nil && matched {
+			return rule.Fields
+		}
+	}
+
+	return nil
+}
+
+// extractFields returns the text of the first element matched by each selector, by field name.
+// The fields whose selector is invalid or does not match anything are left out
+func extractFields(selectors map[string]string, body string) map[string]string {
+	if len(selectors) == 0 {
+		return nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	fields := map[string]string{}
+	for name, selector := range selectors {
+		value := strings.Join(strings.Fields(doc.Find(selector).First().Text()), " ")
+		if value == "" {
+			continue
+		}
+
+		if utf8.RuneCountInString(value) > maxFieldLength {
+			value = string([]rune(value)[:maxFieldLength])
+		}
+		fields[name] = value
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return fields
+}
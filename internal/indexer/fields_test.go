@@ -0,0 +1,79 @@
+package indexer
+
+import (
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"reflect"
+	"testing"
+)
+
+const marketFixture = `
+<html>
+<head><title>Listing - Market</title></head>
+<body>
+	<div class="product">
+		<h1 class="product-title">
+			Premium   Widget
+		</h1>
+		<span class="price">0.0042 BTC</span>
+		<span class="price">0.0040 BTC</span>
+		<div class="vendor"><a href="/vendor/42">trusted_seller</a></div>
+	</div>
+</body>
+</html>
+`
+
+func TestMatchFieldSelectors(t *testing.T) {
+	rules := []configapi.FieldSelectors{
+		{Pattern: "*.market.onion", Fields: map[string]string{"price": ".market-price"}},
+		{Pattern: "shop.onion", Fields: map[string]string{"price": ".shop-price"}},
+		{Pattern: "*.onion", Fields: map[string]string{"title": "h1"}},
+	}
+
+	tests := []struct {
+		url  string
+		want map[string]string
+	}{
+		{"https://www.market.onion/item/1", map[string]string{"price": ".market-price"}},
+		{"http://shop.onion:8080/", map[string]string{"price": ".shop-price"}},
+		{"https://forum.onion", map[string]string{"title": "h1"}},
+		{"https://example.org", nil},
+		{"%", nil},
+	}
+
+	for _, test := range tests {
+		if got := matchFieldSelectors(rules, test.url); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("matchFieldSelectors(%s) = %v, want %v", test.url, got, test.want)
+		}
+	}
+
+	if got := matchFieldSelectors(nil, "https://www.market.onion"); got != nil {
+		t.Errorf("matchFieldSelectors without rules = %v, want nil", got)
+	}
+}
+
+func TestExtractFields(t *testing.T) {
+	selectors := map[string]string{
+		"title":   ".product .product-title",
+		"price":   ".product .price",
+		"vendor":  ".vendor a",
+		"rating":  ".rating",
+		"invalid": "[[",
+	}
+
+	want := map[string]string{
+		"title":  "Premium Widget",
+		"price":  "0.0042 BTC",
+		"vendor": "trusted_seller",
+	}
+
+	if got := extractFields(selectors, marketFixture); !reflect.DeepEqual(got, want) {
+		t.Errorf("extractFields() = %v, want %v", got, want)
+	}
+
+	if got := extractFields(map[string]string{"rating": ".rating"}, marketFixture); got != nil {
+		t.Errorf("extractFields() = %v, want nil", got)
+	}
+	if got := extractFields(nil, marketFixture); got != nil {
+		t.Errorf("extractFields() = %v, want nil", got)
+	}
+}
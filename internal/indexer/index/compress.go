@@ -0,0 +1,70 @@
+package index
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+)
+
+// compressBody returns given body gzipped
+func compressBody(body string) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// decompressBody returns the body gzipped using compressBody
+func decompressBody(compressed []byte) (string, error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// storedBody returns the body of given stored resource, decompressing it if needed
+func storedBody(stored resourceIdx) (string, error) {
+	if len(stored.BodyGz) == 0 {
+		return stored.Body, nil
+	}
+
+	return decompressBody(stored.BodyGz)
+}
+
+// excludeBodyFromSource returns given mapping, the body being excluded from the stored source:
+// it is still indexed (and searchable), but only its compressed copy is stored
+func excludeBodyFromSource(mapping string) (string, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(mapping), &m); err != nil {
+		return "", err
+	}
+
+	mappings, ok := m["mappings"].(map[string]interface{})
+	if !ok {
+		mappings = map[string]interface{}{}
+		m["mappings"] = mappings
+	}
+	mappings["_source"] = map[string]interface{}{"excludes": []string{"body"}}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
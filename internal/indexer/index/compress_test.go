@@ -0,0 +1,110 @@
+package index
+
+import (
+	"encoding/json"
+	"github.com/olivere/elastic/v7"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressBody(t *testing.T) {
+	body := strings.Repeat("<p>Welcome to the market</p>\n", 100)
+
+	compressed, err := compressBody(body)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(compressed) >= len(body) {
+		t.Errorf("got %d bytes compressed want less than %d", len(compressed), len(body))
+	}
+
+	decompressed, err := decompressBody(compressed)
+	if err != nil {
+		t.FailNow()
+	}
+	if decompressed != body {
+		t.Errorf("got %s want %s", decompressed, body)
+	}
+
+	if _, err := decompressBody([]byte("not gzipped")); err == nil {
+		t.Error("invalid body should be rejected")
+	}
+}
+
+func TestBuildMapping_CompressBody(t *testing.T) {
+	mapping, err := buildMapping(Options{CompressBody: true})
+	if err != nil {
+		t.FailNow()
+	}
+	if !strings.Contains(mapping, `"_source":{"excludes":["body"]}`) {
+		t.Errorf("body is not excluded from source: %s", mapping)
+	}
+	if !strings.Contains(mapping, `"body-gz":{"type":"binary"}`) {
+		t.Errorf("body-gz is not mapped: %s", mapping)
+	}
+
+	if _, err := buildMapping(Options{Mapping: "{", CompressBody: true}); err == nil {
+		t.Error("invalid mapping should be rejected")
+	}
+}
+
+// TestElasticSearchIndex_CompressBody index a resource & search it back, the body being excluded from
+// the stored source like Elasticsearch does using the mapping
+func TestElasticSearchIndex_CompressBody(t *testing.T) {
+	body := "<title>Market</title>" + strings.Repeat("<p>Welcome to the market</p>", 50)
+
+	var stored map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/resources/_doc/":
+			b, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(b, &stored); err != nil {
+				t.Errorf("invalid document: %s", err)
+			}
+			// The body is indexed, but not stored
+			if stored["body"] != body {
+				t.Errorf("got body %v want %s", stored["body"], body)
+			}
+			delete(stored, "body")
+
+			_, _ = w.Write([]byte(`{"_index":"resources","_id":"1","result":"created"}`))
+		case "/resources/_search":
+			source, _ := json.Marshal(stored)
+			_, _ = w.Write([]byte(`{"hits":{"total":{"value":1,"relation":"eq"},"hits":[{"_id":"1","_source":` + string(source) + `}]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client, compressBody: true}
+
+	if err := idx.IndexResource(Resource{URL: "https://example.onion", Body: body,
+		Headers: map[string]string{"Content-Type": "text/html"}}); err != nil {
+		t.Fatalf("error while indexing resource: %s", err)
+	}
+	if _, exists := stored["body-gz"]; !exists {
+		t.Fatalf("compressed body is not stored: %v", stored)
+	}
+
+	res, err := idx.Search(SearchParams{Limit: 1})
+	if err != nil {
+		t.Fatalf("error while searching resources: %s", err)
+	}
+	if len(res.Resources) != 1 || res.Resources[0].Body != body {
+		t.Errorf("got %+v want body %s", res.Resources, body)
+	}
+	if res.Resources[0].Title != "Market" {
+		t.Errorf("got title %s want Market", res.Resources[0].Title)
+	}
+}
@@ -2,15 +2,48 @@ package index
 
 import (
 	"context"
-	"github.com/PuerkitoBio/goquery"
+	"encoding/json"
+	"fmt"
 	"github.com/olivere/elastic/v7"
 	"github.com/rs/zerolog/log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const resourcesIndexName = "resources"
-const mapping = `
+
+// urlsPageSize is the number of distinct URLs fetched per request when browsing the index
+const urlsPageSize = 500
+
+// The aggregations used to retrieve the first-seen time of the URLs
+const (
+	urlsAgg      = "urls"
+	firstSeenAgg = "first-seen"
+	oldestAgg    = "oldest"
+)
+
+// The aggregations used to compute the crawl coverage
+const (
+	coverageAgg  = "coverage"
+	pagesAgg     = "pages"
+	hostnamesAgg = "hostnames"
+)
+
+// hostnameGroup is the name of the inner hits holding the resources of an hostname when grouping by hostname
+const hostnameGroup = "hostname"
+
+// nearDuplicateCandidates is the maximum number of candidates checked when looking for near-duplicates
+const nearDuplicateCandidates = 50
+
+// defaultAnalyzer is the analyzer used for the text fields if none is configured
+const defaultAnalyzer = "standard"
+
+// mappingTemplate is the default mapping, the text fields analyzer is formatted in
+const mappingTemplate = `
 {
   "settings": {
     "number_of_shards": 1,
@@ -20,10 +53,15 @@ const mapping = `
     "dynamic": false,
     "properties": {
       "body": {
-        "type": "text"
+        "type": "text",
+        "analyzer": %[1]q
+      },
+      "body-gz": {
+        "type": "binary"
       },
       "description": {
-        "type": "text"
+        "type": "text",
+        "analyzer": %[1]q
       },
       "url": {
         "type": "text",
@@ -33,11 +71,66 @@ const mapping = `
           }
         }
       },
+      "hostname": {
+        "type": "keyword"
+      },
       "time": {
         "type": "date"
       },
+      "first-seen": {
+        "type": "date"
+      },
+      "last-seen": {
+        "type": "date"
+      },
       "title": {
-        "type": "text"
+        "type": "text",
+        "analyzer": %[1]q
+      },
+      "hash": {
+        "type": "keyword"
+      },
+      "truncated": {
+        "type": "boolean"
+      },
+      "partial": {
+        "type": "boolean"
+      },
+      "alias": {
+        "type": "keyword"
+      },
+      "simhash": {
+        "type": "keyword"
+      },
+      "simhash-blocks": {
+        "type": "keyword"
+      },
+      "near-duplicate-of": {
+        "type": "keyword"
+      },
+      "tag": {
+        "type": "keyword"
+      },
+      "entities": {
+        "type": "flattened"
+      },
+      "matched-keywords": {
+        "type": "keyword"
+      },
+      "watchlist-hit": {
+        "type": "boolean"
+      },
+      "via": {
+        "type": "keyword"
+      },
+      "onion-links": {
+        "type": "keyword"
+      },
+      "fields": {
+        "type": "flattened"
+      },
+      "structured-data": {
+        "type": "flattened"
       },
       "headers": {
         "properties": {
@@ -57,59 +150,153 @@ const mapping = `
 
 type resourceIdx struct {
 	URL         string            `json:"url"`
-	Body        string            `json:"body"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Body        string            `json:"body,omitempty"`
 	Time        time.Time         `json:"time"`
+	FirstSeen   time.Time         `json:"first-seen"`
+	LastSeen    time.Time         `json:"last-seen"`
 	Title       string            `json:"title"`
 	Meta        map[string]string `json:"meta"`
 	Description string            `json:"description"`
 	Headers     map[string]string `json:"headers"`
+	Hash        string            `json:"hash"`
+	Truncated   bool              `json:"truncated"`
+	Partial     bool              `json:"partial,omitempty"`
+	Alias       string            `json:"alias,omitempty"`
+	// SimHash is stored as a string since ES does not handle unsigned long
+	SimHash         string   `json:"simhash,omitempty"`
+	SimHashBlocks   []string `json:"simhash-blocks,omitempty"`
+	NearDuplicateOf string   `json:"near-duplicate-of,omitempty"`
+	Tag             string   `json:"tag,omitempty"`
+	// Entities are indexed as keywords whatever the extractor name
+	Entities        map[string][]string `json:"entities,omitempty"`
+	MatchedKeywords []string            `json:"matched-keywords,omitempty"`
+	WatchlistHit    bool                `json:"watchlist-hit"`
+	Via             string              `json:"via,omitempty"`
+	OnionLinks      []string            `json:"onion-links,omitempty"`
+	Fields          map[string]string   `json:"fields,omitempty"`
+	StructuredData  []map[string]string `json:"structured-data,omitempty"`
+	// BodyGz is the gzipped body, only stored if the body compression is enabled
+	BodyGz []byte `json:"body-gz,omitempty"`
 }
 
 type elasticSearchIndex struct {
 	client *elastic.Client
+	router contentRouter
+	// reviewIndex is the index into which the watchlist hits are copied (disabled if empty)
+	reviewIndex string
+	// mapping is used to create the missing indexes
+	mapping string
+	// compressBody stores a gzipped copy of the body instead of the body itself (see excludeBodyFromSource)
+	compressBody bool
 }
 
-func newElasticIndex(uri string) (Index, error) {
+func newElasticIndex(uri string, opts Options) (Index, error) {
+	nodes, err := parseNodes(uri)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create Elasticsearch client
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	ec, err := elastic.DialContext(ctx,
-		elastic.SetURL(uri),
+	ec, err := elastic.DialContext(ctx, append(elasticClientOptions(nodes),
 		elastic.SetSniff(false),
 		elastic.SetHealthcheck(false),
-	)
+	)...)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := setupElasticSearch(ctx, ec); err != nil {
+	indexes := []string{resourcesIndexName}
+	if opts.ReviewIndex != "" {
+		indexes = append(indexes, opts.ReviewIndex)
+	}
+	mapping, err := buildMapping(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupElasticSearch(ctx, ec, mapping, indexes...); err != nil {
 		return nil, err
 	}
 
 	return &elasticSearchIndex{
-		client: ec,
+		client:       ec,
+		router:       contentRouter{flattenJSON: opts.FlattenJSON},
+		reviewIndex:  opts.ReviewIndex,
+		mapping:      mapping,
+		compressBody: opts.CompressBody,
 	}, nil
 }
 
+// elasticClientOptions returns the client options used to reach given nodes.
+// When there are several nodes, the requests are balanced across them using their weight
+func elasticClientOptions(nodes []*node) []elastic.ClientOptionFunc {
+	if len(nodes) == 1 {
+		return []elastic.ClientOptionFunc{elastic.SetURL(nodes[0].url.String())}
+	}
+
+	// The client only knows the first node, the transport route each request to the selected one
+	transport := &nodesTransport{selector: newNodeSelector(nodes), transport: http.DefaultTransport}
+	return []elastic.ClientOptionFunc{
+		elastic.SetURL(nodes[0].url.String()),
+		elastic.SetHttpClient(&http.Client{Transport: transport}),
+	}
+}
+
 func (e *elasticSearchIndex) IndexResource(resource Resource) error {
-	res, err := indexResource(resource)
+	firstSeen, err := e.firstSeen([]string{resource.URL})
+	if err != nil {
+		return err
+	}
+	resource.FirstSeen = earliest(firstSeen[resource.URL], resource.Time)
+
+	res, err := e.newResourceIdx(resource)
 	if err != nil {
 		return err
 	}
 
-	_, err = e.client.Index().
+	if _, err := e.client.Index().
 		Index(resourcesIndexName).
 		BodyJson(res).
-		Do(context.Background())
-	return err
+		Do(context.Background()); err != nil {
+		return err
+	}
+
+	if e.shouldReview(resource) {
+		// The resource is already in the main index: a failed copy should not make it indexed twice
+		if _, err := e.client.Index().
+			Index(e.reviewIndex).
+			BodyJson(res).
+			Do(context.Background()); err != nil {
+			log.Err(err).Str("url", resource.URL).Str("index", e.reviewIndex).Msg("Error while copying resource to review index")
+		}
+	}
+
+	return nil
 }
 
 func (e *elasticSearchIndex) IndexResources(resources []Resource) error {
+	urls := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		urls = append(urls, resource.URL)
+	}
+	firstSeen, err := e.firstSeen(urls)
+	if err != nil {
+		return err
+	}
+
 	bulkRequest := e.client.Bulk()
 
+	// reviewed[i] is set if the i-th request is a copy to the review index
+	var reviewed []bool
 	for _, resource := range resources {
-		resourceIndex, err := indexResource(resource)
+		// The same URL may be crawled several times in a batch
+		resource.FirstSeen = earliest(firstSeen[resource.URL], resource.Time)
+		firstSeen[resource.URL] = resource.FirstSeen
+
+		resourceIndex, err := e.newResourceIdx(resource)
 		if err != nil {
 			return err
 		}
@@ -118,69 +305,577 @@ func (e *elasticSearchIndex) IndexResources(resources []Resource) error {
 			Index(resourcesIndexName).
 			Doc(resourceIndex)
 		bulkRequest.Add(req)
-	}
+		reviewed = append(reviewed, false)
 
-	_, err := bulkRequest.Do(context.Background())
-	return err
-}
+		if e.shouldReview(resource) {
+			req := elastic.NewBulkIndexRequest().
+				Index(e.reviewIndex).
+				Doc(resourceIndex)
+			bulkRequest.Add(req)
+			reviewed = append(reviewed, true)
+		}
+	}
 
-func setupElasticSearch(ctx context.Context, es *elastic.Client) error {
-	// Setup index if doesn't exist
-	exist, err := es.IndexExists(resourcesIndexName).Do(ctx)
+	res, err := bulkRequest.Do(context.Background())
 	if err != nil {
 		return err
 	}
-	if !exist {
-		log.Debug().Str("index", resourcesIndexName).Msg("Creating missing index")
 
-		q := es.CreateIndex(resourcesIndexName).BodyString(mapping)
-		if _, err := q.Do(ctx); err != nil {
-			return err
+	// The items are returned in the order of the requests
+	failures := map[int]BulkFailure{}
+	pos := -1
+	for i, item := range res.Items {
+		if i < len(reviewed) && reviewed[i] {
+			// Like for a single resource, a failed copy to the review index is not retried
+			for _, result := range item {
+				if result.Error != nil {
+					log.Error().Str("index", e.reviewIndex).Str("reason", result.Error.Reason).
+						Msg("Error while copying resource to review index")
+				}
+			}
+			continue
+		}
+		pos++
+
+		for _, result := range item {
+			if result.Error == nil && result.Status < 300 {
+				continue
+			}
+
+			reason := http.StatusText(result.Status)
+			if result.Error != nil {
+				reason = result.Error.Reason
+			}
+
+			failures[pos] = BulkFailure{Reason: reason, Permanent: isPermanentStatus(result.Status)}
 		}
 	}
 
+	if len(failures) > 0 {
+		return &BulkError{Failures: failures}
+	}
+
 	return nil
 }
 
-func indexResource(resource Resource) (*resourceIdx, error) {
-	doc, err := goquery.NewDocumentFromReader(strings.NewReader(resource.Body))
+// newResourceIdx returns the document indexed for given resource
+func (e *elasticSearchIndex) newResourceIdx(resource Resource) (*resourceIdx, error) {
+	resIdx, err := indexResource(resource, e.router)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.compressBody && resIdx.Body != "" {
+		compressed, err := compressBody(resIdx.Body)
+		if err != nil {
+			return nil, err
+		}
+		resIdx.BodyGz = compressed
+	}
+
+	return resIdx, nil
+}
+
+// firstSeen returns the time at which given URLs have been first seen, by URL (missing if not indexed yet).
+// The documents indexed before the first-seen time was stored are accounted for using their crawl time
+func (e *elasticSearchIndex) firstSeen(urls []string) (map[string]time.Time, error) {
+	var values []interface{}
+	for _, u := range urls {
+		values = append(values, u)
+	}
+
+	agg := elastic.NewTermsAggregation().
+		Field("url.keyword").
+		Size(len(urls)).
+		SubAggregation(firstSeenAgg, elastic.NewMinAggregation().Field("first-seen")).
+		SubAggregation(oldestAgg, elastic.NewMinAggregation().Field("time"))
+
+	res, err := e.client.Search(resourcesIndexName).
+		Query(elastic.NewTermsQuery("url.keyword", values...)).
+		Aggregation(urlsAgg, agg).
+		Size(0).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	firstSeen := map[string]time.Time{}
+	buckets, found := res.Aggregations.Terms(urlsAgg)
+	if !found {
+		return firstSeen, nil
+	}
+
+	for _, bucket := range buckets.Buckets {
+		u, ok := bucket.Key.(string)
+		if !ok {
+			continue
+		}
+
+		var t time.Time
+		for _, name := range []string{firstSeenAgg, oldestAgg} {
+			if min, found := bucket.Min(name); found && min.Value != nil {
+				t = earliest(t, time.Unix(0, int64(*min.Value)*int64(time.Millisecond)).UTC())
+			}
+		}
+		if !t.IsZero() {
+			firstSeen[u] = t
+		}
+	}
+
+	return firstSeen, nil
+}
+
+// earliest returns the earliest of given times, ignoring the zero ones
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+
+	return a
+}
+
+// shouldReview returns true if given resource should also be copied to the review index
+func (e *elasticSearchIndex) shouldReview(resource Resource) bool {
+	return e.reviewIndex != "" && resource.WatchlistHit
+}
+
+// recencyBoostQuery returns given query, the score of the matching resources being halved every scale since their crawl
+func recencyBoostQuery(query elastic.Query, scale time.Duration) elastic.Query {
+	seconds := int64(scale / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	decay := elastic.NewExponentialDecayFunction().
+		FieldName("time").
+		Origin("now").
+		Scale(fmt.Sprintf("%ds", seconds)).
+		Decay(0.5)
+
+	return elastic.NewFunctionScoreQuery().
+		Query(query).
+		AddScoreFunc(decay).
+		BoostMode("multiply")
+}
+
+// isPermanentStatus returns true if a bulk item rejected with given status would be rejected again
+func isPermanentStatus(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests
+}
+
+func (e *elasticSearchIndex) Search(params SearchParams) (SearchResult, error) {
+	var query elastic.Query = elastic.NewMatchAllQuery()
+	if params.Keyword != "" {
+		query = elastic.NewMultiMatchQuery(params.Keyword, "title", "description", "body")
+	}
+	if params.Tag != "" || params.Hostname != "" {
+		boolQuery := elastic.NewBoolQuery().Must(query)
+		if params.Tag != "" {
+			boolQuery = boolQuery.Filter(elastic.NewTermQuery("tag", params.Tag))
+		}
+		if params.Hostname != "" {
+			boolQuery = boolQuery.Filter(elastic.NewTermQuery("hostname", params.Hostname))
+		}
+		query = boolQuery
+	}
+	if params.RecencyScale > 0 {
+		query = recencyBoostQuery(query, params.RecencyScale)
+	}
+
+	search := e.client.Search(resourcesIndexName).
+		Query(query).
+		From(params.Offset).
+		Size(params.Limit).
+		TrackTotalHits(true)
+	// Sorting by crawl time would make the recency boost useless
+	if params.RecencyScale <= 0 {
+		search = search.Sort("time", false)
+	}
+	if params.ExcludeBody {
+		search = search.FetchSourceContext(elastic.NewFetchSourceContext(true).Exclude("body", "body-gz"))
+	}
+	if params.GroupByHostname {
+		// The inner hits are only used to count the resources of each hostname
+		search = search.Collapse(elastic.NewCollapseBuilder("hostname").
+			InnerHit(elastic.NewInnerHit().Name(hostnameGroup).Size(0)))
+	}
+
+	res, err := search.Do(context.Background())
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	result := SearchResult{Total: res.TotalHits()}
+	for _, hit := range res.Hits.Hits {
+		var resIdx resourceIdx
+		if err := json.Unmarshal(hit.Source, &resIdx); err != nil {
+			return SearchResult{}, err
+		}
+
+		body, err := storedBody(resIdx)
+		if err != nil {
+			return SearchResult{}, err
+		}
+
+		resource := Resource{
+			URL:       resIdx.URL,
+			Time:      resIdx.Time,
+			FirstSeen: resIdx.FirstSeen,
+			LastSeen:  resIdx.LastSeen,
+			Body:      body,
+			Headers:   resIdx.Headers,
+			Hash:      resIdx.Hash,
+			Truncated: resIdx.Truncated,
+			Partial:   resIdx.Partial,
+			Alias:     resIdx.Alias,
+			Title:     resIdx.Title,
+			Tag:       resIdx.Tag,
+		}
+		// The documents indexed before the first & last seen times were stored only have their crawl time
+		if resource.FirstSeen.IsZero() {
+			resource.FirstSeen = resIdx.Time
+		}
+		if resource.LastSeen.IsZero() {
+			resource.LastSeen = resIdx.Time
+		}
+		if group, exists := hit.InnerHits[hostnameGroup]; exists && group.Hits != nil && group.Hits.TotalHits != nil {
+			resource.HostnameCount = group.Hits.TotalHits.Value
+		}
+
+		result.Resources = append(result.Resources, resource)
+	}
+
+	return result, nil
+}
+
+func (e *elasticSearchIndex) Delete(url string) (int64, error) {
+	res, err := e.client.DeleteByQuery(resourcesIndexName).
+		Query(elastic.NewTermQuery("url.keyword", url)).
+		Do(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.Deleted, nil
+}
+
+func (e *elasticSearchIndex) ListHostnames(afterKey string, size int) (HostnamesPage, error) {
+	// Use a composite aggregation since it paginates cleanly over high-cardinality terms
+	agg := elastic.NewCompositeAggregation().
+		Size(size).
+		Sources(elastic.NewCompositeAggregationTermsValuesSource("hostname").Field("hostname"))
+	if afterKey != "" {
+		agg = agg.AggregateAfter(map[string]interface{}{"hostname": afterKey})
+	}
+
+	res, err := e.client.Search(resourcesIndexName).
+		Size(0).
+		Aggregation("hostnames", agg).
+		Do(context.Background())
+	if err != nil {
+		return HostnamesPage{}, err
+	}
+
+	page := HostnamesPage{Hostnames: []HostnameCount{}}
+
+	hostnames, found := res.Aggregations.Composite("hostnames")
+	if !found {
+		return page, nil
+	}
+
+	for _, bucket := range hostnames.Buckets {
+		hostname, ok := bucket.Key["hostname"].(string)
+		if !ok {
+			continue
+		}
+
+		page.Hostnames = append(page.Hostnames, HostnameCount{Hostname: hostname, Count: bucket.DocCount})
+	}
+
+	// A partial page means there is no more hostnames
+	if len(hostnames.Buckets) == size {
+		if key, ok := hostnames.AfterKey["hostname"].(string); ok {
+			page.AfterKey = key
+		}
+	}
+
+	return page, nil
+}
+
+func (e *elasticSearchIndex) Coverage(interval string) ([]CoverageBucket, error) {
+	// All the resources of an URL share its first seen time, so each URL is counted in a single bucket
+	agg := elastic.NewDateHistogramAggregation().
+		Field("first-seen").
+		CalendarInterval(interval).
+		SubAggregation(pagesAgg, elastic.NewCardinalityAggregation().Field("url.keyword")).
+		SubAggregation(hostnamesAgg, elastic.NewCardinalityAggregation().Field("hostname"))
+
+	res, err := e.client.Search(resourcesIndexName).
+		Size(0).
+		Aggregation(coverageAgg, agg).
+		Do(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
-	// Get resource title
-	title := doc.Find("title").First().Text()
+	buckets := []CoverageBucket{}
+
+	histogram, found := res.Aggregations.DateHistogram(coverageAgg)
+	if !found {
+		return buckets, nil
+	}
+
+	for _, bucket := range histogram.Buckets {
+		b := CoverageBucket{Time: time.Unix(0, int64(bucket.Key)*int64(time.Millisecond)).UTC()}
+		if pages, found := bucket.Cardinality(pagesAgg); found && pages.Value != nil {
+			b.Pages = int64(*pages.Value)
+		}
+		if hostnames, found := bucket.Cardinality(hostnamesAgg); found && hostnames.Value != nil {
+			b.Hostnames = int64(*hostnames.Value)
+		}
+
+		buckets = append(buckets, b)
+	}
+
+	return buckets, nil
+}
+
+func (e *elasticSearchIndex) UpdateCrawlTime(url string, crawlTime time.Time) error {
+	res, err := e.client.Search(resourcesIndexName).
+		Query(elastic.NewTermQuery("url.keyword", url)).
+		Sort("time", false).
+		FetchSource(false).
+		Size(1).
+		Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if len(res.Hits.Hits) == 0 {
+		return fmt.Errorf("no resource found for %s", url)
+	}
+
+	_, err = e.client.Update().
+		Index(resourcesIndexName).
+		Id(res.Hits.Hits[0].Id).
+		Doc(map[string]interface{}{"time": crawlTime, "last-seen": crawlTime}).
+		Do(context.Background())
+	return err
+}
+
+func (e *elasticSearchIndex) LastCrawlTime(url string) (time.Time, error) {
+	res, err := e.client.Search(resourcesIndexName).
+		Query(elastic.NewTermQuery("url.keyword", url)).
+		Sort("time", false).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("time")).
+		Size(1).
+		Do(context.Background())
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if len(res.Hits.Hits) == 0 {
+		return time.Time{}, nil
+	}
+
+	var resIdx resourceIdx
+	if err := json.Unmarshal(res.Hits.Hits[0].Source, &resIdx); err != nil {
+		return time.Time{}, err
+	}
+
+	return resIdx.Time, nil
+}
+
+func (e *elasticSearchIndex) FindNearDuplicate(simHash uint64, maxDistance int) (string, error) {
+	// Two SimHash within a distance of 3 have at least one identical block
+	var blocks []interface{}
+	for _, block := range simHashBlocks(simHash) {
+		blocks = append(blocks, block)
+	}
+
+	res, err := e.client.Search(resourcesIndexName).
+		Query(elastic.NewTermsQuery("simhash-blocks", blocks...)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("url", "simhash")).
+		Size(nearDuplicateCandidates).
+		Do(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	for _, hit := range res.Hits.Hits {
+		var resIdx resourceIdx
+		if err := json.Unmarshal(hit.Source, &resIdx); err != nil {
+			return "", err
+		}
 
-	// Get meta values
-	meta := map[string]string{}
-	doc.Find("meta").Each(func(i int, s *goquery.Selection) {
-		name, _ := s.Attr("name")
-		value, _ := s.Attr("content")
+		candidate, err := strconv.ParseUint(resIdx.SimHash, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if bits.OnesCount64(simHash^candidate) <= maxDistance {
+			return resIdx.URL, nil
+		}
+	}
+
+	return "", nil
+}
+
+// simHashBlocks split given SimHash into 4 blocks of 16 bits, prefixed by their position
+func simHashBlocks(simHash uint64) []string {
+	blocks := make([]string, 4)
+	for i := range blocks {
+		blocks[i] = fmt.Sprintf("%d:%04x", i, (simHash>>(uint(i)*16))&0xFFFF)
+	}
 
-		// if name is empty then try to lookup using property
-		if name == "" {
-			name, _ = s.Attr("property")
-			if name == "" {
-				return
+	return blocks
+}
+
+func (e *elasticSearchIndex) ForEachHostnameURL(hostname string, handler URLHandler) error {
+	query := elastic.NewBoolQuery().Should(
+		elastic.NewPrefixQuery("url.keyword", fmt.Sprintf("http://%s", hostname)),
+		elastic.NewPrefixQuery("url.keyword", fmt.Sprintf("https://%s", hostname)),
+	)
+
+	// Use a composite aggregation to page through the distinct URLs
+	// without loading all of them in memory
+	var afterKey map[string]interface{}
+	for {
+		agg := elastic.NewCompositeAggregation().
+			Size(urlsPageSize).
+			Sources(elastic.NewCompositeAggregationTermsValuesSource("url").Field("url.keyword"))
+		if afterKey != nil {
+			agg = agg.AggregateAfter(afterKey)
+		}
+
+		res, err := e.client.Search(resourcesIndexName).
+			Query(query).
+			Size(0).
+			Aggregation("urls", agg).
+			Do(context.Background())
+		if err != nil {
+			return err
+		}
+
+		urls, found := res.Aggregations.Composite("urls")
+		if !found || len(urls.Buckets) == 0 {
+			return nil
+		}
+
+		for _, bucket := range urls.Buckets {
+			rawURL, ok := bucket.Key["url"].(string)
+			if !ok {
+				continue
+			}
+
+			// The prefix query may match longer hostnames
+			if u, err := url.Parse(rawURL); err != nil || u.Hostname() != hostname {
+				continue
+			}
+
+			if err := handler(rawURL); err != nil {
+				return err
 			}
 		}
 
-		meta[strings.ToLower(name)] = value
-	})
+		afterKey = urls.AfterKey
+		if afterKey == nil {
+			return nil
+		}
+	}
+}
+
+// buildMapping returns the mapping to use when creating the index
+func buildMapping(opts Options) (string, error) {
+	mapping := opts.Mapping
+	if mapping == "" {
+		analyzer := opts.Analyzer
+		if analyzer == "" {
+			analyzer = defaultAnalyzer
+		}
+
+		mapping = fmt.Sprintf(mappingTemplate, analyzer)
+	}
+
+	if opts.CompressBody {
+		return excludeBodyFromSource(mapping)
+	}
+
+	return mapping, nil
+}
+
+func setupElasticSearch(ctx context.Context, es *elastic.Client, mapping string, indexes ...string) error {
+	for _, name := range indexes {
+		// Setup index if doesn't exist
+		exist, err := es.IndexExists(name).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			log.Debug().Str("index", name).Msg("Creating missing index")
+
+			q := es.CreateIndex(name).BodyString(mapping)
+			if _, err := q.Do(ctx); err != nil {
+				return err
+			}
+		}
+	}
 
+	return nil
+}
+
+func indexResource(resource Resource, router contentRouter) (*resourceIdx, error) {
 	// Lowercase headers
 	lowerCasedHeaders := map[string]string{}
 	for key, value := range resource.Headers {
 		lowerCasedHeaders[strings.ToLower(key)] = value
 	}
 
-	return &resourceIdx{
-		URL:         resource.URL,
-		Body:        resource.Body,
-		Time:        resource.Time,
-		Title:       title,
-		Meta:        meta,
-		Description: meta["description"],
-		Headers:     lowerCasedHeaders,
-	}, nil
+	// Extract the body & metadata according to the content type
+	extracted, err := router.extract(lowerCasedHeaders["content-type"], resource.Body, resource.ParseLength)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname := ""
+	if u, err := url.Parse(resource.URL); err == nil {
+		hostname = u.Hostname()
+	}
+
+	resIdx := &resourceIdx{
+		URL:             resource.URL,
+		Hostname:        hostname,
+		Body:            extracted.Body,
+		Time:            resource.Time,
+		FirstSeen:       earliest(resource.FirstSeen, resource.Time),
+		LastSeen:        resource.Time,
+		Title:           extracted.Title,
+		Meta:            extracted.Meta,
+		Description:     extracted.Meta["description"],
+		Headers:         lowerCasedHeaders,
+		Hash:            resource.Hash,
+		Truncated:       resource.Truncated,
+		Partial:         resource.Partial,
+		Alias:           resource.Alias,
+		Tag:             resource.Tag,
+		Entities:        resource.Entities,
+		MatchedKeywords: resource.MatchedKeywords,
+		WatchlistHit:    resource.WatchlistHit,
+		Via:             resource.Via,
+		OnionLinks:      resource.OnionLinks,
+		Fields:          resource.Fields,
+		StructuredData:  resource.StructuredData,
+	}
+
+	if resource.OmitBody {
+		resIdx.Body = ""
+	}
+
+	if resource.SimHash != 0 {
+		resIdx.SimHash = strconv.FormatUint(resource.SimHash, 10)
+		resIdx.SimHashBlocks = simHashBlocks(resource.SimHash)
+		resIdx.NearDuplicateOf = resource.NearDuplicateOf
+	}
+
+	return resIdx, nil
 }
@@ -1,7 +1,17 @@
 package index
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/olivere/elastic/v7"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -24,18 +34,31 @@ This is sparta
 	}
 
 	resIdx, err := indexResource(Resource{
-		URL:     "https://example.org/300",
-		Time:    time.Time{},
-		Body:    body,
-		Headers: map[string]string{"Content-Type": "application/json"},
-	})
+		URL:        "https://example.org/300",
+		Time:       time.Time{},
+		Body:       body,
+		Headers:    map[string]string{"Content-Type": "text/html"},
+		Entities:   map[string][]string{"email": {"admin@example.org"}},
+		OnionLinks: []string{"https://example.onion"},
+	}, contentRouter{})
 	if err != nil {
 		t.FailNow()
 	}
 
+	if !reflect.DeepEqual(resIdx.OnionLinks, []string{"https://example.onion"}) {
+		t.Errorf("got %v want %v", resIdx.OnionLinks, []string{"https://example.onion"})
+	}
+
+	if len(resIdx.Entities["email"]) != 1 || resIdx.Entities["email"][0] != "admin@example.org" {
+		t.Fail()
+	}
+
 	if resIdx.URL != "https://example.org/300" {
 		t.Fail()
 	}
+	if resIdx.Hostname != "example.org" {
+		t.Fail()
+	}
 	if resIdx.Title != "Creekorful Inc" {
 		t.Fail()
 	}
@@ -55,7 +78,774 @@ This is sparta
 		t.Fail()
 	}
 
-	if resIdx.Headers["content-type"] != "application/json" {
+	if resIdx.Headers["content-type"] != "text/html" {
 		t.Fail()
 	}
 }
+
+func TestIndexResource_OmitBody(t *testing.T) {
+	resIdx, err := indexResource(Resource{
+		URL:      "https://example.org/private",
+		Body:     "<title>Private forum</title>Some private content",
+		Headers:  map[string]string{"Content-Type": "text/html"},
+		Hash:     "abcd",
+		OmitBody: true,
+	}, contentRouter{})
+	if err != nil {
+		t.FailNow()
+	}
+
+	if resIdx.Body != "" {
+		t.Errorf("body should be omitted: got: %s", resIdx.Body)
+	}
+	if resIdx.Title != "Private forum" || resIdx.Hostname != "example.org" || resIdx.Hash != "abcd" {
+		t.Errorf("wrong metadata: got: %s/%s/%s", resIdx.Title, resIdx.Hostname, resIdx.Hash)
+	}
+	if resIdx.Headers["content-type"] != "text/html" {
+		t.Errorf("wrong content type: got: %s", resIdx.Headers["content-type"])
+	}
+}
+
+func TestElasticSearchIndex_IndexResources_PartialFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/resources/_search" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"hits":{"total":{"value":0,"relation":"eq"},"hits":[]}}`))
+			return
+		}
+		if r.URL.Path != "/_bulk" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"took":3,"errors":true,"items":[` +
+			`{"index":{"_index":"resources","_id":"1","status":201}},` +
+			`{"index":{"_index":"resources","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}},` +
+			`{"index":{"_index":"resources","status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}}]}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	err = idx.IndexResources([]Resource{
+		{URL: "https://example.onion/1"},
+		{URL: "https://example.onion/2"},
+		{URL: "https://example.onion/3"},
+	})
+
+	var bulkErr *BulkError
+	if !errors.As(err, &bulkErr) {
+		t.Fatalf("got %v want bulk error", err)
+	}
+
+	want := map[int]BulkFailure{
+		1: {Reason: "failed to parse", Permanent: true},
+		2: {Reason: "queue full", Permanent: false},
+	}
+	if !reflect.DeepEqual(bulkErr.Failures, want) {
+		t.Errorf("got %+v want %+v", bulkErr.Failures, want)
+	}
+}
+
+func TestElasticSearchIndex_IndexResource_ReviewIndex(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"_id":"1","result":"created"}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client, reviewIndex: "review"}
+
+	// Not flagged: only indexed in the main index
+	if err := idx.IndexResource(Resource{URL: "https://example.onion"}); err != nil {
+		t.Fatalf("error while indexing resource: %s", err)
+	}
+	if want := []string{"/resources/_search", "/resources/_doc/"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v want %v", paths, want)
+	}
+
+	// Flagged: copied to the review index too
+	paths = nil
+	if err := idx.IndexResource(Resource{URL: "https://example.onion", WatchlistHit: true}); err != nil {
+		t.Fatalf("error while indexing resource: %s", err)
+	}
+	if want := []string{"/resources/_search", "/resources/_doc/", "/review/_doc/"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v want %v", paths, want)
+	}
+}
+
+func TestElasticSearchIndex_IndexResources_ReviewIndex(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+
+		// The review copy of the second resource is rejected, the third resource is rejected
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"took":3,"errors":true,"items":[` +
+			`{"index":{"_index":"resources","_id":"1","status":201}},` +
+			`{"index":{"_index":"resources","_id":"2","status":201}},` +
+			`{"index":{"_index":"review","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}},` +
+			`{"index":{"_index":"resources","status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}}]}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client, reviewIndex: "review"}
+
+	err = idx.IndexResources([]Resource{
+		{URL: "https://example.onion/1"},
+		{URL: "https://example.onion/2", WatchlistHit: true},
+		{URL: "https://example.onion/3"},
+	})
+
+	if got := strings.Count(body, `"_index":"resources"`); got != 3 {
+		t.Errorf("got %d resources requests want 3", got)
+	}
+	if got := strings.Count(body, `"_index":"review"`); got != 1 {
+		t.Errorf("got %d review requests want 1", got)
+	}
+
+	var bulkErr *BulkError
+	if !errors.As(err, &bulkErr) {
+		t.Fatalf("got %v want bulk error", err)
+	}
+
+	want := map[int]BulkFailure{2: {Reason: "queue full", Permanent: false}}
+	if !reflect.DeepEqual(bulkErr.Failures, want) {
+		t.Errorf("got %+v want %+v", bulkErr.Failures, want)
+	}
+}
+
+func TestElasticSearchIndex_IndexResource_FirstSeen(t *testing.T) {
+	var stored map[string]interface{}
+	var firstSeen string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/resources/_search":
+			b, _ := ioutil.ReadAll(r.Body)
+			if !strings.Contains(string(b), `"query":{"terms":{"url.keyword":["https://example.onion"]}}`) {
+				t.Errorf("wrong query: %s", string(b))
+			}
+
+			// Only the updated resource has been indexed already
+			buckets := ``
+			if firstSeen != "" {
+				buckets = `{"key":"https://example.onion","doc_count":1,"first-seen":{"value":` + firstSeen + `},"oldest":{"value":null}}`
+			}
+			_, _ = w.Write([]byte(`{"hits":{"total":{"value":0,"relation":"eq"},"hits":[]},"aggregations":{"urls":{"buckets":[` + buckets + `]}}}`))
+		case "/resources/_doc/":
+			b, _ := ioutil.ReadAll(r.Body)
+			stored = nil
+			_ = json.Unmarshal(b, &stored)
+			_, _ = w.Write([]byte(`{"_id":"1","result":"created"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	// Initial index: first seen now
+	if err := idx.IndexResource(Resource{URL: "https://example.onion", Time: time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)}); err != nil {
+		t.Fatalf("error while indexing resource: %s", err)
+	}
+	if stored["first-seen"] != "2021-03-10T12:00:00Z" || stored["last-seen"] != "2021-03-10T12:00:00Z" {
+		t.Errorf("wrong first/last seen: %v/%v", stored["first-seen"], stored["last-seen"])
+	}
+
+	// Update: the first seen time is preserved
+	firstSeen = strconv.FormatInt(time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC).UnixNano()/int64(time.Millisecond), 10)
+	if err := idx.IndexResource(Resource{URL: "https://example.onion", Time: time.Date(2021, time.April, 1, 8, 0, 0, 0, time.UTC)}); err != nil {
+		t.Fatalf("error while indexing resource: %s", err)
+	}
+	if stored["first-seen"] != "2021-03-10T12:00:00Z" || stored["last-seen"] != "2021-04-01T08:00:00Z" {
+		t.Errorf("wrong first/last seen: %v/%v", stored["first-seen"], stored["last-seen"])
+	}
+}
+
+func TestElasticSearchIndex_IndexResources_FirstSeen(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/resources/_search":
+			// The first resource has been indexed before the first seen time was stored
+			_, _ = w.Write([]byte(`{"hits":{"total":{"value":0,"relation":"eq"},"hits":[]},"aggregations":{"urls":{"buckets":[` +
+				`{"key":"https://example.onion/1","doc_count":2,"first-seen":{"value":null},"oldest":{"value":1615377600000}}]}}}`))
+		case "/_bulk":
+			b, _ := ioutil.ReadAll(r.Body)
+			body = string(b)
+			_, _ = w.Write([]byte(`{"took":3,"errors":false,"items":[` +
+				`{"index":{"_index":"resources","_id":"1","status":201}},` +
+				`{"index":{"_index":"resources","_id":"2","status":201}},` +
+				`{"index":{"_index":"resources","_id":"3","status":201}}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	if err := idx.IndexResources([]Resource{
+		{URL: "https://example.onion/1", Time: time.Date(2021, time.April, 1, 8, 0, 0, 0, time.UTC)},
+		{URL: "https://example.onion/2", Time: time.Date(2021, time.April, 1, 8, 0, 0, 0, time.UTC)},
+		// crawled again within the batch
+		{URL: "https://example.onion/2", Time: time.Date(2021, time.April, 1, 9, 0, 0, 0, time.UTC)},
+	}); err != nil {
+		t.Fatalf("error while indexing resources: %s", err)
+	}
+
+	var firstSeen []interface{}
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &doc); err != nil {
+			t.Fatalf("invalid bulk line: %s", line)
+		}
+		if value, exists := doc["first-seen"]; exists {
+			firstSeen = append(firstSeen, value)
+		}
+	}
+
+	want := []interface{}{"2021-03-10T12:00:00Z", "2021-04-01T08:00:00Z", "2021-04-01T08:00:00Z"}
+	if !reflect.DeepEqual(firstSeen, want) {
+		t.Errorf("got %v want %v", firstSeen, want)
+	}
+}
+
+func TestElasticSearchIndex_Search(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/resources/_search" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(b), `"multi_match":{"fields":["title","description","body"],"query":"sparta"}`) {
+			t.Errorf("wrong query: %s", string(b))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":12,"relation":"eq"},"hits":[` +
+			`{"_index":"resources","_id":"1","_source":{"url":"https://example.onion","body":"This is sparta",` +
+			`"time":"2021-03-10T12:00:00Z","hash":"abc","headers":{"server":"nginx"}}}]}}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	res, err := idx.Search(SearchParams{Keyword: "sparta", Limit: 1})
+	if err != nil {
+		t.FailNow()
+	}
+
+	if res.Total != 12 {
+		t.Errorf("got %d want %d", res.Total, 12)
+	}
+
+	// The first & last seen times default to the crawl time
+	want := []Resource{{
+		URL:       "https://example.onion",
+		Body:      "This is sparta",
+		Time:      time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC),
+		FirstSeen: time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC),
+		LastSeen:  time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC),
+		Hash:      "abc",
+		Headers:   map[string]string{"server": "nginx"},
+	}}
+	if !reflect.DeepEqual(res.Resources, want) {
+		t.Errorf("got %+v want %+v", res.Resources, want)
+	}
+}
+
+func TestElasticSearchIndex_Search_RecencyScale(t *testing.T) {
+	type test struct {
+		scale time.Duration
+		// want is expected in the request, unwanted is not
+		want     []string
+		unwanted []string
+	}
+
+	tests := []test{
+		{
+			want:     []string{`"sort":[{"time":{"order":"desc"}}]`},
+			unwanted: []string{`"function_score"`},
+		},
+		{
+			scale: 30 * 24 * time.Hour,
+			want: []string{
+				`"function_score":{"boost_mode":"multiply","functions":[{"exp":{"time":{"decay":0.5,"origin":"now","scale":"2592000s"}}}],` +
+					`"query":{"multi_match":{"fields":["title","description","body"],"query":"sparta"}}}`,
+			},
+			unwanted: []string{`"sort"`},
+		},
+	}
+
+	for _, tst := range tests {
+		var body string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			body = string(b)
+
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"hits":{"total":{"value":0,"relation":"eq"},"hits":[]}}`))
+		}))
+
+		client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+		if err != nil {
+			t.FailNow()
+		}
+
+		idx := elasticSearchIndex{client: client}
+		if _, err := idx.Search(SearchParams{Keyword: "sparta", Limit: 10, RecencyScale: tst.scale}); err != nil {
+			t.Errorf("error while searching: %s", err)
+		}
+
+		for _, want := range tst.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: request %s does not contain %s", tst.scale, body, want)
+			}
+		}
+		for _, unwanted := range tst.unwanted {
+			if strings.Contains(body, unwanted) {
+				t.Errorf("%s: request %s contains %s", tst.scale, body, unwanted)
+			}
+		}
+
+		srv.Close()
+	}
+}
+
+func TestElasticSearchIndex_Search_GroupByHostname(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(b), `"collapse":{"field":"hostname","inner_hits":{"name":"hostname","size":0}}`) {
+			t.Errorf("wrong query: %s", string(b))
+		}
+
+		// ES returns the most recent resource of each hostname
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":5,"relation":"eq"},"hits":[` +
+			`{"_index":"resources","_id":"1","_source":{"url":"https://forum.onion/threads/2","hostname":"forum.onion"},` +
+			`"inner_hits":{"hostname":{"hits":{"total":{"value":4,"relation":"eq"},"hits":[]}}}},` +
+			`{"_index":"resources","_id":"2","_source":{"url":"https://market.onion","hostname":"market.onion"},` +
+			`"inner_hits":{"hostname":{"hits":{"total":{"value":1,"relation":"eq"},"hits":[]}}}}]}}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	res, err := idx.Search(SearchParams{Limit: 10, GroupByHostname: true})
+	if err != nil {
+		t.FailNow()
+	}
+
+	want := []Resource{
+		{URL: "https://forum.onion/threads/2", HostnameCount: 4},
+		{URL: "https://market.onion", HostnameCount: 1},
+	}
+	if !reflect.DeepEqual(res.Resources, want) {
+		t.Errorf("got %+v want %+v", res.Resources, want)
+	}
+}
+
+func TestElasticSearchIndex_Search_Tag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(b), `"filter":{"term":{"tag":"forums"}}`) {
+			t.Errorf("wrong query: %s", string(b))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":1,"relation":"eq"},"hits":[` +
+			`{"_index":"resources","_id":"1","_source":{"url":"https://example.onion","tag":"forums"}}]}}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	res, err := idx.Search(SearchParams{Tag: "forums", Limit: 10})
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(res.Resources) != 1 || res.Resources[0].Tag != "forums" {
+		t.Errorf("wrong resources: %+v", res.Resources)
+	}
+}
+
+func TestElasticSearchIndex_Search_Hostname(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		want := `{"bool":{"filter":{"term":{"hostname":"example.onion"}},` +
+			`"must":{"multi_match":{"fields":["title","description","body"],"query":"sparta"}}}}`
+		if !strings.Contains(string(b), want) {
+			t.Errorf("wrong query: %s", string(b))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":1,"relation":"eq"},"hits":[` +
+			`{"_index":"resources","_id":"1","_source":{"url":"https://example.onion/sparta","hostname":"example.onion"}}]}}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	res, err := idx.Search(SearchParams{Keyword: "sparta", Hostname: "example.onion", Limit: 10})
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(res.Resources) != 1 || res.Resources[0].URL != "https://example.onion/sparta" {
+		t.Errorf("wrong resources: %+v", res.Resources)
+	}
+}
+
+func TestElasticSearchIndex_Search_TagAndHostname(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(b), `"filter":[{"term":{"tag":"forums"}},{"term":{"hostname":"example.onion"}}]`) {
+			t.Errorf("wrong query: %s", string(b))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":0,"relation":"eq"},"hits":[]}}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	if _, err := idx.Search(SearchParams{Tag: "forums", Hostname: "example.onion", Limit: 10}); err != nil {
+		t.FailNow()
+	}
+}
+
+func TestElasticSearchIndex_Delete(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/resources/_delete_by_query" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(b), `{"term":{"url.keyword":"https://example.onion"}}`) {
+			t.Errorf("wrong query: %s", string(b))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"deleted":2}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	count, err := idx.Delete("https://example.onion")
+	if err != nil {
+		t.FailNow()
+	}
+	if count != 2 {
+		t.Errorf("got %d want %d", count, 2)
+	}
+}
+
+func TestElasticSearchIndex_FindNearDuplicate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(b), `"simhash-blocks":["0:000f","1:0000","2:0000","3:0000"]`) {
+			t.Errorf("wrong query: %s", string(b))
+		}
+
+		// first candidate share a block but is too far away
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":2,"relation":"eq"},"hits":[` +
+			`{"_index":"resources","_id":"1","_source":{"url":"https://far.onion","simhash":"4294901775"}},` +
+			`{"_index":"resources","_id":"2","_source":{"url":"https://near.onion","simhash":"7"}}]}}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	u, err := idx.FindNearDuplicate(15, 3)
+	if err != nil {
+		t.FailNow()
+	}
+	if u != "https://near.onion" {
+		t.Errorf("got %s want %s", u, "https://near.onion")
+	}
+}
+
+func TestElasticSearchIndex_ListHostnames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(b), `"after":{"hostname":"a.onion"}`) {
+			t.Errorf("wrong query: %s", string(b))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":45,"relation":"eq"},"hits":[]},"aggregations":{"hostnames":{` +
+			`"after_key":{"hostname":"market.onion"},"buckets":[` +
+			`{"key":{"hostname":"forum.onion"},"doc_count":42},{"key":{"hostname":"market.onion"},"doc_count":3}]}}}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	page, err := idx.ListHostnames("a.onion", 2)
+	if err != nil {
+		t.FailNow()
+	}
+
+	want := []HostnameCount{{Hostname: "forum.onion", Count: 42}, {Hostname: "market.onion", Count: 3}}
+	if !reflect.DeepEqual(page.Hostnames, want) {
+		t.Errorf("got %v want %v", page.Hostnames, want)
+	}
+	if page.AfterKey != "market.onion" {
+		t.Errorf("got %s want %s", page.AfterKey, "market.onion")
+	}
+
+	// Partial page: no more hostnames
+	if page, err = idx.ListHostnames("a.onion", 3); err != nil || page.AfterKey != "" {
+		t.Errorf("last page should not have an after key: %v", page)
+	}
+}
+
+func TestElasticSearchIndex_Coverage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(b), `"date_histogram":{"calendar_interval":"day","field":"first-seen"}`) {
+			t.Errorf("wrong query: %s", string(b))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":45,"relation":"eq"},"hits":[]},"aggregations":{"coverage":{"buckets":[` +
+			`{"key_as_string":"2021-03-10T00:00:00.000Z","key":1615334400000,"doc_count":40,"pages":{"value":30},"hostnames":{"value":4}},` +
+			`{"key_as_string":"2021-03-11T00:00:00.000Z","key":1615420800000,"doc_count":0,"pages":{"value":0},"hostnames":{"value":0}}]}}}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	buckets, err := idx.Coverage("day")
+	if err != nil {
+		t.Fatalf("error while computing coverage: %s", err)
+	}
+
+	want := []CoverageBucket{
+		{Time: time.Date(2021, time.March, 10, 0, 0, 0, 0, time.UTC), Pages: 30, Hostnames: 4},
+		{Time: time.Date(2021, time.March, 11, 0, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(buckets, want) {
+		t.Errorf("got %v want %v", buckets, want)
+	}
+}
+
+func TestElasticSearchIndex_UpdateCrawlTime(t *testing.T) {
+	updated := false
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/resources/_search":
+			_, _ = w.Write([]byte(`{"hits":{"total":{"value":2,"relation":"eq"},"hits":[{"_index":"resources","_id":"latest"}]}}`))
+		case "/resources/_update/latest":
+			b, _ := ioutil.ReadAll(r.Body)
+			if string(b) != `{"doc":{"last-seen":"2021-03-10T12:00:00Z","time":"2021-03-10T12:00:00Z"}}` {
+				t.Errorf("wrong update: %s", string(b))
+			}
+
+			updated = true
+			_, _ = w.Write([]byte(`{"_index":"resources","_id":"latest","result":"updated"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	if err := idx.UpdateCrawlTime("https://example.onion", time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.FailNow()
+	}
+	if !updated {
+		t.Error("resource should have been updated")
+	}
+}
+
+func TestElasticSearchIndex_LastCrawlTime(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		b, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(b), "https://unknown.onion") {
+			_, _ = w.Write([]byte(`{"hits":{"total":{"value":0,"relation":"eq"},"hits":[]}}`))
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":2,"relation":"eq"},"hits":[{"_index":"resources","_id":"latest","_source":{"time":"2021-03-10T12:00:00Z"}}]}}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	idx := elasticSearchIndex{client: client}
+
+	crawlTime, err := idx.LastCrawlTime("https://example.onion")
+	if err != nil {
+		t.FailNow()
+	}
+	if want := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC); !crawlTime.Equal(want) {
+		t.Errorf("got %s want %s", crawlTime, want)
+	}
+
+	crawlTime, err = idx.LastCrawlTime("https://unknown.onion")
+	if err != nil {
+		t.FailNow()
+	}
+	if !crawlTime.IsZero() {
+		t.Errorf("got %s want zero time", crawlTime)
+	}
+}
+
+func TestSimHashBlocks(t *testing.T) {
+	want := []string{"0:cdef", "1:89ab", "2:4567", "3:0123"}
+	if got := simHashBlocks(0x0123456789abcdef); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestSetupElasticSearch(t *testing.T) {
+	type test struct {
+		opts Options
+		want string
+	}
+
+	tests := []test{
+		{opts: Options{}, want: `"analyzer":"standard"`},
+		{opts: Options{Analyzer: "french"}, want: `"analyzer":"french"`},
+		{opts: Options{Analyzer: "french", Mapping: `{"mappings":{"properties":{"body":{"type":"text","analyzer":"russian"}}}}`}, want: `"analyzer":"russian"`},
+	}
+
+	for _, tst := range tests {
+		var createBody string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodHead:
+				// Index does not exist
+				w.WriteHeader(http.StatusNotFound)
+			case http.MethodPut:
+				b, _ := ioutil.ReadAll(r.Body)
+				createBody = string(b)
+
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"acknowledged":true,"index":"resources"}`))
+			}
+		}))
+
+		client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+		if err != nil {
+			t.FailNow()
+		}
+
+		mapping, err := buildMapping(tst.opts)
+		if err != nil {
+			t.FailNow()
+		}
+
+		if err := setupElasticSearch(context.Background(), client, mapping, resourcesIndexName); err != nil {
+			t.Errorf("error while setting up index: %s", err)
+		}
+
+		if !strings.Contains(strings.Join(strings.Fields(createBody), ""), tst.want) {
+			t.Errorf("create-index request %s does not contains %s", createBody, tst.want)
+		}
+
+		srv.Close()
+	}
+}
@@ -0,0 +1,170 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// extraction is what is extracted from a resource body to be indexed
+type extraction struct {
+	Body  string
+	Title string
+	Meta  map[string]string
+}
+
+// extractFunc extract the body & metadata to index from a resource body
+type extractFunc func(body string) (extraction, error)
+
+// contentRouter dispatch the resource bodies to the extractor matching their content type
+type contentRouter struct {
+	// flattenJSON index the JSON documents as `path: value` lines instead of pretty-printing them
+	flattenJSON bool
+}
+
+// extract the body & metadata to index from given body, using its content type.
+// The HTML title & meta are only parsed from the first parseLength bytes of the body (whole body if 0)
+func (r contentRouter) extract(contentType, body string, parseLength int) (extraction, error) {
+	if parseLength > 0 && len(body) > parseLength && isHTML(contentType) {
+		extracted, err := extractHTML(body[:parseLength])
+		if err != nil {
+			return extraction{}, err
+		}
+
+		// The HTML body is kept as-is
+		extracted.Body = body
+		return extracted, nil
+	}
+
+	return r.route(contentType)(body)
+}
+
+// route returns the extractor to use for given content type
+func (r contentRouter) route(contentType string) extractFunc {
+	mediaType := parseMediaType(contentType)
+
+	switch {
+	case isHTML(mediaType):
+		return extractHTML
+	case mediaType == "text/plain":
+		return extractPlainText
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		if r.flattenJSON {
+			return extractFlattenedJSON
+		}
+		return extractJSON
+	default:
+		return extractDefault
+	}
+}
+
+// parseMediaType returns the lowercased media type of given content type
+func parseMediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+// isHTML returns true if given content type is an HTML one
+func isHTML(contentType string) bool {
+	mediaType := parseMediaType(contentType)
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// extractHTML keep the body as-is and extract the title & meta values
+func extractHTML(body string) (extraction, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return extraction{}, err
+	}
+
+	// Get meta values
+	meta := map[string]string{}
+	doc.Find("meta").Each(func(i int, s *goquery.Selection) {
+		name, _ := s.Attr("name")
+		value, _ := s.Attr("content")
+
+		// if name is empty then try to lookup using property
+		if name == "" {
+			name, _ = s.Attr("property")
+			if name == "" {
+				return
+			}
+		}
+
+		meta[strings.ToLower(name)] = value
+	})
+
+	return extraction{
+		Body:  body,
+		Title: doc.Find("title").First().Text(),
+		Meta:  meta,
+	}, nil
+}
+
+// extractPlainText keep the body as-is
+func extractPlainText(body string) (extraction, error) {
+	return extraction{Body: body, Meta: map[string]string{}}, nil
+}
+
+// extractJSON pretty-print the body, invalid documents are kept as-is
+func extractJSON(body string) (extraction, error) {
+	var b bytes.Buffer
+	if err := json.Indent(&b, []byte(body), "", "  "); err != nil {
+		return extractPlainText(body)
+	}
+
+	return extraction{Body: b.String(), Meta: map[string]string{}}, nil
+}
+
+// extractFlattenedJSON convert the body into `path: value` lines, invalid documents are kept as-is
+func extractFlattenedJSON(body string) (extraction, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return extractPlainText(body)
+	}
+
+	var lines []string
+	flattenJSON("", doc, &lines)
+
+	return extraction{Body: strings.Join(lines, "\n"), Meta: map[string]string{}}, nil
+}
+
+func flattenJSON(path string, value interface{}, lines *[]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			flattenJSON(childPath, v[key], lines)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenJSON(fmt.Sprintf("%s[%d]", path, i), child, lines)
+		}
+	case nil:
+		*lines = append(*lines, fmt.Sprintf("%s: null", path))
+	default:
+		*lines = append(*lines, fmt.Sprintf("%s: %v", path, v))
+	}
+}
+
+// extractDefault is used for the unknown (or missing) content types: the body is sniffed
+// and handled as HTML if it looks like so, as plain text otherwise
+func extractDefault(body string) (extraction, error) {
+	if strings.HasPrefix(http.DetectContentType([]byte(body)), "text/html") {
+		return extractHTML(body)
+	}
+
+	return extractPlainText(body)
+}
@@ -0,0 +1,118 @@
+package index
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContentRouter_PlainText(t *testing.T) {
+	body := "<title>Not a title</title>\nJust some text"
+
+	res, err := contentRouter{}.extract("text/plain; charset=utf-8", body, 0)
+	if err != nil {
+		t.FailNow()
+	}
+
+	// The body should be stored as-is without looking for HTML metadata
+	if res.Body != body || res.Title != "" || len(res.Meta) != 0 {
+		t.Errorf("wrong extraction: %+v", res)
+	}
+}
+
+func TestContentRouter_JSON(t *testing.T) {
+	body := `{"name":"market","tags":["drugs",null],"vendor":{"id":12}}`
+
+	res, err := contentRouter{}.extract("application/json", body, 0)
+	if err != nil {
+		t.FailNow()
+	}
+
+	want := `{
+  "name": "market",
+  "tags": [
+    "drugs",
+    null
+  ],
+  "vendor": {
+    "id": 12
+  }
+}`
+	if res.Body != want {
+		t.Errorf("got %s want %s", res.Body, want)
+	}
+
+	// Flattened
+	res, err = contentRouter{flattenJSON: true}.extract("application/ld+json", body, 0)
+	if err != nil {
+		t.FailNow()
+	}
+
+	want = "name: market\ntags[0]: drugs\ntags[1]: null\nvendor.id: 12"
+	if res.Body != want {
+		t.Errorf("got %s want %s", res.Body, want)
+	}
+
+	// Invalid documents are stored as-is
+	res, err = contentRouter{}.extract("application/json", "{invalid", 0)
+	if err != nil {
+		t.FailNow()
+	}
+	if res.Body != "{invalid" {
+		t.Errorf("got %s want %s", res.Body, "{invalid")
+	}
+}
+
+func TestContentRouter_HTML(t *testing.T) {
+	body := `<html><head><title>Forum</title><meta name="Description" content="Hello"></head></html>`
+
+	for _, contentType := range []string{"text/html; charset=UTF-8", "", "application/octet-stream"} {
+		res, err := contentRouter{}.extract(contentType, body, 0)
+		if err != nil {
+			t.FailNow()
+		}
+
+		if res.Body != body || res.Title != "Forum" || res.Meta["description"] != "Hello" {
+			t.Errorf("%s: wrong extraction: %+v", contentType, res)
+		}
+	}
+}
+
+func TestContentRouter_Default(t *testing.T) {
+	res, err := contentRouter{}.extract("text/css", "body { color: red; }", 0)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if res.Body != "body { color: red; }" || res.Title != "" {
+		t.Errorf("wrong extraction: %+v", res)
+	}
+}
+
+func TestContentRouter_Extract_ParseLength(t *testing.T) {
+	body := `<html><head><title>Huge page</title><meta name="description" content="first"></head><body>` +
+		strings.Repeat("<p>lorem ipsum</p>", 1000) + `<meta name="keywords" content="late"></body></html>`
+
+	res, err := contentRouter{}.extract("text/html", body, 200)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if res.Title != "Huge page" || res.Meta["description"] != "first" {
+		t.Errorf("wrong metadata: %s %v", res.Title, res.Meta)
+	}
+	if _, exists := res.Meta["keywords"]; exists {
+		t.Error("meta past the parsed prefix should be missed")
+	}
+	if res.Body != body {
+		t.Error("HTML body should be kept as-is")
+	}
+
+	// Only the HTML is concerned
+	res, err = contentRouter{}.extract("text/plain", "hello world", 5)
+	if err != nil {
+		t.FailNow()
+	}
+	if res.Body != "hello world" {
+		t.Errorf("got %s want %s", res.Body, "hello world")
+	}
+}
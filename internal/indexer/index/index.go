@@ -3,7 +3,10 @@ package index
 //go:generate mockgen -destination=../index_mock/index_mock.go -package=index_mock . Index
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/olivere/elastic/v7"
 	"time"
 )
 
@@ -14,25 +17,208 @@ const (
 	Local = "local"
 )
 
+// ErrNotSupported is returned when the operation is not supported by the driver
+var ErrNotSupported = errors.New("operation not supported by the driver")
+
 // Resource represent a resource that should be indexed
 type Resource struct {
-	URL     string
-	Time    time.Time
-	Body    string
-	Headers map[string]string
+	URL  string
+	Time time.Time
+	// FirstSeen is the time the URL has been crawled for the first time (set when indexing)
+	FirstSeen time.Time
+	// LastSeen is the time the URL has been crawled for the last time (only set on the resources returned by a search)
+	LastSeen time.Time
+	Body     string
+	Headers  map[string]string
+	// Hash is computed over the full body, even if it has been truncated
+	Hash      string
+	Truncated bool
+	// Partial is set if only the first bytes of the resource have been fetched (ranged fetch)
+	Partial bool
+	// OmitBody is set if the body should only be used to extract the metadata, without being stored
+	OmitBody bool
+	// Alias is the crawled URL when the resource is stored under its canonical URL
+	Alias string
+	// Title is only set on the resources returned by a search
+	Title string
+	// HostnameCount is the number of resources matching the search for the resource hostname
+	// (only set on the resources returned by a search grouped by hostname)
+	HostnameCount int64
+	// SimHash of the body (only computed if near-duplicates detection is enabled)
+	SimHash uint64
+	// NearDuplicateOf is the URL of an already indexed resource having a similar body
+	NearDuplicateOf string
+	// Tag is the crawl campaign the resource belongs to
+	Tag string
+	// Entities are the deduplicated entities (emails, crypto addresses, ...) found in the body, by extractor name
+	Entities map[string][]string
+	// MatchedKeywords are the watchlist keywords found in the body
+	MatchedKeywords []string
+	// WatchlistHit is set if at least one watchlist keyword has been found in the body
+	WatchlistHit bool
+	// Via is the address of the proxy which served the resource (if stored)
+	Via string
+	// OnionLinks are the deduplicated links to hidden services found in the body
+	OnionLinks []string
+	// Fields are the structured fields (price, vendor, ...) extracted using the CSS selectors configured for the hostname
+	Fields map[string]string
+	// StructuredData are the schema.org items (JSON-LD or microdata) found in the body, their properties being flattened
+	StructuredData []map[string]string
+	// ParseLength is the number of leading bytes of the (HTML) body the title & meta are parsed from
+	// (whole body if 0), the body is still stored as-is
+	ParseLength int
+}
+
+// SearchParams are the parameters used to search the indexed resources
+type SearchParams struct {
+	// Keyword is matched against the resource title, description & body (everything is matched if empty)
+	Keyword string
+	// Offset is the number of resources to skip
+	Offset int
+	// Limit is the maximum number of resources returned
+	Limit int
+	// ExcludeBody prevent the resources body from being returned
+	ExcludeBody bool
+	// Tag restrict the search to the resources of given crawl campaign
+	Tag string
+	// Hostname restrict the search to the resources of given hostname
+	Hostname string
+	// GroupByHostname only returns the most recent resource of each hostname (Total is still the number of resources)
+	GroupByHostname bool
+	// RecencyScale ranks the resources by relevance instead of crawl time, the score of a resource being halved
+	// every RecencyScale since it has been crawled (disabled if 0)
+	RecencyScale time.Duration
+}
+
+// SearchResult is the result of a search
+type SearchResult struct {
+	// Total is the total number of resources matching the search
+	Total     int64
+	Resources []Resource
+}
+
+// HostnameCount is the number of resources stored for an hostname
+type HostnameCount struct {
+	Hostname string
+	Count    int64
+}
+
+// HostnamesPage is a page of the indexed hostnames, sorted by hostname
+type HostnamesPage struct {
+	Hostnames []HostnameCount
+	// AfterKey is the key used to retrieve the next page (empty if there is no more page)
+	AfterKey string
 }
 
+// CoverageBucket is the number of pages & hostnames first seen within an interval
+type CoverageBucket struct {
+	// Time is the start of the interval
+	Time time.Time
+	// Pages is the number of distinct URLs first seen within the interval
+	Pages int64
+	// Hostnames is the number of distinct hostnames having an URL first seen within the interval
+	Hostnames int64
+}
+
+// BulkFailure is a resource rejected while indexing resources in bulk
+type BulkFailure struct {
+	Reason string
+	// Permanent is set if the resource will be rejected again (i.e: mapping error)
+	Permanent bool
+}
+
+// BulkError is returned by IndexResources when some of the resources have been rejected, the other ones being indexed
+type BulkError struct {
+	// Failures are the rejected resources, by position
+	Failures map[int]BulkFailure
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("%d resources rejected", len(e.Failures))
+}
+
+// URLHandler is called for each URL returned when browsing the index
+type URLHandler func(url string) error
+
 // Index is the interface used to abstract communication with the persistence unit
 type Index interface {
 	IndexResource(resource Resource) error
+	// IndexResources index given resources at once, a *BulkError is returned if only some of them are rejected
 	IndexResources(resources []Resource) error
+
+	// Search returns the resources matching given params, most recent first
+	Search(params SearchParams) (SearchResult, error)
+	// Delete the resources stored for given URL and returns the number of resources deleted
+	Delete(url string) (int64, error)
+
+	// FindNearDuplicate returns the URL of an indexed resource whose SimHash is within maxDistance
+	// of given SimHash (empty if none). maxDistance should not be greater than 3
+	FindNearDuplicate(simHash uint64, maxDistance int) (string, error)
+
+	// ForEachHostnameURL call handler once for each distinct URL stored for given hostname
+	ForEachHostnameURL(hostname string, handler URLHandler) error
+
+	// UpdateCrawlTime set the time of the most recent resource stored for given URL
+	UpdateCrawlTime(url string, crawlTime time.Time) error
+	// LastCrawlTime returns the time of the most recent resource stored for given URL (zero if none)
+	LastCrawlTime(url string) (time.Time, error)
+
+	// ListHostnames returns at most size indexed hostnames following afterKey (first page if empty),
+	// with the number of resources stored for each
+	ListHostnames(afterKey string, size int) (HostnamesPage, error)
+
+	// Coverage returns the number of pages & hostnames first seen per interval (i.e: day, week or month), oldest first.
+	// The resources indexed without first seen time are not counted
+	Coverage(interval string) ([]CoverageBucket, error)
+}
+
+// Options are the driver specific options used to create an index
+type Options struct {
+	// Analyzer is the analyzer used for the text fields (Elastic only)
+	Analyzer string
+	// Mapping is a custom mapping used when creating the index, it overrides Analyzer (Elastic only)
+	Mapping string
+	// FlattenJSON index the JSON resources as `path: value` lines instead of pretty-printing them (Elastic only)
+	FlattenJSON bool
+	// ReviewIndex is the index into which the watchlist hits are additionally indexed (Elastic only, disabled if empty)
+	ReviewIndex string
+	// CompressBody stores the body gzipped, it is still searchable but excluded from the source (Elastic only)
+	CompressBody bool
+}
+
+// Ping check that the index created using given driver, destination could be reached
+func Ping(driver string, dest string) error {
+	switch driver {
+	case Elastic:
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		nodes, err := parseNodes(dest)
+		if err != nil {
+			return err
+		}
+
+		client, err := elastic.NewSimpleClient(elasticClientOptions(nodes)...)
+		if err != nil {
+			return err
+		}
+
+		// The request is sent to another node if the first one cannot be reached
+		_, _, err = client.Ping(nodes[0].url.String()).Do(ctx)
+		return err
+	case Local:
+		// Nothing to reach, the directory is created when needed
+		return nil
+	default:
+		return fmt.Errorf("no driver named %s found", driver)
+	}
 }
 
 // NewIndex create a new index using given driver, destination
-func NewIndex(driver string, dest string) (Index, error) {
+func NewIndex(driver string, dest string, opts Options) (Index, error) {
 	switch driver {
 	case Elastic:
-		return newElasticIndex(dest)
+		return newElasticIndex(dest, opts)
 	case Local:
 		return newLocalIndex(dest)
 	default:
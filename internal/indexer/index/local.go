@@ -1,8 +1,10 @@
 package index
 
 import (
+	"bufio"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -27,7 +29,12 @@ func (s *localIndex) IndexResource(resource Resource) error {
 		return err
 	}
 
-	content, err := formatResource(resource.URL, resource.Body, resource.Headers)
+	body := resource.Body
+	if resource.OmitBody {
+		body = ""
+	}
+
+	content, err := formatResource(resource.URL, body, resource.Headers)
 	if err != nil {
 		return err
 	}
@@ -58,6 +65,95 @@ func (s *localIndex) IndexResources(resources []Resource) error {
 	return nil
 }
 
+func (s *localIndex) Search(params SearchParams) (SearchResult, error) {
+	return SearchResult{}, ErrNotSupported
+}
+
+func (s *localIndex) Delete(url string) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *localIndex) FindNearDuplicate(simHash uint64, maxDistance int) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (s *localIndex) UpdateCrawlTime(url string, crawlTime time.Time) error {
+	return ErrNotSupported
+}
+
+func (s *localIndex) LastCrawlTime(url string) (time.Time, error) {
+	return time.Time{}, ErrNotSupported
+}
+
+func (s *localIndex) ListHostnames(afterKey string, size int) (HostnamesPage, error) {
+	return HostnamesPage{}, ErrNotSupported
+}
+
+func (s *localIndex) Coverage(interval string) ([]CoverageBucket, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *localIndex) ForEachHostnameURL(hostname string, handler URLHandler) error {
+	seen := map[string]bool{}
+
+	for _, scheme := range []string{"http", "https"} {
+		entries, err := ioutil.ReadDir(filepath.Join(s.baseDir, scheme))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+			// Directory name is the URL host, which may contains the port
+			if u := (url.URL{Host: entry.Name()}); !entry.IsDir() || u.Hostname() != hostname {
+				continue
+			}
+
+			err := filepath.Walk(filepath.Join(s.baseDir, scheme, entry.Name()), func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+
+				rawURL, err := readResourceURL(path)
+				if err != nil {
+					return err
+				}
+
+				if seen[rawURL] {
+					return nil
+				}
+				seen[rawURL] = true
+
+				return handler(rawURL)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readResourceURL returns the URL of the resource stored at given path
+func readResourceURL(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// URL is written on the first line
+	rawURL, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimSpace(rawURL), nil
+}
+
 func formatResource(url string, body string, headers map[string]string) ([]byte, error) {
 	builder := strings.Builder{}
 
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -138,3 +139,56 @@ func TestFormatResource(t *testing.T) {
 		t.Errorf("got %s want %s", string(res), "https://google.com\n\nServer: Traefik\nContent-Type: text/html\n\nHello, world")
 	}
 }
+
+func TestLocalIndex_ForEachHostnameURL(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(d)
+
+	s := localIndex{baseDir: d}
+
+	resources := []Resource{
+		{URL: "https://example.onion", Time: time.Unix(1603973049, 0)},
+		{URL: "https://example.onion", Time: time.Unix(1603973050, 0)},
+		{URL: "http://example.onion:8080/login.php?user=admin", Time: time.Unix(1603973049, 0)},
+		{URL: "https://example2.onion", Time: time.Unix(1603973049, 0)},
+	}
+	if err := s.IndexResources(resources); err != nil {
+		t.FailNow()
+	}
+
+	var urls []string
+	if err := s.ForEachHostnameURL("example.onion", func(url string) error {
+		urls = append(urls, url)
+		return nil
+	}); err != nil {
+		t.FailNow()
+	}
+
+	want := []string{"http://example.onion:8080/login.php?user=admin", "https://example.onion"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("got %v want %v", urls, want)
+	}
+}
+
+func TestLocalIndex_NotSupported(t *testing.T) {
+	s := localIndex{}
+
+	if _, err := s.Search(SearchParams{Keyword: "test"}); err != ErrNotSupported {
+		t.Fail()
+	}
+	if _, err := s.Delete("https://example.onion"); err != ErrNotSupported {
+		t.Fail()
+	}
+	if _, err := s.FindNearDuplicate(42, 3); err != ErrNotSupported {
+		t.Fail()
+	}
+	if err := s.UpdateCrawlTime("https://example.onion", time.Now()); err != ErrNotSupported {
+		t.Fail()
+	}
+	if _, err := s.LastCrawlTime("https://example.onion"); err != ErrNotSupported {
+		t.Fail()
+	}
+}
@@ -0,0 +1,145 @@
+package index
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeDownDuration is the duration a node is skipped after a failed request
+const nodeDownDuration = 30 * time.Second
+
+type node struct {
+	url       *url.URL
+	weight    int
+	current   int
+	downUntil time.Time
+}
+
+// parseNodes parse given comma separated list of nodes, each node being URL or URL=WEIGHT (1 by default)
+func parseNodes(dest string) ([]*node, error) {
+	var nodes []*node
+
+	for _, part := range strings.Split(dest, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		weight := 1
+		if i := strings.LastIndex(part, "="); i != -1 {
+			w, err := strconv.Atoi(part[i+1:])
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight for node %s", part)
+			}
+			part, weight = part[:i], w
+		}
+
+		u, err := url.Parse(part)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid node URL: %s", part)
+		}
+
+		nodes = append(nodes, &node{url: u, weight: weight})
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no node found in %s", dest)
+	}
+
+	return nodes, nil
+}
+
+// nodeSelector select the nodes using a smooth weighted round-robin, skipping the nodes marked as down
+type nodeSelector struct {
+	nodes []*node
+	mutex sync.Mutex
+	now   func() time.Time
+}
+
+func newNodeSelector(nodes []*node) *nodeSelector {
+	return &nodeSelector{nodes: nodes, now: time.Now}
+}
+
+// next returns the node to use for the next request. If every node is down they are all considered healthy
+func (s *nodeSelector) next() *node {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	var healthy []*node
+	for _, n := range s.nodes {
+		if !now.Before(n.downUntil) {
+			healthy = append(healthy, n)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = s.nodes
+	}
+
+	var best *node
+	total := 0
+	for _, n := range healthy {
+		n.current += n.weight
+		total += n.weight
+		if best == nil || n.current > best.current {
+			best = n
+		}
+	}
+	best.current -= total
+
+	return best
+}
+
+// markDown skip given node until nodeDownDuration has elapsed
+func (s *nodeSelector) markDown(n *node) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n.downUntil = s.now().Add(nodeDownDuration)
+}
+
+// nodesTransport send each request to the node returned by the selector, and retry on the next one if the
+// node cannot be reached
+type nodesTransport struct {
+	selector  *nodeSelector
+	transport http.RoundTripper
+}
+
+func (t *nodesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var lastErr error
+
+	for i := 0; i < len(t.selector.nodes); i++ {
+		r := req.Clone(req.Context())
+		if i > 0 && req.Body != nil {
+			// The body has been consumed by the previous attempt
+			if req.GetBody == nil {
+				return nil, lastErr
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		n := t.selector.next()
+		r.URL.Scheme, r.URL.Host, r.Host = n.url.Scheme, n.url.Host, n.url.Host
+
+		resp, err := t.transport.RoundTrip(r)
+		if err == nil {
+			return resp, nil
+		}
+
+		log.Warn().Err(err).Str("node", n.url.String()).Msg("Elasticsearch node is unreachable")
+		t.selector.markDown(n)
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
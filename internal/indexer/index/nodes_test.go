@@ -0,0 +1,91 @@
+package index
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseNodes(t *testing.T) {
+	nodes, err := parseNodes("http://es1:9200=3, http://es2:9200")
+	if err != nil {
+		t.FailNow()
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("wrong number of nodes: got: %d want: %d", len(nodes), 2)
+	}
+	if nodes[0].url.String() != "http://es1:9200" || nodes[0].weight != 3 {
+		t.Errorf("wrong node: got: %s/%d want: %s/%d", nodes[0].url, nodes[0].weight, "http://es1:9200", 3)
+	}
+	if nodes[1].url.String() != "http://es2:9200" || nodes[1].weight != 1 {
+		t.Errorf("wrong node: got: %s/%d want: %s/%d", nodes[1].url, nodes[1].weight, "http://es2:9200", 1)
+	}
+
+	for _, dest := range []string{"", "http://es1:9200=0", "http://es1:9200=a", "es1"} {
+		if _, err := parseNodes(dest); err == nil {
+			t.Errorf("%s should be invalid", dest)
+		}
+	}
+}
+
+func TestNodeSelector_Next(t *testing.T) {
+	nodes, _ := parseNodes("http://es1:9200=3,http://es2:9200=1")
+	now := time.Now()
+	s := newNodeSelector(nodes)
+	s.now = func() time.Time { return now }
+
+	if counts := selectNodes(s, 8); counts["es1:9200"] != 6 || counts["es2:9200"] != 2 {
+		t.Errorf("wrong selection: got: %v", counts)
+	}
+
+	// The node down is skipped
+	s.markDown(nodes[0])
+	if counts := selectNodes(s, 4); counts["es1:9200"] != 0 || counts["es2:9200"] != 4 {
+		t.Errorf("wrong selection while es1 is down: got: %v", counts)
+	}
+
+	// Every node is down, they are all used
+	s.markDown(nodes[1])
+	if counts := selectNodes(s, 8); counts["es1:9200"] != 6 || counts["es2:9200"] != 2 {
+		t.Errorf("wrong selection while every node is down: got: %v", counts)
+	}
+
+	// The nodes are healthy again
+	now = now.Add(nodeDownDuration)
+	if counts := selectNodes(s, 8); counts["es1:9200"] != 6 || counts["es2:9200"] != 2 {
+		t.Errorf("wrong selection once the nodes are up: got: %v", counts)
+	}
+}
+
+func TestNodesTransport_Failover(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	nodes, _ := parseNodes(down.URL + "=5," + srv.URL)
+	transport := &nodesTransport{selector: newNodeSelector(nodes), transport: http.DefaultTransport}
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(down.URL + "/resources/_search")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	if nodes[0].downUntil.IsZero() {
+		t.Error("the node should be marked as down")
+	}
+}
+
+func selectNodes(s *nodeSelector, count int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < count; i++ {
+		counts[s.next().url.Host]++
+	}
+	return counts
+}
@@ -0,0 +1,246 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/olivere/elastic/v7"
+	"github.com/rs/zerolog/log"
+	"strconv"
+)
+
+// defaultReindexBatchSize is the number of resources read & written at once when no batch size is given
+const defaultReindexBatchSize = 500
+
+var errSourceIsIndex = fmt.Errorf("%s is an index and not an alias, it must be deleted to swap the alias", resourcesIndexName)
+
+// ReindexOptions are the options used to copy the indexed resources into a new index
+type ReindexOptions struct {
+	// Dest is the index into which the resources are copied, created using the current mapping if missing
+	Dest string
+	// BatchSize is the number of resources read & written at once
+	BatchSize int
+	// After is the cursor (logged after each batch) following which the resources are copied, used to resume
+	// an interrupted reindex (start from the first resource if empty)
+	After string
+	// DryRun only reads & transforms the resources, nothing is written and the alias is not swapped
+	DryRun bool
+	// DeleteSource allows deleting the resources index when it is not an alias yet, the alias cannot share its name
+	DeleteSource bool
+}
+
+// ReindexResult is the result of a reindex
+type ReindexResult struct {
+	// Count is the number of resources copied (or that would have been copied on a dry run)
+	Count int
+	// Cursor is the cursor of the last resource copied
+	Cursor string
+}
+
+// ResourceTransform is applied to each resource before it is copied to the new index
+type ResourceTransform func(resource Resource) (Resource, error)
+
+// Reindexer is implemented by the indexes whose resources can be copied into a new index
+type Reindexer interface {
+	// Reindex copy the indexed resources into a new index, applying given transform, and swap the resources alias
+	// to point to it once done
+	Reindex(opts ReindexOptions, transform ResourceTransform) (ReindexResult, error)
+}
+
+func (e *elasticSearchIndex) Reindex(opts ReindexOptions, transform ResourceTransform) (ReindexResult, error) {
+	ctx := context.Background()
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultReindexBatchSize
+	}
+
+	after, err := parseReindexCursor(opts.After)
+	if err != nil {
+		return ReindexResult{}, err
+	}
+
+	// Fail fast if the alias could not be swapped once the resources copied
+	aliased, err := e.aliasedIndices(ctx)
+	if err != nil {
+		return ReindexResult{}, err
+	}
+	for _, name := range aliased {
+		if name == opts.Dest {
+			return ReindexResult{}, fmt.Errorf("%s is the current index", opts.Dest)
+		}
+	}
+	if aliased == nil && !opts.DeleteSource && !opts.DryRun {
+		return ReindexResult{}, errSourceIsIndex
+	}
+
+	if !opts.DryRun {
+		if err := setupElasticSearch(ctx, e.client, e.mapping, opts.Dest); err != nil {
+			return ReindexResult{}, err
+		}
+	}
+
+	result := ReindexResult{Cursor: opts.After}
+	for {
+		// The resources are browsed in a stable order, so the cursor can be used to resume
+		search := e.client.Search(resourcesIndexName).
+			Sort("time", true).
+			Sort("_id", true).
+			Size(opts.BatchSize)
+		if after != nil {
+			search = search.SearchAfter(after...)
+		}
+
+		res, err := search.Do(ctx)
+		if err != nil {
+			return result, err
+		}
+		if len(res.Hits.Hits) == 0 {
+			break
+		}
+
+		bulkRequest := e.client.Bulk()
+		for _, hit := range res.Hits.Hits {
+			var stored resourceIdx
+			if err := json.Unmarshal(hit.Source, &stored); err != nil {
+				return result, err
+			}
+
+			body, err := storedBody(stored)
+			if err != nil {
+				return result, err
+			}
+
+			resource, err := transform(storedResource(stored, body))
+			if err != nil {
+				return result, err
+			}
+
+			resIdx, err := e.newResourceIdx(resource)
+			if err != nil {
+				return result, err
+			}
+			// The metadata cannot be extracted again without the body
+			if resIdx.Body == "" {
+				resIdx.Title = stored.Title
+				resIdx.Meta = stored.Meta
+				resIdx.Description = stored.Description
+			}
+
+			// Keeping the identifier makes copying a resource twice harmless when resuming
+			bulkRequest.Add(elastic.NewBulkIndexRequest().Index(opts.Dest).Id(hit.Id).Doc(resIdx))
+		}
+
+		if !opts.DryRun {
+			bulkRes, err := bulkRequest.Do(ctx)
+			if err != nil {
+				return result, err
+			}
+			if failed := bulkRes.Failed(); len(failed) > 0 {
+				return result, fmt.Errorf("%d resources rejected by %s: %s", len(failed), opts.Dest, failed[0].Error.Reason)
+			}
+		}
+
+		after = res.Hits.Hits[len(res.Hits.Hits)-1].Sort
+		result.Count += len(res.Hits.Hits)
+		result.Cursor = formatReindexCursor(after)
+
+		log.Info().Int("count", result.Count).Str("cursor", result.Cursor).Bool("dry-run", opts.DryRun).Msg("Resources reindexed")
+
+		if len(res.Hits.Hits) < opts.BatchSize {
+			break
+		}
+	}
+
+	if opts.DryRun {
+		return result, nil
+	}
+
+	return result, e.swapAlias(ctx, aliased, opts.Dest)
+}
+
+// aliasedIndices returns the indices pointed by the resources alias, nil if the resources are stored in an index
+func (e *elasticSearchIndex) aliasedIndices(ctx context.Context) ([]string, error) {
+	res, err := e.client.Aliases().Alias(resourcesIndexName).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return res.IndicesByAlias(resourcesIndexName), nil
+}
+
+// swapAlias atomically point the resources alias to given index instead of the aliased ones.
+// If the resources are stored in an index, it is deleted in the same operation
+func (e *elasticSearchIndex) swapAlias(ctx context.Context, aliased []string, dest string) error {
+	aliasService := e.client.Alias().Add(dest, resourcesIndexName)
+	if aliased == nil {
+		aliasService = aliasService.Action(elastic.NewAliasRemoveIndexAction(resourcesIndexName))
+	}
+	for _, name := range aliased {
+		aliasService = aliasService.Remove(name, resourcesIndexName)
+	}
+
+	if _, err := aliasService.Do(ctx); err != nil {
+		return err
+	}
+
+	log.Info().Str("alias", resourcesIndexName).Str("index", dest).Strs("previous", aliased).Msg("Swapped alias")
+
+	return nil
+}
+
+// storedResource build back the resource from what has been stored, using given (decompressed) body
+func storedResource(stored resourceIdx, body string) Resource {
+	resource := Resource{
+		URL:             stored.URL,
+		Time:            stored.Time,
+		FirstSeen:       stored.FirstSeen,
+		Body:            body,
+		Headers:         stored.Headers,
+		Hash:            stored.Hash,
+		Truncated:       stored.Truncated,
+		Partial:         stored.Partial,
+		OmitBody:        body == "",
+		Alias:           stored.Alias,
+		NearDuplicateOf: stored.NearDuplicateOf,
+		Tag:             stored.Tag,
+		Entities:        stored.Entities,
+		MatchedKeywords: stored.MatchedKeywords,
+		WatchlistHit:    stored.WatchlistHit,
+		Via:             stored.Via,
+		OnionLinks:      stored.OnionLinks,
+		Fields:          stored.Fields,
+		StructuredData:  stored.StructuredData,
+	}
+	if simHash, err := strconv.ParseUint(stored.SimHash, 10, 64); err == nil {
+		resource.SimHash = simHash
+	}
+
+	return resource
+}
+
+// formatReindexCursor returns the cursor made of given sort values
+func formatReindexCursor(sortValues []interface{}) string {
+	b, err := json.Marshal(sortValues)
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
+}
+
+// parseReindexCursor returns the sort values of given cursor (nil if empty)
+func parseReindexCursor(cursor string) ([]interface{}, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	var sortValues []interface{}
+	if err := json.Unmarshal([]byte(cursor), &sortValues); err != nil || len(sortValues) != 2 {
+		return nil, fmt.Errorf("invalid reindex cursor: %s", cursor)
+	}
+
+	return sortValues, nil
+}
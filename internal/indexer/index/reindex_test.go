@@ -0,0 +1,210 @@
+package index
+
+import (
+	"errors"
+	"github.com/olivere/elastic/v7"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// reindexServer is a fake Elasticsearch storing 3 resources in the resources-v1 index,
+// pointed by the resources alias if aliased is set
+type reindexServer struct {
+	aliased  bool
+	searches []string
+	bulks    []string
+	created  []string
+	aliases  string
+}
+
+func (s *reindexServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	body := string(b)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/_alias/resources":
+		if !s.aliased {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"alias [resources] missing","status":404}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"resources-v1":{"aliases":{"resources":{}}}}`))
+	case r.Method == http.MethodHead:
+		// Index does not exist
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPut:
+		s.created = append(s.created, strings.TrimPrefix(r.URL.Path, "/"))
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	case r.URL.Path == "/resources/_search":
+		s.searches = append(s.searches, body)
+
+		if !strings.Contains(body, `"search_after"`) {
+			_, _ = w.Write([]byte(`{"hits":{"total":{"value":3,"relation":"eq"},"hits":[` +
+				`{"_index":"resources-v1","_id":"a","sort":[1000,"a"],"_source":{"url":"https://example.onion/a","time":"2021-03-10T12:00:00Z","body":"<title>A</title>","headers":{"content-type":"text/html"}}},` +
+				`{"_index":"resources-v1","_id":"b","sort":[2000,"b"],"_source":{"url":"https://example.onion/b","time":"2021-03-10T12:00:01Z","title":"B","description":"Stored","headers":{"content-type":"text/html"}}}]}}`))
+			return
+		}
+
+		if !strings.Contains(body, `"search_after":[2000,"b"]`) {
+			_, _ = w.Write([]byte(`{"hits":{"total":{"value":3,"relation":"eq"},"hits":[]}}`))
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"hits":{"total":{"value":3,"relation":"eq"},"hits":[` +
+			`{"_index":"resources-v1","_id":"c","sort":[3000,"c"],"_source":{"url":"https://example.onion/c","time":"2021-03-10T12:00:02Z","body":"hello","simhash":"42"}}]}}`))
+	case r.URL.Path == "/_bulk":
+		s.bulks = append(s.bulks, body)
+		_, _ = w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	case r.URL.Path == "/_aliases":
+		s.aliases = body
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// tagResource is the transform used by the tests
+func tagResource(resource Resource) (Resource, error) {
+	resource.Tag = "reindexed"
+	return resource, nil
+}
+
+func newReindexIndex(t *testing.T, srv *httptest.Server) *elasticSearchIndex {
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	if err != nil {
+		t.FailNow()
+	}
+
+	return &elasticSearchIndex{client: client, mapping: `{"mappings":{}}`}
+}
+
+func TestElasticSearchIndex_Reindex(t *testing.T) {
+	fake := &reindexServer{aliased: true}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	idx := newReindexIndex(t, srv)
+
+	result, err := idx.Reindex(ReindexOptions{Dest: "resources-v2", BatchSize: 2}, tagResource)
+	if err != nil {
+		t.Fatalf("error while reindexing: %s", err)
+	}
+
+	if want := (ReindexResult{Count: 3, Cursor: `[3000,"c"]`}); result != want {
+		t.Errorf("got %+v want %+v", result, want)
+	}
+	if !reflect.DeepEqual(fake.created, []string{"resources-v2"}) {
+		t.Errorf("got %v created indexes want [resources-v2]", fake.created)
+	}
+	if len(fake.searches) != 2 {
+		t.Fatalf("got %d searches want 2", len(fake.searches))
+	}
+	if !strings.Contains(fake.searches[0], `"sort":[{"time":{"order":"asc"}},{"_id":{"order":"asc"}}]`) {
+		t.Errorf("wrong sort: %s", fake.searches[0])
+	}
+
+	if len(fake.bulks) != 2 {
+		t.Fatalf("got %d bulks want 2", len(fake.bulks))
+	}
+	bulks := strings.Join(fake.bulks, "")
+	for _, want := range []string{
+		`{"index":{"_index":"resources-v2","_id":"a"}}`,
+		`{"index":{"_index":"resources-v2","_id":"b"}}`,
+		`{"index":{"_index":"resources-v2","_id":"c"}}`,
+		// The title is extracted again from the body
+		`"title":"A"`,
+		// The metadata are kept when the body has not been stored
+		`"title":"B"`,
+		`"description":"Stored"`,
+		// The SimHash blocks are computed again
+		`"simhash":"42"`,
+		`"simhash-blocks":["0:002a","1:0000","2:0000","3:0000"]`,
+	} {
+		if !strings.Contains(bulks, want) {
+			t.Errorf("bulk requests %s does not contains %s", bulks, want)
+		}
+	}
+	if got := strings.Count(bulks, `"tag":"reindexed"`); got != 3 {
+		t.Errorf("got %d transformed resources want 3", got)
+	}
+
+	wantAliases := `{"actions":[{"add":{"alias":"resources","index":"resources-v2"}},{"remove":{"alias":"resources","index":"resources-v1"}}]}`
+	if fake.aliases != wantAliases {
+		t.Errorf("got %s want %s", fake.aliases, wantAliases)
+	}
+}
+
+func TestElasticSearchIndex_Reindex_Resume(t *testing.T) {
+	fake := &reindexServer{aliased: true}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	idx := newReindexIndex(t, srv)
+
+	result, err := idx.Reindex(ReindexOptions{Dest: "resources-v2", BatchSize: 2, After: `[2000,"b"]`}, tagResource)
+	if err != nil {
+		t.Fatalf("error while reindexing: %s", err)
+	}
+
+	if want := (ReindexResult{Count: 1, Cursor: `[3000,"c"]`}); result != want {
+		t.Errorf("got %+v want %+v", result, want)
+	}
+	if len(fake.bulks) != 1 || !strings.Contains(fake.bulks[0], `"_id":"c"`) || strings.Contains(fake.bulks[0], `"_id":"a"`) {
+		t.Errorf("wrong bulk requests: %v", fake.bulks)
+	}
+
+	if _, err := idx.Reindex(ReindexOptions{Dest: "resources-v2", After: "b"}, tagResource); err == nil {
+		t.Error("invalid cursor should be rejected")
+	}
+}
+
+func TestElasticSearchIndex_Reindex_DryRun(t *testing.T) {
+	fake := &reindexServer{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	idx := newReindexIndex(t, srv)
+
+	result, err := idx.Reindex(ReindexOptions{Dest: "resources-v2", BatchSize: 2, DryRun: true}, tagResource)
+	if err != nil {
+		t.Fatalf("error while reindexing: %s", err)
+	}
+
+	if result.Count != 3 {
+		t.Errorf("got %d resources want 3", result.Count)
+	}
+	if len(fake.created) != 0 || len(fake.bulks) != 0 || fake.aliases != "" {
+		t.Errorf("nothing should be written on dry run: %v %v %s", fake.created, fake.bulks, fake.aliases)
+	}
+}
+
+func TestElasticSearchIndex_Reindex_SourceIndex(t *testing.T) {
+	fake := &reindexServer{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	idx := newReindexIndex(t, srv)
+
+	// The resources index cannot be replaced by an alias without deleting it
+	if _, err := idx.Reindex(ReindexOptions{Dest: "resources-v2"}, tagResource); !errors.Is(err, errSourceIsIndex) {
+		t.Errorf("got %v want %v", err, errSourceIsIndex)
+	}
+	if len(fake.searches) != 0 {
+		t.Error("nothing should be read")
+	}
+
+	if _, err := idx.Reindex(ReindexOptions{Dest: "resources-v2", DeleteSource: true}, tagResource); err != nil {
+		t.Fatalf("error while reindexing: %s", err)
+	}
+
+	wantAliases := `{"actions":[{"add":{"alias":"resources","index":"resources-v2"}},{"remove_index":{"index":"resources"}}]}`
+	if fake.aliases != wantAliases {
+		t.Errorf("got %s want %s", fake.aliases, wantAliases)
+	}
+}
@@ -1,27 +1,151 @@
 package indexer
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
 	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/constraint"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 var errHostnameNotAllowed = fmt.Errorf("hostname is not allowed")
 
+const (
+	batchSizeFlag     = "index-batch-size"
+	flushIntervalFlag = "index-flush-interval"
+	analyzerFlag      = "index-analyzer"
+	mappingFlag       = "index-mapping"
+	flattenJSONFlag   = "index-flatten-json"
+	simHashFlag       = "simhash"
+	simHashDistFlag   = "simhash-distance"
+	extractorFlag     = "extractor"
+	maxEntitiesFlag   = "extractor-max-matches"
+	transcodeFlag     = "transcode-charset"
+	storeViaFlag      = "store-via"
+	reviewIndexFlag   = "review-index"
+	compressBodyFlag  = "index-compress-body"
+
+	defaultRecentLimit = 10
+	maxRecentLimit     = 100
+
+	defaultHostnamesSize = 100
+	maxHostnamesSize     = 1000
+)
+
+// coverageIntervals are the intervals of the coverage histogram
+var coverageIntervals = map[string]bool{"day": true, "week": true, "month": true}
+
+// The crawl statuses of an URL, by order of precedence
+const (
+	urlStatusBlacklisted = "blacklisted"
+	urlStatusCrawled     = "crawled"
+	urlStatusFailing     = "failing"
+	urlStatusScheduled   = "scheduled"
+	urlStatusUnknown     = "unknown"
+)
+
+// indexRetryPolicy is used to retry the resources which could not be indexed,
+// riding out transient index outages without blocking the indexing queue
+var indexRetryPolicy = event.RetryPolicy{MaxRetries: 5, Delay: 10 * time.Second, MaxDelay: 5 * time.Minute}
+
+// hostnameRegex matches the (lowercased) DNS hostnames
+var hostnameRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// recentResource is a lightweight view of an indexed resource
+type recentResource struct {
+	URL       string    `json:"url"`
+	Title     string    `json:"title"`
+	Hostname  string    `json:"hostname"`
+	CrawlDate time.Time `json:"crawl-date"`
+	FirstSeen time.Time `json:"first-seen"`
+	LastSeen  time.Time `json:"last-seen"`
+	Tag       string    `json:"tag,omitempty"`
+	// HostnameCount is only set when grouping by hostname
+	HostnameCount int64 `json:"hostname-count,omitempty"`
+}
+
+// hostnameCount is the number of resources indexed for an hostname
+type hostnameCount struct {
+	Hostname string `json:"hostname"`
+	Count    int64  `json:"count"`
+}
+
+// hostnamesPage is a page of the indexed hostnames
+type hostnamesPage struct {
+	Hostnames []hostnameCount `json:"hostnames"`
+	// AfterKey is the value of the from parameter used to retrieve the next page
+	AfterKey string `json:"after-key,omitempty"`
+}
+
+// coverageBucket is the number of pages & hostnames discovered within an interval
+type coverageBucket struct {
+	Date      time.Time `json:"date"`
+	Pages     int64     `json:"pages"`
+	Hostnames int64     `json:"hostnames"`
+}
+
+// urlStatus is the consolidated crawl status of an URL
+type urlStatus struct {
+	URL    string `json:"url"`
+	Status string `json:"status"`
+	// Blacklisted is set if the URL hostname is forbidden
+	Blacklisted bool `json:"blacklisted"`
+	// CrawlDate is the time of the most recent resource indexed for the URL
+	CrawlDate *time.Time `json:"crawl-date,omitempty"`
+	// Failures is the number of confirmed failures of the URL hostname (see blacklister)
+	Failures int64 `json:"failures"`
+	// Scheduled is set if the URL has been scheduled during the refresh delay (see scheduler)
+	Scheduled bool `json:"scheduled"`
+}
+
 // State represent the application state
 type State struct {
 	index        index.Index
 	indexDriver  string
 	configClient configapi.Client
+	publisher    event.Publisher
+
+	// urlCache & downHostnameCache are the scheduler & blacklister caches, used to retrieve the URLs status
+	urlCache          cache.Cache
+	downHostnameCache cache.Cache
+	// queueCache holds the approximate number of URLs queued for crawling
+	queueCache cache.Cache
 
 	bufferThreshold int
+	flushInterval   time.Duration
 	resources       []index.Resource
+	messages        []event.RawMessage
+	bufferMutex     sync.Mutex
+
+	simHash         bool
+	simHashDistance int
+
+	extractors  []extractor
+	maxEntities int
+
+	transcodeCharset bool
+	storeVia         bool
+
+	skipPatterns skipPatterns
 }
 
 // Name return the process name
@@ -35,12 +159,24 @@ func (state *State) Description() string {
 The indexing component. It consumes crawled resources, format
 them and finally index them using the configured driver.
 
-This component consumes the 'resource.new' event.`
+This component consumes the 'resource.new' event and produces the
+'resource.indexed' event (and the 'resource.watchlist-hit' event
+for the resources mentioning watchlist keywords). It also
+consumes the 'resource.not-modified' event to update the crawl
+time of the unchanged resources.
+
+The HTTP API allows to re-crawl the URLs of an hostname, to
+retrieve the most recently indexed resources (optionally grouped
+by hostname, or matching a keyword & ranked by relevance decayed
+over time using recency-scale, as JSON or as a RSS feed using
+format=rss), to list the indexed hostnames, to retrieve the crawl
+status of an URL and the number of pages & hostnames discovered
+per day, week or month (/coverage).`
 }
 
 // Features return the process features
 func (state *State) Features() []process.Feature {
-	return []process.Feature{process.EventFeature, process.ConfigFeature}
+	return []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature}
 }
 
 // CustomFlags return process custom flags
@@ -56,25 +192,163 @@ func (state *State) CustomFlags() []cli.Flag {
 			Usage:    "Destination (config) passed to the driver",
 			Required: true,
 		},
+		&cli.IntFlag{
+			Name:  batchSizeFlag,
+			Usage: "Number of resources indexed at once (capped to the event prefetch)",
+		},
+		&cli.DurationFlag{
+			Name:  flushIntervalFlag,
+			Usage: "Maximum duration a resource is kept in the buffer before being indexed",
+			Value: 10 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  analyzerFlag,
+			Usage: "Analyzer used for the text fields when creating the index (i.e: english, french)",
+			Value: "standard",
+		},
+		&cli.StringFlag{
+			Name:  mappingFlag,
+			Usage: "Path to a custom mapping used when creating the index (override the analyzer)",
+		},
+		&cli.BoolFlag{
+			Name:  flattenJSONFlag,
+			Usage: "Index the JSON resources as `path: value` lines instead of pretty-printing them",
+		},
+		&cli.BoolFlag{
+			Name:  simHashFlag,
+			Usage: "Compute the SimHash of the resources to flag near-duplicates",
+		},
+		&cli.IntFlag{
+			Name:  simHashDistFlag,
+			Usage: "Maximum Hamming distance between two near-duplicate resources (up to 3)",
+			Value: 3,
+		},
+		&cli.StringSliceFlag{
+			Name:  extractorFlag,
+			Usage: "Extractor run on the resources body, either a built-in one (email, bitcoin, monero, ethereum) or NAME=REGEX",
+		},
+		&cli.IntFlag{
+			Name:  maxEntitiesFlag,
+			Usage: "Maximum number of entities stored per extractor for a resource (0 means no limit)",
+			Value: 50,
+		},
+		&cli.BoolFlag{
+			Name:  transcodeFlag,
+			Usage: "Transcode the resources body to UTF-8 using the charset declared in the Content-Type header or in a <meta> tag",
+			Value: true,
+		},
+		&cli.BoolFlag{
+			Name:  storeViaFlag,
+			Usage: "Store the address of the proxy which served the resources (Elastic only, for debugging)",
+		},
+		&cli.StringFlag{
+			Name:  reviewIndexFlag,
+			Usage: "Index into which the watchlist hits are additionally indexed for review (Elastic only, disabled if empty)",
+		},
+		&cli.BoolFlag{
+			Name:  compressBodyFlag,
+			Usage: "Store the resources body gzipped when creating the index, it is still searchable (Elastic only)",
+		},
+	}
+}
+
+// Dependencies returns the index the process depends on
+func (state *State) Dependencies(provider process.Provider) []process.Dependency {
+	driver, dest := provider.GetStrValue("index-driver"), provider.GetStrValue("index-dest")
+
+	return []process.Dependency{
+		{Name: "index", Ping: func() error { return index.Ping(driver, dest) }},
 	}
 }
 
 // Initialize the process
 func (state *State) Initialize(provider process.Provider) error {
+	if err := state.initializeIndex(provider); err != nil {
+		return err
+	}
+
+	state.bufferThreshold = provider.GetIntValue(process.EventPrefetchFlag)
+	// Messages are acknowledged once indexed, so we cannot buffer more than the prefetch
+	if batchSize := provider.GetIntValue(batchSizeFlag); batchSize > 0 && batchSize < state.bufferThreshold {
+		state.bufferThreshold = batchSize
+	}
+	state.flushInterval = provider.GetDurationValue(flushIntervalFlag)
+	state.transcodeCharset = provider.GetBoolValue(transcodeFlag)
+	state.storeVia = provider.GetBoolValue(storeViaFlag)
+
+	configClient, err := provider.ConfigClient([]string{configapi.ForbiddenHostnamesKey, configapi.MaxIndexedBodyLengthKey, configapi.RespectRobotsKey,
+		configapi.WatchlistKeywordsKey, configapi.StoreBodyKey, configapi.MinIndexBodyLengthKey,
+		configapi.SkipBodyPatternsKey, configapi.IndexableStatusCodesKey,
+		configapi.IndexLanguagesKey, configapi.FieldSelectorsKey, configapi.MaxParseBytesKey, configapi.AllowedURLsKey,
+		configapi.StripQueryParamsKey})
+	if err != nil {
+		return err
+	}
+	state.configClient = configClient
+
+	pub, err := provider.Publisher()
+	if err != nil {
+		return err
+	}
+	state.publisher = pub
+
+	urlCache, err := provider.Cache("url")
+	if err != nil {
+		return err
+	}
+	state.urlCache = urlCache
+
+	downHostnameCache, err := provider.Cache("down-hostname")
+	if err != nil {
+		return err
+	}
+	state.downHostnameCache = downHostnameCache
+
+	queueCache, err := provider.Cache(constraint.QueuedURLsCache)
+	if err != nil {
+		return err
+	}
+	state.queueCache = queueCache
+
+	if state.bufferThreshold > 1 && state.flushInterval > 0 {
+		go state.flushPeriodically()
+	}
+
+	return nil
+}
+
+// initializeIndex create the index & the extraction settings, shared by the process and the reindex command
+func (state *State) initializeIndex(provider process.Provider) error {
 	indexDriver := provider.GetStrValue("index-driver")
-	idx, err := index.NewIndex(indexDriver, provider.GetStrValue("index-dest"))
+	opts := index.Options{
+		Analyzer:     provider.GetStrValue(analyzerFlag),
+		FlattenJSON:  provider.GetBoolValue(flattenJSONFlag),
+		ReviewIndex:  provider.GetStrValue(reviewIndexFlag),
+		CompressBody: provider.GetBoolValue(compressBodyFlag),
+	}
+	if mappingFile := provider.GetStrValue(mappingFlag); mappingFile != "" {
+		b, err := ioutil.ReadFile(mappingFile)
+		if err != nil {
+			return fmt.Errorf("error while reading index mapping: %s", err)
+		}
+		opts.Mapping = string(b)
+	}
+
+	idx, err := index.NewIndex(indexDriver, provider.GetStrValue("index-dest"), opts)
 	if err != nil {
 		return err
 	}
 	state.index = idx
 	state.indexDriver = indexDriver
-	state.bufferThreshold = provider.GetIntValue(process.EventPrefetchFlag)
+	state.simHash = provider.GetBoolValue(simHashFlag)
+	state.simHashDistance = provider.GetIntValue(simHashDistFlag)
 
-	configClient, err := provider.ConfigClient([]string{configapi.ForbiddenHostnamesKey})
+	extractors, err := parseExtractors(provider.GetStrValues(extractorFlag))
 	if err != nil {
 		return err
 	}
-	state.configClient = configClient
+	state.extractors = extractors
+	state.maxEntities = provider.GetIntValue(maxEntitiesFlag)
 
 	return nil
 }
@@ -82,13 +356,302 @@ func (state *State) Initialize(provider process.Provider) error {
 // Subscribers return the process subscribers
 func (state *State) Subscribers() []process.SubscriberDef {
 	return []process.SubscriberDef{
-		{Exchange: event.NewResourceExchange, Queue: fmt.Sprintf("%sIndexingQueue", state.indexDriver), Handler: state.handleNewResourceEvent},
+		{Exchange: event.NewResourceExchange, Queue: fmt.Sprintf("%sIndexingQueue", state.indexDriver), Handler: state.handleNewResourceEvent, Retry: &indexRetryPolicy},
+		{Exchange: event.NotModifiedResourceExchange, Queue: fmt.Sprintf("%sNotModifiedQueue", state.indexDriver), Handler: state.handleNotModifiedResourceEvent},
 	}
 }
 
 // HTTPHandler returns the HTTP API the process expose
 func (state *State) HTTPHandler() http.Handler {
-	return nil
+	r := mux.NewRouter()
+	r.HandleFunc("/hostnames/{hostname}/recrawl", state.recrawlHostname).Methods(http.MethodPost)
+	r.HandleFunc("/recent", state.getRecentResources).Methods(http.MethodGet)
+	r.HandleFunc("/hostnames", state.getHostnames).Methods(http.MethodGet)
+	r.HandleFunc("/url/status", state.getURLStatus).Methods(http.MethodGet)
+	r.HandleFunc("/coverage", state.getCoverage).Methods(http.MethodGet)
+	r.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
+
+	return r
+}
+
+func (state *State) recrawlHostname(w http.ResponseWriter, r *http.Request) {
+	hostname := mux.Vars(r)["hostname"]
+
+	// When forced, the URLs are sent directly to the crawler, ignoring the refresh delay.
+	// Otherwise they are scheduled as newly found URLs
+	force := r.URL.Query().Get("force") == "true"
+
+	count := 0
+	err := state.index.ForEachHostnameURL(hostname, func(rawURL string) error {
+		var evt event.Event = &event.FoundURLEvent{URL: rawURL}
+		if force {
+			evt = &event.NewURLEvent{URL: rawURL}
+		}
+
+		if err := state.publisher.PublishEvent(evt); err != nil {
+			return fmt.Errorf("error while publishing URL: %s", err)
+		}
+
+		count++
+		return nil
+	})
+
+	// The URLs sent directly to the crawler are queued (the scheduler counts the other ones)
+	if force && count > 0 {
+		if err := constraint.AddQueuedURLs(state.queueCache, int64(count)); err != nil {
+			log.Err(err).Msg("error while counting queued URLs")
+		}
+	}
+
+	if err != nil {
+		log.Err(err).Str("hostname", hostname).Msg("error while re-crawling hostname")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str("hostname", hostname).Int("count", count).Bool("force", force).Msg("Successfully queued hostname URLs")
+
+	process.WriteJSON(w, map[string]int{"count": count})
+}
+
+func (state *State) getRecentResources(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = jsonFormat
+	}
+	if format != jsonFormat && format != rssFormat {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultRecentLimit
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		val, err := strconv.Atoi(rawLimit)
+		if err != nil || val <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit = val
+	}
+
+	if limit > maxRecentLimit {
+		limit = maxRecentLimit
+	}
+
+	var recencyScale time.Duration
+	if rawScale := r.URL.Query().Get("recency-scale"); rawScale != "" {
+		val, err := time.ParseDuration(rawScale)
+		if err != nil || val <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		recencyScale = val
+	}
+
+	// Scope the search to a single hostname
+	var hostname string
+	if rawHostname := r.URL.Query().Get("hostname"); rawHostname != "" {
+		hostname = constraint.NormalizeHostname(rawHostname)
+		if !validHostname(hostname) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := state.index.Search(index.SearchParams{
+		Keyword:         r.URL.Query().Get("keyword"),
+		Limit:           limit,
+		ExcludeBody:     true,
+		Tag:             r.URL.Query().Get("tag"),
+		Hostname:        hostname,
+		GroupByHostname: r.URL.Query().Get("group-by-hostname") == "true",
+		RecencyScale:    recencyScale,
+	})
+	if err != nil {
+		log.Err(err).Msg("error while searching recent resources")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if format == rssFormat {
+		title := "Bathyscaphe recent resources"
+		if keyword := r.URL.Query().Get("keyword"); keyword != "" {
+			title = fmt.Sprintf("Bathyscaphe resources matching %q", keyword)
+		}
+
+		writeRSS(w, newRSS(title, r.URL.String(), res.Resources))
+		return
+	}
+
+	resources := make([]recentResource, 0, len(res.Resources))
+	for _, resource := range res.Resources {
+		hostname := ""
+		if u, err := url.Parse(resource.URL); err == nil {
+			hostname = u.Hostname()
+		}
+
+		resources = append(resources, recentResource{
+			URL:           resource.URL,
+			Title:         resource.Title,
+			Hostname:      hostname,
+			CrawlDate:     resource.Time,
+			FirstSeen:     resource.FirstSeen,
+			LastSeen:      resource.LastSeen,
+			Tag:           resource.Tag,
+			HostnameCount: resource.HostnameCount,
+		})
+	}
+
+	process.WriteJSON(w, resources)
+}
+
+func (state *State) getHostnames(w http.ResponseWriter, r *http.Request) {
+	size := defaultHostnamesSize
+	if rawSize := r.URL.Query().Get("size"); rawSize != "" {
+		val, err := strconv.Atoi(rawSize)
+		if err != nil || val <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		size = val
+	}
+
+	if size > maxHostnamesSize {
+		size = maxHostnamesSize
+	}
+
+	res, err := state.index.ListHostnames(r.URL.Query().Get("from"), size)
+	if err != nil {
+		log.Err(err).Msg("error while listing hostnames")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page := hostnamesPage{Hostnames: make([]hostnameCount, 0, len(res.Hostnames)), AfterKey: res.AfterKey}
+	for _, hostname := range res.Hostnames {
+		page.Hostnames = append(page.Hostnames, hostnameCount{Hostname: hostname.Hostname, Count: hostname.Count})
+	}
+
+	process.WriteJSON(w, page)
+}
+
+func (state *State) getCoverage(w http.ResponseWriter, r *http.Request) {
+	interval := "day"
+	if rawInterval := r.URL.Query().Get("interval"); rawInterval != "" {
+		if !coverageIntervals[rawInterval] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		interval = rawInterval
+	}
+
+	res, err := state.index.Coverage(interval)
+	if err != nil {
+		log.Err(err).Msg("error while computing coverage")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	buckets := make([]coverageBucket, 0, len(res))
+	for _, bucket := range res {
+		buckets = append(buckets, coverageBucket{Date: bucket.Time, Pages: bucket.Pages, Hostnames: bucket.Hostnames})
+	}
+
+	process.WriteJSON(w, buckets)
+}
+
+func (state *State) getURLStatus(w http.ResponseWriter, r *http.Request) {
+	rawURL := r.URL.Query().Get("url")
+	if u, err := url.Parse(rawURL); err != nil || u.Hostname() == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	status, err := state.urlStatus(rawURL)
+	if err != nil {
+		log.Err(err).Str("url", rawURL).Msg("error while retrieving URL status")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	process.WriteJSON(w, status)
+}
+
+// urlStatus consolidate the status of given URL (normalized like the scheduler does) using the forbidden hostnames,
+// the index, the blacklister cache (failures) and the scheduler cache (scheduled URLs)
+func (state *State) urlStatus(rawURL string) (urlStatus, error) {
+	// The URLs are scheduled (then indexed) normalized & stripped of the configured query parameters
+	rawURL, err := constraint.NormalizeURL(rawURL)
+	if err != nil {
+		return urlStatus{}, err
+	}
+
+	stripQueryParams, err := state.configClient.GetStripQueryParams()
+	if err != nil {
+		return urlStatus{}, err
+	}
+	if len(stripQueryParams) > 0 {
+		rawURL = constraint.StripURLQueryParams(rawURL, stripQueryParams)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return urlStatus{}, err
+	}
+
+	status := urlStatus{URL: rawURL}
+
+	allowed, err := constraint.CheckURLAllowed(state.configClient, rawURL)
+	if err != nil {
+		return urlStatus{}, err
+	}
+	status.Blacklisted = !allowed
+
+	crawlTime, err := state.index.LastCrawlTime(rawURL)
+	if err != nil && !errors.Is(err, index.ErrNotSupported) {
+		return urlStatus{}, err
+	}
+	if !crawlTime.IsZero() {
+		status.CrawlDate = &crawlTime
+	}
+
+	// The blacklister use the normalized hostname as key
+	failures, err := state.downHostnameCache.GetInt64(constraint.NormalizeHostname(u.Hostname()))
+	if err != nil {
+		return urlStatus{}, err
+	}
+	status.Failures = failures
+
+	// The scheduler use the URL hash as key
+	c := fnv.New64()
+	if _, err := c.Write([]byte(rawURL)); err != nil {
+		return urlStatus{}, fmt.Errorf("error while computing url hash: %s", err)
+	}
+	scheduled, err := state.urlCache.GetInt64(strconv.FormatUint(c.Sum64(), 10))
+	if err != nil {
+		return urlStatus{}, err
+	}
+	status.Scheduled = constraint.IsScheduled(scheduled, time.Now())
+
+	switch {
+	case status.Blacklisted:
+		status.Status = urlStatusBlacklisted
+	case status.CrawlDate != nil:
+		status.Status = urlStatusCrawled
+	case status.Failures > 0:
+		status.Status = urlStatusFailing
+	case status.Scheduled:
+		status.Status = urlStatusScheduled
+	default:
+		status.Status = urlStatusUnknown
+	}
+
+	return status, nil
+}
+
+// validHostname returns true if given normalized hostname is a DNS hostname or an IP address
+func validHostname(hostname string) bool {
+	return len(hostname) <= 253 && (hostnameRegex.MatchString(hostname) || net.ParseIP(hostname) != nil)
 }
 
 func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg event.RawMessage) error {
@@ -97,52 +660,365 @@ func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg even
 		return err
 	}
 
-	// make sure hostname hasn't been flagged as forbidden
-	if allowed, err := constraint.CheckHostnameAllowed(state.configClient, evt.URL); !allowed || err != nil {
+	// make sure hostname hasn't been flagged as forbidden (unless the URL is explicitly allowed)
+	if allowed, err := constraint.CheckURLAllowed(state.configClient, evt.URL); !allowed || err != nil {
 		return fmt.Errorf("%s %w", evt.URL, errHostnameNotAllowed)
 	}
 
+	// The events published by the crawlers not reporting the status code are indexed
+	if evt.StatusCode != 0 {
+		statusCodes, err := state.configClient.GetIndexableStatusCodes()
+		if err != nil {
+			return err
+		}
+		if len(statusCodes) == 0 {
+			statusCodes = defaultIndexableStatusCodes
+		}
+
+		if !isIndexableStatus(evt.StatusCode, statusCodes) {
+			log.Debug().Str("url", evt.URL).Int("status", evt.StatusCode).Msg("Skipping resource indexing (status code)")
+			return nil
+		}
+	}
+
+	directives, err := constraint.GetRobotsDirectives(state.configClient, evt.Body)
+	if err != nil {
+		return err
+	}
+
+	if directives.NoIndex {
+		log.Debug().Str("url", evt.URL).Msg("Skipping resource indexing (noindex)")
+		return nil
+	}
+
+	minBodyLength, err := state.configClient.GetMinIndexBodyLength()
+	if err != nil {
+		return err
+	}
+
+	if minBodyLength > 0 && textLength(evt.Body) < minBodyLength {
+		log.Debug().Str("url", evt.URL).Msg("Skipping resource indexing (body too short)")
+		return nil
+	}
+
+	patterns, err := state.configClient.GetSkipBodyPatterns()
+	if err != nil {
+		return err
+	}
+
+	if len(patterns) > 0 && state.skipPatterns.get(patterns).match(evt.Body) {
+		log.Debug().Str("url", evt.URL).Msg("Skipping resource indexing (body matching a skip pattern)")
+		return nil
+	}
+
+	languages, err := state.configClient.GetIndexLanguages()
+	if err != nil {
+		return err
+	}
+
+	if len(languages.Languages) > 0 {
+		if language := extractLanguage(evt.Headers, evt.Body); !isIndexableLanguage(language, languages) {
+			log.Debug().Str("url", evt.URL).Str("language", language).Msg("Skipping resource indexing (language)")
+			return nil
+		}
+	}
+
+	resource, err := state.newResource(evt)
+	if err != nil {
+		return err
+	}
+
 	// Direct saving (no buffering)
 	if state.bufferThreshold == 1 {
-		if err := state.index.IndexResource(index.Resource{
-			URL:     evt.URL,
-			Time:    evt.Time,
-			Body:    evt.Body,
-			Headers: evt.Headers,
-		}); err != nil {
-			return fmt.Errorf("error while indexing resource: %s", err)
+		if err := state.index.IndexResource(resource); err != nil {
+			log.Err(err).Str("url", evt.URL).Msg("error while indexing resource, retrying later")
+
+			if err := msg.Retry(); err != nil {
+				log.Err(err).Msg("error while retrying event")
+			}
+
+			return event.ErrAckDeferred
 		}
 
 		log.Info().
 			Str("url", evt.URL).
 			Msg("Successfully indexed resource")
 
+		state.publishResourceIndexed(subscriber, resource)
+
 		return nil
 	}
 
-	// Otherwise we are in buffered saving mode
-	state.resources = append(state.resources, index.Resource{
-		URL:     evt.URL,
-		Time:    evt.Time,
-		Body:    evt.Body,
-		Headers: evt.Headers,
-	})
+	// Otherwise we are in buffered saving mode.
+	// The message will be acknowledged once the resource is indexed
+	state.bufferMutex.Lock()
+	state.resources = append(state.resources, resource)
+	state.messages = append(state.messages, msg)
+	count := len(state.resources)
+	state.bufferMutex.Unlock()
 
 	log.Debug().Str("url", evt.URL).Msg("Successfully stored resource in buffer")
 
-	if len(state.resources) >= state.bufferThreshold {
+	if count >= state.bufferThreshold {
 		// Time to save!
-		if err := state.index.IndexResources(state.resources); err != nil {
-			return fmt.Errorf("error while indexing resources: %s", err)
-		}
+		state.flush()
+	}
 
-		log.Info().
-			Int("count", len(state.resources)).
-			Msg("Successfully indexed buffered resources")
+	return event.ErrAckDeferred
+}
+
+func (state *State) handleNotModifiedResourceEvent(subscriber event.Subscriber, msg event.RawMessage) error {
+	var evt event.NotModifiedResourceEvent
+	if err := subscriber.Read(&msg, &evt); err != nil {
+		return err
+	}
 
-		// Clear cache
-		state.resources = []index.Resource{}
+	if err := state.index.UpdateCrawlTime(evt.URL, evt.Time); err != nil {
+		if err == index.ErrNotSupported {
+			return nil
+		}
+		return err
 	}
 
+	log.Debug().Str("url", evt.URL).Msg("Successfully updated crawl time")
+
+	return nil
+}
+
+// Shutdown index the remaining buffered resources
+func (state *State) Shutdown() error {
+	state.flush()
 	return nil
 }
+
+func (state *State) flushPeriodically() {
+	ticker := time.NewTicker(state.flushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		state.flush()
+	}
+}
+
+// flush index the buffered resources and acknowledge their messages.
+// If indexing fails the messages are retried later, the resources permanently rejected being dead-lettered
+func (state *State) flush() {
+	state.bufferMutex.Lock()
+	defer state.bufferMutex.Unlock()
+
+	if len(state.resources) == 0 {
+		return
+	}
+
+	failures := map[int]index.BulkFailure{}
+	if err := state.index.IndexResources(state.resources); err != nil {
+		var bulkErr *index.BulkError
+		if !errors.As(err, &bulkErr) {
+			log.Err(err).Int("count", len(state.resources)).Msg("error while indexing resources")
+
+			for _, msg := range state.messages {
+				if err := msg.Retry(); err != nil {
+					log.Err(err).Msg("error while retrying event")
+				}
+			}
+
+			state.resources = []index.Resource{}
+			state.messages = []event.RawMessage{}
+			return
+		}
+
+		failures = bulkErr.Failures
+	}
+
+	log.Info().
+		Int("count", len(state.resources)-len(failures)).
+		Msg("Successfully indexed buffered resources")
+
+	for i, resource := range state.resources {
+		msg := state.messages[i]
+
+		failure, failed := failures[i]
+		if !failed {
+			state.publishResourceIndexed(state.publisher, resource)
+
+			if err := msg.Ack(); err != nil {
+				log.Err(err).Msg("error while acknowledging event")
+			}
+			continue
+		}
+
+		if failure.Permanent {
+			log.Warn().Str("url", resource.URL).Str("reason", failure.Reason).Msg("Resource rejected, dead-lettering it")
+
+			if err := msg.DeadLetter(); err != nil {
+				log.Err(err).Msg("error while dead-lettering event")
+			}
+			continue
+		}
+
+		log.Debug().Str("url", resource.URL).Str("reason", failure.Reason).Msg("Resource rejected, retrying later")
+
+		if err := msg.Retry(); err != nil {
+			log.Err(err).Msg("error while retrying event")
+		}
+	}
+
+	// Clear cache
+	state.resources = []index.Resource{}
+	state.messages = []event.RawMessage{}
+}
+
+// newResource create the resource to index from given event, truncating its body if needed,
+// using the canonical URL as identity, extracting its entities and flagging watchlist hits & near-duplicates
+func (state *State) newResource(evt event.NewResourceEvent) (index.Resource, error) {
+	maxBodyLength, err := state.configClient.GetMaxIndexedBodyLength()
+	if err != nil {
+		return index.Resource{}, err
+	}
+
+	// Everything is extracted from the UTF-8 body
+	fullBody := evt.Body
+	if state.transcodeCharset {
+		fullBody = toUTF8(evt.Headers, evt.Body)
+	}
+
+	storeBody, err := state.configClient.GetStoreBody()
+	if err != nil {
+		return index.Resource{}, err
+	}
+
+	maxParseBytes, err := state.configClient.GetMaxParseBytes()
+	if err != nil {
+		return index.Resource{}, err
+	}
+
+	// The HTML is only parsed from the beginning of the body to bound the parsing cost of the huge pages,
+	// whatever is past it (links included) is missed by design
+	parsedBody := truncateBytes(fullBody, maxParseBytes)
+
+	body, truncated := truncateBody(fullBody, maxBodyLength)
+
+	resource := index.Resource{
+		URL:       evt.URL,
+		Time:      evt.Time,
+		Body:      body,
+		Headers:   evt.Headers,
+		Hash:      computeHash(fullBody),
+		Truncated: truncated,
+		Partial:   evt.StatusCode == http.StatusPartialContent,
+		OmitBody:  !storeBody,
+		Tag:       evt.Tag,
+	}
+	if state.storeVia {
+		resource.Via = evt.Via
+	}
+	if len(parsedBody) < len(fullBody) {
+		resource.ParseLength = len(parsedBody)
+	}
+
+	// Store the resource under its canonical URL
+	if canonicalURL := extractCanonicalURL(evt.URL, parsedBody); canonicalURL != "" && canonicalURL != evt.URL {
+		resource.URL = canonicalURL
+		resource.Alias = evt.URL
+	}
+
+	keywords, err := state.configClient.GetWatchlistKeywords()
+	if err != nil {
+		return index.Resource{}, err
+	}
+	if matched := matchKeywords(fullBody, keywords); len(matched) > 0 {
+		resource.MatchedKeywords = matched
+		resource.WatchlistHit = true
+	}
+
+	// The links are extracted from the parsed body, to build the onion-to-onion graph
+	resource.OnionLinks = extractOnionLinks(evt.URL, parsedBody)
+
+	// The structured fields are only extracted from the hostnames having selectors configured,
+	// the other resources rely on the generic title & meta extraction
+	fieldSelectors, err := state.configClient.GetFieldSelectors()
+	if err != nil {
+		return index.Resource{}, err
+	}
+	if selectors := matchFieldSelectors(fieldSelectors, evt.URL); selectors != nil {
+		resource.Fields = extractFields(selectors, parsedBody)
+	}
+
+	resource.StructuredData = extractStructuredData(parsedBody)
+
+	// The entities are extracted from the full body, even if it has been truncated
+	if len(state.extractors) > 0 {
+		resource.Entities = extractEntities(state.extractors, fullBody, state.maxEntities)
+	}
+
+	if state.simHash {
+		resource.SimHash = computeSimHash(fullBody)
+
+		duplicateOf, err := state.index.FindNearDuplicate(resource.SimHash, state.simHashDistance)
+		if err != nil && err != index.ErrNotSupported {
+			return index.Resource{}, err
+		}
+		if duplicateOf != resource.URL {
+			resource.NearDuplicateOf = duplicateOf
+		}
+	}
+
+	return resource, nil
+}
+
+// truncateBody truncate given body to maxLength runes (0 means no limit)
+// the boolean returned indicate if the body has been truncated
+func truncateBody(body string, maxLength int) (string, bool) {
+	if maxLength <= 0 || len(body) <= maxLength {
+		return body, false
+	}
+
+	count := 0
+	for i := range body {
+		if count == maxLength {
+			return body[:i], true
+		}
+		count++
+	}
+
+	return body, false
+}
+
+// truncateBytes truncate given body to at most maxBytes bytes, without splitting a rune (0 means no limit)
+func truncateBytes(body string, maxBytes int) string {
+	if maxBytes <= 0 || len(body) <= maxBytes {
+		return body
+	}
+
+	for maxBytes > 0 && !utf8.RuneStart(body[maxBytes]) {
+		maxBytes--
+	}
+
+	return body[:maxBytes]
+}
+
+// computeHash returns the hex encoded SHA-256 of given body
+func computeHash(body string) string {
+	h := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(h[:])
+}
+
+// publishResourceIndexed notify that given resource has been indexed, and that it mentions watchlist keywords if so.
+// Publishing failure does not make indexing fail
+func (state *State) publishResourceIndexed(pub event.Publisher, resource index.Resource) {
+	if err := pub.PublishEvent(newResourceIndexedEvent(resource)); err != nil {
+		log.Err(err).Str("url", resource.URL).Msg("error while publishing indexed resource")
+	}
+
+	if resource.WatchlistHit {
+		evt := &event.WatchlistHitEvent{
+			URL:      resource.URL,
+			Keywords: resource.MatchedKeywords,
+			Time:     resource.Time,
+			Tag:      resource.Tag,
+		}
+		if err := pub.PublishEvent(evt); err != nil {
+			log.Err(err).Str("url", resource.URL).Msg("error while publishing watchlist hit")
+		}
+	}
+}
@@ -2,6 +2,8 @@ package indexer
 
 import (
 	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
@@ -12,7 +14,14 @@ import (
 	"github.com/darkspot-org/bathyscaphe/internal/process_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/test"
 	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,12 +35,14 @@ func TestState_Name(t *testing.T) {
 
 func TestState_Features(t *testing.T) {
 	s := State{}
-	test.CheckProcessFeatures(t, &s, []process.Feature{process.EventFeature, process.ConfigFeature})
+	test.CheckProcessFeatures(t, &s, []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature})
 }
 
 func TestState_CustomFlags(t *testing.T) {
 	s := State{}
-	test.CheckProcessCustomFlags(t, &s, []string{"index-driver", "index-dest"})
+	test.CheckProcessCustomFlags(t, &s, []string{"index-driver", "index-dest", "index-batch-size", "index-flush-interval",
+		"index-analyzer", "index-mapping", "index-flatten-json", "simhash", "simhash-distance", "extractor", "extractor-max-matches",
+		"transcode-charset", "store-via", "review-index", "index-compress-body"})
 }
 
 func TestState_Initialize(t *testing.T) {
@@ -39,15 +50,60 @@ func TestState_Initialize(t *testing.T) {
 	test.CheckInitialize(t, &s, func(p *process_mock.MockProviderMockRecorder) {
 		p.GetStrValue("index-driver").Return("local")
 		p.GetStrValue("index-dest")
+		p.GetStrValue("index-analyzer")
+		p.GetStrValue("index-mapping")
+		p.GetBoolValue("index-flatten-json")
+		p.GetStrValue("review-index")
+		p.GetBoolValue("index-compress-body")
 		p.GetIntValue(process.EventPrefetchFlag).Return(10)
-		p.ConfigClient([]string{client.ForbiddenHostnamesKey})
+		p.GetIntValue("index-batch-size").Return(5)
+		p.GetDurationValue("index-flush-interval")
+		p.GetBoolValue("simhash").Return(true)
+		p.GetIntValue("simhash-distance").Return(3)
+		p.GetStrValues("extractor").Return([]string{"email", "bitcoin"})
+		p.GetIntValue("extractor-max-matches").Return(50)
+		p.GetBoolValue("transcode-charset").Return(true)
+		p.GetBoolValue("store-via")
+		p.ConfigClient([]string{client.ForbiddenHostnamesKey, client.MaxIndexedBodyLengthKey, client.RespectRobotsKey,
+			client.WatchlistKeywordsKey, client.StoreBodyKey, client.MinIndexBodyLengthKey,
+			client.SkipBodyPatternsKey, client.IndexableStatusCodesKey,
+			client.IndexLanguagesKey, client.FieldSelectorsKey, client.MaxParseBytesKey, client.AllowedURLsKey,
+			client.StripQueryParamsKey})
+		p.Publisher()
+		p.Cache("url")
+		p.Cache("down-hostname")
+		p.Cache("queue")
 	})
 
 	if s.indexDriver != "local" {
 		t.Errorf("wrong driver: got: %s want: %s", s.indexDriver, "local")
 	}
-	if s.bufferThreshold != 10 {
-		t.Errorf("wrong buffer threshold: got: %d want: %d", s.bufferThreshold, 10)
+	if s.bufferThreshold != 5 {
+		t.Errorf("wrong buffer threshold: got: %d want: %d", s.bufferThreshold, 5)
+	}
+	if !s.simHash || s.simHashDistance != 3 {
+		t.Errorf("wrong simhash configuration: got: %v/%d want: %v/%d", s.simHash, s.simHashDistance, true, 3)
+	}
+	if len(s.extractors) != 2 || s.maxEntities != 50 {
+		t.Errorf("wrong extractors configuration: got: %d/%d want: %d/%d", len(s.extractors), s.maxEntities, 2, 50)
+	}
+}
+
+func TestState_Dependencies(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	providerMock := process_mock.NewMockProvider(mockCtrl)
+	providerMock.EXPECT().GetStrValue("index-driver").Return("local")
+	providerMock.EXPECT().GetStrValue("index-dest").Return("/tmp/index")
+
+	s := State{}
+	deps := s.Dependencies(providerMock)
+	if len(deps) != 1 || deps[0].Name != "index" {
+		t.Fatalf("wrong dependencies: got: %v", deps)
+	}
+	if err := deps[0].Ping(); err != nil {
+		t.Errorf("unexpected error: %s", err)
 	}
 }
 
@@ -55,6 +111,7 @@ func TestState_Subscribers(t *testing.T) {
 	s := State{indexDriver: "elastic"}
 	test.CheckProcessSubscribers(t, &s, []test.SubscriberDef{
 		{Queue: "elasticIndexingQueue", Exchange: "resource.new"},
+		{Queue: "elasticNotModifiedQueue", Exchange: "resource.not-modified"},
 	})
 }
 
@@ -76,6 +133,7 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 
 	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
 	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
 	indexMock := index_mock.NewMockIndex(mockCtrl)
 
 	tn := time.Now()
@@ -91,12 +149,29 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 		}).Return(nil)
 
 	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{{Hostname: "example2.onion"}}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
 	indexMock.EXPECT().IndexResource(index.Resource{
-		URL:     "https://example.onion",
-		Time:    tn,
-		Body:    body,
-		Headers: map[string]string{"Server": "Traefik", "Content-Type": "application/html"},
+		URL:        "https://example.onion",
+		Time:       tn,
+		Body:       body,
+		Headers:    map[string]string{"Server": "Traefik", "Content-Type": "application/html"},
+		Hash:       computeHash(body),
+		OnionLinks: []string{"https://help.facebook.onion/"},
 	})
+	subscriberMock.EXPECT().PublishEvent(&event.ResourceIndexedEvent{
+		URL:         "https://example.onion",
+		Hostname:    "example.onion",
+		ContentType: "application/html",
+		BodyLength:  len(body),
+		Time:        tn,
+	}).Return(errors.New("broker unavailable")) // should not make indexing fail
 
 	s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 1}
 	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
@@ -122,6 +197,7 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 
 	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
 	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
 	indexMock := index_mock.NewMockIndex(mockCtrl)
 
 	tn := time.Now()
@@ -137,9 +213,17 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 		}).Return(nil)
 
 	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{{Hostname: "example2.onion"}}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
 
 	s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 5}
-	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
 		t.FailNow()
 	}
 
@@ -159,6 +243,9 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 	if s.resources[0].Time != tn {
 		t.Fail()
 	}
+	if s.resources[0].Hash != computeHash(body) || s.resources[0].Truncated {
+		t.Fail()
+	}
 }
 
 func TestHandleNewResourceEvent_Buffering_Dispatch(t *testing.T) {
@@ -179,6 +266,8 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 
 	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
 	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+	publisherMock := event_mock.NewMockPublisher(mockCtrl)
 	indexMock := index_mock.NewMockIndex(mockCtrl)
 
 	tn := time.Now()
@@ -194,34 +283,725 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 		}).Return(nil)
 
 	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{{Hostname: "example2.onion"}}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
 	indexMock.EXPECT().IndexResources([]index.Resource{
 		{
 			URL: "https://google.onion",
 		},
 		{
-			URL:     "https://example.onion",
-			Time:    tn,
-			Body:    body,
-			Headers: map[string]string{"Server": "Traefik", "Content-Type": "application/html"},
+			URL:        "https://example.onion",
+			Time:       tn,
+			Body:       body,
+			Headers:    map[string]string{"Server": "Traefik", "Content-Type": "application/html"},
+			Hash:       computeHash(body),
+			OnionLinks: []string{"https://help.facebook.onion/"},
 		},
 	})
+	publisherMock.EXPECT().PublishEvent(&event.ResourceIndexedEvent{URL: "https://google.onion", Hostname: "google.onion"})
+	publisherMock.EXPECT().PublishEvent(&event.ResourceIndexedEvent{
+		URL:         "https://example.onion",
+		Hostname:    "example.onion",
+		ContentType: "application/html",
+		BodyLength:  len(body),
+		Time:        tn,
+	})
 
 	s := State{
 		index:           indexMock,
 		configClient:    configClientMock,
+		publisher:       publisherMock,
 		bufferThreshold: 2,
 		resources:       []index.Resource{{URL: "https://google.onion"}},
+		messages:        []event.RawMessage{{}},
 	}
-	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
 		t.FailNow()
 	}
 
 	// should be reset
-	if len(s.resources) != 0 {
+	if len(s.resources) != 0 || len(s.messages) != 0 {
 		t.Fail()
 	}
 }
 
+func TestHandleNewResourceEvent_Canonical(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+
+	body := `<link rel="canonical" href="https://example.onion/posts/1">`
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://example.onion/posts/1?ref=home", Body: body, Tag: "forums"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+
+	s := State{configClient: configClientMock, bufferThreshold: 5}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.FailNow()
+	}
+
+	if s.resources[0].URL != "https://example.onion/posts/1" {
+		t.Errorf("got %s want %s", s.resources[0].URL, "https://example.onion/posts/1")
+	}
+	if s.resources[0].Alias != "https://example.onion/posts/1?ref=home" {
+		t.Errorf("got %s want %s", s.resources[0].Alias, "https://example.onion/posts/1?ref=home")
+	}
+	if s.resources[0].Tag != "forums" {
+		t.Errorf("got %s want %s", s.resources[0].Tag, "forums")
+	}
+}
+
+func TestHandleNewResourceEvent_NearDuplicate(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	body := "<html><body>Welcome to the forum, there are 42 users online</body></html>"
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://example.onion/index.php", Body: body}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+
+	indexMock.EXPECT().FindNearDuplicate(computeSimHash(body), 3).Return("https://example.onion", nil)
+
+	s := State{configClient: configClientMock, index: indexMock, bufferThreshold: 5, simHash: true, simHashDistance: 3}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.FailNow()
+	}
+
+	if s.resources[0].SimHash != computeSimHash(body) {
+		t.Errorf("got %d want %d", s.resources[0].SimHash, computeSimHash(body))
+	}
+	if s.resources[0].NearDuplicateOf != "https://example.onion" {
+		t.Errorf("got %s want %s", s.resources[0].NearDuplicateOf, "https://example.onion")
+	}
+}
+
+func TestHandleNewResourceEvent_Fields(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://shop.market.onion/item/1", Body: marketFixture}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return([]client.FieldSelectors{
+		{Pattern: "forum.onion", Fields: map[string]string{"author": ".author"}},
+		{Pattern: "*.market.onion", Fields: map[string]string{"price": ".price", "vendor": ".vendor"}},
+	}, nil)
+
+	s := State{configClient: configClientMock, bufferThreshold: 5}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.FailNow()
+	}
+
+	want := map[string]string{"price": "0.0042 BTC", "vendor": "trusted_seller"}
+	if !reflect.DeepEqual(s.resources[0].Fields, want) {
+		t.Errorf("got %v want %v", s.resources[0].Fields, want)
+	}
+}
+
+func TestHandleNewResourceEvent_Entities(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+
+	body := "<html><body>Contact: admin@market.onion - Donate: 1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2</body></html>"
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://market.onion", Body: body}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+	// entities must be extracted from the full body
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(10, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+
+	extractors, err := parseExtractors([]string{"email", "bitcoin", "monero"})
+	if err != nil {
+		t.FailNow()
+	}
+
+	s := State{configClient: configClientMock, bufferThreshold: 5, extractors: extractors, maxEntities: 50}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.FailNow()
+	}
+
+	want := map[string][]string{
+		"email":   {"admin@market.onion"},
+		"bitcoin": {"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"},
+	}
+	if !reflect.DeepEqual(s.resources[0].Entities, want) {
+		t.Errorf("got %v want %v", s.resources[0].Entities, want)
+	}
+}
+
+func TestHandleNewResourceEvent_OmitBody(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+
+	body := "<title>Private forum</title>Some private content"
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://forum.onion", Body: body}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(false, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+
+	s := State{configClient: configClientMock, bufferThreshold: 5}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.FailNow()
+	}
+
+	// The body is kept to extract the metadata, the index drop it
+	res := s.resources[0]
+	if !res.OmitBody {
+		t.Error("the body should be omitted")
+	}
+	if res.Hash != computeHash(body) {
+		t.Errorf("wrong hash: got: %s want: %s", res.Hash, computeHash(body))
+	}
+}
+
+func TestHandleNewResourceEvent_WatchlistHit(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	body := "<html><body>Fresh Database LEAK of the week, contact the vendor</body></html>"
+	tn := time.Now()
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://market.onion", Body: body, Time: tn, Tag: "leaks"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+	configClientMock.EXPECT().GetWatchlistKeywords().Return([]string{"database leak", "ransom", "vendor"}, nil)
+
+	indexMock.EXPECT().IndexResource(index.Resource{
+		URL:             "https://market.onion",
+		Time:            tn,
+		Body:            body,
+		Hash:            computeHash(body),
+		Tag:             "leaks",
+		MatchedKeywords: []string{"database leak", "vendor"},
+		WatchlistHit:    true,
+	}).Return(nil)
+
+	subscriberMock.EXPECT().PublishEvent(gomock.AssignableToTypeOf(&event.ResourceIndexedEvent{})).Return(nil)
+	subscriberMock.EXPECT().PublishEvent(&event.WatchlistHitEvent{
+		URL:      "https://market.onion",
+		Keywords: []string{"database leak", "vendor"},
+		Time:     tn,
+		Tag:      "leaks",
+	}).Return(nil)
+
+	s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 1}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.FailNow()
+	}
+}
+
+func TestHandleNewResourceEvent_NoIndex(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{
+			URL:  "https://example.onion",
+			Body: `<meta name="robots" content="noindex"><title>Hello</title>`,
+		}).Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+
+	// Nothing should be indexed
+	s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 1}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.FailNow()
+	}
+}
+
+func TestHandleNewResourceEvent_MinBodyLength(t *testing.T) {
+	type test struct {
+		body    string
+		indexed bool
+	}
+
+	// 12 characters once extracted
+	tests := []test{
+		{body: "<title>Hello</title> world!", indexed: true},
+		{body: "<title>Hello</title> world", indexed: false},
+	}
+
+	for _, test := range tests {
+		mockCtrl := gomock.NewController(t)
+
+		subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+		configClientMock := client_mock.NewMockClient(mockCtrl)
+		configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+		indexMock := index_mock.NewMockIndex(mockCtrl)
+
+		msg := event.RawMessage{}
+		subscriberMock.EXPECT().
+			Read(&msg, &event.NewResourceEvent{}).
+			SetArg(1, event.NewResourceEvent{URL: "https://example.onion", Body: test.body}).
+			Return(nil)
+
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+		configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+		configClientMock.EXPECT().GetMinIndexBodyLength().Return(12, nil)
+
+		if test.indexed {
+			configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+			configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+			configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+			configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+			configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+			configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+			indexMock.EXPECT().IndexResource(gomock.Any()).Return(nil)
+			subscriberMock.EXPECT().PublishEvent(gomock.AssignableToTypeOf(&event.ResourceIndexedEvent{})).Return(nil)
+		}
+
+		s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 1}
+		if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+			t.Errorf("%s: %s", test.body, err)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestHandleNewResourceEvent_SkipBodyPatterns(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{
+			URL:  "https://example.onion",
+			Body: `<title>Welcome</title>Site Under Construction`,
+		}).Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return([]string{"/^Index of /", "site under construction"}, nil)
+
+	// Nothing should be indexed
+	s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 1}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.FailNow()
+	}
+}
+
+func TestHandleNewResourceEvent_StatusCode(t *testing.T) {
+	type test struct {
+		statusCode int
+		indexed    bool
+	}
+
+	tests := []test{
+		{statusCode: 200, indexed: true},
+		{statusCode: 404, indexed: false},
+	}
+
+	for _, test := range tests {
+		mockCtrl := gomock.NewController(t)
+
+		subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+		configClientMock := client_mock.NewMockClient(mockCtrl)
+		configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+		indexMock := index_mock.NewMockIndex(mockCtrl)
+
+		msg := event.RawMessage{}
+		subscriberMock.EXPECT().
+			Read(&msg, &event.NewResourceEvent{}).
+			SetArg(1, event.NewResourceEvent{URL: "https://example.onion", Body: "Hello", StatusCode: test.statusCode}).
+			Return(nil)
+
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+		configClientMock.EXPECT().GetIndexableStatusCodes().Return(nil, nil)
+
+		if test.indexed {
+			configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+			configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+			configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+			configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+			configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+			configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+			configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+			configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+			indexMock.EXPECT().IndexResource(gomock.Any()).Return(nil)
+			subscriberMock.EXPECT().PublishEvent(gomock.AssignableToTypeOf(&event.ResourceIndexedEvent{})).Return(nil)
+		}
+
+		s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 1}
+		if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+			t.Errorf("%d: %s", test.statusCode, err)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestHandleNewResourceEvent_IndexLanguages(t *testing.T) {
+	type test struct {
+		body           string
+		skipUndetected bool
+		indexed        bool
+	}
+
+	tests := []test{
+		{body: `<html lang="ru-RU"><title>Hello</title></html>`, indexed: true},
+		{body: `<html lang="fr"><title>Hello</title></html>`, indexed: false},
+		{body: `<html><title>Hello</title></html>`, indexed: true},
+		{body: `<html><title>Hello</title></html>`, skipUndetected: true, indexed: false},
+	}
+
+	for _, test := range tests {
+		mockCtrl := gomock.NewController(t)
+
+		subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+		configClientMock := client_mock.NewMockClient(mockCtrl)
+		configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+		indexMock := index_mock.NewMockIndex(mockCtrl)
+
+		msg := event.RawMessage{}
+		subscriberMock.EXPECT().
+			Read(&msg, &event.NewResourceEvent{}).
+			SetArg(1, event.NewResourceEvent{URL: "https://example.onion", Body: test.body}).
+			Return(nil)
+
+		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+		configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+		configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+		configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+		configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{
+			Languages:      []string{"en", "RU"},
+			SkipUndetected: test.skipUndetected,
+		}, nil)
+
+		if test.indexed {
+			configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+			configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+			configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+			configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+			indexMock.EXPECT().IndexResource(gomock.Any()).Return(nil)
+			subscriberMock.EXPECT().PublishEvent(gomock.AssignableToTypeOf(&event.ResourceIndexedEvent{})).Return(nil)
+		}
+
+		s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 1}
+		if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+			t.Errorf("%s: %s", test.body, err)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestHandleNotModifiedResourceEvent(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	tn := time.Now()
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NotModifiedResourceEvent{}).
+		SetArg(1, event.NotModifiedResourceEvent{URL: "https://example.onion", Time: tn}).
+		Return(nil)
+
+	indexMock.EXPECT().UpdateCrawlTime("https://example.onion", tn).Return(nil)
+
+	s := State{index: indexMock}
+	if err := s.handleNotModifiedResourceEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestState_Shutdown(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	publisherMock := event_mock.NewMockPublisher(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	indexMock.EXPECT().IndexResources([]index.Resource{{URL: "https://example.onion"}}).Return(nil)
+	publisherMock.EXPECT().PublishEvent(&event.ResourceIndexedEvent{URL: "https://example.onion", Hostname: "example.onion"})
+
+	s := State{
+		index:           indexMock,
+		publisher:       publisherMock,
+		bufferThreshold: 10,
+		resources:       []index.Resource{{URL: "https://example.onion"}},
+		messages:        []event.RawMessage{{}},
+	}
+
+	// remaining resources should be flushed
+	if err := s.Shutdown(); err != nil {
+		t.FailNow()
+	}
+	if len(s.resources) != 0 || len(s.messages) != 0 {
+		t.Fail()
+	}
+
+	// nothing to flush
+	if err := s.Shutdown(); err != nil {
+		t.FailNow()
+	}
+}
+
+func TestFlush_Error(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	publisherMock := event_mock.NewMockPublisher(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	// No event should be published when indexing fails
+	indexMock.EXPECT().IndexResources([]index.Resource{{URL: "https://example.onion"}}).Return(errors.New("es unavailable"))
+
+	s := State{
+		index:           indexMock,
+		publisher:       publisherMock,
+		bufferThreshold: 10,
+		resources:       []index.Resource{{URL: "https://example.onion"}},
+		messages:        []event.RawMessage{{}},
+	}
+	s.flush()
+
+	if len(s.resources) != 0 || len(s.messages) != 0 {
+		t.Fail()
+	}
+}
+
+func TestFlush_PartialFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	publisherMock := event_mock.NewMockPublisher(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	resources := []index.Resource{{URL: "https://example.onion/1"}, {URL: "https://example.onion/2"}, {URL: "https://example.onion/3"}}
+
+	indexMock.EXPECT().IndexResources(resources).Return(&index.BulkError{Failures: map[int]index.BulkFailure{
+		1: {Reason: "failed to parse", Permanent: true},
+		2: {Reason: "queue full"},
+	}})
+
+	// Only the indexed resource should be published
+	publisherMock.EXPECT().PublishEvent(&event.ResourceIndexedEvent{URL: "https://example.onion/1", Hostname: "example.onion"})
+
+	s := State{
+		index:           indexMock,
+		publisher:       publisherMock,
+		bufferThreshold: 10,
+		resources:       resources,
+		messages:        []event.RawMessage{{}, {}, {}},
+	}
+	s.flush()
+
+	if len(s.resources) != 0 || len(s.messages) != 0 {
+		t.Fail()
+	}
+}
+
+func TestHandleNewResourceEvent_Retry(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		Times(2).
+		SetArg(1, event.NewResourceEvent{URL: "https://example.onion", Body: "Hello"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Times(2).Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Times(2).Return(false, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Times(2).Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Times(2).Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Times(2).Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Times(2).Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Times(2).Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Times(2).Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Times(2).Return(nil, nil)
+	configClientMock.EXPECT().GetWatchlistKeywords().Times(2).Return(nil, nil)
+
+	resource := index.Resource{URL: "https://example.onion", Body: "Hello", Hash: computeHash("Hello")}
+	gomock.InOrder(
+		indexMock.EXPECT().IndexResource(resource).Return(errors.New("es unavailable")),
+		indexMock.EXPECT().IndexResource(resource).Return(nil),
+	)
+
+	s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 1}
+
+	// The message should be retried later instead of being lost
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.Errorf("got %v want %v", err, event.ErrAckDeferred)
+	}
+
+	// Then indexed once the index is back
+	subscriberMock.EXPECT().PublishEvent(gomock.AssignableToTypeOf(&event.ResourceIndexedEvent{})).Return(nil)
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+}
+
+func TestState_SubscribersRetry(t *testing.T) {
+	s := State{indexDriver: "elastic"}
+
+	subscribers := s.Subscribers()
+	if subscribers[0].Retry == nil || subscribers[0].Retry.MaxRetries == 0 {
+		t.Error("index failures should be retried")
+	}
+	if subscribers[1].Retry != nil {
+		t.Error("crawl time updates should not be retried")
+	}
+}
+
+func TestFlushPeriodically(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	publisherMock := event_mock.NewMockPublisher(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	flushed := make(chan struct{})
+	indexMock.EXPECT().IndexResources([]index.Resource{{URL: "https://example.onion"}}).Return(nil)
+	publisherMock.EXPECT().PublishEvent(&event.ResourceIndexedEvent{URL: "https://example.onion", Hostname: "example.onion"}).
+		DoAndReturn(func(evt event.Event) error {
+			close(flushed)
+			return nil
+		})
+
+	s := State{
+		index:           indexMock,
+		publisher:       publisherMock,
+		bufferThreshold: 10,
+		flushInterval:   10 * time.Millisecond,
+		resources:       []index.Resource{{URL: "https://example.onion"}},
+		messages:        []event.RawMessage{{}},
+	}
+	go s.flushPeriodically()
+
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Error("buffer has not been flushed")
+	}
+}
+
 func TestHandleMessageForbiddenHostname(t *testing.T) {
 	body := `
 <title>Creekorful Inc</title>
@@ -238,6 +1018,7 @@ This is sparta (hosted on https://example.org)
 
 	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
 	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
 
 	tn := time.Now()
 
@@ -252,9 +1033,512 @@ This is sparta (hosted on https://example.org)
 		}).Return(nil)
 
 	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{{Hostname: "example.onion"}}, nil)
+	configClientMock.EXPECT().GetAllowedURLs().Return(nil, nil)
 
 	s := State{configClient: configClientMock}
 	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, errHostnameNotAllowed) {
 		t.FailNow()
 	}
 }
+
+func TestHandleNewResourceEvent_Partial(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+
+	// The first bytes of a text dump, answered to a ranged fetch
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://example.onion/dump.txt", Body: "0123456789",
+			Headers: map[string]string{"Content-Type": "text/plain", "Content-Range": "bytes 0-9/1000000"}, StatusCode: 206}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetIndexableStatusCodes().Return(nil, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+
+	s := State{configClient: configClientMock, bufferThreshold: 5}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.FailNow()
+	}
+
+	if !s.resources[0].Partial {
+		t.Error("resource should be flagged as partial")
+	}
+	if s.resources[0].Body != "0123456789" || s.resources[0].Truncated {
+		t.Errorf("got body %s (truncated: %v) want the whole prefix", s.resources[0].Body, s.resources[0].Truncated)
+	}
+}
+
+func TestHandleNewResourceEvent_Truncate(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+
+	body := "Привет мир"
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://example.onion", Body: body}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(6, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(0, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+
+	s := State{configClient: configClientMock, bufferThreshold: 5}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.FailNow()
+	}
+
+	if s.resources[0].Body != "Привет" {
+		t.Errorf("got %s want %s", s.resources[0].Body, "Привет")
+	}
+	if !s.resources[0].Truncated {
+		t.Error("resource should be flagged as truncated")
+	}
+	// Hash should be computed over the full body
+	if s.resources[0].Hash != computeHash(body) {
+		t.Error("wrong resource hash")
+	}
+}
+
+func TestHandleNewResourceEvent_MaxParseBytes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetWatchlistKeywords().AnyTimes().Return(nil, nil)
+
+	// The second link and the canonical URL are past the parsed prefix
+	prefix := `<html><head><title>Huge page</title></head><body><a href="http://first.onion/">first</a>`
+	body := prefix + strings.Repeat("<p>lorem ipsum</p>", 10000) +
+		`<a href="http://second.onion/">second</a><link rel="canonical" href="https://example.onion/canonical"></body></html>`
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://example.onion", Body: body}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+	configClientMock.EXPECT().GetMinIndexBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetSkipBodyPatterns().Return(nil, nil)
+	configClientMock.EXPECT().GetIndexLanguages().Return(client.IndexLanguages{}, nil)
+	configClientMock.EXPECT().GetMaxIndexedBodyLength().Return(0, nil)
+	configClientMock.EXPECT().GetMaxParseBytes().Return(len(prefix)+100, nil)
+	configClientMock.EXPECT().GetStoreBody().Return(true, nil)
+	configClientMock.EXPECT().GetFieldSelectors().Return(nil, nil)
+
+	s := State{configClient: configClientMock, bufferThreshold: 5}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.FailNow()
+	}
+
+	resource := s.resources[0]
+	if want := []string{"http://first.onion/"}; !reflect.DeepEqual(resource.OnionLinks, want) {
+		t.Errorf("got %v want %v", resource.OnionLinks, want)
+	}
+	if resource.URL != "https://example.onion" || resource.Alias != "" {
+		t.Errorf("canonical URL past the parsed prefix should be missed: got %s", resource.URL)
+	}
+	if resource.ParseLength != len(prefix)+100 {
+		t.Errorf("got parse length %d want %d", resource.ParseLength, len(prefix)+100)
+	}
+	// The body is still stored in full
+	if resource.Body != body || resource.Truncated {
+		t.Error("body should not be truncated")
+	}
+}
+
+func TestTruncateBytes(t *testing.T) {
+	type test struct {
+		body     string
+		maxBytes int
+		want     string
+	}
+
+	tests := []test{
+		{body: "hello world", maxBytes: 0, want: "hello world"},
+		{body: "hello world", maxBytes: 5, want: "hello"},
+		{body: "hello", maxBytes: 5, want: "hello"},
+		// runes should not be split
+		{body: "héllö", maxBytes: 2, want: "h"},
+		{body: "héllö", maxBytes: 3, want: "hé"},
+		{body: "日本語", maxBytes: 5, want: "日"},
+		{body: "🙂🙂", maxBytes: 3, want: ""},
+	}
+
+	for _, test := range tests {
+		if got := truncateBytes(test.body, test.maxBytes); got != test.want {
+			t.Errorf("truncateBytes(%s, %d): got %s want %s", test.body, test.maxBytes, got, test.want)
+		}
+	}
+}
+
+func TestTruncateBody(t *testing.T) {
+	type test struct {
+		body      string
+		maxLength int
+		want      string
+		truncated bool
+	}
+
+	tests := []test{
+		{body: "hello world", maxLength: 0, want: "hello world", truncated: false},
+		{body: "hello world", maxLength: 5, want: "hello", truncated: true},
+		{body: "hello", maxLength: 5, want: "hello", truncated: false},
+		// more bytes than runes: should not be truncated
+		{body: "héllö wörld", maxLength: 11, want: "héllö wörld", truncated: false},
+		{body: "héllö wörld", maxLength: 2, want: "hé", truncated: true},
+		{body: "日本語", maxLength: 1, want: "日", truncated: true},
+		{body: "日本語", maxLength: 3, want: "日本語", truncated: false},
+		{body: "🙂🙂", maxLength: 1, want: "🙂", truncated: true},
+	}
+
+	for _, test := range tests {
+		got, truncated := truncateBody(test.body, test.maxLength)
+		if got != test.want || truncated != test.truncated {
+			t.Errorf("truncateBody(%s, %d): got (%s, %v) want (%s, %v)", test.body, test.maxLength, got, truncated, test.want, test.truncated)
+		}
+	}
+}
+
+func TestRecrawlHostname(t *testing.T) {
+	type test struct {
+		target string
+		events []event.Event
+		queued int64
+	}
+
+	tests := []test{
+		{
+			target: "/hostnames/example.onion/recrawl",
+			events: []event.Event{
+				&event.FoundURLEvent{URL: "https://example.onion"},
+				&event.FoundURLEvent{URL: "https://example.onion/login.php"},
+			},
+		},
+		{
+			target: "/hostnames/example.onion/recrawl?force=true",
+			events: []event.Event{
+				&event.NewURLEvent{URL: "https://example.onion"},
+				&event.NewURLEvent{URL: "https://example.onion/login.php"},
+			},
+			queued: 2,
+		},
+	}
+
+	for _, tst := range tests {
+		mockCtrl := gomock.NewController(t)
+
+		publisherMock := event_mock.NewMockPublisher(mockCtrl)
+		indexMock := index_mock.NewMockIndex(mockCtrl)
+
+		indexMock.EXPECT().ForEachHostnameURL("example.onion", gomock.Any()).
+			DoAndReturn(func(hostname string, handler index.URLHandler) error {
+				for _, u := range []string{"https://example.onion", "https://example.onion/login.php"} {
+					if err := handler(u); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+
+		for _, evt := range tst.events {
+			publisherMock.EXPECT().PublishEvent(evt).Return(nil)
+		}
+
+		// Only the URLs sent directly to the crawler should be counted as queued
+		queueCacheMock := cache_mock.NewMockCache(mockCtrl)
+		if tst.queued > 0 {
+			queueCacheMock.EXPECT().IncrBy("urls", tst.queued, cache.NoTTL).Return(tst.queued, nil)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, tst.target, nil)
+		req = mux.SetURLVars(req, map[string]string{"hostname": "example.onion"})
+		rec := httptest.NewRecorder()
+
+		s := State{index: indexMock, publisher: publisherMock, queueCache: queueCacheMock}
+		s.recrawlHostname(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("got status %d want %d", rec.Code, http.StatusOK)
+		}
+		if got := rec.Body.String(); got != `{"count":2}` {
+			t.Errorf("got %s want %s", got, `{"count":2}`)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetRecentResources(t *testing.T) {
+	type test struct {
+		target   string
+		limit    int
+		tag      string
+		hostname string
+		group    bool
+		keyword  string
+		scale    time.Duration
+		status   int
+	}
+
+	tests := []test{
+		{target: "/recent", limit: 10, status: http.StatusOK},
+		{target: "/recent?keyword=sparta&recency-scale=720h", limit: 10, keyword: "sparta", scale: 720 * time.Hour, status: http.StatusOK},
+		{target: "/recent?recency-scale=0s", status: http.StatusBadRequest},
+		{target: "/recent?recency-scale=abc", status: http.StatusBadRequest},
+		{target: "/recent?group-by-hostname=true", limit: 10, group: true, status: http.StatusOK},
+		{target: "/recent?limit=2", limit: 2, status: http.StatusOK},
+		{target: "/recent?limit=5000", limit: 100, status: http.StatusOK},
+		{target: "/recent?tag=forums", limit: 10, tag: "forums", status: http.StatusOK},
+		{target: "/recent?keyword=sparta&hostname=Example.onion", limit: 10, keyword: "sparta", hostname: "example.onion", status: http.StatusOK},
+		{target: "/recent?hostname=127.0.0.1", limit: 10, hostname: "127.0.0.1", status: http.StatusOK},
+		{target: "/recent?hostname=example.onion/index.php", status: http.StatusBadRequest},
+		{target: "/recent?hostname=-example.onion", status: http.StatusBadRequest},
+		{target: "/recent?hostname=example..onion", status: http.StatusBadRequest},
+		{target: "/recent?limit=-1", status: http.StatusBadRequest},
+		{target: "/recent?limit=abc", status: http.StatusBadRequest},
+	}
+
+	tn := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	for _, tst := range tests {
+		mockCtrl := gomock.NewController(t)
+		indexMock := index_mock.NewMockIndex(mockCtrl)
+
+		if tst.status == http.StatusOK {
+			indexMock.EXPECT().Search(index.SearchParams{Keyword: tst.keyword, Limit: tst.limit, ExcludeBody: true, Tag: tst.tag,
+				Hostname: tst.hostname, GroupByHostname: tst.group, RecencyScale: tst.scale}).Return(index.SearchResult{
+				Total: 42,
+				Resources: []index.Resource{
+					{URL: "https://example.onion/login.php", Title: "Login", Time: tn, FirstSeen: tn.Add(-24 * time.Hour), LastSeen: tn},
+					{URL: "http://test.onion:8080", Time: tn, FirstSeen: tn, LastSeen: tn},
+				},
+			}, nil)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, tst.target, nil)
+		rec := httptest.NewRecorder()
+
+		s := State{index: indexMock}
+		s.getRecentResources(rec, req)
+
+		if rec.Code != tst.status {
+			t.Errorf("%s: got status %d want %d", tst.target, rec.Code, tst.status)
+		}
+
+		if tst.status == http.StatusOK {
+			want := `[{"url":"https://example.onion/login.php","title":"Login","hostname":"example.onion","crawl-date":"2021-03-10T12:00:00Z",` +
+				`"first-seen":"2021-03-09T12:00:00Z","last-seen":"2021-03-10T12:00:00Z"},` +
+				`{"url":"http://test.onion:8080","title":"","hostname":"test.onion","crawl-date":"2021-03-10T12:00:00Z",` +
+				`"first-seen":"2021-03-10T12:00:00Z","last-seen":"2021-03-10T12:00:00Z"}]`
+			if got := rec.Body.String(); got != want {
+				t.Errorf("got %s want %s", got, want)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetHostnames(t *testing.T) {
+	type test struct {
+		target string
+		from   string
+		size   int
+		status int
+	}
+
+	tests := []test{
+		{target: "/hostnames", size: 100, status: http.StatusOK},
+		{target: "/hostnames?from=example.onion&size=2", from: "example.onion", size: 2, status: http.StatusOK},
+		{target: "/hostnames?size=5000", size: 1000, status: http.StatusOK},
+		{target: "/hostnames?size=0", status: http.StatusBadRequest},
+		{target: "/hostnames?size=abc", status: http.StatusBadRequest},
+	}
+
+	for _, tst := range tests {
+		mockCtrl := gomock.NewController(t)
+		indexMock := index_mock.NewMockIndex(mockCtrl)
+
+		if tst.status == http.StatusOK {
+			indexMock.EXPECT().ListHostnames(tst.from, tst.size).Return(index.HostnamesPage{
+				Hostnames: []index.HostnameCount{{Hostname: "forum.onion", Count: 42}, {Hostname: "market.onion", Count: 3}},
+				AfterKey:  "market.onion",
+			}, nil)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, tst.target, nil)
+		rec := httptest.NewRecorder()
+
+		s := State{index: indexMock}
+		s.getHostnames(rec, req)
+
+		if rec.Code != tst.status {
+			t.Errorf("%s: got status %d want %d", tst.target, rec.Code, tst.status)
+		}
+
+		if tst.status == http.StatusOK {
+			want := `{"hostnames":[{"hostname":"forum.onion","count":42},{"hostname":"market.onion","count":3}],"after-key":"market.onion"}`
+			if got := rec.Body.String(); got != want {
+				t.Errorf("got %s want %s", got, want)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetCoverage(t *testing.T) {
+	type test struct {
+		target   string
+		interval string
+		status   int
+	}
+
+	tests := []test{
+		{target: "/coverage", interval: "day", status: http.StatusOK},
+		{target: "/coverage?interval=month", interval: "month", status: http.StatusOK},
+		{target: "/coverage?interval=hour", status: http.StatusBadRequest},
+	}
+
+	for _, tst := range tests {
+		mockCtrl := gomock.NewController(t)
+		indexMock := index_mock.NewMockIndex(mockCtrl)
+
+		if tst.status == http.StatusOK {
+			indexMock.EXPECT().Coverage(tst.interval).Return([]index.CoverageBucket{
+				{Time: time.Date(2021, time.March, 10, 0, 0, 0, 0, time.UTC), Pages: 30, Hostnames: 4},
+				{Time: time.Date(2021, time.March, 11, 0, 0, 0, 0, time.UTC)},
+			}, nil)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, tst.target, nil)
+		rec := httptest.NewRecorder()
+
+		s := State{index: indexMock}
+		s.getCoverage(rec, req)
+
+		if rec.Code != tst.status {
+			t.Errorf("%s: got status %d want %d", tst.target, rec.Code, tst.status)
+		}
+
+		if tst.status == http.StatusOK {
+			want := `[{"date":"2021-03-10T00:00:00Z","pages":30,"hostnames":4},{"date":"2021-03-11T00:00:00Z","pages":0,"hostnames":0}]`
+			if got := rec.Body.String(); got != want {
+				t.Errorf("got %s want %s", got, want)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetURLStatus(t *testing.T) {
+	// The URL should be looked up as scheduled: normalized & stripped of the configured query parameters
+	const rawURL = "https://Market.onion/index.php?utm_source=feed"
+	const normalizedURL = "https://market.onion"
+	crawlTime := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	c := fnv.New64()
+	_, _ = c.Write([]byte(normalizedURL))
+	urlHash := strconv.FormatUint(c.Sum64(), 10)
+
+	type test struct {
+		forbidden []client.ForbiddenHostname
+		allowed   []string
+		crawlTime time.Time
+		crawlErr  error
+		failures  int64
+		scheduled int64
+		want      string
+	}
+
+	tests := []test{
+		{forbidden: []client.ForbiddenHostname{{Hostname: "market.onion"}}, crawlTime: crawlTime,
+			want: `{"url":"https://market.onion","status":"blacklisted","blacklisted":true,"crawl-date":"2021-03-10T12:00:00Z","failures":0,"scheduled":false}`},
+		// The URL is allowed despite its forbidden hostname
+		{forbidden: []client.ForbiddenHostname{{Hostname: "market.onion"}}, allowed: []string{normalizedURL}, crawlTime: crawlTime,
+			want: `{"url":"https://market.onion","status":"crawled","blacklisted":false,"crawl-date":"2021-03-10T12:00:00Z","failures":0,"scheduled":false}`},
+		{crawlTime: crawlTime, failures: 2, scheduled: 1,
+			want: `{"url":"https://market.onion","status":"crawled","blacklisted":false,"crawl-date":"2021-03-10T12:00:00Z","failures":2,"scheduled":true}`},
+		{failures: 2, scheduled: 1,
+			want: `{"url":"https://market.onion","status":"failing","blacklisted":false,"failures":2,"scheduled":true}`},
+		{scheduled: 1,
+			want: `{"url":"https://market.onion","status":"scheduled","blacklisted":false,"failures":0,"scheduled":true}`},
+		{crawlErr: index.ErrNotSupported,
+			want: `{"url":"https://market.onion","status":"unknown","blacklisted":false,"failures":0,"scheduled":false}`},
+	}
+
+	for _, tst := range tests {
+		mockCtrl := gomock.NewController(t)
+		configClientMock := client_mock.NewMockClient(mockCtrl)
+		indexMock := index_mock.NewMockIndex(mockCtrl)
+		urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+		downHostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+		configClientMock.EXPECT().GetStripQueryParams().Return([]string{"utm_*"}, nil)
+		configClientMock.EXPECT().GetForbiddenHostnames().Return(tst.forbidden, nil)
+		if len(tst.forbidden) > 0 {
+			configClientMock.EXPECT().GetAllowedURLs().Return(tst.allowed, nil)
+		}
+		indexMock.EXPECT().LastCrawlTime(normalizedURL).Return(tst.crawlTime, tst.crawlErr)
+		downHostnameCacheMock.EXPECT().GetInt64("market.onion").Return(tst.failures, nil)
+		urlCacheMock.EXPECT().GetInt64(urlHash).Return(tst.scheduled, nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/url/status?url="+url.QueryEscape(rawURL), nil)
+		rec := httptest.NewRecorder()
+
+		s := State{configClient: configClientMock, index: indexMock, urlCache: urlCacheMock, downHostnameCache: downHostnameCacheMock}
+		s.getURLStatus(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("got status %d want %d", rec.Code, http.StatusOK)
+		}
+		if got := rec.Body.String(); got != tst.want {
+			t.Errorf("got %s want %s", got, tst.want)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetURLStatus_BadRequest(t *testing.T) {
+	for _, target := range []string{"/url/status", "/url/status?url=market.onion", "/url/status?url=%25zz"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+
+		s := State{}
+		s.getURLStatus(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
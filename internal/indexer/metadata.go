@@ -0,0 +1,171 @@
+package indexer
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
+	"mvdan.cc/xurls/v2"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxOnionLinks is the maximum number of onion links stored per resource
+const maxOnionLinks = 500
+
+// newResourceIndexedEvent build the event published once given resource has been indexed
+func newResourceIndexedEvent(resource index.Resource) *event.ResourceIndexedEvent {
+	hostname := ""
+	if u, err := url.Parse(resource.URL); err == nil {
+		hostname = u.Hostname()
+	}
+
+	return &event.ResourceIndexedEvent{
+		URL:         resource.URL,
+		Hostname:    hostname,
+		ContentType: getHeader(resource.Headers, "Content-Type"),
+		BodyLength:  len(resource.Body),
+		Language:    extractLanguage(resource.Headers, resource.Body),
+		Time:        resource.Time,
+		Tag:         resource.Tag,
+	}
+}
+
+// extractLanguage returns the resource language using the Content-Language header
+// or the html lang attribute
+func extractLanguage(headers map[string]string, body string) string {
+	lang := getHeader(headers, "Content-Language")
+
+	if lang == "" {
+		if doc, err := goquery.NewDocumentFromReader(strings.NewReader(body)); err == nil {
+			lang, _ = doc.Find("html").First().Attr("lang")
+		}
+	}
+
+	// Only keep the first primary language tag (i.e: en-US, fr -> en)
+	lang = strings.TrimSpace(strings.Split(lang, ",")[0])
+	lang = strings.Split(lang, "-")[0]
+
+	return strings.ToLower(lang)
+}
+
+// isIndexableLanguage returns true if given language (as returned by extractLanguage, empty if undetected)
+// should be indexed according to given config
+func isIndexableLanguage(language string, config configapi.IndexLanguages) bool {
+	if len(config.Languages) == 0 {
+		return true
+	}
+	if language == "" {
+		return !config.SkipUndetected
+	}
+
+	for _, allowed := range config.Languages {
+		// The configured languages are normalized like the detected ones (i.e: en-US -> en)
+		if strings.ToLower(strings.TrimSpace(strings.Split(allowed, "-")[0])) == language {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extractCanonicalURL returns the canonical URL of the resource if any.
+// Canonical URL pointing to another origin are ignored
+func extractCanonicalURL(rawURL string, body string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	href, exists := doc.Find("link[rel~='canonical']").First().Attr("href")
+	if !exists || strings.TrimSpace(href) == "" {
+		return ""
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	// Canonical URL may be relative
+	canonical, err := u.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return ""
+	}
+
+	if canonical.Scheme != u.Scheme || canonical.Host != u.Host {
+		return ""
+	}
+
+	canonical.Fragment = ""
+
+	return canonical.String()
+}
+
+// extractOnionLinks returns the deduplicated links to hidden services found in given body: the URLs written as-is,
+// and the <a href> links resolved against the page URL (the fragment being removed)
+func extractOnionLinks(pageURL string, body string) []string {
+	rawURLs := xurls.Strict().FindAllString(body, -1)
+
+	if base, err := url.Parse(pageURL); err == nil {
+		if doc, err := goquery.NewDocumentFromReader(strings.NewReader(body)); err == nil {
+			doc.Find("a[href]").Each(func(i int, s *goquery.Selection) {
+				href, _ := s.Attr("href")
+				if ref, err := url.Parse(strings.TrimSpace(href)); err == nil {
+					rawURLs = append(rawURLs, base.ResolveReference(ref).String())
+				}
+			})
+		}
+	}
+
+	var links []string
+	seen := map[string]bool{}
+	for _, rawURL := range rawURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		if !strings.HasSuffix(strings.ToLower(u.Hostname()), ".onion") {
+			continue
+		}
+
+		u.Fragment = ""
+		link := u.String()
+		if seen[link] {
+			continue
+		}
+
+		if len(links) == maxOnionLinks {
+			break
+		}
+		seen[link] = true
+		links = append(links, link)
+	}
+
+	return links
+}
+
+// textLength returns the number of characters of the text extracted from given body,
+// ignoring the markup, the scripts & the consecutive whitespaces
+func textLength(body string) int {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return utf8.RuneCountInString(body)
+	}
+
+	doc.Find("script, style, noscript").Remove()
+
+	return utf8.RuneCountInString(strings.Join(strings.Fields(doc.Text()), " "))
+}
+
+// getHeader returns given header value (case insensitive)
+func getHeader(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,121 @@
+package indexer
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewResourceIndexedEvent(t *testing.T) {
+	tn := time.Now()
+	body := `<html lang="fr-FR"><title>Bonjour</title></html>`
+
+	evt := newResourceIndexedEvent(index.Resource{
+		URL:     "https://example.onion:8080/test.php",
+		Time:    tn,
+		Body:    body,
+		Headers: map[string]string{"content-type": "text/html; charset=UTF-8"},
+		Tag:     "forums",
+	})
+
+	want := &event.ResourceIndexedEvent{
+		URL:         "https://example.onion:8080/test.php",
+		Hostname:    "example.onion",
+		ContentType: "text/html; charset=UTF-8",
+		BodyLength:  len(body),
+		Language:    "fr",
+		Time:        tn,
+		Tag:         "forums",
+	}
+
+	if !reflect.DeepEqual(evt, want) {
+		t.Errorf("got %+v want %+v", evt, want)
+	}
+}
+
+func TestExtractLanguage(t *testing.T) {
+	type test struct {
+		headers map[string]string
+		body    string
+		lang    string
+	}
+
+	tests := []test{
+		{headers: map[string]string{"Content-Language": "en-US, fr"}, body: `<html lang="ru">`, lang: "en"},
+		{headers: map[string]string{}, body: `<html lang="RU"><body>Привет</body></html>`, lang: "ru"},
+		{headers: map[string]string{}, body: `Hello world`, lang: ""},
+	}
+
+	for _, test := range tests {
+		if got := extractLanguage(test.headers, test.body); got != test.lang {
+			t.Errorf("got %s want %s", got, test.lang)
+		}
+	}
+}
+
+func TestExtractCanonicalURL(t *testing.T) {
+	type test struct {
+		url       string
+		body      string
+		canonical string
+	}
+
+	tests := []test{
+		// absent
+		{url: "https://example.onion/posts?id=1", body: `<html><head><title>Post</title></head></html>`, canonical: ""},
+		// present
+		{url: "https://example.onion/posts?id=1&ref=home", body: `<link rel="canonical" href="https://example.onion/posts?id=1">`, canonical: "https://example.onion/posts?id=1"},
+		// relative
+		{url: "https://example.onion/posts?id=1&ref=home", body: `<link rel="canonical" href="/posts/1#top">`, canonical: "https://example.onion/posts/1"},
+		// cross-origin
+		{url: "https://example.onion/posts?id=1", body: `<link rel="canonical" href="https://evil.onion/posts?id=1">`, canonical: ""},
+		{url: "https://example.onion/posts?id=1", body: `<link rel="canonical" href="http://example.onion/posts?id=1">`, canonical: ""},
+		{url: "https://example.onion/posts?id=1", body: `<link rel="canonical" href="">`, canonical: ""},
+	}
+
+	for _, test := range tests {
+		if got := extractCanonicalURL(test.url, test.body); got != test.canonical {
+			t.Errorf("%s: got %s want %s", test.body, got, test.canonical)
+		}
+	}
+}
+
+func TestExtractOnionLinks(t *testing.T) {
+	body := `<html><body>
+<a href="https://google.com/search?q=tor">Search</a>
+<a href="/forum#latest">Forum</a>
+<a href="http://market.onion/listings?page=2">Market</a>
+<a href="http://market.onion/listings?page=2#top">Market (top)</a>
+<a href="mailto:admin@example.onion">Contact</a>
+Mirror: https://mirror.onion/index.html, or https://example.org/about
+</body></html>`
+
+	links := extractOnionLinks("https://example.onion/index.php", body)
+
+	// The URLs written as-is come first
+	want := []string{
+		"http://market.onion/listings?page=2",
+		"https://mirror.onion/index.html",
+		"https://example.onion/forum",
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("got %v want %v", links, want)
+	}
+}
+
+func TestTextLength(t *testing.T) {
+	tests := map[string]int{
+		"":                                  0,
+		"Hello world":                       11,
+		"<title>Hello</title>\n\n  world  ": 11,
+		"<p>Été</p><script>var a = 12;</script><style>p {}</style>": 3,
+	}
+
+	for body, want := range tests {
+		if got := textLength(body); got != want {
+			t.Errorf("%s: got %d want %d", body, got, want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package indexer
+
+import (
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	reindexDestFlag         = "dest"
+	reindexBatchSizeFlag    = "batch-size"
+	reindexAfterFlag        = "after"
+	reindexDryRunFlag       = "dry-run"
+	reindexDeleteSourceFlag = "delete-source"
+)
+
+// Commands return the process commands
+func (state *State) Commands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:  "reindex",
+			Usage: "Copy the indexed resources into a new index, populating the fields added since they have been indexed",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     reindexDestFlag,
+					Usage:    "Name of the new index, the resources alias is swapped to point to it once done",
+					Required: true,
+				},
+				&cli.IntFlag{
+					Name:  reindexBatchSizeFlag,
+					Usage: "Number of resources read & written at once",
+					Value: 500,
+				},
+				&cli.StringFlag{
+					Name:  reindexAfterFlag,
+					Usage: "Cursor (logged after each batch) following which the resources are copied, to resume an interrupted reindex",
+				},
+				&cli.BoolFlag{
+					Name:  reindexDryRunFlag,
+					Usage: "Only count the resources that would be copied",
+				},
+				&cli.BoolFlag{
+					Name:  reindexDeleteSourceFlag,
+					Usage: "Delete the resources index if it is not an alias yet (required to swap the alias the first time)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return state.reindex(process.NewDefaultProvider(c), index.ReindexOptions{
+					Dest:         c.String(reindexDestFlag),
+					BatchSize:    c.Int(reindexBatchSizeFlag),
+					After:        c.String(reindexAfterFlag),
+					DryRun:       c.Bool(reindexDryRunFlag),
+					DeleteSource: c.Bool(reindexDeleteSourceFlag),
+				})
+			},
+		},
+	}
+}
+
+// reindex copy the indexed resources into a new index, extracting them again
+func (state *State) reindex(provider process.Provider, opts index.ReindexOptions) error {
+	if err := state.initializeIndex(provider); err != nil {
+		return err
+	}
+
+	reindexer, ok := state.index.(index.Reindexer)
+	if !ok {
+		return fmt.Errorf("the %s driver does not support reindexing", state.indexDriver)
+	}
+
+	result, err := reindexer.Reindex(opts, state.enrichResource)
+	if err != nil {
+		log.Err(err).Int("count", result.Count).Str("cursor", result.Cursor).Msg("error while reindexing resources")
+		return err
+	}
+
+	log.Info().Int("count", result.Count).Str("dest", opts.Dest).Bool("dry-run", opts.DryRun).Msg("Successfully reindexed resources")
+
+	return nil
+}
+
+// enrichResource extract again the fields of given indexed resource which only depend on its body
+func (state *State) enrichResource(resource index.Resource) (index.Resource, error) {
+	// Nothing can be extracted if the body has not been stored
+	if resource.Body == "" {
+		return resource, nil
+	}
+
+	// The fields extracted from the full body are not overridden using a truncated one, only populated if missing
+	if resource.OnionLinks == nil || !resource.Truncated {
+		resource.OnionLinks = extractOnionLinks(resource.URL, resource.Body)
+	}
+	if len(state.extractors) > 0 && (resource.Entities == nil || !resource.Truncated) {
+		resource.Entities = extractEntities(state.extractors, resource.Body, state.maxEntities)
+	}
+	if resource.StructuredData == nil || !resource.Truncated {
+		resource.StructuredData = extractStructuredData(resource.Body)
+	}
+	if state.simHash && resource.SimHash == 0 {
+		resource.SimHash = computeSimHash(resource.Body)
+	}
+
+	return resource, nil
+}
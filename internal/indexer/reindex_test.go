@@ -0,0 +1,47 @@
+package indexer
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
+	"reflect"
+	"testing"
+)
+
+func TestState_EnrichResource(t *testing.T) {
+	extractors, err := parseExtractors([]string{"email"})
+	if err != nil {
+		t.FailNow()
+	}
+
+	s := State{extractors: extractors, maxEntities: 50}
+
+	body := `<a href="http://market.onion/">Market</a> Contact: admin@market.onion`
+	resource, err := s.enrichResource(index.Resource{URL: "https://example.onion", Body: body})
+	if err != nil {
+		t.FailNow()
+	}
+	if !reflect.DeepEqual(resource.OnionLinks, []string{"http://market.onion/"}) {
+		t.Errorf("got %v want %v", resource.OnionLinks, []string{"http://market.onion/"})
+	}
+	if !reflect.DeepEqual(resource.Entities, map[string][]string{"email": {"admin@market.onion"}}) {
+		t.Errorf("got %v want email entity", resource.Entities)
+	}
+
+	// The links extracted from the full body are kept when the stored one is truncated
+	resource, err = s.enrichResource(index.Resource{URL: "https://example.onion", Body: "truncated", Truncated: true,
+		OnionLinks: []string{"http://forum.onion"}})
+	if err != nil {
+		t.FailNow()
+	}
+	if !reflect.DeepEqual(resource.OnionLinks, []string{"http://forum.onion"}) {
+		t.Errorf("got %v want %v", resource.OnionLinks, []string{"http://forum.onion"})
+	}
+
+	// Nothing is extracted without body
+	resource, err = s.enrichResource(index.Resource{URL: "https://example.onion", OmitBody: true})
+	if err != nil {
+		t.FailNow()
+	}
+	if resource.OnionLinks != nil || resource.Entities != nil {
+		t.Errorf("got %v %v want nothing extracted", resource.OnionLinks, resource.Entities)
+	}
+}
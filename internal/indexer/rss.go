@@ -0,0 +1,81 @@
+package indexer
+
+import (
+	"encoding/xml"
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+const (
+	jsonFormat = "json"
+	rssFormat  = "rss"
+)
+
+// rss is a RSS 2.0 document
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title   string  `xml:"title"`
+	Link    string  `xml:"link"`
+	GUID    rssGUID `xml:"guid"`
+	PubDate string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// newRSS returns the RSS feed of given resources, the URL being used as title of the untitled ones
+func newRSS(title, link string, resources []index.Resource) rss {
+	items := make([]rssItem, 0, len(resources))
+	for _, resource := range resources {
+		itemTitle := resource.Title
+		if itemTitle == "" {
+			itemTitle = resource.URL
+		}
+
+		items = append(items, rssItem{
+			Title:   itemTitle,
+			Link:    resource.URL,
+			GUID:    rssGUID{IsPermaLink: true, Value: resource.URL},
+			PubDate: resource.Time.UTC().Format(time.RFC1123Z),
+		})
+	}
+
+	return rss{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        link,
+			Description: "Resources indexed by bathyscaphe, most recent first",
+			Items:       items,
+		},
+	}
+}
+
+func writeRSS(w http.ResponseWriter, value rss) {
+	b, err := xml.Marshal(value)
+	if err != nil {
+		log.Err(err).Msg("error while encoding response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(b)
+}
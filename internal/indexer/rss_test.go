@@ -0,0 +1,88 @@
+package indexer
+
+import (
+	"encoding/xml"
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index_mock"
+	"github.com/golang/mock/gomock"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetRecentResources_RSS(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	tn := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+	indexMock.EXPECT().Search(index.SearchParams{Keyword: "sparta", Limit: 10, ExcludeBody: true}).Return(index.SearchResult{
+		Total: 42,
+		Resources: []index.Resource{
+			{URL: "https://example.onion/login.php?a=1&b=2", Title: "Login <Sparta>", Time: tn},
+			{URL: "http://test.onion:8080", Time: tn.Add(-time.Hour)},
+		},
+	}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/recent?keyword=sparta&format=rss", nil)
+	rec := httptest.NewRecorder()
+
+	s := State{index: indexMock}
+	s.getRecentResources(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d want %d", rec.Code, http.StatusOK)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/rss+xml; charset=utf-8" {
+		t.Errorf("got content type %s", ct)
+	}
+
+	// The feed should be well-formed
+	var feed rss
+	if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+
+	if feed.Version != "2.0" {
+		t.Errorf("got version %s want 2.0", feed.Version)
+	}
+	if feed.Channel.Title != `Bathyscaphe resources matching "sparta"` {
+		t.Errorf("got title %s", feed.Channel.Title)
+	}
+	if feed.Channel.Link != "/recent?keyword=sparta&format=rss" {
+		t.Errorf("got link %s", feed.Channel.Link)
+	}
+
+	want := []rssItem{
+		{
+			Title:   "Login <Sparta>",
+			Link:    "https://example.onion/login.php?a=1&b=2",
+			GUID:    rssGUID{IsPermaLink: true, Value: "https://example.onion/login.php?a=1&b=2"},
+			PubDate: "Wed, 10 Mar 2021 12:00:00 +0000",
+		},
+		{
+			Title:   "http://test.onion:8080",
+			Link:    "http://test.onion:8080",
+			GUID:    rssGUID{IsPermaLink: true, Value: "http://test.onion:8080"},
+			PubDate: "Wed, 10 Mar 2021 11:00:00 +0000",
+		},
+	}
+	if !reflect.DeepEqual(feed.Channel.Items, want) {
+		t.Errorf("got %+v want %+v", feed.Channel.Items, want)
+	}
+}
+
+func TestGetRecentResources_InvalidFormat(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/recent?format=atom", nil)
+	rec := httptest.NewRecorder()
+
+	s := State{}
+	s.getRecentResources(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,45 @@
+package indexer
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"unicode"
+)
+
+// computeSimHash returns the 64 bits SimHash of given text.
+// Near-identical texts have SimHash with a small hamming distance
+func computeSimHash(text string) uint64 {
+	tokens := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	var weights [64]int
+	for _, token := range tokens {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(token))
+		tokenHash := h.Sum64()
+
+		for i := 0; i < 64; i++ {
+			if tokenHash&(1<<uint(i)) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+
+	var simHash uint64
+	for i, weight := range weights {
+		if weight > 0 {
+			simHash |= 1 << uint(i)
+		}
+	}
+
+	return simHash
+}
+
+// hammingDistance returns the number of bits that differ between given hashes
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,42 @@
+package indexer
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestComputeSimHash(t *testing.T) {
+	page := `<html><head><title>Onion Market</title></head><body>
+<h1>Welcome to the onion market</h1>
+<p>Browse hundreds of listings from trusted vendors, all payments are made using escrow.</p>
+<ul><li>Electronics</li><li>Books</li><li>Services</li><li>Software</li></ul>
+<p>Read the rules before opening a dispute, support answers within 24 hours.</p>
+<footer>Visitors online: %s - Page generated at %s</footer>
+</body></html>`
+
+	first := computeSimHash(fmt.Sprintf(page, "1245", "2021-03-10 12:00:01"))
+	second := computeSimHash(fmt.Sprintf(page, "1312", "2021-03-10 12:07:45"))
+	other := computeSimHash(`<html><body><h1>My personal blog</h1><p>Today I will talk about cooking pasta.</p></body></html>`)
+
+	if first == 0 {
+		t.Error("SimHash should not be empty")
+	}
+	if distance := hammingDistance(first, second); distance > 3 {
+		t.Errorf("near-identical pages should be within the threshold, got distance %d", distance)
+	}
+	if distance := hammingDistance(first, other); distance <= 3 {
+		t.Errorf("different pages should not be within the threshold, got distance %d", distance)
+	}
+}
+
+func TestHammingDistance(t *testing.T) {
+	if d := hammingDistance(0, 0); d != 0 {
+		t.Errorf("got %d want %d", d, 0)
+	}
+	if d := hammingDistance(0xF0, 0x0F); d != 8 {
+		t.Errorf("got %d want %d", d, 8)
+	}
+	if d := hammingDistance(1<<63, 0); d != 1 {
+		t.Errorf("got %d want %d", d, 1)
+	}
+}
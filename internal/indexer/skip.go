@@ -0,0 +1,89 @@
+package indexer
+
+import (
+	"github.com/rs/zerolog/log"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxSkipBodyPatterns is the maximum number of skip patterns applied, the other ones are ignored
+const maxSkipBodyPatterns = 100
+
+// bodyMatcher match the bodies against the skip patterns, formatted either as a substring (case insensitive)
+// or as a regex wrapped in slashes (i.e: /under construction/)
+type bodyMatcher struct {
+	substrings []string
+	regexps    []*regexp.Regexp
+}
+
+// parseSkipPatterns parse given patterns, the invalid ones being ignored
+func parseSkipPatterns(patterns []string) bodyMatcher {
+	if len(patterns) > maxSkipBodyPatterns {
+		log.Warn().Int("count", len(patterns)).Int("max", maxSkipBodyPatterns).Msg("Too many skip patterns, ignoring the extra ones")
+		patterns = patterns[:maxSkipBodyPatterns]
+	}
+
+	var m bodyMatcher
+	for _, pattern := range patterns {
+		if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			exp, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				log.Warn().Str("pattern", pattern).Err(err).Msg("Ignoring invalid skip pattern")
+				continue
+			}
+
+			m.regexps = append(m.regexps, exp)
+		} else if pattern != "" {
+			m.substrings = append(m.substrings, strings.ToLower(pattern))
+		}
+	}
+
+	return m
+}
+
+// match returns true if given body match any of the patterns.
+// Go regexps run in linear time, only the beginning of the body is scanned to bound the matching cost
+func (m bodyMatcher) match(body string) bool {
+	if len(body) > maxExtractedTextLength {
+		body = body[:maxExtractedTextLength]
+	}
+
+	if len(m.substrings) > 0 {
+		lowerBody := strings.ToLower(body)
+		for _, substring := range m.substrings {
+			if strings.Contains(lowerBody, substring) {
+				return true
+			}
+		}
+	}
+
+	for _, exp := range m.regexps {
+		if exp.MatchString(body) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skipPatterns keep the matcher of the configured skip patterns, which are only parsed again once changed
+type skipPatterns struct {
+	patterns []string
+	matcher  bodyMatcher
+	mutex    sync.Mutex
+}
+
+// get returns the matcher of given patterns
+func (s *skipPatterns) get(patterns []string) bodyMatcher {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !reflect.DeepEqual(s.patterns, patterns) {
+		s.patterns = patterns
+		s.matcher = parseSkipPatterns(patterns)
+	}
+
+	return s.matcher
+}
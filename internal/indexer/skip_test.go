@@ -0,0 +1,49 @@
+package indexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBodyMatcher_Match(t *testing.T) {
+	m := parseSkipPatterns([]string{"Under Construction", "/^<title>Index of /", "/[invalid/", ""})
+
+	if len(m.substrings) != 1 || len(m.regexps) != 1 {
+		t.Fatalf("wrong patterns: %+v", m)
+	}
+
+	tests := map[string]bool{
+		"<h1>This site is under construction</h1>":   true,
+		"<title>Index of /files</title>":             true,
+		"<title>Welcome</title>Index of /files":      false,
+		"<title>Market</title>Best products, cheap!": false,
+		"[invalid": false,
+	}
+
+	for body, want := range tests {
+		if got := m.match(body); got != want {
+			t.Errorf("%s: got %v want %v", body, got, want)
+		}
+	}
+}
+
+func TestParseSkipPatterns_Max(t *testing.T) {
+	patterns := strings.Split(strings.Repeat("pattern,", maxSkipBodyPatterns+10), ",")
+
+	if m := parseSkipPatterns(patterns); len(m.substrings) != maxSkipBodyPatterns {
+		t.Errorf("got %d want %d", len(m.substrings), maxSkipBodyPatterns)
+	}
+}
+
+func TestSkipPatterns_Get(t *testing.T) {
+	var s skipPatterns
+
+	if !s.get([]string{"construction"}).match("under construction") {
+		t.Error("body should match")
+	}
+
+	// patterns have changed
+	if s.get([]string{"maintenance"}).match("under construction") {
+		t.Error("body should not match")
+	}
+}
@@ -0,0 +1,48 @@
+package indexer
+
+import (
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+// defaultIndexableStatusCodes are the status codes of the resources to index used when none are configured
+var defaultIndexableStatusCodes = []string{"200-299"}
+
+// isIndexableStatus returns true if given status code match one of given status codes, formatted either as
+// a single code (i.e: 200) or as an inclusive range (i.e: 200-299). The invalid ones are ignored
+func isIndexableStatus(code int, statusCodes []string) bool {
+	for _, statusCode := range statusCodes {
+		min, max, err := parseStatusRange(statusCode)
+		if err != nil {
+			log.Warn().Str("status-code", statusCode).Err(err).Msg("Ignoring invalid indexable status code")
+			continue
+		}
+
+		if code >= min && code <= max {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseStatusRange returns the bounds of given status code range, a single code being a range of its own
+func parseStatusRange(statusCode string) (int, int, error) {
+	parts := strings.SplitN(statusCode, "-", 2)
+
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return min, min, nil
+	}
+
+	max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return min, max, nil
+}
@@ -0,0 +1,27 @@
+package indexer
+
+import "testing"
+
+func TestIsIndexableStatus(t *testing.T) {
+	type test struct {
+		code        int
+		statusCodes []string
+		want        bool
+	}
+
+	tests := []test{
+		{code: 200, statusCodes: defaultIndexableStatusCodes, want: true},
+		{code: 299, statusCodes: defaultIndexableStatusCodes, want: true},
+		{code: 301, statusCodes: defaultIndexableStatusCodes, want: false},
+		{code: 404, statusCodes: defaultIndexableStatusCodes, want: false},
+		{code: 404, statusCodes: []string{"200-299", "404"}, want: true},
+		{code: 410, statusCodes: []string{"abc", "400-x", "410"}, want: true},
+		{code: 200, statusCodes: nil, want: false},
+	}
+
+	for _, test := range tests {
+		if got := isIndexableStatus(test.code, test.statusCodes); got != test.want {
+			t.Errorf("%d %v: got %v want %v", test.code, test.statusCodes, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxStructuredItems is the maximum number of structured data items stored per resource
+	maxStructuredItems = 20
+	// maxStructuredProperties is the maximum number of properties stored per structured data item
+	maxStructuredProperties = 50
+)
+
+// extractStructuredData returns the schema.org items embedded in given body, either as JSON-LD blocks or as microdata.
+// The properties of each item are flattened as `path: value` (i.e: offers.price: 10), the @type being stored as type.
+// The malformed JSON-LD blocks are ignored
+func extractStructuredData(body string) []map[string]string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	var items []map[string]string
+	doc.Find("script[type]").Each(func(i int, s *goquery.Selection) {
+		scriptType, _ := s.Attr("type")
+		if !strings.EqualFold(strings.TrimSpace(strings.Split(scriptType, ";")[0]), "application/ld+json") {
+			return
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(s.Text()), &value); err != nil {
+			log.Trace().Err(err).Msg("Ignoring malformed JSON-LD block")
+			return
+		}
+
+		for _, node := range jsonLDNodes(value) {
+			if item := flattenStructuredItem(node); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+	})
+
+	// Only the top level items are extracted, the nested ones being properties
+	doc.Find("[itemscope][itemtype]").Each(func(i int, s *goquery.Selection) {
+		if _, nested := s.Attr("itemprop"); nested {
+			return
+		}
+		if item := microdataItem(s); len(item) > 0 {
+			items = append(items, item)
+		}
+	})
+
+	if len(items) > maxStructuredItems {
+		items = items[:maxStructuredItems]
+	}
+
+	return items
+}
+
+// jsonLDNodes returns the nodes of given JSON-LD document, which can be a node, an array of nodes or a graph
+func jsonLDNodes(value interface{}) []map[string]interface{} {
+	var nodes []map[string]interface{}
+
+	switch v := value.(type) {
+	case []interface{}:
+		for _, child := range v {
+			nodes = append(nodes, jsonLDNodes(child)...)
+		}
+	case map[string]interface{}:
+		if graph, exists := v["@graph"]; exists {
+			return jsonLDNodes(graph)
+		}
+		nodes = append(nodes, v)
+	}
+
+	return nodes
+}
+
+// flattenStructuredItem flattens the properties of given JSON-LD node
+func flattenStructuredItem(node map[string]interface{}) map[string]string {
+	item := map[string]string{}
+	flattenStructuredValue("", node, item)
+
+	return item
+}
+
+func flattenStructuredValue(path string, value interface{}, item map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// Sort the keys so the same properties are kept whatever the map order
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if name := structuredPropertyName(key); name != "" {
+				flattenStructuredValue(joinStructuredPath(path, name), v[key], item)
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			flattenStructuredValue(path, child, item)
+		}
+	case nil:
+	default:
+		addStructuredProperty(item, path, fmt.Sprintf("%v", v))
+	}
+}
+
+// structuredPropertyName returns the name under which given JSON-LD key is stored (empty if ignored)
+func structuredPropertyName(key string) string {
+	switch key {
+	case "@type":
+		return "type"
+	case "@id":
+		return "id"
+	}
+
+	// The other keywords (@context, ...) are not properties
+	if strings.HasPrefix(key, "@") {
+		return ""
+	}
+
+	return key
+}
+
+// addStructuredProperty add given property to the item, the values of a repeated property being joined
+func addStructuredProperty(item map[string]string, name, value string) {
+	value = strings.Join(strings.Fields(value), " ")
+	if name == "" || value == "" {
+		return
+	}
+
+	if existing, exists := item[name]; exists {
+		value = existing + ", " + value
+	} else if len(item) == maxStructuredProperties {
+		return
+	}
+
+	if utf8.RuneCountInString(value) > maxFieldLength {
+		value = string([]rune(value)[:maxFieldLength])
+	}
+	item[name] = value
+}
+
+// microdataItem returns the properties of given microdata item, the nested items being flattened
+func microdataItem(s *goquery.Selection) map[string]string {
+	item := map[string]string{}
+	addMicrodataProperties(s, "", item)
+
+	return item
+}
+
+func addMicrodataProperties(s *goquery.Selection, path string, item map[string]string) {
+	itemType, _ := s.Attr("itemtype")
+	addStructuredProperty(item, joinStructuredPath(path, "type"), schemaType(itemType))
+
+	s.Find("[itemprop]").Each(func(i int, prop *goquery.Selection) {
+		// Only the properties of this item, not the ones of the nested items
+		if !prop.ParentsFiltered("[itemscope]").First().IsSelection(s) {
+			return
+		}
+
+		name, _ := prop.Attr("itemprop")
+		name = joinStructuredPath(path, strings.TrimSpace(name))
+
+		if _, nested := prop.Attr("itemscope"); nested {
+			addMicrodataProperties(prop, name, item)
+			return
+		}
+
+		addStructuredProperty(item, name, microdataValue(prop))
+	})
+}
+
+// microdataValue returns the value of given microdata property, according to its element
+func microdataValue(prop *goquery.Selection) string {
+	if content, exists := prop.Attr("content"); exists {
+		return content
+	}
+
+	attr := ""
+	switch goquery.NodeName(prop) {
+	case "a", "link", "area":
+		attr = "href"
+	case "img", "audio", "video", "source", "iframe", "embed":
+		attr = "src"
+	case "time":
+		attr = "datetime"
+	case "meta":
+		attr = "content"
+	case "data", "meter":
+		attr = "value"
+	}
+	if value, exists := prop.Attr(attr); attr != "" && exists {
+		return value
+	}
+
+	return prop.Text()
+}
+
+// schemaType returns the schema.org type name of given microdata item type (i.e: https://schema.org/Product: Product)
+func schemaType(itemType string) string {
+	itemType = strings.TrimSpace(itemType)
+	for _, prefix := range []string{"https://schema.org/", "http://schema.org/"} {
+		if strings.HasPrefix(itemType, prefix) {
+			return strings.TrimPrefix(itemType, prefix)
+		}
+	}
+
+	return itemType
+}
+
+func joinStructuredPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
@@ -0,0 +1,82 @@
+package indexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+const jsonLDFixture = `
+<html>
+<head>
+	<title>Premium Widget</title>
+	<script type="application/ld+json">
+	{
+		"@context": "https://schema.org",
+		"@type": "Product",
+		"name": "Premium   Widget",
+		"sku": 1234,
+		"image": ["https://market.onion/1.jpg", "https://market.onion/2.jpg"],
+		"offers": {
+			"@type": "Offer",
+			"price": 0.0042,
+			"priceCurrency": "BTC",
+			"seller": {"@type": "Organization", "name": "trusted_seller"}
+		}
+	}
+	</script>
+	<script type="application/ld+json; charset=utf-8">
+	{"@context": "https://schema.org", "@graph": [{"@type": "WebSite", "@id": "https://market.onion/#website", "url": "https://market.onion"}]}
+	</script>
+	<script type="application/ld+json">{"@type": "Broken", </script>
+	<script type="text/javascript">var a = {"@type": "NotStructured"};</script>
+</head>
+<body>
+	<div itemscope itemtype="https://schema.org/Person">
+		<span itemprop="name">Jane Doe</span>
+		<a itemprop="url" href="https://jane.onion">Profile</a>
+		<div itemprop="address" itemscope itemtype="https://schema.org/PostalAddress">
+			<span itemprop="addressLocality">Paris</span>
+		</div>
+	</div>
+</body>
+</html>
+`
+
+func TestExtractStructuredData(t *testing.T) {
+	want := []map[string]string{
+		{
+			"type":                 "Product",
+			"name":                 "Premium Widget",
+			"sku":                  "1234",
+			"image":                "https://market.onion/1.jpg, https://market.onion/2.jpg",
+			"offers.type":          "Offer",
+			"offers.price":         "0.0042",
+			"offers.priceCurrency": "BTC",
+			"offers.seller.type":   "Organization",
+			"offers.seller.name":   "trusted_seller",
+		},
+		{
+			"type": "WebSite",
+			"id":   "https://market.onion/#website",
+			"url":  "https://market.onion",
+		},
+		{
+			"type":                    "Person",
+			"name":                    "Jane Doe",
+			"url":                     "https://jane.onion",
+			"address.type":            "PostalAddress",
+			"address.addressLocality": "Paris",
+		},
+	}
+
+	if got := extractStructuredData(jsonLDFixture); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	if got := extractStructuredData("<html><body>Hello</body></html>"); got != nil {
+		t.Errorf("got %v want nil", got)
+	}
+	if got := extractStructuredData(`<script type="application/ld+json">not json</script>`); got != nil {
+		t.Errorf("got %v want nil", got)
+	}
+}
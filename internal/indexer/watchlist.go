@@ -0,0 +1,55 @@
+package indexer
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// matchKeywords returns the keywords found in given text. The matching is case insensitive
+// and only whole words are matched (i.e: `market` is not found in `supermarket`)
+func matchKeywords(text string, keywords []string) []string {
+	text = strings.ToLower(text)
+
+	var matched []string
+	for _, keyword := range keywords {
+		k := strings.ToLower(strings.TrimSpace(keyword))
+		if k == "" {
+			continue
+		}
+
+		if containsWord(text, k) {
+			matched = append(matched, keyword)
+		}
+	}
+
+	return matched
+}
+
+// containsWord returns true if given word is found in text surrounded by word boundaries
+func containsWord(text, word string) bool {
+	for offset := 0; offset < len(text); {
+		i := strings.Index(text[offset:], word)
+		if i == -1 {
+			return false
+		}
+
+		start := offset + i
+		end := start + len(word)
+
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+
+		_, size := utf8.DecodeRuneInString(text[start:])
+		offset = start + size
+	}
+
+	return false
+}
+
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_')
+}
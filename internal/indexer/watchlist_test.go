@@ -0,0 +1,28 @@
+package indexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchKeywords(t *testing.T) {
+	keywords := []string{"Market", "credit card", "c++", "", "été"}
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "Welcome to the MARKET!", want: []string{"Market"}},
+		{text: "Welcome to the supermarket, markets are open", want: nil},
+		{text: "We sell <b>credit card</b> dumps", want: []string{"credit card"}},
+		{text: "credit cards and c++ books", want: []string{"c++"}},
+		{text: "Bel ÉTÉ, pas d'étés", want: []string{"été"}},
+		{text: "nothing to see here", want: nil},
+	}
+
+	for _, test := range tests {
+		if got := matchKeywords(test.text, keywords); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v want %v", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package process
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// logSamplingFlag is the flag used to sample the logs of a level (i.e: debug=100 only emits 1 debug log out of 100)
+const logSamplingFlag = "log-sampling"
+
+// newLogger returns a logger writing to given output, sampled using given rules (level=N)
+func newLogger(out io.Writer, samplingRules []string) (zerolog.Logger, error) {
+	logger := zerolog.New(out).With().Timestamp().Logger()
+
+	sampler, err := newLogSampler(samplingRules)
+	if err != nil {
+		return zerolog.Logger{}, err
+	}
+	if sampler != nil {
+		logger = logger.Sample(sampler)
+	}
+
+	return logger, nil
+}
+
+// newLogSampler returns the sampler emitting 1 log out of N for the levels of given rules (level=N), nil if there is no rule.
+// Only the levels below error may be sampled, so the errors are never dropped
+func newLogSampler(rules []string) (zerolog.Sampler, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	sampler := zerolog.LevelSampler{}
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid log sampling %s: should be level=N", rule)
+		}
+
+		n, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid log sampling %s: N should be a positive integer", rule)
+		}
+		basic := &zerolog.BasicSampler{N: uint32(n)}
+
+		level, err := zerolog.ParseLevel(strings.ToLower(strings.TrimSpace(parts[0])))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log sampling %s: %s", rule, err)
+		}
+
+		switch level {
+		case zerolog.TraceLevel:
+			sampler.TraceSampler = basic
+		case zerolog.DebugLevel:
+			sampler.DebugSampler = basic
+		case zerolog.InfoLevel:
+			sampler.InfoSampler = basic
+		case zerolog.WarnLevel:
+			sampler.WarnSampler = basic
+		default:
+			return nil, fmt.Errorf("invalid log sampling %s: %s logs cannot be sampled", rule, level)
+		}
+	}
+
+	return sampler, nil
+}
@@ -0,0 +1,52 @@
+package process
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+
+	logger, err := newLogger(&out, []string{"info=3", "warn=1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// 1 info log out of 3 is emitted
+	for i := 0; i < 9; i++ {
+		logger.Info().Msg("sampled")
+	}
+	// errors are never sampled
+	for i := 0; i < 5; i++ {
+		logger.Error().Msg("failure")
+	}
+
+	if count := strings.Count(out.String(), "sampled"); count != 3 {
+		t.Errorf("got %d info logs want 3", count)
+	}
+	if count := strings.Count(out.String(), "failure"); count != 5 {
+		t.Errorf("got %d error logs want 5", count)
+	}
+
+	// Nothing is sampled by default
+	out.Reset()
+	if logger, err = newLogger(&out, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i := 0; i < 9; i++ {
+		logger.Info().Msg("sampled")
+	}
+	if count := strings.Count(out.String(), "sampled"); count != 9 {
+		t.Errorf("got %d info logs want 9", count)
+	}
+}
+
+func TestNewLogSampler_Invalid(t *testing.T) {
+	for _, rule := range []string{"debug", "debug=0", "debug=-2", "debug=abc", "verbose=10", "error=10", "fatal=2"} {
+		if _, err := newLogSampler([]string{rule}); err == nil {
+			t.Errorf("%s: error should have been returned", rule)
+		}
+	}
+}
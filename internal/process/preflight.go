@@ -0,0 +1,68 @@
+package process
+
+import (
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// Dependency is an external service a process depends on
+type Dependency struct {
+	Name string
+	// Ping returns an error if the service cannot be reached
+	Ping func() error
+}
+
+// DependenciesProvider is implemented by the processes depending on services not covered by their features
+type DependenciesProvider interface {
+	Dependencies(provider Provider) []Dependency
+}
+
+// dependencies returns the services given process depends on, using the values of given provider
+func dependencies(process Process, provider Provider) []Dependency {
+	var deps []Dependency
+
+	for _, feature := range process.Features() {
+		switch feature {
+		case EventFeature:
+			uri := provider.GetStrValue(eventURIFlag)
+			deps = append(deps, Dependency{Name: "event-server", Ping: func() error { return event.Ping(uri) }})
+		case ConfigFeature:
+			uri := provider.GetStrValue(configAPIURIFlag)
+			deps = append(deps, Dependency{Name: "config-api", Ping: func() error { return configapi.Ping(uri) }})
+		case CacheFeature:
+			uri := provider.GetStrValue(cacheSRVFlag)
+			deps = append(deps, Dependency{Name: "cache", Ping: func() error { return cache.Ping(uri) }})
+		}
+	}
+
+	if dp, ok := process.(DependenciesProvider); ok {
+		deps = append(deps, dp.Dependencies(provider)...)
+	}
+
+	return deps
+}
+
+// preflight ping every given dependency, an error listing the unreachable ones is returned
+func preflight(deps []Dependency) error {
+	var unreachable []string
+
+	for _, dep := range deps {
+		if err := dep.Ping(); err != nil {
+			log.Error().Err(err).Str("dependency", dep.Name).Msg("Dependency is unreachable")
+			unreachable = append(unreachable, dep.Name)
+			continue
+		}
+
+		log.Debug().Str("dependency", dep.Name).Msg("Dependency is reachable")
+	}
+
+	if len(unreachable) > 0 {
+		return fmt.Errorf("unreachable dependencies: %s", strings.Join(unreachable, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+package process
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	ok := func() error { return nil }
+	ko := func() error { return errors.New("connection refused") }
+
+	if err := preflight([]Dependency{{Name: "event-server", Ping: ok}, {Name: "cache", Ping: ok}}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	err := preflight([]Dependency{{Name: "event-server", Ping: ko}, {Name: "config-api", Ping: ok}, {Name: "cache", Ping: ko}})
+	if err == nil || err.Error() != "unreachable dependencies: event-server, cache" {
+		t.Errorf("wrong error: got: %v", err)
+	}
+}
@@ -4,7 +4,7 @@ package process
 
 import (
 	"context"
-	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	"github.com/darkspot-org/bathyscaphe/internal/clock"
@@ -14,8 +14,6 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
-	"github.com/valyala/fasthttp"
-	"github.com/valyala/fasthttp/fasthttpproxy"
 	"net/http"
 	"os"
 	"os/signal"
@@ -41,11 +39,23 @@ const (
 	// EventPrefetchFlag is the prefetch count for the event subscriber
 	EventPrefetchFlag = "event-prefetch"
 
+	preflightFlag = "preflight"
+
+	eventConfirmFlag = "event-confirm"
 	eventURIFlag     = "event-srv"
 	configAPIURIFlag = "config-api"
 	cacheSRVFlag     = "cache-srv"
 	torURIFlag       = "tor-proxy"
+	torUsernameFlag  = "tor-proxy-username"
+	torPasswordFlag  = "tor-proxy-password"
 	userAgentFlag    = "user-agent"
+
+	maxConnsPerHostFlag     = "max-conns-per-host"
+	maxIdleConnDurationFlag = "max-idle-conn-duration"
+	dialTimeoutFlag         = "http-dial-timeout"
+	readTimeoutFlag         = "http-read-timeout"
+	maxRedirectHostsFlag    = "max-redirect-hosts"
+	maxRequestDurationFlag  = "max-request-duration"
 )
 
 // Provider is the implementation provider
@@ -60,14 +70,18 @@ type Provider interface {
 	Publisher() (event.Publisher, error)
 	// Cache return a new configured cache
 	Cache(keyPrefix string) (cache.Cache, error)
-	// HTTPClient return a new configured http client
-	HTTPClient() (chttp.Client, error)
+	// HTTPClient return a new configured http client, using given host mapping & minimum TLS version (if any)
+	HTTPClient(hostMapping chttp.HostMappingFunc, minTLSVersion chttp.TLSVersionFunc) (chttp.Client, error)
 	// GetStrValue return string value for given key
 	GetStrValue(key string) string
 	// GetStrValues return string slice for given key
 	GetStrValues(key string) []string
 	// GetIntValue return int value for given key
 	GetIntValue(key string) int
+	// GetDurationValue return duration value for given key
+	GetDurationValue(key string) time.Duration
+	// GetBoolValue return bool value for given key
+	GetBoolValue(key string) bool
 }
 
 type defaultProvider struct {
@@ -93,26 +107,35 @@ func (p *defaultProvider) ConfigClient(keys []string) (configapi.Client, error)
 }
 
 func (p *defaultProvider) Subscriber() (event.Subscriber, error) {
-	return event.NewSubscriber(p.ctx.String(eventURIFlag), p.ctx.Int(EventPrefetchFlag))
+	return event.NewSubscriber(p.ctx.String(eventURIFlag), p.ctx.Int(EventPrefetchFlag), event.PublisherOptions{
+		Confirm: p.ctx.Bool(eventConfirmFlag),
+	})
 }
 
 func (p *defaultProvider) Publisher() (event.Publisher, error) {
-	return event.NewPublisher(p.ctx.String(eventURIFlag))
+	return event.NewPublisher(p.ctx.String(eventURIFlag), event.PublisherOptions{
+		Confirm: p.ctx.Bool(eventConfirmFlag),
+	})
 }
 
 func (p *defaultProvider) Cache(keyPrefix string) (cache.Cache, error) {
 	return cache.NewRedisCache(p.ctx.String(cacheSRVFlag), keyPrefix)
 }
 
-func (p *defaultProvider) HTTPClient() (chttp.Client, error) {
-	return chttp.NewFastHTTPClient(&fasthttp.Client{
-		// Use given TOR proxy to reach the hidden services
-		Dial: fasthttpproxy.FasthttpSocksDialer(p.ctx.String(torURIFlag)),
-		// Disable SSL verification since we do not really care about this
-		TLSConfig:    &tls.Config{InsecureSkipVerify: true},
-		ReadTimeout:  time.Second * 5,
-		WriteTimeout: time.Second * 5,
-		Name:         p.ctx.String(userAgentFlag),
+func (p *defaultProvider) HTTPClient(hostMapping chttp.HostMappingFunc, minTLSVersion chttp.TLSVersionFunc) (chttp.Client, error) {
+	return chttp.NewClient(chttp.Options{
+		ProxyURI:            p.ctx.String(torURIFlag),
+		ProxyUsername:       p.ctx.String(torUsernameFlag),
+		ProxyPassword:       p.ctx.String(torPasswordFlag),
+		UserAgent:           p.ctx.String(userAgentFlag),
+		DialTimeout:         p.ctx.Duration(dialTimeoutFlag),
+		ReadTimeout:         p.ctx.Duration(readTimeoutFlag),
+		MaxConnsPerHost:     p.ctx.Int(maxConnsPerHostFlag),
+		MaxIdleConnDuration: p.ctx.Duration(maxIdleConnDurationFlag),
+		HostMapping:         hostMapping,
+		MinTLSVersion:       minTLSVersion,
+		MaxRedirectHosts:    p.ctx.Int(maxRedirectHostsFlag),
+		MaxRequestDuration:  p.ctx.Duration(maxRequestDurationFlag),
 	}), nil
 }
 
@@ -128,11 +151,21 @@ func (p *defaultProvider) GetIntValue(key string) int {
 	return p.ctx.Int(key)
 }
 
+func (p *defaultProvider) GetDurationValue(key string) time.Duration {
+	return p.ctx.Duration(key)
+}
+
+func (p *defaultProvider) GetBoolValue(key string) bool {
+	return p.ctx.Bool(key)
+}
+
 // SubscriberDef is the subscriber definition
 type SubscriberDef struct {
 	Exchange string
 	Queue    string
 	Handler  event.Handler
+	// Retry is the policy used to retry the messages (see event.RawMessage.Retry), if any
+	Retry *event.RetryPolicy
 }
 
 // Process is a component of Bathyscaphe
@@ -146,6 +179,36 @@ type Process interface {
 	HTTPHandler() http.Handler
 }
 
+// Shutdowner is implemented by the processes that need to be notified on graceful shutdown
+type Shutdowner interface {
+	Shutdown() error
+}
+
+// WriteJSON write given value as the JSON response of a process HTTPHandler
+func WriteJSON(w http.ResponseWriter, value interface{}) {
+	WriteJSONStatus(w, http.StatusOK, value)
+}
+
+// WriteJSONStatus write given value as the JSON response of a process HTTPHandler, using given status code
+func WriteJSONStatus(w http.ResponseWriter, statusCode int, value interface{}) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		log.Err(err).Msg("error while encoding response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The header must be set before writing the status code
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(b)
+}
+
+// Commander is implemented by the processes providing additional commands (i.e: maintenance tasks)
+type Commander interface {
+	Commands() []*cli.Command
+}
+
 // MakeApp return cli.App corresponding for given Process
 func MakeApp(process Process) *cli.App {
 	app := &cli.App{
@@ -159,6 +222,14 @@ func MakeApp(process Process) *cli.App {
 				Usage: "Set the application log level",
 				Value: "info",
 			},
+			&cli.StringSliceFlag{
+				Name:  logSamplingFlag,
+				Usage: "Only emit 1 log out of N for a level below error, using level=N (i.e: debug=100)",
+			},
+			&cli.BoolFlag{
+				Name:  preflightFlag,
+				Usage: "Check that the dependencies (event server, ConfigAPI, cache, ...) can be reached before starting",
+			},
 		},
 		Authors: []*cli.Author{
 			{
@@ -182,6 +253,21 @@ func MakeApp(process Process) *cli.App {
 		app.Flags = append(app.Flags, flag)
 	}
 
+	// Add the dead-letters replay to the processes consuming events
+	for _, feature := range process.Features() {
+		if feature == EventFeature {
+			app.Commands = append(app.Commands, replayCommand())
+		}
+	}
+
+	// Add the process specific commands
+	if commander, ok := process.(Commander); ok {
+		for _, command := range commander.Commands() {
+			command.Before = configureLogger
+			app.Commands = append(app.Commands, command)
+		}
+	}
+
 	return app
 }
 
@@ -190,7 +276,17 @@ func execute(process Process) cli.ActionFunc {
 		provider := NewDefaultProvider(c)
 
 		// Common setup
-		configureLogger(c)
+		if err := configureLogger(c); err != nil {
+			return err
+		}
+
+		// Fail fast if a dependency cannot be reached
+		if c.Bool(preflightFlag) {
+			if err := preflight(dependencies(process, provider)); err != nil {
+				log.Err(err).Msg("error while checking dependencies")
+				return err
+			}
+		}
 
 		// Custom setup
 		if err := process.Initialize(provider); err != nil {
@@ -207,7 +303,14 @@ func execute(process Process) cli.ActionFunc {
 			// TODO sub.Close()
 
 			for _, subscriberDef := range process.Subscribers() {
-				if err := sub.Subscribe(subscriberDef.Exchange, subscriberDef.Queue, subscriberDef.Handler); err != nil {
+				var err error
+				if subscriberDef.Retry != nil {
+					err = sub.SubscribeWithRetry(subscriberDef.Exchange, subscriberDef.Queue, *subscriberDef.Retry, subscriberDef.Handler)
+				} else {
+					err = sub.Subscribe(subscriberDef.Exchange, subscriberDef.Queue, subscriberDef.Handler)
+				}
+
+				if err != nil {
 					log.Err(err).
 						Str("exchange", subscriberDef.Exchange).
 						Str("queue", subscriberDef.Queue).
@@ -251,6 +354,12 @@ func execute(process Process) cli.ActionFunc {
 			_ = srv.Shutdown(context.Background())
 		}
 
+		if shutdowner, ok := process.(Shutdowner); ok {
+			if err := shutdowner.Shutdown(); err != nil {
+				log.Err(err).Msg("error while shutting down app")
+			}
+		}
+
 		// Connections are deferred here
 
 		return nil
@@ -268,9 +377,13 @@ func getFeaturesFlags() map[Feature][]cli.Flag {
 		},
 		&cli.IntFlag{
 			Name:  EventPrefetchFlag,
-			Usage: "Prefetch for the event subscriber",
+			Usage: "Maximum number of unacknowledged events held by each subscriber (events are processed one at a time)",
 			Value: 1,
 		},
+		&cli.BoolFlag{
+			Name:  eventConfirmFlag,
+			Usage: "Wait for the event server to confirm each published event (safer but slower)",
+		},
 	}
 
 	flags[ConfigFeature] = []cli.Flag{
@@ -295,18 +408,62 @@ func getFeaturesFlags() map[Feature][]cli.Flag {
 			Usage:    "URI to the TOR SOCKS proxy",
 			Required: true,
 		},
+		&cli.StringFlag{
+			Name:    torUsernameFlag,
+			Usage:   "Username used to authenticate against the TOR SOCKS proxy",
+			EnvVars: []string{"BS_TOR_PROXY_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    torPasswordFlag,
+			Usage:   "Password used to authenticate against the TOR SOCKS proxy",
+			EnvVars: []string{"BS_TOR_PROXY_PASSWORD"},
+		},
 		&cli.StringFlag{
 			Name:  userAgentFlag,
 			Usage: "User agent to use",
 			Value: "Mozilla/5.0 (Windows NT 10.0; rv:68.0) Gecko/20100101 Firefox/68.0",
 		},
+		&cli.IntFlag{
+			Name:  maxConnsPerHostFlag,
+			Usage: "Maximum number of connections per crawled host",
+			Value: chttp.DefaultMaxConnsPerHost,
+		},
+		&cli.DurationFlag{
+			Name:  maxIdleConnDurationFlag,
+			Usage: "Duration after which idle connections are closed",
+			Value: chttp.DefaultMaxIdleConnDuration,
+		},
+		&cli.DurationFlag{
+			Name:  dialTimeoutFlag,
+			Usage: "Maximum duration of the connection establishment (including the TOR circuit opening)",
+			Value: chttp.DefaultDialTimeout,
+		},
+		&cli.DurationFlag{
+			Name:  readTimeoutFlag,
+			Usage: "Maximum duration of the response reading, once connected",
+			Value: chttp.DefaultReadTimeout,
+		},
+		&cli.IntFlag{
+			Name:  maxRedirectHostsFlag,
+			Usage: "Maximum number of distinct hosts a redirect chain may go through (the requested one included)",
+			Value: chttp.DefaultMaxRedirectHosts,
+		},
+		&cli.DurationFlag{
+			Name:  maxRequestDurationFlag,
+			Usage: "Maximum duration of a request (redirects included), whatever the progress of the response reading",
+			Value: chttp.DefaultMaxRequestDuration,
+		},
 	}
 
 	return flags
 }
 
-func configureLogger(ctx *cli.Context) {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+func configureLogger(ctx *cli.Context) error {
+	logger, err := newLogger(zerolog.ConsoleWriter{Out: os.Stderr}, ctx.StringSlice(logSamplingFlag))
+	if err != nil {
+		return err
+	}
+	log.Logger = logger
 
 	// Set application log level
 	if lvl, err := zerolog.ParseLevel(ctx.String("log-level")); err == nil {
@@ -316,4 +473,6 @@ func configureLogger(ctx *cli.Context) {
 	}
 
 	log.Debug().Stringer("lvl", zerolog.GlobalLevel()).Msg("Setting log level")
+
+	return nil
 }
@@ -0,0 +1,70 @@
+package process
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	replayQueueFlag    = "queue"
+	replayMaxCountFlag = "max-count"
+	replayDryRunFlag   = "dry-run"
+)
+
+// replayCommand is the command used to publish back the dead-lettered messages of a queue, once the cause
+// of their failure has been fixed
+func replayCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "replay-dead-letters",
+		Usage: "Publish back to their queue the dead-lettered messages",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     replayQueueFlag,
+				Usage:    "Name of the queue whose dead-lettered messages should be replayed (i.e: elasticIndexingQueue)",
+				Required: true,
+			},
+			&cli.IntFlag{
+				Name:  replayMaxCountFlag,
+				Usage: "Maximum number of messages to replay (0 means no limit)",
+			},
+			&cli.BoolFlag{
+				Name:  replayDryRunFlag,
+				Usage: "Only count the messages that would be replayed",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if err := configureLogger(c); err != nil {
+				return err
+			}
+
+			sub, err := NewDefaultProvider(c).Subscriber()
+			if err != nil {
+				return err
+			}
+			defer sub.Close()
+
+			return replay(sub, c.String(replayQueueFlag), event.ReplayOptions{
+				MaxCount: c.Int(replayMaxCountFlag),
+				DryRun:   c.Bool(replayDryRunFlag),
+			})
+		},
+	}
+}
+
+// replay the dead-lettered messages of given queue, logging how many have been replayed
+func replay(sub event.Subscriber, queue string, opts event.ReplayOptions) error {
+	count, err := sub.ReplayDeadLetters(queue, opts)
+	if err != nil {
+		log.Err(err).Str("queue", queue).Int("count", count).Msg("error while replaying dead-lettered messages")
+		return err
+	}
+
+	if opts.DryRun {
+		log.Info().Str("queue", queue).Int("count", count).Msg("Dead-lettered messages to replay (dry run)")
+	} else {
+		log.Info().Str("queue", queue).Int("count", count).Msg("Successfully replayed dead-lettered messages")
+	}
+
+	return nil
+}
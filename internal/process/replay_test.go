@@ -0,0 +1,27 @@
+package process
+
+import (
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/golang/mock/gomock"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+
+	opts := event.ReplayOptions{MaxCount: 10}
+	subscriberMock.EXPECT().ReplayDeadLetters("elasticIndexingQueue", opts).Return(10, nil)
+	if err := replay(subscriberMock, "elasticIndexingQueue", opts); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	subscriberMock.EXPECT().ReplayDeadLetters("elasticIndexingQueue", opts).Return(2, errors.New("channel closed"))
+	if err := replay(subscriberMock, "elasticIndexingQueue", opts); err == nil {
+		t.Error("error should have been returned")
+	}
+}
@@ -0,0 +1,94 @@
+package scheduler
+
+import (
+	"errors"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/constraint"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDrainPollInterval is the interval at which the queued URLs are counted while the publishing is paused
+	defaultDrainPollInterval = 5 * time.Second
+	// maxDrainChecks is the number of times the queued URLs are counted before retrying the event later
+	maxDrainChecks = 12
+)
+
+// errQueueNotDrained is returned when the publishing is still paused after waiting for the queue to drain
+var errQueueNotDrained = errors.New("queue has not drained")
+
+// backpressure pauses the publishing while the crawlers are behind, using the queue watermarks as hysteresis:
+// the publishing is paused once the queued URLs reach the high watermark, and resumed once they fall to the low one
+type backpressure struct {
+	mutex  sync.Mutex
+	paused bool
+}
+
+// update the state using given number of queued URLs, returning true if the publishing is paused
+func (b *backpressure) update(queued int64, watermarks configapi.QueueWatermarks) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch {
+	case watermarks.High <= 0:
+		b.paused = false
+	case !b.paused && queued >= watermarks.High:
+		log.Warn().Int64("queued", queued).Int64("high", watermarks.High).Msg("Crawlers are behind, pausing publishing")
+		b.paused = true
+	case b.paused && queued <= watermarks.Low:
+		log.Info().Int64("queued", queued).Int64("low", watermarks.Low).Msg("Queue has drained, resuming publishing")
+		b.paused = false
+	}
+
+	return b.paused
+}
+
+// waitForDrain waits while the publishing is paused, errQueueNotDrained being returned if the queue has not drained
+// after maxDrainChecks (or if the scheduler is shutting down)
+func (state *State) waitForDrain() error {
+	for i := 0; ; i++ {
+		watermarks, err := state.configClient.GetQueueWatermarks()
+		if err != nil {
+			return err
+		}
+
+		var queued int64
+		if watermarks.High > 0 {
+			if queued, err = constraint.GetQueuedURLs(state.queueCache); err != nil {
+				return err
+			}
+		}
+
+		if !state.backpressure.update(queued, watermarks) {
+			return nil
+		}
+		if i == maxDrainChecks-1 {
+			return errQueueNotDrained
+		}
+
+		select {
+		case <-time.After(state.drainPollInterval):
+		case <-state.ctx.Done():
+			return errQueueNotDrained
+		}
+	}
+}
+
+// retryIfBehind retry the event later if it has not been scheduled because the queue has not drained.
+// Like the events which could not be published, it is dead-lettered once the maximum number of retries is reached
+func retryIfBehind(msg event.RawMessage, err error) error {
+	if !errors.Is(err, errQueueNotDrained) {
+		return err
+	}
+
+	log.Debug().Msg("Queue has not drained, retrying event later")
+
+	if err := msg.Retry(); err != nil {
+		return err
+	}
+
+	return event.ErrAckDeferred
+}
@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+func TestBackpressure_Update(t *testing.T) {
+	watermarks := client.QueueWatermarks{High: 100, Low: 50}
+
+	// The publishing stays paused until the queue falls to the low watermark
+	steps := []struct {
+		queued int64
+		paused bool
+	}{
+		{queued: 10, paused: false},
+		{queued: 99, paused: false},
+		{queued: 100, paused: true},
+		{queued: 80, paused: true},
+		{queued: 51, paused: true},
+		{queued: 50, paused: false},
+		{queued: 80, paused: false},
+	}
+
+	var b backpressure
+	for _, step := range steps {
+		if paused := b.update(step.queued, watermarks); paused != step.paused {
+			t.Errorf("%d queued: got %v want %v", step.queued, paused, step.paused)
+		}
+	}
+
+	// Disabling the watermarks resumes the publishing
+	b.update(200, watermarks)
+	if b.update(200, client.QueueWatermarks{}) {
+		t.Error("publishing should be resumed once disabled")
+	}
+}
+
+func TestWaitForDrain(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	queueCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	watermarks := client.QueueWatermarks{High: 100, Low: 50}
+	configClientMock.EXPECT().GetQueueWatermarks().Times(3).Return(watermarks, nil)
+	gomock.InOrder(
+		queueCacheMock.EXPECT().GetInt64("urls").Return(int64(120), nil),
+		queueCacheMock.EXPECT().GetInt64("urls").Return(int64(70), nil),
+		queueCacheMock.EXPECT().GetInt64("urls").Return(int64(40), nil),
+	)
+
+	s := State{configClient: configClientMock, queueCache: queueCacheMock, ctx: context.Background()}
+	if err := s.waitForDrain(); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+	if s.backpressure.paused {
+		t.Error("publishing should be resumed")
+	}
+}
+
+func TestWaitForDrain_NotDrained(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	queueCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	configClientMock.EXPECT().GetQueueWatermarks().Times(maxDrainChecks).Return(client.QueueWatermarks{High: 100, Low: 50}, nil)
+	queueCacheMock.EXPECT().GetInt64("urls").Times(maxDrainChecks).Return(int64(100), nil)
+
+	s := State{configClient: configClientMock, queueCache: queueCacheMock, ctx: context.Background()}
+	if err := s.waitForDrain(); !errors.Is(err, errQueueNotDrained) {
+		t.Errorf("got %v want %v", err, errQueueNotDrained)
+	}
+}
+
+func TestScheduleURLs_QueueNotDrained(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	queueCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetQueueWatermarks().Times(maxDrainChecks).Return(client.QueueWatermarks{High: 100, Low: 50}, nil)
+	queueCacheMock.EXPECT().GetInt64("urls").Times(maxDrainChecks).Return(int64(150), nil)
+
+	// Nothing should be published
+	s := State{configClient: configClientMock, queueCache: queueCacheMock, ctx: context.Background()}
+	if err := s.scheduleURLs(subscriberMock, []string{"https://example.onion"}, ""); !errors.Is(err, errQueueNotDrained) {
+		t.Errorf("got %v want %v", err, errQueueNotDrained)
+	}
+}
+
+func TestWaitForDrain_Shutdown(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	queueCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{High: 100, Low: 50}, nil)
+	queueCacheMock.EXPECT().GetInt64("urls").Return(int64(150), nil)
+
+	// The wait should be interrupted on shutdown
+	s := State{configClient: configClientMock, queueCache: queueCacheMock, drainPollInterval: time.Hour}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	_ = s.Shutdown()
+
+	if err := s.waitForDrain(); !errors.Is(err, errQueueNotDrained) {
+		t.Errorf("got %v want %v", err, errQueueNotDrained)
+	}
+}
+
+func TestRetryIfBehind(t *testing.T) {
+	if err := retryIfBehind(event.RawMessage{}, errQueueNotDrained); !errors.Is(err, event.ErrAckDeferred) {
+		t.Errorf("got %v want %v", err, event.ErrAckDeferred)
+	}
+
+	if err := retryIfBehind(event.RawMessage{}, errNotPublished); !errors.Is(err, errNotPublished) {
+		t.Errorf("got %v want %v", err, errNotPublished)
+	}
+}
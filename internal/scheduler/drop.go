@@ -0,0 +1,63 @@
+package scheduler
+
+import (
+	"errors"
+	"expvar"
+	"github.com/rs/zerolog/log"
+)
+
+// dropReason is the reason why an URL has not been scheduled
+type dropReason string
+
+const (
+	dropPaused            dropReason = "paused"
+	dropInvalid           dropReason = "invalid"
+	dropScheme            dropReason = "scheme"
+	dropPort              dropReason = "port"
+	dropTooLong           dropReason = "too-long"
+	dropCrawlTrap         dropReason = "crawl-trap"
+	dropTooManyLinks      dropReason = "too-many-links"
+	dropQueueFull         dropReason = "queue-full"
+	dropNotOnion          dropReason = "not-onion"
+	dropExtension         dropReason = "extension"
+	dropForbiddenHostname dropReason = "forbidden-hostname"
+	dropAlreadyScheduled  dropReason = "already-scheduled"
+)
+
+// droppedURLs is the number of URLs dropped, by reason
+var droppedURLs = expvar.NewMap("scheduler.dropped-urls")
+
+// dropURL record that given URL has been dropped for given reason, logging it with the optional given fields
+// (i.e: the URL length)
+func dropURL(rawURL string, reason dropReason, fields ...map[string]interface{}) {
+	droppedURLs.Add(string(reason), 1)
+
+	e := log.Trace().Str("url", rawURL).Str("reason", string(reason))
+	for _, f := range fields {
+		e = e.Fields(f)
+	}
+	e.Msg("Dropping URL")
+}
+
+// dropURLs record that count URLs have been dropped for given reason
+func dropURLs(count int, reason dropReason) {
+	droppedURLs.Add(string(reason), int64(count))
+}
+
+// dropReasonOf returns the reason of an URL dropped by processURL, if the error is a drop reason
+func dropReasonOf(err error) (dropReason, bool) {
+	switch {
+	case errors.Is(err, errNotOnionHostname):
+		return dropNotOnion, true
+	case errors.Is(err, errProtocolNotAllowed):
+		return dropScheme, true
+	case errors.Is(err, errExtensionNotAllowed):
+		return dropExtension, true
+	case errors.Is(err, errHostnameNotAllowed):
+		return dropForbiddenHostname, true
+	case errors.Is(err, errAlreadyScheduled):
+		return dropAlreadyScheduled, true
+	default:
+		return "", false
+	}
+}
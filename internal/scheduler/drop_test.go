@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"testing"
+)
+
+// droppedCount returns the number of URLs dropped for given reason
+func droppedCount(reason dropReason) int64 {
+	if count, ok := droppedURLs.Get(string(reason)).(*expvar.Int); ok {
+		return count.Value()
+	}
+
+	return 0
+}
+
+func TestDropReasonOf(t *testing.T) {
+	tests := map[error]dropReason{
+		errNotOnionHostname:    dropNotOnion,
+		errProtocolNotAllowed:  dropScheme,
+		errExtensionNotAllowed: dropExtension,
+		errHostnameNotAllowed:  dropForbiddenHostname,
+		errAlreadyScheduled:    dropAlreadyScheduled,
+	}
+
+	for err, want := range tests {
+		if got, ok := dropReasonOf(fmt.Errorf("https://example.onion %w", err)); !ok || got != want {
+			t.Errorf("%s: got %s want %s", err, got, want)
+		}
+	}
+
+	if _, ok := dropReasonOf(fmt.Errorf("error while publishing URL")); ok {
+		t.Error("the error should not be a drop reason")
+	}
+}
+
+func TestFilters_DropReasons(t *testing.T) {
+	type test struct {
+		filter func([]string) []string
+		url    string
+		reason dropReason
+	}
+
+	tests := []test{
+		{
+			filter: func(urls []string) []string { return filterURLSchemes(urls, []string{"https"}) },
+			url:    "ftp://example.onion/file.zip",
+			reason: dropScheme,
+		},
+		{
+			filter: func(urls []string) []string { return filterURLSchemes(urls, []string{"https"}) },
+			url:    "https://example.onion/%zz",
+			reason: dropInvalid,
+		},
+		{
+			filter: func(urls []string) []string { return filterURLPorts(urls, []int{443}) },
+			url:    "https://example.onion:22",
+			reason: dropPort,
+		},
+		{
+			filter: func(urls []string) []string { return filterURLLength(urls, 20) },
+			url:    "https://example.onion/very/long/path",
+			reason: dropTooLong,
+		},
+		{
+			filter: func(urls []string) []string { return filterCrawlTraps(urls, 3) },
+			url:    "https://example.onion/a/a/a/a",
+			reason: dropCrawlTrap,
+		},
+	}
+
+	for _, test := range tests {
+		count := droppedCount(test.reason)
+
+		if got := test.filter([]string{test.url}); len(got) != 0 {
+			t.Errorf("%s should have been dropped", test.url)
+		}
+		if droppedCount(test.reason) != count+1 {
+			t.Errorf("%s: drop reason %s not recorded", test.url, test.reason)
+		}
+	}
+}
+
+func TestDropURL_Fields(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	defer func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	}()
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+
+	filterURLLength([]string{"https://example.onion/very/long/path"}, 20)
+	filterCrawlTraps([]string{"https://example.onion/a/a/a/a"}, 3)
+
+	for _, field := range []string{`"length":36`, `"segment":"a"`, `"count":4`} {
+		if !strings.Contains(buf.String(), field) {
+			t.Errorf("missing field %s in %s", field, buf.String())
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package scheduler
+
+import (
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// defaultPublishWorkers is the default number of URLs published concurrently
+const defaultPublishWorkers = 8
+
+// errNotPublished is returned when some of the scheduled URLs could not be published
+var errNotPublished = errors.New("could not be published")
+
+// publishRetryPolicy is used to retry the events whose URLs could not all be published
+var publishRetryPolicy = event.RetryPolicy{MaxRetries: 5, Delay: 10 * time.Second, MaxDelay: 5 * time.Minute}
+
+// publishURLs publish given URLs using up to workers goroutines, and returns the URLs which could not be published
+func publishURLs(pub event.Publisher, urls []string, tag string, workers int) []string {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(urls) {
+		workers = len(urls)
+	}
+
+	jobs := make(chan string)
+
+	var failed []string
+	var failedMutex sync.Mutex
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for u := range jobs {
+				if err := pub.PublishEvent(&event.NewURLEvent{URL: u, Tag: tag}); err != nil {
+					log.Err(err).Str("url", u).Msg("error while publishing URL")
+
+					failedMutex.Lock()
+					failed = append(failed, u)
+					failedMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, u := range urls {
+		jobs <- u
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	return failed
+}
+
+// retryIfNotPublished retry the event whose URLs could not all be published, it is dead-lettered once the
+// maximum number of retries is reached
+func retryIfNotPublished(msg event.RawMessage, err error) error {
+	if !errors.Is(err, errNotPublished) {
+		return err
+	}
+
+	log.Warn().Err(err).Msg("Retrying event")
+
+	if err := msg.Retry(); err != nil {
+		return err
+	}
+
+	return event.ErrAckDeferred
+}
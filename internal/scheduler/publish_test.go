@@ -0,0 +1,160 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPublishURLs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	var urls []string
+	for i := 0; i < 100; i++ {
+		urls = append(urls, fmt.Sprintf("https://example.onion/%d", i))
+	}
+
+	var published []string
+	var mutex sync.Mutex
+	pubMock.EXPECT().PublishEvent(gomock.Any()).Times(100).DoAndReturn(func(evt event.Event) error {
+		u := evt.(*event.NewURLEvent)
+		if u.Tag != "forums" {
+			t.Errorf("got tag %s want forums", u.Tag)
+		}
+		if strings.HasSuffix(u.URL, "/42") || strings.HasSuffix(u.URL, "/7") {
+			return errors.New("channel closed")
+		}
+
+		mutex.Lock()
+		published = append(published, u.URL)
+		mutex.Unlock()
+		return nil
+	})
+
+	failed := publishURLs(pubMock, urls, "forums", 8)
+
+	sort.Strings(failed)
+	if want := []string{"https://example.onion/42", "https://example.onion/7"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("got %v want %v", failed, want)
+	}
+	if len(published) != 98 {
+		t.Errorf("got %d published URLs want 98", len(published))
+	}
+}
+
+func TestHandleNewResourceEvent_ManyLinks(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	// A page having thousands of links
+	var body strings.Builder
+	for i := 0; i < 5000; i++ {
+		body.WriteString(fmt.Sprintf(`<a href="https://forum.onion/threads/%d">Thread</a>`, i))
+	}
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://forum.onion/index.php", Body: body.String()}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+	configClientMock.EXPECT().GetMaxLinksPerPage().Return(0, nil)
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{}, nil)
+	configClientMock.EXPECT().GetAllowedSchemes().Return(nil, nil)
+	configClientMock.EXPECT().GetAllowedPorts().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxURLLength().Return(0, nil)
+	configClientMock.EXPECT().GetStripQueryParams().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxPathRepetition().Return(0, nil)
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 0}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxQueuedURLs().Return(int64(0), nil)
+	configClientMock.EXPECT().GetAllowedMimeTypes().Times(5000).Return(nil, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Times(5000).Return(nil, nil)
+
+	urlCacheMock.EXPECT().GetManyInt64(gomock.Len(5000)).Return(map[string]int64{}, nil)
+
+	// Every link should be published before the event is acknowledged
+	published := map[string]bool{}
+	var mutex sync.Mutex
+	subscriberMock.EXPECT().PublishEvent(gomock.Any()).Times(5000).DoAndReturn(func(evt event.Event) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		published[evt.(*event.NewURLEvent).URL] = true
+		return nil
+	})
+
+	urlCacheMock.EXPECT().SetManyInt64(gomock.Len(5000), cache.NoTTL).Return(nil)
+
+	s := State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: newQueueCacheMock(mockCtrl, 5000),
+		publishWorkers: 8}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+
+	if len(published) != 5000 {
+		t.Errorf("got %d published URLs want 5000", len(published))
+	}
+}
+
+func TestHandleFoundURLEvent_NotPublished(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.FoundURLEvent{}).
+		SetArg(1, event.FoundURLEvent{URL: "https://example.onion/forum"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{}, nil)
+	configClientMock.EXPECT().GetAllowedSchemes().Return(nil, nil)
+	configClientMock.EXPECT().GetAllowedPorts().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxURLLength().Return(0, nil)
+	configClientMock.EXPECT().GetStripQueryParams().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxPathRepetition().Return(0, nil)
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return(nil, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return(nil, nil)
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 0}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxQueuedURLs().Return(int64(0), nil)
+
+	urlCacheMock.EXPECT().GetManyInt64([]string{"17434438323079886193"}).Return(map[string]int64{}, nil)
+	subscriberMock.EXPECT().
+		PublishEvent(&event.NewURLEvent{URL: "https://example.onion/forum"}).
+		Return(errors.New("channel closed"))
+
+	// The URL should not be marked as scheduled, nor counted as queued
+	urlCacheMock.EXPECT().SetManyInt64(map[string]int64{}, cache.NoTTL).Return(nil)
+
+	// The event should be retried
+	s := State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: cache_mock.NewMockCache(mockCtrl)}
+	if err := s.handleFoundURLEvent(subscriberMock, msg); !errors.Is(err, event.ErrAckDeferred) {
+		t.Errorf("got %v want %v", err, event.ErrAckDeferred)
+	}
+}
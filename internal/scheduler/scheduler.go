@@ -1,22 +1,29 @@
 package scheduler
 
 import (
+	"context"
 	"errors"
+	"expvar"
 	"fmt"
-	"github.com/PuerkitoBio/purell"
+	"github.com/PuerkitoBio/goquery"
 	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/constraint"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
 	"mvdan.cc/xurls/v2"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -27,10 +34,54 @@ var (
 	errAlreadyScheduled    = errors.New("URL is already scheduled")
 )
 
+const (
+	seedURLFlag        = "seed-url"
+	seedFileFlag       = "seed-file"
+	publishWorkersFlag = "publish-workers"
+
+	// seededKey is the cache key used to mark the seeds as published
+	seededKey = "seeded"
+
+	// defaultSeedTag is the tag of the seeds not having one
+	defaultSeedTag = "default"
+	// seedLanguagePrefix is the prefix of the seed language hint
+	seedLanguagePrefix = "lang="
+)
+
+// defaultAllowedSchemes are the URL schemes allowed when none are configured
+var defaultAllowedSchemes = []string{"http", "https"}
+
+// defaultAllowedPorts are the explicit URL ports allowed when none are configured
+var defaultAllowedPorts = []int{80, 443}
+
+// defaultMaxURLLength is the maximum URL length used when none is configured
+const defaultMaxURLLength = 2048
+
+// defaultMaxPathRepetition is the maximum number of occurrences of a path segment used when none is configured
+const defaultMaxPathRepetition = 3
+
 // State represent the application state
 type State struct {
 	configClient configapi.Client
 	urlCache     cache.Cache
+	// queueCache holds the approximate number of URLs queued for crawling
+	queueCache        cache.Cache
+	backpressure      backpressure
+	drainPollInterval time.Duration
+	// ctx is cancelled on shutdown, to stop waiting for the queue to drain
+	ctx    context.Context
+	cancel context.CancelFunc
+	// publishWorkers is the number of URLs published concurrently
+	publishWorkers int
+}
+
+// Shutdown stop waiting for the queue to drain
+func (state *State) Shutdown() error {
+	if state.cancel != nil {
+		state.cancel()
+	}
+
+	return nil
 }
 
 // Name return the process name
@@ -46,8 +97,33 @@ and apply a predicate to determinate if the URL is eligible
 for crawling. If it is, it will publish a event and update the
 scheduling cache.
 
-This component consumes the 'resource.new' event and produces
-the 'url.new' event.`
+This component consumes the 'resource.new' and 'url.found' events
+and produces the 'url.new' event.
+
+Seed URLs given at startup are published once, the first time the
+scheduler is started.
+
+The scheduling state (scheduled URLs & refresh delays) is stored
+in the cache, so it is shared by the instances and kept on restart.
+The URLs (or hostnames) of the 'always-crawl' config key are
+scheduled each time they are found, whatever the refresh delay, and
+the URLs of the 'allowed-urls' config key (matched exactly) are
+scheduled even if their hostname is forbidden.
+
+The number of URLs queued for crawling is approximated using a cache
+counter (decremented by the crawlers), the new URLs being dropped
+once it reaches the 'max-queued-urls' config key. The publishing can
+also be paused once it reaches the 'queue-watermarks' high watermark,
+the events being held then retried later until it falls to the low
+one.
+
+The number of URLs dropped by reason (forbidden hostname, already
+scheduled, ...) is exposed by the HTTP API (/debug/vars).
+
+The URLs of an event are published concurrently ('--publish-workers'),
+the event being acknowledged once all of them have been published.
+If some could not be published the event is retried (only the failed
+URLs being published again), then dead-lettered.`
 }
 
 // Features return the process features
@@ -57,12 +133,30 @@ func (state *State) Features() []process.Feature {
 
 // CustomFlags return process custom flags
 func (state *State) CustomFlags() []cli.Flag {
-	return []cli.Flag{}
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  seedURLFlag,
+			Usage: "URL to publish for crawling at first startup (use `POST URL CONTENT-TYPE BODY` for a POST request, prefix with `[TAG]` to set the campaign)",
+		},
+		&cli.StringFlag{
+			Name:  seedFileFlag,
+			Usage: "Path to a file containing URLs (one per line) to publish for crawling at first startup",
+		},
+		&cli.IntFlag{
+			Name:  publishWorkersFlag,
+			Usage: "Number of URLs published concurrently, to not stall on the pages having many links",
+			Value: defaultPublishWorkers,
+		},
+	}
 }
 
 // Initialize the process
 func (state *State) Initialize(provider process.Provider) error {
-	keys := []string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey, configapi.RefreshDelayKey}
+	keys := []string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey, configapi.RefreshDelayKey, configapi.RespectRobotsKey,
+		configapi.AllowedSchemesKey, configapi.MaxURLLengthKey, configapi.StripQueryParamsKey,
+		configapi.MaxPathRepetitionKey, configapi.CrawlingPausedKey, configapi.MaxLinksPerPageKey,
+		configapi.AllowedPortsKey, configapi.MaxQueuedURLsKey, configapi.QueueWatermarksKey, configapi.AlwaysCrawlKey,
+		configapi.AllowedURLsKey}
 	configClient, err := provider.ConfigClient(keys)
 	if err != nil {
 		return err
@@ -75,19 +169,156 @@ func (state *State) Initialize(provider process.Provider) error {
 	}
 	state.urlCache = urlCache
 
+	queueCache, err := provider.Cache(constraint.QueuedURLsCache)
+	if err != nil {
+		return err
+	}
+	state.queueCache = queueCache
+	state.drainPollInterval = defaultDrainPollInterval
+	state.ctx, state.cancel = context.WithCancel(context.Background())
+	state.publishWorkers = provider.GetIntValue(publishWorkersFlag)
+
+	// The scheduling state only lives in the cache: if it cannot be reached the URLs will be scheduled again
+	if err := urlCache.Ping(); err != nil {
+		log.Warn().Err(err).Msg("Cache is unreachable, the already scheduled URLs may be scheduled again")
+	}
+
+	seeds := provider.GetStrValues(seedURLFlag)
+	if seedFile := provider.GetStrValue(seedFileFlag); seedFile != "" {
+		fileSeeds, err := loadSeedFile(seedFile)
+		if err != nil {
+			return err
+		}
+		seeds = append(seeds, fileSeeds...)
+	}
+
+	if len(seeds) > 0 {
+		pub, err := provider.Publisher()
+		if err != nil {
+			return err
+		}
+		defer pub.Close()
+
+		if err := state.seedURLs(pub, seeds); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // Subscribers return the process subscribers
 func (state *State) Subscribers() []process.SubscriberDef {
 	return []process.SubscriberDef{
-		{Exchange: event.NewResourceExchange, Queue: "schedulingQueue", Handler: state.handleNewResourceEvent},
+		{Exchange: event.NewResourceExchange, Queue: "schedulingQueue", Handler: state.handleNewResourceEvent, Retry: &publishRetryPolicy},
+		{Exchange: event.FoundURLExchange, Queue: "foundURLSchedulingQueue", Handler: state.handleFoundURLEvent, Retry: &publishRetryPolicy},
 	}
 }
 
 // HTTPHandler returns the HTTP API the process expose
 func (state *State) HTTPHandler() http.Handler {
-	return nil
+	r := mux.NewRouter()
+	r.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
+
+	return r
+}
+
+func (state *State) seedURLs(pub event.Publisher, urls []string) error {
+	// Make sure we haven't already seeded
+	seeded, err := state.urlCache.GetInt64(seededKey)
+	if err != nil {
+		return err
+	}
+	if seeded > 0 {
+		log.Debug().Msg("Seeds already published, skipping")
+		return nil
+	}
+
+	for _, u := range urls {
+		evt, err := parseSeed(u)
+		if err != nil {
+			return err
+		}
+
+		if err := pub.PublishEvent(evt); err != nil {
+			return fmt.Errorf("error while publishing seed URL: %s", err)
+		}
+	}
+
+	log.Info().Int("count", len(urls)).Msg("Successfully published seed URLs")
+
+	if err := constraint.AddQueuedURLs(state.queueCache, int64(len(urls))); err != nil {
+		log.Err(err).Msg("error while counting queued URLs")
+	}
+
+	return state.urlCache.SetInt64(seededKey, 1, cache.NoTTL)
+}
+
+// parseSeed parse given seed, formatted either as `URL` or as `POST URL CONTENT-TYPE BODY`
+// optionally prefixed by the `[TAG]` of the campaign and by a `lang=LANGUAGE` hint
+func parseSeed(seed string) (*event.NewURLEvent, error) {
+	seed = strings.TrimSpace(seed)
+
+	tag := defaultSeedTag
+	if strings.HasPrefix(seed, "[") {
+		end := strings.Index(seed, "]")
+		if end < 2 {
+			return nil, fmt.Errorf("invalid seed tag: %s", seed)
+		}
+
+		tag = seed[1:end]
+		seed = strings.TrimSpace(seed[end+1:])
+	}
+
+	language := ""
+	if strings.HasPrefix(seed, seedLanguagePrefix) {
+		parts := strings.SplitN(seed, " ", 2)
+		if len(parts) != 2 || parts[0] == seedLanguagePrefix {
+			return nil, fmt.Errorf("invalid seed language: %s", seed)
+		}
+
+		language = strings.TrimPrefix(parts[0], seedLanguagePrefix)
+		seed = strings.TrimSpace(parts[1])
+	}
+
+	parts := strings.SplitN(seed, " ", 4)
+	if len(parts) == 1 {
+		return &event.NewURLEvent{URL: parts[0], Tag: tag, Language: language}, nil
+	}
+
+	if len(parts) != 4 || !strings.EqualFold(parts[0], http.MethodPost) {
+		return nil, fmt.Errorf("invalid seed: %s", seed)
+	}
+
+	return &event.NewURLEvent{
+		URL:         parts[1],
+		Tag:         tag,
+		Language:    language,
+		Method:      http.MethodPost,
+		ContentType: parts[2],
+		Body:        parts[3],
+	}, nil
+}
+
+func loadSeedFile(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading seed file: %s", err)
+	}
+
+	var urls []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+
+		// Skip empty lines & comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		urls = append(urls, line)
+	}
+
+	return urls, nil
 }
 
 func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg event.RawMessage) error {
@@ -98,11 +329,119 @@ func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg even
 
 	log.Trace().Str("url", evt.URL).Msg("Processing new resource")
 
+	directives, err := constraint.GetRobotsDirectives(state.configClient, evt.Body)
+	if err != nil {
+		return err
+	}
+
+	if directives.NoFollow {
+		log.Debug().Str("url", evt.URL).Msg("Skipping resource links (nofollow)")
+		return nil
+	}
+
 	urls, err := extractURLS(&evt)
 	if err != nil {
 		return fmt.Errorf("error while extracting URLs")
 	}
 
+	maxLinks, err := state.configClient.GetMaxLinksPerPage()
+	if err != nil {
+		return err
+	}
+	if maxLinks > 0 && len(urls) > maxLinks {
+		log.Warn().Str("url", evt.URL).Int("count", len(urls)).Int("max", maxLinks).Msg("Too many links found, truncating")
+		limited := limitLinks(evt.URL, urls, maxLinks)
+		dropURLs(len(urls)-len(limited), dropTooManyLinks)
+		urls = limited
+	}
+
+	return retryIfNotPublished(msg, retryIfBehind(msg, state.scheduleURLs(subscriber, urls, evt.Tag)))
+}
+
+func (state *State) handleFoundURLEvent(subscriber event.Subscriber, msg event.RawMessage) error {
+	var evt event.FoundURLEvent
+	if err := subscriber.Read(&msg, &evt); err != nil {
+		return err
+	}
+
+	log.Trace().Str("url", evt.URL).Msg("Processing found URL")
+
+	u, err := constraint.NormalizeURL(evt.URL)
+	if err != nil {
+		return err
+	}
+
+	return retryIfNotPublished(msg, retryIfBehind(msg, state.scheduleURLs(subscriber, []string{u}, evt.Tag)))
+}
+
+// scheduleURLs publish the eligible URLs, tagging them with given tag
+func (state *State) scheduleURLs(pub event.Publisher, urls []string, tag string) error {
+	// The URLs are not marked as scheduled, they will be scheduled once found again
+	paused, err := state.configClient.GetCrawlingPaused()
+	if err != nil {
+		return err
+	}
+	if paused {
+		log.Debug().Int("count", len(urls)).Msg("Crawling is paused, dropping URLs")
+		dropURLs(len(urls), dropPaused)
+		return nil
+	}
+
+	// Hold the URLs while the crawlers are behind
+	if err := state.waitForDrain(); err != nil {
+		return err
+	}
+
+	allowedSchemes, err := state.configClient.GetAllowedSchemes()
+	if err != nil {
+		return err
+	}
+	if len(allowedSchemes) == 0 {
+		allowedSchemes = defaultAllowedSchemes
+	}
+
+	urls = filterURLSchemes(urls, allowedSchemes)
+
+	allowedPorts, err := state.configClient.GetAllowedPorts()
+	if err != nil {
+		return err
+	}
+	if len(allowedPorts) == 0 {
+		allowedPorts = defaultAllowedPorts
+	}
+
+	urls = filterURLPorts(urls, allowedPorts)
+
+	stripQueryParams, err := state.configClient.GetStripQueryParams()
+	if err != nil {
+		return err
+	}
+	if len(stripQueryParams) > 0 {
+		for i, u := range urls {
+			urls[i] = constraint.StripURLQueryParams(u, stripQueryParams)
+		}
+	}
+
+	maxURLLength, err := state.configClient.GetMaxURLLength()
+	if err != nil {
+		return err
+	}
+	if maxURLLength <= 0 {
+		maxURLLength = defaultMaxURLLength
+	}
+
+	urls = filterURLLength(urls, maxURLLength)
+
+	maxPathRepetition, err := state.configClient.GetMaxPathRepetition()
+	if err != nil {
+		return err
+	}
+	if maxPathRepetition <= 0 {
+		maxPathRepetition = defaultMaxPathRepetition
+	}
+
+	urls = filterCrawlTraps(urls, maxPathRepetition)
+
 	// We are working using URL hash to reduce memory consumption.
 	// See: https://github.com/darkspot-org/bathyscaphe/issues/130
 	var urlHashes []string
@@ -114,6 +453,10 @@ func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg even
 
 		urlHashes = append(urlHashes, strconv.FormatUint(c.Sum64(), 10))
 	}
+	hashes := make(map[string]string, len(urls))
+	for i, u := range urls {
+		hashes[u] = urlHashes[i]
+	}
 
 	// Load values in batch
 	urlCache, err := state.urlCache.GetManyInt64(urlHashes)
@@ -121,27 +464,92 @@ func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg even
 		return err
 	}
 
-	for _, u := range urls {
-		if err := state.processURL(u, subscriber, urlCache); err != nil {
-			log.Err(err).Msg("error while processing URL")
-		}
+	delay, err := state.configClient.GetRefreshDelay()
+	if err != nil {
+		return err
 	}
 
-	// Update URL cache
-	delay, err := state.configClient.GetRefreshDelay()
+	alwaysCrawl, err := state.configClient.GetAlwaysCrawl()
 	if err != nil {
 		return err
 	}
 
-	// Update values in batch
-	if err := state.urlCache.SetManyInt64(urlCache, delay.Delay); err != nil {
+	maxQueuedURLs, err := state.configClient.GetMaxQueuedURLs()
+	if err != nil {
+		return err
+	}
+
+	var queuedURLs int64
+	if maxQueuedURLs > 0 {
+		if queuedURLs, err = constraint.GetQueuedURLs(state.queueCache); err != nil {
+			return err
+		}
+	}
+
+	// The dropped URLs are not marked as scheduled, they will be scheduled once found again
+	var scheduled []string
+	var dropped int64
+	for _, u := range urls {
+		if err := state.processURL(u, urlCache, delay, alwaysCrawl); err != nil {
+			if reason, ok := dropReasonOf(err); ok {
+				dropURL(u, reason)
+			} else {
+				log.Err(err).Msg("error while processing URL")
+			}
+			continue
+		}
+
+		// Only the eligible URLs count toward the cap, so that the other drop reasons are kept accurate
+		if maxQueuedURLs > 0 && queuedURLs+int64(len(scheduled)) >= maxQueuedURLs {
+			delete(urlCache, hashes[u])
+			dropURL(u, dropQueueFull)
+			dropped++
+			continue
+		}
+
+		scheduled = append(scheduled, u)
+	}
+
+	// Neither are the URLs which could not be published, they will be published when the event is retried
+	failed := publishURLs(pub, scheduled, tag, state.publishWorkers)
+	for _, u := range failed {
+		delete(urlCache, hashes[u])
+	}
+	published := int64(len(scheduled) - len(failed))
+
+	if dropped > 0 {
+		log.Warn().
+			Int64("queued", queuedURLs+int64(len(scheduled))).
+			Int64("max", maxQueuedURLs).
+			Int64("dropped", dropped).
+			Msg("Too many URLs queued for crawling, dropping URLs")
+	}
+
+	if published > 0 {
+		if err := constraint.AddQueuedURLs(state.queueCache, published); err != nil {
+			log.Err(err).Msg("error while counting queued URLs")
+		}
+	}
+
+	// Update values in batch, the entries are kept until the end of the jitter band
+	TTL := delay.Delay
+	if TTL > 0 {
+		TTL += delay.Jitter
+	}
+	if err := state.urlCache.SetManyInt64(urlCache, TTL); err != nil {
 		return err
 	}
 
+	if len(failed) > 0 {
+		return fmt.Errorf("%d URLs %w", len(failed), errNotPublished)
+	}
+
 	return nil
 }
 
-func (state *State) processURL(rawURL string, pub event.Publisher, urlCache map[string]int64) error {
+// processURL check that given URL should be scheduled, and mark it as scheduled if so.
+// The URLs matching given always crawled entries are scheduled even if they are already
+func (state *State) processURL(rawURL string, urlCache map[string]int64, delay configapi.RefreshDelay, alwaysCrawl []string) error {
 	u, err := url.Parse(rawURL)
 	if err != nil {
 		return fmt.Errorf("error while parsing URL: %s", err)
@@ -188,8 +596,8 @@ func (state *State) processURL(rawURL string, pub event.Publisher, urlCache map[
 		return fmt.Errorf("%s %w", u, errExtensionNotAllowed)
 	}
 
-	// Make sure hostname is not forbidden
-	if allowed, err := constraint.CheckHostnameAllowed(state.configClient, rawURL); err != nil {
+	// Make sure hostname is not forbidden, unless the URL is explicitly allowed
+	if allowed, err := constraint.CheckURLAllowed(state.configClient, rawURL); err != nil {
 		return err
 	} else if !allowed {
 		log.Debug().Str("url", rawURL).Msg("Skipping forbidden hostname")
@@ -204,19 +612,35 @@ func (state *State) processURL(rawURL string, pub event.Publisher, urlCache map[
 	urlHash := strconv.FormatUint(c.Sum64(), 10)
 
 	// Check if URL should be scheduled
-	if urlCache[urlHash] > 0 {
+	now := time.Now()
+	if constraint.IsScheduled(urlCache[urlHash], now) && !constraint.IsAlwaysCrawled(alwaysCrawl, rawURL) {
 		return fmt.Errorf("%s %w", u, errAlreadyScheduled)
 	}
 
 	log.Debug().Stringer("url", u).Msg("URL should be scheduled")
 
-	urlCache[urlHash]++
+	urlCache[urlHash] = nextCrawlTime(delay, now)
+
+	return nil
+}
+
+// nextCrawlTime returns the URL cache value of an URL scheduled at given time: the time after which it can be
+// scheduled again, randomly spread within delay ± jitter. The URLs are never re-scheduled without refresh delay
+func nextCrawlTime(delay configapi.RefreshDelay, now time.Time) int64 {
+	if delay.Delay <= 0 {
+		return constraint.ScheduledUntilExpiry
+	}
 
-	if err := pub.PublishEvent(&event.NewURLEvent{URL: rawURL}); err != nil {
-		return fmt.Errorf("error while publishing URL: %s", err)
+	d := delay.Delay
+	if jitter := delay.Jitter; jitter > 0 {
+		// Make sure the URL is not immediately eligible again
+		if jitter > delay.Delay {
+			jitter = delay.Delay
+		}
+		d += time.Duration(rand.Int63n(int64(2*jitter)+1)) - jitter
 	}
 
-	return nil
+	return now.Add(d).UnixNano()
 }
 
 func extractURLS(msg *event.NewResourceEvent) ([]string, error) {
@@ -224,26 +648,243 @@ func extractURLS(msg *event.NewResourceEvent) ([]string, error) {
 	xu := xurls.Strict()
 	urls := xu.FindAllString(msg.Body, -1)
 
+	// Extract the links (which may be relative)
+	urls = append(urls, extractLinks(msg.URL, msg.Body)...)
+
 	var normalizedURLS []string
+	seen := map[string]bool{}
 
 	for _, u := range urls {
-		normalizedURL, err := normalizeURL(u)
-		if err != nil {
+		normalizedURL, err := constraint.NormalizeURL(u)
+		if err != nil || seen[normalizedURL] {
 			continue
 		}
 
+		seen[normalizedURL] = true
 		normalizedURLS = append(normalizedURLS, normalizedURL)
 	}
 
 	return normalizedURLS, nil
 }
 
-func normalizeURL(u string) (string, error) {
-	normalizedURL, err := purell.NormalizeURLString(u, purell.FlagsUsuallySafeGreedy|
-		purell.FlagRemoveDirectoryIndex|purell.FlagRemoveFragment|purell.FlagRemoveDuplicateSlashes)
+// extractLinks returns the links of given body, resolved against the page base URL
+// (the <base href> if any, the page URL otherwise)
+func extractLinks(pageURL string, body string) []string {
+	base, err := url.Parse(pageURL)
 	if err != nil {
-		return "", fmt.Errorf("error while normalizing URL %s: %s", u, err)
+		return nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	if href, exists := doc.Find("base[href]").First().Attr("href"); exists {
+		if ref, err := url.Parse(strings.TrimSpace(href)); err == nil {
+			base = base.ResolveReference(ref)
+		}
+	}
+
+	var links []string
+	doc.Find("a[href]").Each(func(i int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		ref, err := url.Parse(strings.TrimSpace(href))
+		if err != nil {
+			return
+		}
+
+		links = append(links, base.ResolveReference(ref).String())
+	})
+
+	return links
+}
+
+// filterURLSchemes returns the URLs whose scheme is allowed
+func filterURLSchemes(urls []string, allowedSchemes []string) []string {
+	var filteredURLs []string
+
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			dropURL(rawURL, dropInvalid)
+			continue
+		}
+
+		allowed := false
+		for _, scheme := range allowedSchemes {
+			if strings.EqualFold(u.Scheme, scheme) {
+				allowed = true
+				break
+			}
+		}
+
+		if allowed {
+			filteredURLs = append(filteredURLs, rawURL)
+		} else {
+			dropURL(rawURL, dropScheme)
+		}
+	}
+
+	return filteredURLs
+}
+
+// filterURLPorts returns the URLs without explicit port, or whose port is allowed.
+// The default port of the URL scheme is treated as no port, as done when normalizing the URLs
+func filterURLPorts(urls []string, allowedPorts []int) []string {
+	var filteredURLs []string
+
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			dropURL(rawURL, dropInvalid)
+			continue
+		}
+
+		if isPortAllowed(u, allowedPorts) {
+			filteredURLs = append(filteredURLs, rawURL)
+		} else {
+			dropURL(rawURL, dropPort)
+		}
+	}
+
+	return filteredURLs
+}
+
+// isPortAllowed returns true if given URL has no explicit port, or if its port is allowed
+func isPortAllowed(u *url.URL, allowedPorts []int) bool {
+	port := u.Port()
+	if port == "" || (port == "80" && strings.EqualFold(u.Scheme, "http")) || (port == "443" && strings.EqualFold(u.Scheme, "https")) {
+		return true
+	}
+
+	for _, allowedPort := range allowedPorts {
+		if port == strconv.Itoa(allowedPort) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterURLLength returns the URLs not exceeding given length
+func filterURLLength(urls []string, maxLength int) []string {
+	var filteredURLs []string
+
+	for _, u := range urls {
+		if len(u) > maxLength {
+			dropURL(u, dropTooLong, map[string]interface{}{"length": len(u)})
+			continue
+		}
+
+		filteredURLs = append(filteredURLs, u)
+	}
+
+	return filteredURLs
+}
+
+// limitLinks returns at most max links of given page, the links to the same host
+// then the shallower ones being kept first
+func limitLinks(pageURL string, links []string, max int) []string {
+	if len(links) <= max {
+		return links
+	}
+
+	pageHost := ""
+	if u, err := url.Parse(pageURL); err == nil {
+		pageHost = strings.ToLower(u.Hostname())
+	}
+
+	type link struct {
+		url      string
+		sameHost bool
+		depth    int
+	}
+
+	candidates := make([]link, 0, len(links))
+	for _, rawURL := range links {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+
+		candidates = append(candidates, link{
+			url:      rawURL,
+			sameHost: strings.ToLower(u.Hostname()) == pageHost,
+			depth:    pathDepth(u.Path),
+		})
+	}
+
+	// Keep the page order for the links having the same priority
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].sameHost != candidates[j].sameHost {
+			return candidates[i].sameHost
+		}
+		return candidates[i].depth < candidates[j].depth
+	})
+
+	if len(candidates) > max {
+		candidates = candidates[:max]
+	}
+
+	limited := make([]string, 0, len(candidates))
+	for _, l := range candidates {
+		limited = append(limited, l.url)
+	}
+
+	return limited
+}
+
+// pathDepth returns the number of segments of given path
+func pathDepth(p string) int {
+	depth := 0
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			depth++
+		}
+	}
+
+	return depth
+}
+
+// filterCrawlTraps returns the URLs not looking like a crawl trap
+// (i.e: /a/b/a/b/a/b/ generated by broken relative links)
+func filterCrawlTraps(urls []string, maxRepetition int) []string {
+	var filteredURLs []string
+
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			dropURL(rawURL, dropInvalid)
+			continue
+		}
+
+		if segment, count := mostRepeatedSegment(u.Path); count > maxRepetition {
+			dropURL(rawURL, dropCrawlTrap, map[string]interface{}{"segment": segment, "count": count})
+			continue
+		}
+
+		filteredURLs = append(filteredURLs, rawURL)
+	}
+
+	return filteredURLs
+}
+
+// mostRepeatedSegment returns the path segment having the most occurrences, with its number of occurrences
+func mostRepeatedSegment(p string) (string, int) {
+	counts := map[string]int{}
+
+	segment, count := "", 0
+	for _, s := range strings.Split(p, "/") {
+		if s == "" {
+			continue
+		}
+
+		counts[s]++
+		if counts[s] > count {
+			segment, count = s, counts[s]
+		}
 	}
 
-	return normalizedURL, nil
+	return segment, count
 }
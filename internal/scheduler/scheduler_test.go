@@ -13,8 +13,13 @@ import (
 	"github.com/darkspot-org/bathyscaphe/internal/test"
 	"github.com/golang/mock/gomock"
 	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestState_Name(t *testing.T) {
@@ -31,13 +36,28 @@ func TestState_Features(t *testing.T) {
 
 func TestState_CustomFlags(t *testing.T) {
 	s := State{}
-	test.CheckProcessCustomFlags(t, &s, nil)
+	test.CheckProcessCustomFlags(t, &s, []string{"seed-url", "seed-file", "publish-workers"})
 }
 
 func TestState_Initialize(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// An unreachable cache should not prevent the scheduler from starting
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	urlCacheMock.EXPECT().Ping().Return(errors.New("connection refused"))
+
 	test.CheckInitialize(t, &State{}, func(p *process_mock.MockProviderMockRecorder) {
-		p.Cache("url")
-		p.ConfigClient([]string{client.AllowedMimeTypesKey, client.ForbiddenHostnamesKey, client.RefreshDelayKey})
+		p.Cache("url").Return(urlCacheMock, nil)
+		p.Cache("queue")
+		p.ConfigClient([]string{client.AllowedMimeTypesKey, client.ForbiddenHostnamesKey, client.RefreshDelayKey, client.RespectRobotsKey,
+			client.AllowedSchemesKey, client.MaxURLLengthKey, client.StripQueryParamsKey,
+			client.MaxPathRepetitionKey, client.CrawlingPausedKey, client.MaxLinksPerPageKey,
+			client.AllowedPortsKey, client.MaxQueuedURLsKey, client.QueueWatermarksKey, client.AlwaysCrawlKey,
+			client.AllowedURLsKey})
+		p.GetIntValue("publish-workers")
+		p.GetStrValues("seed-url")
+		p.GetStrValue("seed-file")
 	})
 }
 
@@ -45,20 +65,10 @@ func TestState_Subscribers(t *testing.T) {
 	s := State{}
 	test.CheckProcessSubscribers(t, &s, []test.SubscriberDef{
 		{Queue: "schedulingQueue", Exchange: "resource.new"},
+		{Queue: "foundURLSchedulingQueue", Exchange: "url.found"},
 	})
 }
 
-func TestNormalizeURL(t *testing.T) {
-	url, err := normalizeURL("https://this-is-sparta.de?url=url-query-param#fragment-23")
-	if err != nil {
-		t.FailNow()
-	}
-
-	if url != "https://this-is-sparta.de?url=url-query-param" {
-		t.Fail()
-	}
-}
-
 func TestProcessURL_NotDotOnion(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -67,7 +77,7 @@ func TestProcessURL_NotDotOnion(t *testing.T) {
 
 	for _, url := range urls {
 		state := State{}
-		if err := state.processURL(url, nil, nil); !errors.Is(err, errNotOnionHostname) {
+		if err := state.processURL(url, nil, client.RefreshDelay{}, nil); !errors.Is(err, errNotOnionHostname) {
 			t.Fail()
 		}
 	}
@@ -81,7 +91,7 @@ func TestProcessURL_ProtocolForbidden(t *testing.T) {
 
 	for _, url := range urls {
 		state := State{}
-		if err := state.processURL(url, nil, nil); !errors.Is(err, errProtocolNotAllowed) {
+		if err := state.processURL(url, nil, client.RefreshDelay{}, nil); !errors.Is(err, errProtocolNotAllowed) {
 			t.Fail()
 		}
 	}
@@ -99,7 +109,7 @@ func TestProcessURL_ExtensionForbidden(t *testing.T) {
 		configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{Extensions: []string{"html", "php"}}}, nil)
 
 		state := State{configClient: configClientMock}
-		if err := state.processURL(url, nil, nil); !errors.Is(err, errExtensionNotAllowed) {
+		if err := state.processURL(url, nil, client.RefreshDelay{}, nil); !errors.Is(err, errExtensionNotAllowed) {
 			t.Fail()
 		}
 	}
@@ -138,14 +148,34 @@ func TestProcessURL_HostnameForbidden(t *testing.T) {
 	for _, tst := range tests {
 		configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{Extensions: []string{"html", "php"}}}, nil)
 		configClientMock.EXPECT().GetForbiddenHostnames().Return(tst.forbiddenHostnames, nil)
+		configClientMock.EXPECT().GetAllowedURLs().Return(nil, nil)
 
 		state := State{configClient: configClientMock}
-		if err := state.processURL(tst.url, nil, nil); !errors.Is(err, errHostnameNotAllowed) {
+		if err := state.processURL(tst.url, nil, client.RefreshDelay{}, nil); !errors.Is(err, errHostnameNotAllowed) {
 			t.Fail()
 		}
 	}
 }
 
+func TestProcessURL_AllowedURL(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	configClientMock.EXPECT().GetAllowedMimeTypes().Times(2).Return([]client.MimeType{{Extensions: []string{"html", "php"}}}, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Times(2).Return([]client.ForbiddenHostname{{Hostname: "market.onion"}}, nil)
+	configClientMock.EXPECT().GetAllowedURLs().Times(2).Return([]string{"https://market.onion/status.php"}, nil)
+
+	state := State{configClient: configClientMock}
+	if err := state.processURL("https://market.onion/status.php", map[string]int64{}, client.RefreshDelay{}, nil); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+	if err := state.processURL("https://market.onion/login.php", map[string]int64{}, client.RefreshDelay{}, nil); !errors.Is(err, errHostnameNotAllowed) {
+		t.Errorf("got %v want %v", err, errHostnameNotAllowed)
+	}
+}
+
 func TestProcessURL_AlreadyScheduled(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -157,17 +187,50 @@ func TestProcessURL_AlreadyScheduled(t *testing.T) {
 
 	urlCache := map[string]int64{"3056224523184958": 1}
 	state := State{configClient: configClientMock}
-	if err := state.processURL("https://facebookcorewwi.onion/test.php?id=12", nil, urlCache); !errors.Is(err, errAlreadyScheduled) {
+	if err := state.processURL("https://facebookcorewwi.onion/test.php?id=12", urlCache, client.RefreshDelay{}, nil); !errors.Is(err, errAlreadyScheduled) {
 		t.Fail()
 	}
 }
 
+func TestProcessURL_AlwaysCrawled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return(nil, nil).Times(2)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return(nil, nil).Times(2)
+
+	delay := client.RefreshDelay{Delay: time.Hour}
+	alwaysCrawl := []string{"directory.onion"}
+
+	// Scheduled a minute ago: within the refresh window
+	urlCache := map[string]int64{}
+	state := State{configClient: configClientMock}
+	if err := state.processURL("https://directory.onion/links", urlCache, delay, alwaysCrawl); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+	for hash := range urlCache {
+		urlCache[hash] = time.Now().Add(59 * time.Minute).UnixNano()
+	}
+
+	// The URL should be scheduled anyway
+	if err := state.processURL("https://directory.onion/links", urlCache, delay, alwaysCrawl); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+	// Unlike the other ones
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return(nil, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return(nil, nil)
+	if err := state.processURL("https://directory.onion/links", urlCache, delay, nil); !errors.Is(err, errAlreadyScheduled) {
+		t.Errorf("got %v want %v", err, errAlreadyScheduled)
+	}
+}
+
 func TestProcessURL(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	configClientMock := client_mock.NewMockClient(mockCtrl)
-	pubMock := event_mock.NewMockPublisher(mockCtrl)
 
 	urls := []string{"https://example.onion/index.php", "http://google.onion/admin.secret/login.html",
 		"https://example.onion", "https://www.facebookcorewwwi.onion/recover.now/initiate?ars=facebook_login"}
@@ -178,10 +241,8 @@ func TestProcessURL(t *testing.T) {
 		configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{Extensions: []string{"html", "php"}}}, nil)
 		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
 
-		pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: url}).Return(nil)
-
 		state := State{configClient: configClientMock}
-		if err := state.processURL(url, pubMock, urlCache); err != nil {
+		if err := state.processURL(url, urlCache, client.RefreshDelay{}, nil); err != nil {
 			t.Fail()
 		}
 
@@ -198,6 +259,46 @@ func TestProcessURL(t *testing.T) {
 	}
 }
 
+func TestProcessURL_Jitter(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return(nil, nil).Times(2)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return(nil, nil).Times(2)
+
+	delay := client.RefreshDelay{Delay: time.Hour, Jitter: 10 * time.Minute}
+	start := time.Now()
+
+	urlCache := map[string]int64{}
+	state := State{configClient: configClientMock}
+	for _, u := range []string{"https://example.onion/forum", "https://example.onion/market"} {
+		if err := state.processURL(u, urlCache, delay, nil); err != nil {
+			t.FailNow()
+		}
+	}
+
+	var eligibility []int64
+	for _, value := range urlCache {
+		if value < start.Add(50*time.Minute).UnixNano() || value > time.Now().Add(70*time.Minute).UnixNano() {
+			t.Errorf("eligibility time not within the jitter band: %s", time.Unix(0, value))
+		}
+		eligibility = append(eligibility, value)
+	}
+	if len(eligibility) != 2 || eligibility[0] == eligibility[1] {
+		t.Errorf("the URLs should have distinct eligibility times: got: %v", eligibility)
+	}
+}
+
+// newQueueCacheMock returns a queue cache expecting given number of URLs to be queued at once
+func newQueueCacheMock(mockCtrl *gomock.Controller, queued int64) *cache_mock.MockCache {
+	queueCacheMock := cache_mock.NewMockCache(mockCtrl)
+	queueCacheMock.EXPECT().IncrBy("urls", queued, cache.NoTTL).Return(queued, nil)
+
+	return queueCacheMock
+}
+
 func TestHandleNewResourceEvent(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -212,13 +313,23 @@ func TestHandleNewResourceEvent(t *testing.T) {
 		SetArg(1, event.NewResourceEvent{
 			URL: "https://l.facebookcorewwwi.onion/test.php",
 			Body: `
-<a href=\"https://facebook.onion/test.php?id=1\">This is a little test</a>. 
+<a href="https://facebook.onion/test.php?id=1">This is a little test</a>. 
 Check out https://google.onion. This is an image https://example.onion/test.png
 This domain is blacklisted: https://m.fbi.onion/test.php
 `,
 		}).
 		Return(nil)
 
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+	configClientMock.EXPECT().GetMaxLinksPerPage().Return(0, nil)
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{}, nil)
+	configClientMock.EXPECT().GetAllowedSchemes().Return([]string{"http", "https"}, nil)
+	configClientMock.EXPECT().GetAllowedPorts().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxURLLength().Return(0, nil)
+	configClientMock.EXPECT().GetStripQueryParams().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxPathRepetition().Return(0, nil)
+
 	urlCacheMock.EXPECT().
 		GetManyInt64([]string{"15038381360563270096", "17173291053643777680", "14332094874591870497", "5985629257333875968"}).
 		Return(map[string]int64{
@@ -233,7 +344,10 @@ This domain is blacklisted: https://m.fbi.onion/test.php
 		Return([]client.ForbiddenHostname{
 			{Hostname: "fbi.onion"},
 		}, nil)
+	configClientMock.EXPECT().GetAllowedURLs().Return(nil, nil)
 	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 0}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxQueuedURLs().Return(int64(0), nil)
 
 	subscriberMock.EXPECT().PublishEvent(&event.NewURLEvent{
 		URL: "https://facebook.onion/test.php?id=1",
@@ -244,8 +358,615 @@ This domain is blacklisted: https://m.fbi.onion/test.php
 		"15038381360563270096": 1,
 	}, cache.NoTTL).Return(nil)
 
-	s := State{urlCache: urlCacheMock, configClient: configClientMock}
+	reasons := []dropReason{dropAlreadyScheduled, dropExtension, dropForbiddenHostname}
+	counts := map[dropReason]int64{}
+	for _, reason := range reasons {
+		counts[reason] = droppedCount(reason)
+	}
+
+	s := State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: newQueueCacheMock(mockCtrl, 1)}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+
+	for _, reason := range reasons {
+		if droppedCount(reason) != counts[reason]+1 {
+			t.Errorf("drop reason %s not recorded", reason)
+		}
+	}
+}
+
+func TestHandleNewResourceEvent_NoFollow(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{
+			URL: "https://l.facebookcorewwwi.onion/test.php",
+			Body: `<meta name="robots" content="nofollow">
+<a href="https://facebook.onion/test.php?id=1">This is a little test</a>`,
+		}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetRespectRobots().Return(true, nil)
+
+	s := State{configClient: configClientMock}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleNewResourceEvent_Schemes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{
+			URL: "https://facebook.onion/posts/index.php",
+			Body: `
+<a href="mailto:admin@facebook.onion">Contact</a>
+<a href="javascript:void(0)">Menu</a>
+<a href="../test.php?id=1">This is a little test</a>`,
+		}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+	configClientMock.EXPECT().GetMaxLinksPerPage().Return(0, nil)
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{}, nil)
+	configClientMock.EXPECT().GetAllowedSchemes().Return(nil, nil)
+	configClientMock.EXPECT().GetAllowedPorts().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxURLLength().Return(0, nil)
+	configClientMock.EXPECT().GetStripQueryParams().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxPathRepetition().Return(0, nil)
+
+	// Only the resolved relative link should be scheduled
+	urlCacheMock.EXPECT().GetManyInt64([]string{"15038381360563270096"}).Return(map[string]int64{}, nil)
+
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{Extensions: []string{"php"}}}, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 0}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxQueuedURLs().Return(int64(0), nil)
+
+	subscriberMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://facebook.onion/test.php?id=1"})
+
+	urlCacheMock.EXPECT().SetManyInt64(map[string]int64{"15038381360563270096": 1}, cache.NoTTL).Return(nil)
+
+	s := State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: newQueueCacheMock(mockCtrl, 1)}
 	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
 		t.Fail()
 	}
 }
+
+func TestExtractLinks(t *testing.T) {
+	type test struct {
+		pageURL string
+		body    string
+		links   []string
+	}
+
+	tests := []test{
+		// absolute
+		{pageURL: "https://example.onion/posts/1", body: `<a href="https://other.onion/index.php">`, links: []string{"https://other.onion/index.php"}},
+		// root-relative
+		{pageURL: "https://example.onion/posts/1", body: `<a href="/about.php">`, links: []string{"https://example.onion/about.php"}},
+		// path-relative
+		{pageURL: "https://example.onion/posts/1", body: `<a href="2">`, links: []string{"https://example.onion/posts/2"}},
+		{pageURL: "https://example.onion/posts/1", body: `<a href="../users/admin">`, links: []string{"https://example.onion/users/admin"}},
+		// query only
+		{pageURL: "https://example.onion/search.php?q=test", body: `<a href="?q=test&page=2">`, links: []string{"https://example.onion/search.php?q=test&page=2"}},
+		// protocol-relative
+		{pageURL: "http://example.onion/posts/1", body: `<a href="//other.onion/index.php">`, links: []string{"http://other.onion/index.php"}},
+		// base href
+		{pageURL: "https://example.onion/posts/1", body: `<base href="https://example.onion/blog/"><a href="post.php">`, links: []string{"https://example.onion/blog/post.php"}},
+		{pageURL: "https://example.onion/posts/1", body: `<base href="/blog/"><a href="post.php">`, links: []string{"https://example.onion/blog/post.php"}},
+		// no links
+		{pageURL: "https://example.onion/posts/1", body: `<a>Hello</a>`, links: nil},
+	}
+
+	for _, test := range tests {
+		if links := extractLinks(test.pageURL, test.body); !reflect.DeepEqual(links, test.links) {
+			t.Errorf("%s: got %v want %v", test.body, links, test.links)
+		}
+	}
+}
+
+func TestFilterURLSchemes(t *testing.T) {
+	urls := []string{
+		"https://example.onion",
+		"HTTP://example.onion/index.php",
+		"mailto:admin@example.onion",
+		"javascript:alert(1)",
+		"data:text/plain;base64,SGVsbG8=",
+		"ftp://example.onion/file.zip",
+	}
+
+	got := filterURLSchemes(urls, []string{"http", "https"})
+	want := []string{"https://example.onion", "HTTP://example.onion/index.php"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestFilterURLPorts(t *testing.T) {
+	urls := []string{
+		"https://example.onion/index.php",
+		"https://example.onion:443/index.php",
+		"http://example.onion:80/index.php",
+		"http://example.onion:443/index.php",
+		"http://example.onion:8080/index.php",
+		"https://example.onion:22",
+	}
+
+	got := filterURLPorts(urls, []int{443})
+	want := []string{
+		"https://example.onion/index.php",
+		"https://example.onion:443/index.php",
+		"http://example.onion:80/index.php",
+		"http://example.onion:443/index.php",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestHandleNewResourceEvent_MaxLinks(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{
+			URL: "https://forum.onion/index.php",
+			Body: `
+<a href="https://other.onion/">Other</a>
+<a href="/threads/1/posts/2">Post</a>
+<a href="/threads/1">Thread</a>
+<a href="/members">Members</a>`,
+		}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetRespectRobots().Return(false, nil)
+	configClientMock.EXPECT().GetMaxLinksPerPage().Return(2, nil)
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{}, nil)
+	configClientMock.EXPECT().GetAllowedSchemes().Return(nil, nil)
+	configClientMock.EXPECT().GetAllowedPorts().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxURLLength().Return(0, nil)
+	configClientMock.EXPECT().GetStripQueryParams().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxPathRepetition().Return(0, nil)
+
+	// Only the two shallowest links of the page host should be scheduled
+	urlCacheMock.EXPECT().GetManyInt64(gomock.Len(2)).Return(map[string]int64{}, nil)
+	configClientMock.EXPECT().GetAllowedMimeTypes().Times(2).Return(nil, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Times(2).Return(nil, nil)
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 0}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxQueuedURLs().Return(int64(0), nil)
+
+	subscriberMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://forum.onion/threads/1"})
+	subscriberMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://forum.onion/members"})
+
+	urlCacheMock.EXPECT().SetManyInt64(gomock.Len(2), cache.NoTTL).Return(nil)
+
+	s := State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: newQueueCacheMock(mockCtrl, 2)}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleFoundURLEvent_Restart(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.FoundURLEvent{}).
+		SetArg(1, event.FoundURLEvent{URL: "https://example.onion/forum"}).
+		Return(nil).
+		Times(2)
+
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil).AnyTimes()
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{}, nil).AnyTimes()
+	configClientMock.EXPECT().GetAllowedSchemes().Return(nil, nil).AnyTimes()
+	configClientMock.EXPECT().GetAllowedPorts().Return(nil, nil).AnyTimes()
+	configClientMock.EXPECT().GetMaxURLLength().Return(0, nil).AnyTimes()
+	configClientMock.EXPECT().GetStripQueryParams().Return(nil, nil).AnyTimes()
+	configClientMock.EXPECT().GetMaxPathRepetition().Return(0, nil).AnyTimes()
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return(nil, nil).AnyTimes()
+	configClientMock.EXPECT().GetForbiddenHostnames().Return(nil, nil).AnyTimes()
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: time.Hour}, nil).AnyTimes()
+	configClientMock.EXPECT().GetAlwaysCrawl().AnyTimes().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxQueuedURLs().Return(int64(0), nil).AnyTimes()
+
+	// The cache outlives the scheduler instances
+	stored := map[string]int64{}
+	urlCacheMock.EXPECT().GetManyInt64(gomock.Any()).DoAndReturn(func(keys []string) (map[string]int64, error) {
+		values := map[string]int64{}
+		for _, key := range keys {
+			if value, exists := stored[key]; exists {
+				values[key] = value
+			}
+		}
+		return values, nil
+	}).Times(2)
+	urlCacheMock.EXPECT().SetManyInt64(gomock.Any(), time.Hour).DoAndReturn(func(values map[string]int64, TTL time.Duration) error {
+		for key, value := range values {
+			stored[key] = value
+		}
+		return nil
+	}).Times(2)
+
+	// The URL should only be published by the first instance
+	subscriberMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://example.onion/forum"})
+	queueCacheMock := newQueueCacheMock(mockCtrl, 1)
+
+	s := State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: queueCacheMock}
+	if err := s.handleFoundURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+
+	// Simulate a restart
+	s = State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: queueCacheMock}
+	if err := s.handleFoundURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleFoundURLEvent_MaxQueuedURLs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	queueCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.FoundURLEvent{}).
+		SetArg(1, event.FoundURLEvent{URL: "https://example.onion/forum"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{}, nil)
+	configClientMock.EXPECT().GetAllowedSchemes().Return(nil, nil)
+	configClientMock.EXPECT().GetAllowedPorts().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxURLLength().Return(0, nil)
+	configClientMock.EXPECT().GetStripQueryParams().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxPathRepetition().Return(0, nil)
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 0}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxQueuedURLs().Return(int64(1000), nil)
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{}, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+
+	urlCacheMock.EXPECT().GetManyInt64([]string{"17434438323079886193"}).Return(map[string]int64{}, nil)
+	queueCacheMock.EXPECT().GetInt64("urls").Return(int64(1000), nil)
+
+	// The URL should be dropped without being marked as scheduled
+	urlCacheMock.EXPECT().SetManyInt64(map[string]int64{}, cache.NoTTL).Return(nil)
+
+	count := droppedCount(dropQueueFull)
+
+	s := State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: queueCacheMock}
+	if err := s.handleFoundURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+
+	if droppedCount(dropQueueFull) != count+1 {
+		t.Error("drop reason not recorded")
+	}
+}
+
+func TestScheduleURLs_MaxQueuedURLsAfterProcessing(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	queueCacheMock := cache_mock.NewMockCache(mockCtrl)
+
+	urls := []string{"https://example.onion/forum", "https://example.onion/market"}
+	var hashes []string
+	for _, u := range urls {
+		c := fnv.New64()
+		_, _ = c.Write([]byte(u))
+		hashes = append(hashes, strconv.FormatUint(c.Sum64(), 10))
+	}
+
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{}, nil)
+	configClientMock.EXPECT().GetAllowedSchemes().Return(nil, nil)
+	configClientMock.EXPECT().GetAllowedPorts().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxURLLength().Return(0, nil)
+	configClientMock.EXPECT().GetStripQueryParams().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxPathRepetition().Return(0, nil)
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 0}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxQueuedURLs().Return(int64(1000), nil)
+	configClientMock.EXPECT().GetAllowedMimeTypes().Times(2).Return([]client.MimeType{}, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Times(2).Return([]client.ForbiddenHostname{}, nil)
+
+	// The first URL is already scheduled, the second one is eligible
+	urlCacheMock.EXPECT().GetManyInt64(hashes).Return(map[string]int64{hashes[0]: 1}, nil)
+	queueCacheMock.EXPECT().GetInt64("urls").Return(int64(1000), nil)
+	urlCacheMock.EXPECT().SetManyInt64(map[string]int64{hashes[0]: 1}, cache.NoTTL).Return(nil)
+
+	scheduled := droppedCount(dropAlreadyScheduled)
+	queueFull := droppedCount(dropQueueFull)
+
+	// Only the eligible URL should be dropped because of the cap
+	s := State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: queueCacheMock}
+	if err := s.scheduleURLs(subscriberMock, urls, ""); err != nil {
+		t.Errorf("got %v want nil", err)
+	}
+
+	if got := droppedCount(dropAlreadyScheduled); got != scheduled+1 {
+		t.Errorf("got %d already scheduled want %d", got, scheduled+1)
+	}
+	if got := droppedCount(dropQueueFull); got != queueFull+1 {
+		t.Errorf("got %d queue full want %d", got, queueFull+1)
+	}
+}
+
+func TestLimitLinks(t *testing.T) {
+	links := []string{
+		"https://other.onion/",
+		"https://forum.onion/threads/1/posts/2",
+		"https://forum.onion/threads/1",
+		"https://forum.onion/members",
+		"https://forum.onion/threads/2",
+	}
+
+	got := limitLinks("https://forum.onion/index.php", links, 3)
+	want := []string{"https://forum.onion/members", "https://forum.onion/threads/1", "https://forum.onion/threads/2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	if got := limitLinks("https://forum.onion/index.php", links, 10); !reflect.DeepEqual(got, links) {
+		t.Errorf("got %v want %v", got, links)
+	}
+}
+
+func TestFilterCrawlTraps(t *testing.T) {
+	urls := []string{
+		"https://example.onion/a/a/a/a/index.php",
+		"https://example.onion/forum/thread/forum/thread/forum/thread/forum/thread",
+		"https://example.onion/2021/03/10/blog/posts/category/tech/deep/page.php",
+		"https://example.onion/a/b/a/b/a/b",
+	}
+
+	got := filterCrawlTraps(urls, 3)
+	want := []string{
+		"https://example.onion/2021/03/10/blog/posts/category/tech/deep/page.php",
+		"https://example.onion/a/b/a/b/a/b",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestFilterURLLength(t *testing.T) {
+	prefix := "https://example.onion/"
+	under := prefix + strings.Repeat("a", 100-len(prefix)-1)
+	exact := prefix + strings.Repeat("a", 100-len(prefix))
+	over := prefix + strings.Repeat("a", 100-len(prefix)+1)
+
+	got := filterURLLength([]string{under, exact, over}, 100)
+	want := []string{under, exact}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestHandleFoundURLEvent(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.FoundURLEvent{}).
+		SetArg(1, event.FoundURLEvent{URL: "https://facebook.onion/test.php?id=1#comments", Tag: "forums"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetCrawlingPaused().Return(false, nil)
+	configClientMock.EXPECT().GetQueueWatermarks().Return(client.QueueWatermarks{}, nil)
+	configClientMock.EXPECT().GetAllowedSchemes().Return(nil, nil)
+	configClientMock.EXPECT().GetAllowedPorts().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxURLLength().Return(0, nil)
+	configClientMock.EXPECT().GetStripQueryParams().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxPathRepetition().Return(0, nil)
+	urlCacheMock.EXPECT().GetManyInt64([]string{"15038381360563270096"}).Return(map[string]int64{}, nil)
+
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{Extensions: []string{"php"}}}, nil)
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 0}, nil)
+	configClientMock.EXPECT().GetAlwaysCrawl().Return(nil, nil)
+	configClientMock.EXPECT().GetMaxQueuedURLs().Return(int64(0), nil)
+
+	// The tag should be propagated to the scheduled URL
+	subscriberMock.EXPECT().PublishEvent(&event.NewURLEvent{
+		URL: "https://facebook.onion/test.php?id=1",
+		Tag: "forums",
+	})
+
+	urlCacheMock.EXPECT().SetManyInt64(map[string]int64{"15038381360563270096": 1}, cache.NoTTL).Return(nil)
+
+	s := State{urlCache: urlCacheMock, configClient: configClientMock, queueCache: newQueueCacheMock(mockCtrl, 1)}
+	if err := s.handleFoundURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestSeedURLs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	urlCacheMock.EXPECT().GetInt64("seeded").Return(int64(0), nil)
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://example.onion", Tag: "default"}).Return(nil)
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://google.onion/index.php", Tag: "markets"}).Return(nil)
+	urlCacheMock.EXPECT().SetInt64("seeded", int64(1), cache.NoTTL).Return(nil)
+
+	s := State{urlCache: urlCacheMock, queueCache: newQueueCacheMock(mockCtrl, 2)}
+	if err := s.seedURLs(pubMock, []string{"https://example.onion", "[markets] https://google.onion/index.php"}); err != nil {
+		t.Fail()
+	}
+}
+
+func TestSeedURLs_Post(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	urlCacheMock.EXPECT().GetInt64("seeded").Return(int64(0), nil)
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{
+		URL:         "https://directory.onion/search.php",
+		Tag:         "default",
+		Method:      "POST",
+		ContentType: "application/x-www-form-urlencoded",
+		Body:        "q=market&page=1",
+	}).Return(nil)
+	urlCacheMock.EXPECT().SetInt64("seeded", int64(1), cache.NoTTL).Return(nil)
+
+	s := State{urlCache: urlCacheMock, queueCache: newQueueCacheMock(mockCtrl, 1)}
+	if err := s.seedURLs(pubMock, []string{"POST https://directory.onion/search.php application/x-www-form-urlencoded q=market&page=1"}); err != nil {
+		t.Fail()
+	}
+}
+
+func TestParseSeed(t *testing.T) {
+	if _, err := parseSeed("POST https://directory.onion/search.php"); err == nil {
+		t.Error("seed without body should be rejected")
+	}
+	if _, err := parseSeed("PUT https://directory.onion/search.php text/plain hello"); err == nil {
+		t.Error("seed using non POST method should be rejected")
+	}
+
+	evt, err := parseSeed("post https://directory.onion/search.php application/json {\"q\": \"a b\"}")
+	if err != nil {
+		t.FailNow()
+	}
+	if evt.Method != "POST" || evt.ContentType != "application/json" || evt.Body != `{"q": "a b"}` {
+		t.Errorf("wrong seed: %+v", evt)
+	}
+
+	if _, err := parseSeed("[] https://example.onion"); err == nil {
+		t.Error("seed with empty tag should be rejected")
+	}
+
+	evt, err = parseSeed("[forums] POST https://directory.onion/search.php text/plain q")
+	if err != nil {
+		t.FailNow()
+	}
+	if evt.Tag != "forums" || evt.URL != "https://directory.onion/search.php" || evt.Method != "POST" {
+		t.Errorf("wrong seed: %+v", evt)
+	}
+
+	if _, err := parseSeed("lang= https://example.onion"); err == nil {
+		t.Error("seed with empty language should be rejected")
+	}
+
+	evt, err = parseSeed("[forums] lang=fr-FR,fr;q=0.9 https://example.onion")
+	if err != nil {
+		t.FailNow()
+	}
+	if evt.Tag != "forums" || evt.Language != "fr-FR,fr;q=0.9" || evt.URL != "https://example.onion" {
+		t.Errorf("wrong seed: %+v", evt)
+	}
+}
+
+func TestSeedURLs_AlreadySeeded(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	urlCacheMock.EXPECT().GetInt64("seeded").Return(int64(1), nil)
+
+	s := State{urlCache: urlCacheMock}
+	if err := s.seedURLs(pubMock, []string{"https://example.onion"}); err != nil {
+		t.Fail()
+	}
+}
+
+func TestLoadSeedFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString("# my seeds\nhttps://example.onion\n\n  https://google.onion/index.php  \n"); err != nil {
+		t.FailNow()
+	}
+	_ = f.Close()
+
+	urls, err := loadSeedFile(f.Name())
+	if err != nil {
+		t.FailNow()
+	}
+
+	if want := []string{"https://example.onion", "https://google.onion/index.php"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("got %v want %v", urls, want)
+	}
+}
+
+func TestHandleFoundURLEvent_Paused(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.FoundURLEvent{}).
+		SetArg(1, event.FoundURLEvent{URL: "https://facebook.onion/test.php?id=1"}).
+		Return(nil)
+
+	// Nothing should be published nor marked as scheduled
+	configClientMock.EXPECT().GetCrawlingPaused().Return(true, nil)
+
+	s := State{configClient: configClientMock}
+	if err := s.handleFoundURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}